@@ -8,5 +8,7 @@ routers.go: router binding and core logic
 serializers.go: definition the schema of return data
 
 validators.go: definition the validator of form data
+
+policies.go: who may change the articles and the comments, their authors and the moderators
 */
 package articles
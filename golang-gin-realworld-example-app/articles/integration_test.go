@@ -1,6 +1,7 @@
 package articles
 
 import (
+	"context"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -77,7 +78,7 @@ func TestIntegration_Articles_CreateArticle(t *testing.T) {
 	
 	// Verify in database
 	slug := article["slug"].(string)
-	dbArticle, err := FindOneArticle(&ArticleModel{Slug: slug})
+	dbArticle, err := FindOneArticle(context.Background(), &ArticleModel{Slug: slug})
 	asserts.NoError(err, "Article should exist in database")
 	asserts.Equal("Test Article", dbArticle.Title)
 }
@@ -176,8 +177,8 @@ func TestIntegration_Articles_ListArticles(t *testing.T) {
 	user1 := userModels[0]
 	user2 := userModels[1]
 	
-	articleUser1 := GetArticleUserModel(user1)
-	articleUser2 := GetArticleUserModel(user2)
+	articleUser1 := GetArticleUserModel(context.Background(), user1)
+	articleUser2 := GetArticleUserModel(context.Background(), user2)
 	
 	articleModelMocker(3, articleUser1)
 	articleModelMocker(2, articleUser2)
@@ -213,7 +214,7 @@ func TestIntegration_Articles_RetrieveSingleArticle(t *testing.T) {
 	
 	userModels := userModelMocker(1)
 	user := userModels[0]
-	articleUser := GetArticleUserModel(user)
+	articleUser := GetArticleUserModel(context.Background(), user)
 	articles := articleModelMocker(1, articleUser)
 	article := articles[0]
 	
@@ -258,7 +259,7 @@ func TestIntegration_Articles_UpdateArticle(t *testing.T) {
 	userModels := userModelMocker(1)
 	user := userModels[0]
 	token := common.GenToken(user.ID)
-	articleUser := GetArticleUserModel(user)
+	articleUser := GetArticleUserModel(context.Background(), user)
 	articles := articleModelMocker(1, articleUser)
 	article := articles[0]
 	
@@ -299,7 +300,7 @@ func TestIntegration_Articles_DeleteArticle(t *testing.T) {
 	userModels := userModelMocker(1)
 	user := userModels[0]
 	token := common.GenToken(user.ID)
-	articleUser := GetArticleUserModel(user)
+	articleUser := GetArticleUserModel(context.Background(), user)
 	articles := articleModelMocker(1, articleUser)
 	article := articles[0]
 	
@@ -313,7 +314,7 @@ func TestIntegration_Articles_DeleteArticle(t *testing.T) {
 	asserts.Equal(http.StatusOK, w.Code)
 	
 	// Verify deletion in database
-	_, err := FindOneArticle(&ArticleModel{Slug: article.Slug})
+	_, err := FindOneArticle(context.Background(), &ArticleModel{Slug: article.Slug})
 	asserts.Error(err, "Article should be deleted from database")
 }
 
@@ -329,7 +330,7 @@ func TestIntegration_Articles_FavoriteArticle(t *testing.T) {
 	author := userModels[0]
 	favoriter := userModels[1]
 	
-	articleUser := GetArticleUserModel(author)
+	articleUser := GetArticleUserModel(context.Background(), author)
 	articles := articleModelMocker(1, articleUser)
 	article := articles[0]
 	
@@ -350,9 +351,9 @@ func TestIntegration_Articles_FavoriteArticle(t *testing.T) {
 	asserts.Equal(true, articleResp["favorited"])
 	
 	// Verify in database
-	favArticleUser := GetArticleUserModel(favoriter)
-	dbArticle, _ := FindOneArticle(&ArticleModel{Slug: article.Slug})
-	asserts.True(dbArticle.isFavoriteBy(favArticleUser), "Favorite relationship should exist")
+	favArticleUser := GetArticleUserModel(context.Background(), favoriter)
+	dbArticle, _ := FindOneArticle(context.Background(), &ArticleModel{Slug: article.Slug})
+	asserts.True(dbArticle.isFavoriteBy(context.Background(), favArticleUser), "Favorite relationship should exist")
 }
 
 // TestIntegration_Articles_UnfavoriteArticle tests unfavorite functionality
@@ -367,13 +368,13 @@ func TestIntegration_Articles_UnfavoriteArticle(t *testing.T) {
 	author := userModels[0]
 	favoriter := userModels[1]
 	
-	articleUser := GetArticleUserModel(author)
+	articleUser := GetArticleUserModel(context.Background(), author)
 	articles := articleModelMocker(1, articleUser)
 	article := articles[0]
 	
 	// Create favorite relationship
-	favArticleUser := GetArticleUserModel(favoriter)
-	article.favoriteBy(favArticleUser)
+	favArticleUser := GetArticleUserModel(context.Background(), favoriter)
+	article.favoriteBy(context.Background(), favArticleUser)
 	
 	token := common.GenToken(favoriter.ID)
 	
@@ -404,7 +405,7 @@ func TestIntegration_Articles_CreateComment(t *testing.T) {
 	author := userModels[0]
 	commenter := userModels[1]
 	
-	articleUser := GetArticleUserModel(author)
+	articleUser := GetArticleUserModel(context.Background(), author)
 	articles := articleModelMocker(1, articleUser)
 	article := articles[0]
 	
@@ -445,7 +446,7 @@ func TestIntegration_Articles_ListComments(t *testing.T) {
 	
 	userModels := userModelMocker(1)
 	user := userModels[0]
-	articleUser := GetArticleUserModel(user)
+	articleUser := GetArticleUserModel(context.Background(), user)
 	articles := articleModelMocker(1, articleUser)
 	article := articles[0]
 	
@@ -487,7 +488,7 @@ func TestIntegration_Articles_DeleteComment(t *testing.T) {
 	
 	userModels := userModelMocker(1)
 	user := userModels[0]
-	articleUser := GetArticleUserModel(user)
+	articleUser := GetArticleUserModel(context.Background(), user)
 	articles := articleModelMocker(1, articleUser)
 	article := articles[0]
 	
@@ -530,7 +531,7 @@ func TestIntegration_Articles_ListTags(t *testing.T) {
 	// Create articles with tags
 	userModels := userModelMocker(1)
 	user := userModels[0]
-	articleUser := GetArticleUserModel(user)
+	articleUser := GetArticleUserModel(context.Background(), user)
 	
 	db := common.GetDB()
 	tagsList := []string{"golang", "testing", "backend", "api"}
@@ -1,17 +1,21 @@
 package articles
 
 import (
+	"context"
 	_ "fmt"
 	"realworld-backend/common"
+	"realworld-backend/tracing"
 	"realworld-backend/users"
 	"strconv"
 
+	"github.com/gosimple/slug"
 	"github.com/jinzhu/gorm"
 )
 
+// The unique string columns keep an explicit size, mysql can't put an unique index on a text column.
 type ArticleModel struct {
 	gorm.Model
-	Slug        string `gorm:"unique_index"`
+	Slug        string `gorm:"size:255;unique_index"`
 	Title       string
 	Description string `gorm:"size:2048"`
 	Body        string `gorm:"size:2048"`
@@ -39,7 +43,7 @@ type FavoriteModel struct {
 
 type TagModel struct {
 	gorm.Model
-	Tag           string         `gorm:"unique_index"`
+	Tag           string         `gorm:"size:255;unique_index"`
 	ArticleModels []ArticleModel `gorm:"many2many:article_tags;"`
 }
 
@@ -52,12 +56,14 @@ type CommentModel struct {
 	Body      string `gorm:"size:2048"`
 }
 
-func GetArticleUserModel(userModel users.UserModel) ArticleUserModel {
+func GetArticleUserModel(ctx context.Context, userModel users.UserModel) ArticleUserModel {
 	var articleUserModel ArticleUserModel
 	if userModel.ID == 0 {
 		return articleUserModel
 	}
-	db := common.GetDB()
+	ctx, span := tracing.Start(ctx, "articles.GetArticleUserModel")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	db.Where(&ArticleUserModel{
 		UserModelID: userModel.ID,
 	}).FirstOrCreate(&articleUserModel)
@@ -65,8 +71,10 @@ func GetArticleUserModel(userModel users.UserModel) ArticleUserModel {
 	return articleUserModel
 }
 
-func (article ArticleModel) favoritesCount() uint {
-	db := common.GetDB()
+func (article ArticleModel) favoritesCount(ctx context.Context) uint {
+	ctx, span := tracing.Start(ctx, "articles.ArticleModel.favoritesCount")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	var count uint
 	db.Model(&FavoriteModel{}).Where(FavoriteModel{
 		FavoriteID: article.ID,
@@ -74,8 +82,10 @@ func (article ArticleModel) favoritesCount() uint {
 	return count
 }
 
-func (article ArticleModel) isFavoriteBy(user ArticleUserModel) bool {
-	db := common.GetDB()
+func (article ArticleModel) isFavoriteBy(ctx context.Context, user ArticleUserModel) bool {
+	ctx, span := tracing.Start(ctx, "articles.ArticleModel.isFavoriteBy")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	var favorite FavoriteModel
 	db.Where(FavoriteModel{
 		FavoriteID:   article.ID,
@@ -84,8 +94,10 @@ func (article ArticleModel) isFavoriteBy(user ArticleUserModel) bool {
 	return favorite.ID != 0
 }
 
-func (article ArticleModel) favoriteBy(user ArticleUserModel) error {
-	db := common.GetDB()
+func (article ArticleModel) favoriteBy(ctx context.Context, user ArticleUserModel) error {
+	ctx, span := tracing.Start(ctx, "articles.ArticleModel.favoriteBy")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	var favorite FavoriteModel
 	err := db.FirstOrCreate(&favorite, &FavoriteModel{
 		FavoriteID:   article.ID,
@@ -94,8 +106,10 @@ func (article ArticleModel) favoriteBy(user ArticleUserModel) error {
 	return err
 }
 
-func (article ArticleModel) unFavoriteBy(user ArticleUserModel) error {
-	db := common.GetDB()
+func (article ArticleModel) unFavoriteBy(ctx context.Context, user ArticleUserModel) error {
+	ctx, span := tracing.Start(ctx, "articles.ArticleModel.unFavoriteBy")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	err := db.Where(FavoriteModel{
 		FavoriteID:   article.ID,
 		FavoriteByID: user.ID,
@@ -103,14 +117,18 @@ func (article ArticleModel) unFavoriteBy(user ArticleUserModel) error {
 	return err
 }
 
-func SaveOne(data interface{}) error {
-	db := common.GetDB()
+func SaveOne(ctx context.Context, data interface{}) error {
+	ctx, span := tracing.Start(ctx, "articles.SaveOne")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	err := db.Save(data).Error
 	return err
 }
 
-func FindOneArticle(condition interface{}) (ArticleModel, error) {
-	db := common.GetDB()
+func FindOneArticle(ctx context.Context, condition interface{}) (ArticleModel, error) {
+	ctx, span := tracing.Start(ctx, "articles.FindOneArticle")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	var model ArticleModel
 	tx := db.Begin()
 	err := tx.Where(condition).First(&model).Error
@@ -125,8 +143,10 @@ func FindOneArticle(condition interface{}) (ArticleModel, error) {
 	return model, err
 }
 
-func (self *ArticleModel) getComments() error {
-	db := common.GetDB()
+func (self *ArticleModel) getComments(ctx context.Context) error {
+	ctx, span := tracing.Start(ctx, "articles.ArticleModel.getComments")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	tx := db.Begin()
 	tx.Model(self).Related(&self.Comments, "Comments")
 	for i, _ := range self.Comments {
@@ -137,15 +157,19 @@ func (self *ArticleModel) getComments() error {
 	return err
 }
 
-func getAllTags() ([]TagModel, error) {
-	db := common.GetDB()
+func getAllTags(ctx context.Context) ([]TagModel, error) {
+	ctx, span := tracing.Start(ctx, "articles.getAllTags")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	var models []TagModel
 	err := db.Find(&models).Error
 	return models, err
 }
 
-func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleModel, int, error) {
-	db := common.GetDB()
+func FindManyArticle(ctx context.Context, tag, author, limit, offset, favorited string) ([]ArticleModel, int, error) {
+	ctx, span := tracing.Start(ctx, "articles.FindManyArticle")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	var models []ArticleModel
 	var count int
 
@@ -170,7 +194,7 @@ func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleMod
 	} else if author != "" {
 		var userModel users.UserModel
 		tx.Where(users.UserModel{Username: author}).First(&userModel)
-		articleUserModel := GetArticleUserModel(userModel)
+		articleUserModel := GetArticleUserModel(ctx, userModel)
 
 		if articleUserModel.ID != 0 {
 			count = tx.Model(&articleUserModel).Association("ArticleModels").Count()
@@ -179,7 +203,7 @@ func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleMod
 	} else if favorited != "" {
 		var userModel users.UserModel
 		tx.Where(users.UserModel{Username: favorited}).First(&userModel)
-		articleUserModel := GetArticleUserModel(userModel)
+		articleUserModel := GetArticleUserModel(ctx, userModel)
 		if articleUserModel.ID != 0 {
 			var favoriteModels []FavoriteModel
 			tx.Where(FavoriteModel{
@@ -207,8 +231,10 @@ func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleMod
 	return models, count, err
 }
 
-func (self *ArticleUserModel) GetArticleFeed(limit, offset string) ([]ArticleModel, int, error) {
-	db := common.GetDB()
+func (self *ArticleUserModel) GetArticleFeed(ctx context.Context, limit, offset string) ([]ArticleModel, int, error) {
+	ctx, span := tracing.Start(ctx, "articles.ArticleUserModel.GetArticleFeed")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	var models []ArticleModel
 	var count int
 
@@ -222,14 +248,21 @@ func (self *ArticleUserModel) GetArticleFeed(limit, offset string) ([]ArticleMod
 	}
 
 	tx := db.Begin()
-	followings := self.UserModel.GetFollowings()
+	followings := self.UserModel.GetFollowings(ctx)
 	var articleUserModels []uint
 	for _, following := range followings {
-		articleUserModel := GetArticleUserModel(following)
+		articleUserModel := GetArticleUserModel(ctx, following)
 		articleUserModels = append(articleUserModels, articleUserModel.ID)
 	}
 
-	tx.Where("author_id in (?)", articleUserModels).Order("updated_at desc").Offset(offset_int).Limit(limit_int).Find(&models)
+	// Nobody followed means an empty feed, gorm would turn the empty list into `IN (NULL)` otherwise.
+	if len(articleUserModels) == 0 {
+		err = tx.Commit().Error
+		return models, count, err
+	}
+	feed := tx.Model(&ArticleModel{}).Where("author_id IN (?)", articleUserModels)
+	feed.Count(&count)
+	feed.Order("updated_at desc").Offset(offset_int).Limit(limit_int).Find(&models)
 
 	for i, _ := range models {
 		tx.Model(&models[i]).Related(&models[i].Author, "Author")
@@ -240,8 +273,10 @@ func (self *ArticleUserModel) GetArticleFeed(limit, offset string) ([]ArticleMod
 	return models, count, err
 }
 
-func (model *ArticleModel) setTags(tags []string) error {
-	db := common.GetDB()
+func (model *ArticleModel) setTags(ctx context.Context, tags []string) error {
+	ctx, span := tracing.Start(ctx, "articles.ArticleModel.setTags")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	var tagList []TagModel
 	for _, tag := range tags {
 		var tagModel TagModel
@@ -255,14 +290,18 @@ func (model *ArticleModel) setTags(tags []string) error {
 	return nil
 }
 
-func (model *ArticleModel) Update(data interface{}) error {
-	db := common.GetDB()
+func (model *ArticleModel) Update(ctx context.Context, data interface{}) error {
+	ctx, span := tracing.Start(ctx, "articles.ArticleModel.Update")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	err := db.Model(model).Update(data).Error
 	return err
 }
 
-func DeleteArticleModel(condition interface{}) error {
-	db := common.GetDB()
+func DeleteArticleModel(ctx context.Context, condition interface{}) error {
+	ctx, span := tracing.Start(ctx, "articles.DeleteArticleModel")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	// Delete the article and check if any rows were affected
 	result := db.Where(condition).Delete(&ArticleModel{})
 	if result.Error != nil {
@@ -275,8 +314,94 @@ func DeleteArticleModel(condition interface{}) error {
 	return nil
 }
 
-func DeleteCommentModel(condition interface{}) error {
-	db := common.GetDB()
+// The comment of the article, gorm.ErrRecordNotFound when the article has no such comment.
+func FindOneComment(ctx context.Context, articleID uint, id uint) (CommentModel, error) {
+	ctx, span := tracing.Start(ctx, "articles.FindOneComment")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	var model CommentModel
+	err := db.Where("id = ? AND article_id = ?", id, articleID).First(&model).Error
+	return model, err
+}
+
+func DeleteCommentModel(ctx context.Context, condition interface{}) error {
+	ctx, span := tracing.Start(ctx, "articles.DeleteCommentModel")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	err := db.Where(condition).Delete(CommentModel{}).Error
 	return err
 }
+
+// Delete everything an user owns in the articles module for the `delete-user` command:
+// the user's articles with their comments, favorites and tags, the comments and favorites
+// the user made, and the ArticleUserModel itself. Soft deleted rows go as well.
+func DeleteArticleUserModel(userModel users.UserModel) error {
+	db := common.GetDB()
+	var articleUserModel ArticleUserModel
+	err := db.Where(&ArticleUserModel{UserModelID: userModel.ID}).First(&articleUserModel).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	id := articleUserModel.ID
+	tx := db.Begin()
+	articleIDs := tx.Unscoped().Model(&ArticleModel{}).Where("author_id = ?", id).Select("id").QueryExpr()
+	steps := []func() error{
+		func() error {
+			return tx.Unscoped().Where("article_id IN (?) OR author_id = ?", articleIDs, id).Delete(CommentModel{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("favorite_id IN (?) OR favorite_by_id = ?", articleIDs, id).Delete(FavoriteModel{}).Error
+		},
+		func() error {
+			return tx.Exec("DELETE FROM article_tags WHERE article_model_id IN (?)", articleIDs).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("author_id = ?", id).Delete(ArticleModel{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Delete(&articleUserModel).Error
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// Recompute the slug of every article from its title, the way ArticleModelValidator does,
+// so the stored slug is the one ArticleSerializer returns again (e.g. after the slug library changed).
+// A slug already taken by another article is left as it is and its article is returned in conflicts.
+//
+//	updated, conflicts, err := ReindexSlugs()
+func ReindexSlugs() (int, []ArticleModel, error) {
+	db := common.GetDB()
+	var models []ArticleModel
+	if err := db.Order("id").Find(&models).Error; err != nil {
+		return 0, nil, err
+	}
+	updated := 0
+	var conflicts []ArticleModel
+	for _, model := range models {
+		newSlug := slug.Make(model.Title)
+		if newSlug == model.Slug {
+			continue
+		}
+		var count int
+		db.Unscoped().Model(&ArticleModel{}).Where("slug = ? AND id <> ?", newSlug, model.ID).Count(&count)
+		if count > 0 {
+			conflicts = append(conflicts, model)
+			continue
+		}
+		if err := db.Model(&model).UpdateColumn("slug", newSlug).Error; err != nil {
+			return updated, conflicts, err
+		}
+		updated++
+	}
+	return updated, conflicts, nil
+}
@@ -0,0 +1,53 @@
+package articles
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+// Who may change a resource of the articles: its author, and the users with one of the
+// Overrides permissions, e.g. the moderators. A new role overrides a policy by getting one
+// of its permissions, see users.GrantRole.
+type OwnershipPolicy struct {
+	// The key of the errors, like the other errors of the resource.
+	Key       string
+	Overrides []string
+}
+
+var (
+	ArticlePolicy = OwnershipPolicy{Key: "articles", Overrides: []string{users.PermissionArticlesModerate}}
+	CommentPolicy = OwnershipPolicy{Key: "comment", Overrides: []string{users.PermissionCommentsModerate}}
+)
+
+// Whether the user of the request may change the resource of the author, an ArticleUserModel ID.
+func (p OwnershipPolicy) Allows(c *gin.Context, authorID uint) bool {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	myArticleUserModel := GetArticleUserModel(c.Request.Context(), myUserModel)
+	if myArticleUserModel.ID != 0 && authorID == myArticleUserModel.ID {
+		return true
+	}
+	for _, permission := range p.Overrides {
+		if users.HasPermission(c, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// Like Allows, but answers a 403 with the message when the user may not, for the handlers.
+//
+//	if !ArticlePolicy.Authorize(c, articleModel.AuthorID, "You can only delete your own articles") {
+//		return
+//	}
+func (p OwnershipPolicy) Authorize(c *gin.Context, authorID uint, message string) bool {
+	if p.Allows(c, authorID) {
+		return true
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, common.NewError(p.Key, errors.New(message)))
+	return false
+}
@@ -3,6 +3,7 @@ package articles
 import (
 	"errors"
 	"realworld-backend/common"
+	"realworld-backend/metrics"
 	"realworld-backend/users"
 	"github.com/gin-gonic/gin"
 	"net/http"
@@ -10,13 +11,13 @@ import (
 )
 
 func ArticlesRegister(router *gin.RouterGroup) {
-	router.POST("/", ArticleCreate)
-	router.PUT("/:slug", ArticleUpdate)
-	router.DELETE("/:slug", ArticleDelete)
-	router.POST("/:slug/favorite", ArticleFavorite)
-	router.DELETE("/:slug/favorite", ArticleUnfavorite)
-	router.POST("/:slug/comments", ArticleCommentCreate)
-	router.DELETE("/:slug/comments/:id", ArticleCommentDelete)
+	router.POST("/", users.RequireScope(users.ScopeArticlesWrite), users.RequireVerifiedEmail(), ArticleCreate)
+	router.PUT("/:slug", users.RequireScope(users.ScopeArticlesWrite), ArticleUpdate)
+	router.DELETE("/:slug", users.RequireScope(users.ScopeArticlesWrite), ArticleDelete)
+	router.POST("/:slug/favorite", users.RequireScope(users.ScopeFavoritesWrite), ArticleFavorite)
+	router.DELETE("/:slug/favorite", users.RequireScope(users.ScopeFavoritesWrite), ArticleUnfavorite)
+	router.POST("/:slug/comments", users.RequireScope(users.ScopeCommentsWrite), users.RequireVerifiedEmail(), ArticleCommentCreate)
+	router.DELETE("/:slug/comments/:id", users.RequireScope(users.ScopeCommentsWrite), ArticleCommentDelete)
 }
 
 func ArticlesAnonymousRegister(router *gin.RouterGroup) {
@@ -37,10 +38,11 @@ func ArticleCreate(c *gin.Context) {
 	}
 	//fmt.Println(articleModelValidator.articleModel.Author.UserModel)
 
-	if err := SaveOne(&articleModelValidator.articleModel); err != nil {
+	if err := SaveOne(c.Request.Context(), &articleModelValidator.articleModel); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	metrics.ArticlesCreated.Inc()
 	serializer := ArticleSerializer{c, articleModelValidator.articleModel}
 	c.JSON(http.StatusCreated, gin.H{"article": serializer.Response()})
 }
@@ -52,7 +54,7 @@ func ArticleList(c *gin.Context) {
 	favorited := c.Query("favorited")
 	limit := c.Query("limit")
 	offset := c.Query("offset")
-	articleModels, modelCount, err := FindManyArticle(tag, author, limit, offset, favorited)
+	articleModels, modelCount, err := FindManyArticle(c.Request.Context(), tag, author, limit, offset, favorited)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
 		return
@@ -69,8 +71,8 @@ func ArticleFeed(c *gin.Context) {
 		c.AbortWithError(http.StatusUnauthorized, errors.New("{error : \"Require auth!\"}"))
 		return
 	}
-	articleUserModel := GetArticleUserModel(myUserModel)
-	articleModels, modelCount, err := articleUserModel.GetArticleFeed(limit, offset)
+	articleUserModel := GetArticleUserModel(c.Request.Context(), myUserModel)
+	articleModels, modelCount, err := articleUserModel.GetArticleFeed(c.Request.Context(), limit, offset)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
 		return
@@ -85,7 +87,7 @@ func ArticleRetrieve(c *gin.Context) {
 		ArticleFeed(c)
 		return
 	}
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	articleModel, err := FindOneArticle(c.Request.Context(), &ArticleModel{Slug: slug})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
@@ -96,11 +98,14 @@ func ArticleRetrieve(c *gin.Context) {
 
 func ArticleUpdate(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	articleModel, err := FindOneArticle(c.Request.Context(), &ArticleModel{Slug: slug})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
+	if !ArticlePolicy.Authorize(c, articleModel.AuthorID, "You can only change your own articles") {
+		return
+	}
 	articleModelValidator := NewArticleModelValidatorFillWith(articleModel)
 	if err := articleModelValidator.Bind(c); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
@@ -108,7 +113,9 @@ func ArticleUpdate(c *gin.Context) {
 	}
 
 	articleModelValidator.articleModel.ID = articleModel.ID
-	if err := articleModel.Update(articleModelValidator.articleModel); err != nil {
+	// A moderator's change leaves the article to its author.
+	articleModelValidator.articleModel.Author = articleModel.Author
+	if err := articleModel.Update(c.Request.Context(), articleModelValidator.articleModel); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
@@ -118,7 +125,15 @@ func ArticleUpdate(c *gin.Context) {
 
 func ArticleDelete(c *gin.Context) {
 	slug := c.Param("slug")
-	err := DeleteArticleModel(&ArticleModel{Slug: slug})
+	articleModel, err := FindOneArticle(c.Request.Context(), &ArticleModel{Slug: slug})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
+	if !ArticlePolicy.Authorize(c, articleModel.AuthorID, "You can only delete your own articles") {
+		return
+	}
+	err = DeleteArticleModel(c.Request.Context(), &ArticleModel{Slug: slug})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
@@ -128,33 +143,39 @@ func ArticleDelete(c *gin.Context) {
 
 func ArticleFavorite(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	articleModel, err := FindOneArticle(c.Request.Context(), &ArticleModel{Slug: slug})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
-	err = articleModel.favoriteBy(GetArticleUserModel(myUserModel))
+	err = articleModel.favoriteBy(c.Request.Context(), GetArticleUserModel(c.Request.Context(), myUserModel))
+	if err == nil {
+		metrics.Favorites.WithLabelValues(metrics.ActionFavorite).Inc()
+	}
 	serializer := ArticleSerializer{c, articleModel}
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
 }
 
 func ArticleUnfavorite(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	articleModel, err := FindOneArticle(c.Request.Context(), &ArticleModel{Slug: slug})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
-	err = articleModel.unFavoriteBy(GetArticleUserModel(myUserModel))
+	err = articleModel.unFavoriteBy(c.Request.Context(), GetArticleUserModel(c.Request.Context(), myUserModel))
+	if err == nil {
+		metrics.Favorites.WithLabelValues(metrics.ActionUnfavorite).Inc()
+	}
 	serializer := ArticleSerializer{c, articleModel}
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
 }
 
 func ArticleCommentCreate(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	articleModel, err := FindOneArticle(c.Request.Context(), &ArticleModel{Slug: slug})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
 		return
@@ -166,10 +187,11 @@ func ArticleCommentCreate(c *gin.Context) {
 	}
 	commentModelValidator.commentModel.Article = articleModel
 
-	if err := SaveOne(&commentModelValidator.commentModel); err != nil {
+	if err := SaveOne(c.Request.Context(), &commentModelValidator.commentModel); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	metrics.Comments.WithLabelValues(metrics.ActionCreate).Inc()
 	serializer := CommentSerializer{c, commentModelValidator.commentModel}
 	c.JSON(http.StatusCreated, gin.H{"comment": serializer.Response()})
 }
@@ -181,22 +203,37 @@ func ArticleCommentDelete(c *gin.Context) {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
 		return
 	}
-	err = DeleteCommentModel([]uint{id})
+	articleModel, err := FindOneArticle(c.Request.Context(), &ArticleModel{Slug: c.Param("slug")})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
+		return
+	}
+	// The comments of the other articles are not found, whoever asks.
+	commentModel, err := FindOneComment(c.Request.Context(), articleModel.ID, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	if !CommentPolicy.Authorize(c, commentModel.AuthorID, "You can only delete your own comments") {
+		return
+	}
+	err = DeleteCommentModel(c.Request.Context(), []uint{id})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
 		return
 	}
+	metrics.Comments.WithLabelValues(metrics.ActionDelete).Inc()
 	c.JSON(http.StatusOK, gin.H{"comment": "Delete success"})
 }
 
 func ArticleCommentList(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	articleModel, err := FindOneArticle(c.Request.Context(), &ArticleModel{Slug: slug})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Invalid slug")))
 		return
 	}
-	err = articleModel.getComments()
+	err = articleModel.getComments(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Database error")))
 		return
@@ -205,7 +242,7 @@ func ArticleCommentList(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"comments": serializer.Response()})
 }
 func TagList(c *gin.Context) {
-	tagModels, err := getAllTags()
+	tagModels, err := getAllTags(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
 		return
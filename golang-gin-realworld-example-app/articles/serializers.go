@@ -76,8 +76,8 @@ func (s *ArticleSerializer) Response() ArticleResponse {
 		//UpdatedAt:      s.UpdatedAt.UTC().Format(time.RFC3339Nano),
 		UpdatedAt:      s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		Author:         authorSerializer.Response(),
-		Favorite:       s.isFavoriteBy(GetArticleUserModel(myUserModel)),
-		FavoritesCount: s.favoritesCount(),
+		Favorite:       s.isFavoriteBy(s.C.Request.Context(), GetArticleUserModel(s.C.Request.Context(), myUserModel)),
+		FavoritesCount: s.favoritesCount(s.C.Request.Context()),
 	}
 	response.Tags = make([]string, 0)
 	for _, tag := range s.Tags {
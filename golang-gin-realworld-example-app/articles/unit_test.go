@@ -1,6 +1,7 @@
 package articles
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -12,6 +13,7 @@ import (
 	"net/http/httptest"
 	"realworld-backend/common"
 	"realworld-backend/users"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
@@ -94,6 +96,24 @@ func HeaderTokenMock(req *http.Request, u uint) {
 	req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(u)))
 }
 
+// Serve a request with a JSON body on r, the token goes to the Authorization header unless it is
+// empty. The options change the request before it is served, e.g. its User-Agent.
+//
+//	code, body := RequestMock(router, "DELETE", "/api/articles/"+slug, "", common.GenToken(userModel.ID))
+func RequestMock(r http.Handler, method, url, body, token string, options ...func(*http.Request)) (int, string) {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	for _, option := range options {
+		option(req)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code, w.Body.String()
+}
+
 // makeUserFollow creates a follow relationship between two users using the database directly
 func makeUserFollow(follower, following users.UserModel) error {
 	db := common.GetDB()
@@ -120,36 +140,36 @@ func TestArticleModel(t *testing.T) {
 	user2 := userModels[1]
 
 	// Get article user models
-	articleUser1 := GetArticleUserModel(user1)
-	articleUser2 := GetArticleUserModel(user2)
+	articleUser1 := GetArticleUserModel(context.Background(), user1)
+	articleUser2 := GetArticleUserModel(context.Background(), user2)
 
 	// Create test articles
 	articles := articleModelMocker(2, articleUser1)
 	article := articles[0]
 
 	// Test favorites count
-	initialCount := article.favoritesCount()
+	initialCount := article.favoritesCount(context.Background())
 	asserts.Equal(uint(0), initialCount, "Initial favorites count should be 0")
 
 	// Test isFavoriteBy
-	asserts.False(article.isFavoriteBy(articleUser2), "Article should not be favorited initially")
+	asserts.False(article.isFavoriteBy(context.Background(), articleUser2), "Article should not be favorited initially")
 
 	// Test favoriteBy
-	err := article.favoriteBy(articleUser2)
+	err := article.favoriteBy(context.Background(), articleUser2)
 	asserts.NoError(err, "Should be able to favorite article")
-	asserts.True(article.isFavoriteBy(articleUser2), "Article should be favorited after favoriteBy")
-	asserts.Equal(uint(1), article.favoritesCount(), "Favorites count should be 1")
+	asserts.True(article.isFavoriteBy(context.Background(), articleUser2), "Article should be favorited after favoriteBy")
+	asserts.Equal(uint(1), article.favoritesCount(context.Background()), "Favorites count should be 1")
 
 	// Test duplicate favorite (should not error)
-	err = article.favoriteBy(articleUser2)
+	err = article.favoriteBy(context.Background(), articleUser2)
 	asserts.NoError(err, "Duplicate favorite should not error")
-	asserts.Equal(uint(1), article.favoritesCount(), "Favorites count should still be 1")
+	asserts.Equal(uint(1), article.favoritesCount(context.Background()), "Favorites count should still be 1")
 
 	// Test unFavoriteBy
-	err = article.unFavoriteBy(articleUser2)
+	err = article.unFavoriteBy(context.Background(), articleUser2)
 	asserts.NoError(err, "Should be able to unfavorite article")
-	asserts.False(article.isFavoriteBy(articleUser2), "Article should not be favorited after unfavorite")
-	asserts.Equal(uint(0), article.favoritesCount(), "Favorites count should be 0 after unfavorite")
+	asserts.False(article.isFavoriteBy(context.Background(), articleUser2), "Article should not be favorited after unfavorite")
+	asserts.Equal(uint(0), article.favoritesCount(context.Background()), "Favorites count should be 0 after unfavorite")
 }
 
 // TestTagModel tests tag-related functionality
@@ -167,13 +187,13 @@ func TestTagModel(t *testing.T) {
 	asserts.NoError(err, "Should create second tag successfully")
 
 	// Test getAllTags
-	tags, err := getAllTags()
+	tags, err := getAllTags(context.Background())
 	asserts.NoError(err, "Should get all tags")
 	asserts.GreaterOrEqual(len(tags), 2, "Should have at least 2 tags")
 
 	// Test setTags on article
 	userModels := userModelMocker(1)
-	articleUser := GetArticleUserModel(userModels[0])
+	articleUser := GetArticleUserModel(context.Background(), userModels[0])
 	
 	article := ArticleModel{
 		Slug:        "test-tags-article",
@@ -186,7 +206,7 @@ func TestTagModel(t *testing.T) {
 	test_db.Create(&article)
 
 	tagNames := []string{"golang", "testing", "web"}
-	err = article.setTags(tagNames)
+	err = article.setTags(context.Background(), tagNames)
 	asserts.NoError(err, "Should set tags successfully")
 	asserts.Equal(3, len(article.Tags), "Should have 3 tags")
 }
@@ -197,18 +217,18 @@ func TestFindOneArticle(t *testing.T) {
 	resetDBWithMock()
 
 	userModels := userModelMocker(1)
-	articleUser := GetArticleUserModel(userModels[0])
+	articleUser := GetArticleUserModel(context.Background(), userModels[0])
 	articles := articleModelMocker(1, articleUser)
 	testArticle := articles[0]
 
 	// Find by slug
-	found, err := FindOneArticle(&ArticleModel{Slug: testArticle.Slug})
+	found, err := FindOneArticle(context.Background(), &ArticleModel{Slug: testArticle.Slug})
 	asserts.NoError(err, "Should find article by slug")
 	asserts.Equal(testArticle.Title, found.Title, "Found article should match")
 	asserts.NotNil(found.Author.UserModel, "Author should be loaded")
 
 	// Find non-existent article (GORM returns empty model with ID = 0 instead of error)
-	notFound, err := FindOneArticle(&ArticleModel{Slug: "non-existent-slug"})
+	notFound, err := FindOneArticle(context.Background(), &ArticleModel{Slug: "non-existent-slug"})
 	// Check if the article was not found by checking ID
 	asserts.Equal(uint(0), notFound.ID, "Should return empty model for non-existent article")
 }
@@ -219,26 +239,26 @@ func TestFindManyArticle(t *testing.T) {
 	resetDBWithMock()
 
 	userModels := userModelMocker(2)
-	articleUser1 := GetArticleUserModel(userModels[0])
-	articleUser2 := GetArticleUserModel(userModels[1])
+	articleUser1 := GetArticleUserModel(context.Background(), userModels[0])
+	articleUser2 := GetArticleUserModel(context.Background(), userModels[1])
 
 	// Create articles with different authors
 	articleModelMocker(3, articleUser1)
 	articleModelMocker(2, articleUser2)
 
 	// Test getting all articles
-	articles, count, err := FindManyArticle("", "", "5", "0", "")
+	articles, count, err := FindManyArticle(context.Background(), "", "", "5", "0", "")
 	asserts.NoError(err, "Should get all articles")
 	asserts.GreaterOrEqual(count, 5, "Should have at least 5 articles")
 	asserts.GreaterOrEqual(len(articles), 5, "Should return at least 5 articles")
 
 	// Test limit and offset
-	articles, count, err = FindManyArticle("", "", "2", "0", "")
+	articles, count, err = FindManyArticle(context.Background(), "", "", "2", "0", "")
 	asserts.NoError(err, "Should get articles with limit")
 	asserts.Equal(2, len(articles), "Should return 2 articles")
 
 	// Test filter by author
-	articles, count, err = FindManyArticle("", userModels[0].Username, "10", "0", "")
+	articles, count, err = FindManyArticle(context.Background(), "", userModels[0].Username, "10", "0", "")
 	asserts.NoError(err, "Should filter by author")
 	asserts.Equal(3, count, "Should have 3 articles by user1")
 }
@@ -249,8 +269,8 @@ func TestArticleComments(t *testing.T) {
 	resetDBWithMock()
 
 	userModels := userModelMocker(2)
-	articleUser1 := GetArticleUserModel(userModels[0])
-	articleUser2 := GetArticleUserModel(userModels[1])
+	articleUser1 := GetArticleUserModel(context.Background(), userModels[0])
+	articleUser2 := GetArticleUserModel(context.Background(), userModels[1])
 
 	articles := articleModelMocker(1, articleUser1)
 	article := articles[0]
@@ -263,7 +283,7 @@ func TestArticleComments(t *testing.T) {
 		AuthorID:  articleUser2.ID,
 		Body:      "Great article!",
 	}
-	err := SaveOne(&comment1)
+	err := SaveOne(context.Background(), &comment1)
 	asserts.NoError(err, "Should save comment")
 
 	comment2 := CommentModel{
@@ -273,11 +293,11 @@ func TestArticleComments(t *testing.T) {
 		AuthorID:  articleUser1.ID,
 		Body:      "Thanks for reading!",
 	}
-	err = SaveOne(&comment2)
+	err = SaveOne(context.Background(), &comment2)
 	asserts.NoError(err, "Should save second comment")
 
 	// Get comments
-	err = article.getComments()
+	err = article.getComments(context.Background())
 	asserts.NoError(err, "Should get comments")
 	asserts.Equal(2, len(article.Comments), "Should have 2 comments")
 	asserts.NotNil(article.Comments[0].Author.UserModel, "Comment author should be loaded")
@@ -328,7 +348,7 @@ var articleRequestTests = []struct {
 		func(req *http.Request) {
 			resetDBWithMock()
 			users := userModelMocker(1)
-			articleUser := GetArticleUserModel(users[0])
+			articleUser := GetArticleUserModel(context.Background(), users[0])
 			articleModelMocker(5, articleUser)
 		},
 		"/api/articles/",
@@ -342,7 +362,7 @@ var articleRequestTests = []struct {
 		func(req *http.Request) {
 			resetDBWithMock()
 			users := userModelMocker(1)
-			articleUser := GetArticleUserModel(users[0])
+			articleUser := GetArticleUserModel(context.Background(), users[0])
 			articleModelMocker(1, articleUser)
 		},
 		"/api/articles/test-article-1",
@@ -356,7 +376,7 @@ var articleRequestTests = []struct {
 		func(req *http.Request) {
 			resetDBWithMock()
 			users := userModelMocker(1)
-			articleUser := GetArticleUserModel(users[0])
+			articleUser := GetArticleUserModel(context.Background(), users[0])
 			articleModelMocker(1, articleUser)
 			HeaderTokenMock(req, users[0].ID)
 		},
@@ -371,7 +391,7 @@ var articleRequestTests = []struct {
 		func(req *http.Request) {
 			resetDBWithMock()
 			users := userModelMocker(1)
-			articleUser := GetArticleUserModel(users[0])
+			articleUser := GetArticleUserModel(context.Background(), users[0])
 			articleModelMocker(1, articleUser)
 			HeaderTokenMock(req, users[0].ID)
 		},
@@ -386,7 +406,7 @@ var articleRequestTests = []struct {
 		func(req *http.Request) {
 			resetDBWithMock()
 			users := userModelMocker(2)
-			articleUser := GetArticleUserModel(users[0])
+			articleUser := GetArticleUserModel(context.Background(), users[0])
 			articleModelMocker(1, articleUser)
 			HeaderTokenMock(req, users[1].ID)
 		},
@@ -401,11 +421,11 @@ var articleRequestTests = []struct {
 		func(req *http.Request) {
 			resetDBWithMock()
 			users := userModelMocker(2)
-			articleUser := GetArticleUserModel(users[0])
+			articleUser := GetArticleUserModel(context.Background(), users[0])
 			articles := articleModelMocker(1, articleUser)
 			// Favorite first
-			articleUser2 := GetArticleUserModel(users[1])
-			articles[0].favoriteBy(articleUser2)
+			articleUser2 := GetArticleUserModel(context.Background(), users[1])
+			articles[0].favoriteBy(context.Background(), articleUser2)
 			HeaderTokenMock(req, users[1].ID)
 		},
 		"/api/articles/test-article-1/favorite",
@@ -419,7 +439,7 @@ var articleRequestTests = []struct {
 		func(req *http.Request) {
 			resetDBWithMock()
 			users := userModelMocker(2)
-			articleUser := GetArticleUserModel(users[0])
+			articleUser := GetArticleUserModel(context.Background(), users[0])
 			articleModelMocker(1, articleUser)
 			HeaderTokenMock(req, users[1].ID)
 		},
@@ -434,8 +454,8 @@ var articleRequestTests = []struct {
 		func(req *http.Request) {
 			resetDBWithMock()
 			users := userModelMocker(2)
-			articleUser1 := GetArticleUserModel(users[0])
-			articleUser2 := GetArticleUserModel(users[1])
+			articleUser1 := GetArticleUserModel(context.Background(), users[0])
+			articleUser2 := GetArticleUserModel(context.Background(), users[1])
 			articles := articleModelMocker(1, articleUser1)
 			
 			// Add comments
@@ -446,7 +466,7 @@ var articleRequestTests = []struct {
 				AuthorID:  articleUser2.ID,
 				Body:      "Test comment",
 			}
-			SaveOne(&comment)
+			SaveOne(context.Background(), &comment)
 		},
 		"/api/articles/test-article-1/comments",
 		"GET",
@@ -595,30 +615,37 @@ func TestArticleFeed(t *testing.T) {
 	asserts.NoError(err, "User1 should follow User2")
 
 	// Create articles by different users
-	articleUser2 := GetArticleUserModel(user2)
-	articleUser3 := GetArticleUserModel(user3)
+	articleUser2 := GetArticleUserModel(context.Background(), user2)
+	articleUser3 := GetArticleUserModel(context.Background(), user3)
 	
 	articleModelMocker(2, articleUser2) // User2's articles
 	articleModelMocker(1, articleUser3) // User3's articles
 
 	// Test GetArticleFeed
-	articleUser1 := GetArticleUserModel(user1)
-	articles, _, err := articleUser1.GetArticleFeed("10", "0")
+	articleUser1 := GetArticleUserModel(context.Background(), user1)
+	articles, _, err := articleUser1.GetArticleFeed(context.Background(), "10", "0")
 	asserts.NoError(err, "Should get article feed")
 	asserts.Equal(2, len(articles), "Should have 2 articles in feed from followed user")
 
 	// Test with limit
-	articles, _, err = articleUser1.GetArticleFeed("1", "0")
+	articles, count, err := articleUser1.GetArticleFeed(context.Background(), "1", "0")
 	asserts.NoError(err, "Should get article feed with limit")
 	asserts.Equal(1, len(articles), "Should have 1 article with limit")
+	asserts.Equal(2, count, "Count should ignore the limit")
+
+	// Test without any following
+	articles, count, err = articleUser3.GetArticleFeed(context.Background(), "10", "0")
+	asserts.NoError(err, "Should get an empty feed")
+	asserts.Equal(0, len(articles), "Should have no article without following")
+	asserts.Equal(0, count, "Should count no article without following")
 
 	// Test with offset
-	articles, _, err = articleUser1.GetArticleFeed("10", "1")
+	articles, _, err = articleUser1.GetArticleFeed(context.Background(), "10", "1")
 	asserts.NoError(err, "Should get article feed with offset")
 	asserts.Equal(1, len(articles), "Should have 1 article with offset")
 
 	// Test with invalid limit and offset (should use defaults)
-	articles, _, err = articleUser1.GetArticleFeed("invalid", "invalid")
+	articles, _, err = articleUser1.GetArticleFeed(context.Background(), "invalid", "invalid")
 	asserts.NoError(err, "Should handle invalid limit/offset")
 	asserts.Equal(2, len(articles), "Should use default limit/offset")
 }
@@ -629,7 +656,7 @@ func TestDeleteCommentModel(t *testing.T) {
 	resetDBWithMock()
 
 	userModels := userModelMocker(1)
-	articleUser := GetArticleUserModel(userModels[0])
+	articleUser := GetArticleUserModel(context.Background(), userModels[0])
 	articles := articleModelMocker(1, articleUser)
 	article := articles[0]
 
@@ -641,11 +668,11 @@ func TestDeleteCommentModel(t *testing.T) {
 		AuthorID:  articleUser.ID,
 		Body:      "Test comment to delete",
 	}
-	err := SaveOne(&comment)
+	err := SaveOne(context.Background(), &comment)
 	asserts.NoError(err, "Should save comment")
 
 	// Delete the comment
-	err = DeleteCommentModel([]uint{comment.ID})
+	err = DeleteCommentModel(context.Background(), []uint{comment.ID})
 	asserts.NoError(err, "Should delete comment")
 
 	// Verify deletion
@@ -668,7 +695,7 @@ func TestArticleFeedEndpoint(t *testing.T) {
 	asserts.NoError(err, "User1 should follow User2")
 
 	// Create articles by User2
-	articleUser2 := GetArticleUserModel(user2)
+	articleUser2 := GetArticleUserModel(context.Background(), user2)
 	articleModelMocker(3, articleUser2)
 
 	router, recorder := makeTestContext()
@@ -699,7 +726,7 @@ func TestArticleCommentDeleteEndpoint(t *testing.T) {
 
 	userModels := userModelMocker(2)
 	user1 := userModels[0]
-	articleUser := GetArticleUserModel(user1)
+	articleUser := GetArticleUserModel(context.Background(), user1)
 	articles := articleModelMocker(1, articleUser)
 	article := articles[0]
 
@@ -711,7 +738,7 @@ func TestArticleCommentDeleteEndpoint(t *testing.T) {
 		AuthorID:  articleUser.ID,
 		Body:      "Test comment to delete via endpoint",
 	}
-	SaveOne(&comment)
+	SaveOne(context.Background(), &comment)
 
 	router, recorder := makeTestContext()
 	v1 := router.Group("/api")
@@ -741,7 +768,7 @@ func TestFindManyArticleWithTags(t *testing.T) {
 	resetDBWithMock()
 
 	userModels := userModelMocker(1)
-	articleUser := GetArticleUserModel(userModels[0])
+	articleUser := GetArticleUserModel(context.Background(), userModels[0])
 
 	// Create articles with specific tags
 	article1 := ArticleModel{
@@ -753,7 +780,7 @@ func TestFindManyArticleWithTags(t *testing.T) {
 		AuthorID:    articleUser.ID,
 	}
 	test_db.Create(&article1)
-	article1.setTags([]string{"golang", "programming"})
+	article1.setTags(context.Background(), []string{"golang", "programming"})
 	test_db.Save(&article1)
 
 	article2 := ArticleModel{
@@ -765,16 +792,16 @@ func TestFindManyArticleWithTags(t *testing.T) {
 		AuthorID:    articleUser.ID,
 	}
 	test_db.Create(&article2)
-	article2.setTags([]string{"python", "programming"})
+	article2.setTags(context.Background(), []string{"python", "programming"})
 	test_db.Save(&article2)
 
 	// Test filter by tag
-	articles, count, err := FindManyArticle("golang", "", "10", "0", "")
+	articles, count, err := FindManyArticle(context.Background(), "golang", "", "10", "0", "")
 	asserts.NoError(err, "Should find articles by tag")
 	asserts.Equal(1, count, "Should have 1 article with golang tag")
 
 	// Test with non-existent tag
-	articles, count, err = FindManyArticle("nonexistent", "", "10", "0", "")
+	articles, count, err = FindManyArticle(context.Background(), "nonexistent", "", "10", "0", "")
 	asserts.NoError(err, "Should handle non-existent tag")
 	asserts.Equal(0, len(articles), "Should return 0 articles for non-existent tag")
 }
@@ -788,24 +815,24 @@ func TestFindManyArticleWithFavorited(t *testing.T) {
 	user1 := userModels[0]
 	user2 := userModels[1]
 
-	articleUser1 := GetArticleUserModel(user1)
-	articleUser2 := GetArticleUserModel(user2)
+	articleUser1 := GetArticleUserModel(context.Background(), user1)
+	articleUser2 := GetArticleUserModel(context.Background(), user2)
 
 	// Create articles
 	articles := articleModelMocker(3, articleUser1)
 
 	// User2 favorites some articles
-	articles[0].favoriteBy(articleUser2)
-	articles[1].favoriteBy(articleUser2)
+	articles[0].favoriteBy(context.Background(), articleUser2)
+	articles[1].favoriteBy(context.Background(), articleUser2)
 
 	// Test filter by favorited
-	foundArticles, count, err := FindManyArticle("", "", "10", "0", user2.Username)
+	foundArticles, count, err := FindManyArticle(context.Background(), "", "", "10", "0", user2.Username)
 	asserts.NoError(err, "Should find favorited articles")
 	asserts.Equal(2, count, "Should have 2 favorited articles")
 	asserts.Equal(2, len(foundArticles), "Should return 2 favorited articles")
 
 	// Test with user who hasn't favorited any articles
-	foundArticles, count, err = FindManyArticle("", "", "10", "0", "nonexistentuser")
+	foundArticles, count, err = FindManyArticle(context.Background(), "", "", "10", "0", "nonexistentuser")
 	asserts.NoError(err, "Should handle non-existent user")
 	asserts.Equal(0, len(foundArticles), "Should return 0 articles for non-existent user")
 }
@@ -818,7 +845,7 @@ func TestErrorPaths(t *testing.T) {
 	userModels := userModelMocker(1)
 	user1 := userModels[0]
 
-	articleUser1 := GetArticleUserModel(user1)
+	articleUser1 := GetArticleUserModel(context.Background(), user1)
 	_ = articleModelMocker(1, articleUser1)
 
 	router, recorder := makeTestContext()
@@ -906,7 +933,7 @@ func TestMoreRouterErrorPaths(t *testing.T) {
 
 	userModels := userModelMocker(1)
 	user1 := userModels[0]
-	articleUser := GetArticleUserModel(user1)
+	articleUser := GetArticleUserModel(context.Background(), user1)
 	articles := articleModelMocker(1, articleUser)
 
 	router, recorder := makeTestContext()
@@ -992,7 +1019,7 @@ func TestNewArticleModelValidatorFillWith(t *testing.T) {
 	resetDBWithMock()
 
 	userModels := userModelMocker(1)
-	articleUser := GetArticleUserModel(userModels[0])
+	articleUser := GetArticleUserModel(context.Background(), userModels[0])
 
 	// Create an article with tags
 	article := ArticleModel{
@@ -1004,7 +1031,7 @@ func TestNewArticleModelValidatorFillWith(t *testing.T) {
 		AuthorID:    articleUser.ID,
 	}
 	test_db.Create(&article)
-	article.setTags([]string{"tag1", "tag2", "tag3"})
+	article.setTags(context.Background(), []string{"tag1", "tag2", "tag3"})
 	test_db.Save(&article)
 
 	// Load article with tags
@@ -1024,7 +1051,7 @@ func TestSetTagsError(t *testing.T) {
 	resetDBWithMock()
 
 	userModels := userModelMocker(1)
-	articleUser := GetArticleUserModel(userModels[0])
+	articleUser := GetArticleUserModel(context.Background(), userModels[0])
 
 	article := ArticleModel{
 		Slug:        "test-set-tags",
@@ -1037,17 +1064,17 @@ func TestSetTagsError(t *testing.T) {
 	test_db.Create(&article)
 
 	// Test with empty tags
-	err := article.setTags([]string{})
+	err := article.setTags(context.Background(), []string{})
 	asserts.NoError(err, "Should handle empty tags")
 	asserts.Equal(0, len(article.Tags), "Should have 0 tags")
 
 	// Test with valid tags
-	err = article.setTags([]string{"tag1", "tag2"})
+	err = article.setTags(context.Background(), []string{"tag1", "tag2"})
 	asserts.NoError(err, "Should set tags successfully")
 	asserts.Equal(2, len(article.Tags), "Should have 2 tags")
 
 	// Test setting tags again (FirstOrCreate should not duplicate)
-	err = article.setTags([]string{"tag1", "tag2", "tag3"})
+	err = article.setTags(context.Background(), []string{"tag1", "tag2", "tag3"})
 	asserts.NoError(err, "Should set tags again")
 	asserts.Equal(3, len(article.Tags), "Should have 3 tags")
 }
@@ -1125,8 +1152,8 @@ func TestFindManyArticleAllFilters(t *testing.T) {
 	user1 := userModels[0]
 	user2 := userModels[1]
 
-	articleUser1 := GetArticleUserModel(user1)
-	articleUser2 := GetArticleUserModel(user2)
+	articleUser1 := GetArticleUserModel(context.Background(), user1)
+	articleUser2 := GetArticleUserModel(context.Background(), user2)
 
 	// Create articles with tags
 	article1 := ArticleModel{
@@ -1138,39 +1165,39 @@ func TestFindManyArticleAllFilters(t *testing.T) {
 		AuthorID:    articleUser1.ID,
 	}
 	test_db.Create(&article1)
-	article1.setTags([]string{"tech", "golang"})
+	article1.setTags(context.Background(), []string{"tech", "golang"})
 	test_db.Save(&article1)
 
 	// Test filter by tag
-	articles, count, err := FindManyArticle("tech", "", "10", "0", "")
+	articles, count, err := FindManyArticle(context.Background(), "tech", "", "10", "0", "")
 	asserts.NoError(err, "Should find articles by tag")
 	asserts.GreaterOrEqual(count, 1, "Should have at least 1 article with tech tag")
 
 	// Test filter by author with valid author
-	articles, count, err = FindManyArticle("", user1.Username, "10", "0", "")
+	articles, count, err = FindManyArticle(context.Background(), "", user1.Username, "10", "0", "")
 	asserts.NoError(err, "Should find articles by author")
 	asserts.GreaterOrEqual(count, 1, "Should have at least 1 article by user1")
 
 	// Favorite an article
-	article1.favoriteBy(articleUser2)
+	article1.favoriteBy(context.Background(), articleUser2)
 
 	// Test filter by favorited
-	articles, count, err = FindManyArticle("", "", "10", "0", user2.Username)
+	articles, count, err = FindManyArticle(context.Background(), "", "", "10", "0", user2.Username)
 	asserts.NoError(err, "Should find favorited articles")
 	asserts.Equal(1, count, "Should have 1 favorited article")
 
 	// Test with non-existent author
-	articles, count, err = FindManyArticle("", "nonexistentauthor", "10", "0", "")
+	articles, count, err = FindManyArticle(context.Background(), "", "nonexistentauthor", "10", "0", "")
 	asserts.NoError(err, "Should handle non-existent author")
 	asserts.Equal(0, len(articles), "Should return 0 articles for non-existent author")
 
 	// Test with non-existent favorited user
-	articles, count, err = FindManyArticle("", "", "10", "0", "nonexistentuser")
+	articles, count, err = FindManyArticle(context.Background(), "", "", "10", "0", "nonexistentuser")
 	asserts.NoError(err, "Should handle non-existent favorited user")
 	asserts.Equal(0, len(articles), "Should return 0 articles for non-existent favorited user")
 
 	// Test with non-existent tag
-	articles, count, err = FindManyArticle("nonexistenttag", "", "10", "0", "")
+	articles, count, err = FindManyArticle(context.Background(), "nonexistenttag", "", "10", "0", "")
 	asserts.NoError(err, "Should handle non-existent tag")
 	asserts.Equal(0, len(articles), "Should return 0 articles for non-existent tag")
 }
@@ -1184,16 +1211,203 @@ func TestGetArticleUserModel(t *testing.T) {
 	userModels := userModelMocker(1)
 	user := userModels[0]
 
-	articleUser := GetArticleUserModel(user)
+	articleUser := GetArticleUserModel(context.Background(), user)
 	asserts.NotEqual(uint(0), articleUser.ID, "Should create article user model")
 	asserts.Equal(user.ID, articleUser.UserModelID, "UserModelID should match")
 
 	// Test getting the same user again (should return existing)
-	articleUser2 := GetArticleUserModel(user)
+	articleUser2 := GetArticleUserModel(context.Background(), user)
 	asserts.Equal(articleUser.ID, articleUser2.ID, "Should return existing article user model")
 
 	// Test with empty user model (ID = 0)
 	emptyUser := users.UserModel{}
-	articleUserEmpty := GetArticleUserModel(emptyUser)
+	articleUserEmpty := GetArticleUserModel(context.Background(), emptyUser)
 	asserts.Equal(uint(0), articleUserEmpty.ID, "Should return empty model for empty user")
 }
+
+// TestDeleteArticleUserModel tests deleting everything an user owns
+func TestDeleteArticleUserModel(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	userModels := userModelMocker(2)
+	author := GetArticleUserModel(context.Background(), userModels[0])
+	reader := GetArticleUserModel(context.Background(), userModels[1])
+	authorArticles := articleModelMocker(2, author)
+	readerArticles := articleModelMocker(1, reader)
+
+	test_db.Create(&CommentModel{ArticleID: authorArticles[0].ID, AuthorID: reader.ID, Body: "on author's article"})
+	test_db.Create(&CommentModel{ArticleID: readerArticles[0].ID, AuthorID: author.ID, Body: "by author"})
+	test_db.Create(&CommentModel{ArticleID: readerArticles[0].ID, AuthorID: reader.ID, Body: "kept"})
+	authorArticles[0].favoriteBy(context.Background(), reader)
+	readerArticles[0].favoriteBy(context.Background(), author)
+	readerArticles[0].favoriteBy(context.Background(), reader)
+
+	err := DeleteArticleUserModel(userModels[0])
+	asserts.NoError(err, "Should delete the user's data")
+
+	var count int
+	test_db.Unscoped().Model(&ArticleModel{}).Where("author_id = ?", author.ID).Count(&count)
+	asserts.Equal(0, count, "Author's articles should be deleted")
+	test_db.Unscoped().Model(&CommentModel{}).Count(&count)
+	asserts.Equal(1, count, "Only the comment unrelated to the author should be kept")
+	test_db.Unscoped().Model(&FavoriteModel{}).Count(&count)
+	asserts.Equal(1, count, "Only the favorite unrelated to the author should be kept")
+	test_db.Table("article_tags").Where("article_model_id = ?", authorArticles[1].ID).Count(&count)
+	asserts.Equal(0, count, "Tags of the author's articles should be detached")
+	test_db.Unscoped().Model(&ArticleUserModel{}).Where("id = ?", author.ID).Count(&count)
+	asserts.Equal(0, count, "ArticleUserModel should be deleted")
+	_, err = FindOneArticle(context.Background(), &ArticleModel{Slug: readerArticles[0].Slug})
+	asserts.NoError(err, "Other users' articles should be kept")
+
+	err = DeleteArticleUserModel(userModels[0])
+	asserts.NoError(err, "Deleting twice should be a no-op")
+}
+
+// TestReindexSlugs tests recomputing the slugs from the titles
+func TestReindexSlugs(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	userModels := userModelMocker(1)
+	author := GetArticleUserModel(context.Background(), userModels[0])
+	articles := articleModelMocker(3, author)
+
+	// Two stale slugs, and a title whose slug is taken by another article
+	test_db.Model(&articles[0]).UpdateColumn("slug", "stale-slug-1")
+	test_db.Model(&articles[1]).UpdateColumn("slug", "stale-slug-2")
+	test_db.Model(&articles[2]).UpdateColumn("title", "Test Article 1")
+
+	updated, conflicts, err := ReindexSlugs()
+	asserts.NoError(err)
+	asserts.Equal(2, updated, "Slugs should follow the titles")
+	asserts.Len(conflicts, 1, "A taken slug should be reported")
+	asserts.Equal(articles[2].ID, conflicts[0].ID)
+
+	article, err := FindOneArticle(context.Background(), &ArticleModel{Slug: "test-article-1"})
+	asserts.NoError(err)
+	asserts.Equal(articles[0].ID, article.ID)
+
+	updated, conflicts, err = ReindexSlugs()
+	asserts.NoError(err)
+	asserts.Equal(0, updated, "Reindex should be a no-op the second time")
+	asserts.Len(conflicts, 1)
+}
+
+func TestPersonalAccessTokenScopes(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	userModels := userModelMocker(1)
+	article := articleModelMocker(1, GetArticleUserModel(context.Background(), userModels[0]))[0]
+
+	router, _ := makeTestContext()
+	authenticatedArticles := router.Group("/api/articles")
+	authenticatedArticles.Use(users.AuthMiddleware(true))
+	ArticlesRegister(authenticatedArticles)
+
+	_, none, err := users.CreatePersonalAccessToken(context.Background(), userModels[0].ID, "none", nil, nil)
+	asserts.NoError(err)
+	for _, route := range router.Routes() {
+		url := strings.NewReplacer(":slug", article.Slug, ":id", "1").Replace(route.Path)
+		code, body := RequestMock(router, route.Method, url, `{}`, none)
+		asserts.Equal(http.StatusForbidden, code, "%s %s should ask for a scope", route.Method, route.Path)
+		asserts.Regexp(`^{"errors":{"scope":"The token lacks the [a-z]+:write scope"}}$`, body)
+	}
+
+	_, writer, _ := users.CreatePersonalAccessToken(context.Background(), userModels[0].ID, "ci", []string{users.ScopeArticlesWrite}, nil)
+	code, _ := RequestMock(router, "POST", "/api/articles/", `{"article":{"title":"From the CI","description":"Bots","body":"Beep"}}`, writer)
+	asserts.Equal(http.StatusCreated, code, "the scope should let the token post")
+	code, body := RequestMock(router, "POST", "/api/articles/"+article.Slug+"/favorite", ``, writer)
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(`{"errors":{"scope":"The token lacks the favorites:write scope"}}`, body)
+
+	code, _ = RequestMock(router, "POST", "/api/articles/", `{}`, users.PersonalAccessTokenPrefix+"Qm9yaW5n")
+	asserts.Equal(http.StatusUnauthorized, code, "an unknown token should get a 401")
+}
+
+func TestModeratorOverrides(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	userModels := userModelMocker(3)
+	author, moderator, other := userModels[0], userModels[1], userModels[2]
+	articleUser := GetArticleUserModel(context.Background(), author)
+	articles := articleModelMocker(2, articleUser)
+	comment := CommentModel{ArticleID: articles[0].ID, AuthorID: articleUser.ID, Body: "Spam"}
+	test_db.Create(&comment)
+	asserts.NoError(users.GrantRole(context.Background(), moderator.ID, users.RoleModerator))
+
+	router, _ := makeTestContext()
+	authenticatedArticles := router.Group("/api/articles")
+	authenticatedArticles.Use(users.AuthMiddleware(true))
+	ArticlesRegister(authenticatedArticles)
+
+	code, body := RequestMock(router, "PUT", "/api/articles/"+articles[0].Slug, `{"article":{"body":"Vandalized"}}`, common.GenToken(other.ID))
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(`{"errors":{"articles":"You can only change your own articles"}}`, body)
+	code, _ = RequestMock(router, "DELETE", "/api/articles/"+articles[0].Slug, ``, common.GenToken(other.ID))
+	asserts.Equal(http.StatusForbidden, code)
+	code, _ = RequestMock(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", articles[0].Slug, comment.ID), ``, common.GenToken(other.ID))
+	asserts.Equal(http.StatusForbidden, code)
+
+	code, body = RequestMock(router, "PUT", "/api/articles/"+articles[0].Slug, `{"article":{"body":"Moderated"}}`, common.GenToken(moderator.ID))
+	asserts.Equal(http.StatusOK, code, body)
+	article, _ := FindOneArticle(context.Background(), &ArticleModel{Slug: articles[0].Slug})
+	asserts.Equal("Moderated", article.Body)
+	asserts.Equal(articleUser.ID, article.AuthorID, "a moderator's change should leave the article to its author")
+	code, _ = RequestMock(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", articles[0].Slug, comment.ID), ``, common.GenToken(moderator.ID))
+	asserts.Equal(http.StatusOK, code)
+	code, _ = RequestMock(router, "DELETE", "/api/articles/"+articles[1].Slug, ``, common.GenToken(moderator.ID))
+	asserts.Equal(http.StatusOK, code)
+
+	code, _ = RequestMock(router, "PUT", "/api/articles/"+articles[0].Slug, `{"article":{"body":"Mine again"}}`, common.GenToken(author.ID))
+	asserts.Equal(http.StatusOK, code, "the author should still change the article")
+}
+
+func TestOwnershipPolicies(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	userModels := userModelMocker(2)
+	author, other := userModels[0], userModels[1]
+	articleUser := GetArticleUserModel(context.Background(), author)
+	articles := articleModelMocker(2, articleUser)
+	comment := CommentModel{ArticleID: articles[0].ID, AuthorID: articleUser.ID, Body: "First"}
+	test_db.Create(&comment)
+
+	router, _ := makeTestContext()
+	authenticatedArticles := router.Group("/api/articles")
+	authenticatedArticles.Use(users.AuthMiddleware(true))
+	ArticlesRegister(authenticatedArticles)
+
+	code, body := RequestMock(router, "DELETE", "/api/articles/"+articles[0].Slug, "", common.GenToken(other.ID))
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(`{"errors":{"articles":"You can only delete your own articles"}}`, body)
+	code, body = RequestMock(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", articles[0].Slug, comment.ID), "", common.GenToken(other.ID))
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(`{"errors":{"comment":"You can only delete your own comments"}}`, body)
+
+	code, body = RequestMock(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", articles[1].Slug, comment.ID), "", common.GenToken(author.ID))
+	asserts.Equal(http.StatusNotFound, code, "a comment of another article should not be found")
+	asserts.Equal(`{"errors":{"comment":"Invalid id"}}`, body)
+	code, _ = RequestMock(router, "DELETE", fmt.Sprintf("/api/articles/missing/comments/%d", comment.ID), "", common.GenToken(author.ID))
+	asserts.Equal(http.StatusNotFound, code)
+	asserts.NoError(test_db.First(&CommentModel{}, comment.ID).Error, "the comment should still be there")
+
+	code, _ = RequestMock(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", articles[0].Slug, comment.ID), "", common.GenToken(author.ID))
+	asserts.Equal(http.StatusOK, code)
+	code, _ = RequestMock(router, "DELETE", "/api/articles/"+articles[0].Slug, "", common.GenToken(author.ID))
+	asserts.Equal(http.StatusOK, code)
+
+	requestOf := func(user users.UserModel) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", "/", nil)
+		c.Set("my_user_id", user.ID)
+		c.Set("my_user_model", user)
+		return c
+	}
+	asserts.True(ArticlePolicy.Allows(requestOf(author), articleUser.ID))
+	asserts.False(ArticlePolicy.Allows(requestOf(other), articleUser.ID))
+	asserts.NoError(users.GrantRole(context.Background(), other.ID, users.RoleModerator))
+	asserts.True(ArticlePolicy.Allows(requestOf(other), articleUser.ID), "a moderator should override the article policy")
+	policy := OwnershipPolicy{Key: "articles", Overrides: []string{users.PermissionRolesManage}}
+	asserts.False(policy.Allows(requestOf(other), articleUser.ID), "a moderator lacks the overrides of the policy")
+}
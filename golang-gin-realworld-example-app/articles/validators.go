@@ -43,8 +43,8 @@ func (s *ArticleModelValidator) Bind(c *gin.Context) error {
 	s.articleModel.Title = s.Article.Title
 	s.articleModel.Description = s.Article.Description
 	s.articleModel.Body = s.Article.Body
-	s.articleModel.Author = GetArticleUserModel(myUserModel)
-	s.articleModel.setTags(s.Article.Tags)
+	s.articleModel.Author = GetArticleUserModel(c.Request.Context(), myUserModel)
+	s.articleModel.setTags(c.Request.Context(), s.Article.Tags)
 	return nil
 }
 
@@ -67,6 +67,6 @@ func (s *CommentModelValidator) Bind(c *gin.Context) error {
 		return err
 	}
 	s.commentModel.Body = s.Comment.Body
-	s.commentModel.Author = GetArticleUserModel(myUserModel)
+	s.commentModel.Author = GetArticleUserModel(c.Request.Context(), myUserModel)
 	return nil
 }
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"gopkg.in/yaml.v3"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/migrations"
+	"realworld-backend/users"
+)
+
+// A subcommand of the server binary:
+//
+//	realworld-server [-config file] <command> [flags]
+//
+// Without a command the server is started, as `serve` does.
+type command struct {
+	name    string
+	summary string
+	run     func(cfg *config.Config, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "start the HTTP server (the default)", serveCommand},
+		{"migrate", "up | down [steps] | status", migrateCommand},
+		{"create-user", "-username NAME -email EMAIL [-password PASS] [-admin]", createUserCommand},
+		{"set-password", "-email EMAIL [-password PASS]", setPasswordCommand},
+		{"promote-admin", "-email EMAIL [-revoke]", promoteAdminCommand},
+		{"grant-role", "-email EMAIL -role admin|moderator [-revoke]", grantRoleCommand},
+		{"delete-user", "-email EMAIL", deleteUserCommand},
+		{"unlock-login", "-email EMAIL | -ip IP", unlockLoginCommand},
+		{"disable-2fa", "-email EMAIL", disableTwoFactorCommand},
+		{"jwt-keys", "list | add [-algorithm ALG] [-activate] | activate KID | retire KID | prune", jwtKeysCommand},
+		{"reindex", "recompute the article slugs from their titles", reindexCommand},
+		{"check-config", "validate the config and print it with the secrets masked", checkConfigCommand},
+	}
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [-config file] <command> [flags]\n\nflags:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintln(out, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-14s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+// Open the database for a command, the schema should be current before the models are used.
+func openDB(cfg *config.Config) (*gorm.DB, error) {
+	db := common.Init()
+	if err := db.DB().Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("database: %w", err)
+	}
+	if cfg.Database.AutoMigrate {
+		if _, err := migrations.Up(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return db, nil
+	}
+	pending, err := migrations.Pending(db)
+	if err == nil && len(pending) > 0 {
+		err = fmt.Errorf("%d pending migrations, run `migrate up` first", len(pending))
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func migrateCommand(cfg *config.Config, args []string) error {
+	db := common.Init()
+	defer db.Close()
+	return runMigrate(db, args, os.Stdout)
+}
+
+// The flags of a command, the usage printed on error is the command's summary.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s\n", name, findCommand(name).summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// The password is read from stdin when it isn't given as a flag, so it stays out of the shell history.
+func readPassword(password string, in io.Reader) (string, error) {
+	if password != "" {
+		return password, nil
+	}
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", errors.New("password: nothing to read on stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func findUserByEmail(email string) (users.UserModel, error) {
+	if email == "" {
+		return users.UserModel{}, errors.New("-email is required")
+	}
+	userModel, err := users.FindOneUser(context.Background(), &users.UserModel{Email: email})
+	if err != nil {
+		return userModel, fmt.Errorf("user %s: %w", email, err)
+	}
+	return userModel, nil
+}
+
+func createUserCommand(cfg *config.Config, args []string) error {
+	fs := newFlagSet("create-user")
+	username := fs.String("username", "", "username, 4 to 255 letters and digits")
+	email := fs.String("email", "", "email address")
+	password := fs.String("password", "", "password, read from stdin when empty")
+	admin := fs.Bool("admin", false, "promote the new user to admin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pass, err := readPassword(*password, os.Stdin)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	userModelValidator := users.NewUserModelValidator()
+	userModelValidator.User.Username = *username
+	userModelValidator.User.Email = *email
+	userModelValidator.User.Password = pass
+	userModel, err := userModelValidator.Validate()
+	if err != nil {
+		return err
+	}
+	if err := users.SaveOne(context.Background(), &userModel); err != nil {
+		return err
+	}
+	if *admin {
+		if err := users.GrantRole(context.Background(), userModel.ID, users.RoleAdmin); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("created user %d %s <%s>\n", userModel.ID, userModel.Username, userModel.Email)
+	return nil
+}
+
+func setPasswordCommand(cfg *config.Config, args []string) error {
+	fs := newFlagSet("set-password")
+	email := fs.String("email", "", "email address of the user")
+	password := fs.String("password", "", "new password, read from stdin when empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	userModel, err := findUserByEmail(*email)
+	if err != nil {
+		return err
+	}
+	pass, err := readPassword(*password, os.Stdin)
+	if err != nil {
+		return err
+	}
+	// The same rules as PUT /api/user/password, without the current password.
+	if err := users.ValidatePassword(pass); err != nil {
+		return err
+	}
+	if err := users.SetPassword(userModel, pass); err != nil {
+		return err
+	}
+	fmt.Printf("password of %s changed\n", userModel.Email)
+	return nil
+}
+
+func promoteAdminCommand(cfg *config.Config, args []string) error {
+	fs := newFlagSet("promote-admin")
+	email := fs.String("email", "", "email address of the user")
+	revoke := fs.Bool("revoke", false, "take the admin role back instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return setRole(cfg, *email, users.RoleAdmin, *revoke)
+}
+
+func grantRoleCommand(cfg *config.Config, args []string) error {
+	fs := newFlagSet("grant-role")
+	email := fs.String("email", "", "email address of the user")
+	role := fs.String("role", "", "admin or moderator")
+	revoke := fs.Bool("revoke", false, "take the role back instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return setRole(cfg, *email, *role, *revoke)
+}
+
+// Grant the role to the user of the email, or revoke it.
+func setRole(cfg *config.Config, email string, role string, revoke bool) error {
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	userModel, err := findUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	if revoke {
+		err = users.RevokeRole(context.Background(), userModel.ID, role)
+	} else {
+		err = users.GrantRole(context.Background(), userModel.ID, role)
+	}
+	if err != nil {
+		return fmt.Errorf("role %q: %w", role, err)
+	}
+	roles, err := users.UserRoles(context.Background(), userModel.ID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s roles: %s\n", userModel.Email, strings.Join(roles, ", "))
+	return nil
+}
+
+func deleteUserCommand(cfg *config.Config, args []string) error {
+	fs := newFlagSet("delete-user")
+	email := fs.String("email", "", "email address of the user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	userModel, err := findUserByEmail(*email)
+	if err != nil {
+		return err
+	}
+	// Checked again by DeleteUserModel, but the articles would be gone by then.
+	if last, err := users.IsLastAdmin(context.Background(), userModel.ID); err != nil {
+		return err
+	} else if last {
+		return users.ErrLastAdmin
+	}
+	if err := articles.DeleteArticleUserModel(userModel); err != nil {
+		return err
+	}
+	if err := users.DeleteUserModel(userModel); err != nil {
+		return err
+	}
+	fmt.Printf("deleted user %d %s <%s>\n", userModel.ID, userModel.Username, userModel.Email)
+	return nil
+}
+
+func unlockLoginCommand(cfg *config.Config, args []string) error {
+	fs := newFlagSet("unlock-login")
+	email := fs.String("email", "", "email address the logins were tried with")
+	ip := fs.String("ip", "", "client IP the logins came from")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" && *ip == "" {
+		return errors.New("-email or -ip is required")
+	}
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	failures, err := users.UnlockLogin(*email, *ip)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("unlocked, %d failed logins forgotten\n", failures)
+	return nil
+}
+
+func disableTwoFactorCommand(cfg *config.Config, args []string) error {
+	fs := newFlagSet("disable-2fa")
+	email := fs.String("email", "", "email address of the user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	userModel, err := findUserByEmail(*email)
+	if err != nil {
+		return err
+	}
+	if err := users.ResetTwoFactor(userModel.ID); err != nil {
+		return err
+	}
+	fmt.Printf("two-factor authentication of %s disabled\n", userModel.Email)
+	return nil
+}
+
+func jwtKeysCommand(cfg *config.Config, args []string) error {
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return runJWTKeys(args, os.Stdout)
+}
+
+func reindexCommand(cfg *config.Config, args []string) error {
+	if err := newFlagSet("reindex").Parse(args); err != nil {
+		return err
+	}
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	updated, conflicts, err := articles.ReindexSlugs()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d slugs updated\n", updated)
+	for _, article := range conflicts {
+		fmt.Printf("article %d %q kept slug %q, its new slug is taken\n", article.ID, article.Title, article.Slug)
+	}
+	return nil
+}
+
+// config.Load already validated cfg before any command runs, so only the printing is left.
+func checkConfigCommand(cfg *config.Config, args []string) error {
+	if err := newFlagSet("check-config").Parse(args); err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+	fmt.Fprintln(os.Stderr, "config is valid")
+	return nil
+}
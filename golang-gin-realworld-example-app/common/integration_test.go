@@ -7,6 +7,8 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
+
+	"realworld-backend/config"
 )
 
 // TestIntegration_Common_DatabaseConnection tests database initialization
@@ -34,6 +36,9 @@ func TestIntegration_Common_DatabaseConnection(t *testing.T) {
 
 // TestIntegration_Common_TestDatabaseLifecycle tests test database management
 func TestIntegration_Common_TestDatabaseLifecycle(t *testing.T) {
+	if driver, _ := TestDBSource(); driver != "sqlite3" {
+		t.Skip("checks the sqlite test database file")
+	}
 	asserts := assert.New(t)
 	
 	// Initialize test database
@@ -139,10 +144,10 @@ func TestIntegration_Common_JWTTokenGeneration(t *testing.T) {
 		asserts.Equal(float64(userID), claims["id"], "Token should contain user ID")
 		asserts.Contains(claims, "exp", "Token should contain expiration")
 		
-		// Verify expiration is approximately 24 hours from now
+		// Verify expiration is approximately jwt.token_lifetime from now
 		exp := int64(claims["exp"].(float64))
-		expectedExp := time.Now().Add(time.Hour * 24).Unix()
-		asserts.InDelta(expectedExp, exp, 60, "Expiration should be ~24 hours")
+		expectedExp := time.Now().Add(config.Get().JWT.TokenLifetime).Unix()
+		asserts.InDelta(expectedExp, exp, 60, "Expiration should be ~jwt.token_lifetime")
 	}
 }
 
@@ -0,0 +1,107 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// A public key as a JSON Web Key (RFC 7517), e.g.
+//
+//	{"kid":"5f2b0c61a3e9d4b7","kty":"OKP","alg":"EdDSA","use":"sig","crv":"Ed25519","x":"11qYAYKx..."}
+type JWK struct {
+	KID string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// The document of /.well-known/jwks.json.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func encodeJWKValue(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The JWK of an RSA, P-256 or Ed25519 public key.
+func NewJWK(kid string, alg string, public crypto.PublicKey) (JWK, error) {
+	jwk := JWK{KID: kid, Alg: alg, Use: "sig"}
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeJWKValue(public.N.Bytes())
+		jwk.E = encodeJWKValue(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		key, err := public.ECDH()
+		if err != nil {
+			return jwk, err
+		}
+		// The uncompressed point: 0x04, then X and Y of 32 bytes each.
+		point := key.Bytes()
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = encodeJWKValue(point[1:33])
+		jwk.Y = encodeJWKValue(point[33:])
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encodeJWKValue(public)
+	default:
+		return jwk, fmt.Errorf("jwk: unsupported public key %T", public)
+	}
+	return jwk, nil
+}
+
+// The public key of the JWK, the other way round of NewJWK, e.g. to verify the tokens of another issuer.
+func (jwk JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch {
+	case jwk.Kty == "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %s: n: %w", jwk.KID, err)
+		}
+		e, err := decode(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("jwk %s: invalid e", jwk.KID)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case jwk.Kty == "EC" && jwk.Crv == "P-256":
+		x, errX := decode(jwk.X)
+		y, errY := decode(jwk.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("jwk %s: invalid point", jwk.KID)
+		}
+		// The point is checked to be on the curve by crypto/ecdh.
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, fmt.Errorf("jwk %s: %w", jwk.KID, err)
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+		x, err := decode(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("jwk %s: invalid x", jwk.KID)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("jwk %s: unsupported key type %s %s", jwk.KID, jwk.Kty, jwk.Crv)
+}
+
+// The keys of a JWKSet are sorted by kid, so the document doesn't change between two reloads.
+func sortJWKs(keys []JWK) {
+	sort.Slice(keys, func(i, j int) bool { return keys[i].KID < keys[j].KID })
+}
@@ -0,0 +1,473 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/config"
+)
+
+// The kid of config.JWTConfig.Secret, it signs the tokens while no key of the table is active.
+const ConfigKeyID = "config"
+
+// The signing methods of the keys. HS256 shares its secret, the other ones publish their public key.
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmES256 = "ES256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// The life cycle of a SigningKey.
+const (
+	KeyNew     = "new"
+	KeyActive  = "active"
+	KeyRetired = "retired"
+	KeyExpired = "expired"
+)
+
+var (
+	ErrUnknownKey          = errors.New("unknown signing key")
+	ErrConfigSecretRefused = errors.New("the tokens of the config secret are not accepted anymore")
+)
+
+// A key of the signing_keys table. An HS256 key has the base64 of 32 random bytes in Secret,
+// the other ones have their PKCS #8 PEM in PrivateKey.
+// A new key only verifies tokens, the active one signs them too. A retired key verifies
+// the tokens it signed until they expire, that is jwt.token_lifetime after RetiredAt.
+type SigningKey struct {
+	ID          uint   `gorm:"primary_key"`
+	KID         string `gorm:"column:kid;size:64;unique_index"`
+	Algorithm   string `gorm:"column:algorithm;size:16;not null"`
+	Secret      string `gorm:"column:secret;size:255;not null"`
+	PrivateKey  string `gorm:"column:private_key;type:text"`
+	CreatedAt   time.Time
+	ActivatedAt *time.Time
+	RetiredAt   *time.Time
+}
+
+func (SigningKey) TableName() string {
+	return "signing_keys"
+}
+
+// One of KeyNew, KeyActive, KeyRetired or KeyExpired at the time now.
+func (key SigningKey) Status(now time.Time, lifetime time.Duration) string {
+	switch {
+	case key.RetiredAt != nil && !now.Before(key.RetiredAt.Add(lifetime)):
+		return KeyExpired
+	case key.RetiredAt != nil:
+		return KeyRetired
+	case key.ActivatedAt != nil:
+		return KeyActive
+	}
+	return KeyNew
+}
+
+// The keys given to jwt: the secret twice for HS256, else the private key and its public key.
+func (key SigningKey) material() (sign interface{}, verify interface{}, err error) {
+	if key.Algorithm == AlgorithmHS256 {
+		secret, err := base64.StdEncoding.DecodeString(key.Secret)
+		if err != nil {
+			return nil, nil, fmt.Errorf("signing key %s: %w", key.KID, err)
+		}
+		return secret, secret, nil
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, nil, fmt.Errorf("signing key %s: no PEM private key", key.KID)
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signing key %s: %w", key.KID, err)
+	}
+	var public crypto.PublicKey
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		if key.Algorithm == AlgorithmRS256 {
+			public = &private.PublicKey
+		}
+	case *ecdsa.PrivateKey:
+		if key.Algorithm == AlgorithmES256 && private.Curve == elliptic.P256() {
+			public = &private.PublicKey
+		}
+	case ed25519.PrivateKey:
+		if key.Algorithm == AlgorithmEdDSA {
+			public = private.Public()
+		}
+	}
+	if public == nil {
+		return nil, nil, fmt.Errorf("signing key %s: a %T is not a %s key", key.KID, private, key.Algorithm)
+	}
+	return private, public, nil
+}
+
+// A random key of the algorithm, not saved yet.
+func newSigningKey(algorithm string) (SigningKey, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return SigningKey{}, err
+	}
+	key := SigningKey{KID: hex.EncodeToString(id), Algorithm: algorithm}
+	var private interface{}
+	var err error
+	switch algorithm {
+	case AlgorithmHS256:
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return key, err
+		}
+		key.Secret = base64.StdEncoding.EncodeToString(secret)
+		return key, nil
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgorithmES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return key, fmt.Errorf("unknown signing algorithm %q, use HS256, RS256, ES256 or EdDSA", algorithm)
+	}
+	if err != nil {
+		return key, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return key, err
+	}
+	key.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	return key, nil
+}
+
+// A key of the keyring with its parsed material.
+type loadedKey struct {
+	SigningKey
+	sign   interface{}
+	verify interface{}
+}
+
+// An unknown kid reloads the keys at once, e.g. a token signed by a server which saw a new key
+// first, but not more often than this so random kids can't hammer the database.
+const unknownKeyReload = time.Second
+
+// The keys of the signing_keys table with the config secret, cached for jwt.keyring_refresh.
+// The token checks read a snapshot of the keys without a lock, a reload swaps in a new one.
+type Keyring struct {
+	getDB func() *gorm.DB
+	now   func() time.Time
+
+	state atomic.Pointer[keyringState]
+	// One reload at a time, the query runs without blocking the token checks.
+	reloadMu sync.Mutex
+}
+
+// The keys loaded at loadedAt, never changed once stored.
+type keyringState struct {
+	loadedAt time.Time
+	keys     map[string]*loadedKey
+	active   *loadedKey
+	// When the asymmetric keys started signing, nil while the active key (if any) is HS256.
+	asymmetricSince *time.Time
+}
+
+// A keyring reading the table of getDB, it only has the config secret while the table doesn't exist.
+func NewKeyring(getDB func() *gorm.DB) *Keyring {
+	return &Keyring{getDB: getDB, now: time.Now}
+}
+
+var keyring = NewKeyring(GetDB)
+
+// The keyring of GenToken and of the AuthMiddleware.
+func GetKeyring() *Keyring {
+	return keyring
+}
+
+// Read the keys again, the ones expired are left out. The keys are kept when the query fails.
+func (k *Keyring) Reload() error {
+	k.reloadMu.Lock()
+	defer k.reloadMu.Unlock()
+	return k.reload()
+}
+
+func (k *Keyring) reload() error {
+	now := k.now()
+	state := &keyringState{loadedAt: now}
+	defer func() { k.state.Store(state) }()
+	db := k.getDB()
+	if db == nil || !db.HasTable(&SigningKey{}) {
+		return nil
+	}
+	var records []SigningKey
+	if err := db.Find(&records).Error; err != nil {
+		if previous := k.state.Load(); previous != nil {
+			kept := *previous
+			kept.loadedAt = now
+			state = &kept
+		}
+		return err
+	}
+	lifetime := config.Get().JWT.TokenLifetime
+	state.keys = make(map[string]*loadedKey, len(records))
+	for _, record := range records {
+		status := record.Status(now, lifetime)
+		if status == KeyExpired {
+			continue
+		}
+		sign, verify, err := record.material()
+		if err != nil {
+			// One broken key should not take the others down with it.
+			slog.Error("jwt keyring: key skipped", "kid", record.KID, "error", err)
+			continue
+		}
+		key := &loadedKey{record, sign, verify}
+		if status == KeyActive && (state.active == nil || key.ActivatedAt.After(*state.active.ActivatedAt)) {
+			state.active = key
+		}
+		state.keys[key.KID] = key
+	}
+	// The retired keys stay loaded for a lifetime, so a rotation keeps the time of the first one.
+	if state.active != nil && state.active.Algorithm != AlgorithmHS256 {
+		for _, key := range state.keys {
+			if key.Algorithm != AlgorithmHS256 && key.ActivatedAt != nil &&
+				(state.asymmetricSince == nil || key.ActivatedAt.Before(*state.asymmetricSince)) {
+				state.asymmetricSince = key.ActivatedAt
+			}
+		}
+	}
+	return nil
+}
+
+// The keys, reloaded when they are older than maxAge. A single caller reloads, the other ones
+// go on with the keys they have meanwhile. Only the first load is waited for, or every load
+// when wait is set, e.g. for a kid the keys don't know yet.
+func (k *Keyring) snapshot(maxAge time.Duration, wait bool) *keyringState {
+	state := k.state.Load()
+	if state != nil && k.now().Sub(state.loadedAt) < maxAge {
+		return state
+	}
+	if state == nil || wait {
+		k.reloadMu.Lock()
+	} else if !k.reloadMu.TryLock() {
+		return state
+	}
+	defer k.reloadMu.Unlock()
+	// Another caller may have reloaded while this one waited.
+	if state = k.state.Load(); state == nil || k.now().Sub(state.loadedAt) >= maxAge {
+		if err := k.reload(); err != nil {
+			slog.Error("jwt keyring: reload failed", "error", err)
+		}
+		state = k.state.Load()
+	}
+	return state
+}
+
+func (k *Keyring) refresh() *keyringState {
+	return k.snapshot(config.Get().JWT.KeyringRefresh, false)
+}
+
+// The kid of the key signing the new tokens, ConfigKeyID when no key is active.
+func (k *Keyring) ActiveKeyID() string {
+	state := k.refresh()
+	if state.active == nil {
+		return ConfigKeyID
+	}
+	return state.active.KID
+}
+
+// Sign the claims with the active key, its kid goes in the header of the token.
+//
+//	token, err := common.GetKeyring().Sign(jwt.MapClaims{"id": id})
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	kid, algorithm, secret := ConfigKeyID, AlgorithmHS256, interface{}([]byte(config.Get().JWT.Secret))
+	if active := k.refresh().active; active != nil {
+		kid, algorithm, secret = active.KID, active.Algorithm, active.sign
+	}
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(algorithm), claims)
+	token.Header["kid"] = kid
+	return token.SignedString(secret)
+}
+
+// Whether the config secret verifies tokens: always while it signs them, then while
+// jwt.accept_config_secret, until the asymmetric keys have signed for a full jwt.token_lifetime.
+// Past that, whoever knows the secret can't mint tokens anymore.
+func (k *Keyring) acceptsConfigSecret(state *keyringState) bool {
+	if state.active == nil {
+		return true
+	}
+	if !config.Get().JWT.AcceptConfigSecret {
+		return false
+	}
+	return state.asymmetricSince == nil || k.now().Sub(*state.asymmetricSince) < config.Get().JWT.TokenLifetime
+}
+
+// The jwt.Keyfunc giving the key of a token by its kid, the algorithm of the token has to be
+// the one of the key. The tokens without a kid were signed before the keyring existed, they
+// are verified with the config secret, see acceptsConfigSecret.
+//
+//	token, err := jwt.Parse(tokenString, common.GetKeyring().Keyfunc)
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	state := k.refresh()
+	if kid == "" || kid == ConfigKeyID {
+		if token.Method.Alg() != AlgorithmHS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Method.Alg())
+		}
+		if !k.acceptsConfigSecret(state) {
+			return nil, ErrConfigSecretRefused
+		}
+		return []byte(config.Get().JWT.Secret), nil
+	}
+
+	key, ok := state.keys[kid]
+	if !ok {
+		state = k.snapshot(unknownKeyReload, true)
+		key, ok = state.keys[kid]
+	}
+	if !ok || key.Status(k.now(), config.Get().JWT.TokenLifetime) == KeyExpired {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Method.Alg())
+	}
+	return key.verify, nil
+}
+
+// The public keys of the keyring, the HS256 keys are secret and left out.
+func (k *Keyring) JWKS() JWKSet {
+	state := k.refresh()
+	set := JWKSet{Keys: []JWK{}}
+	now, lifetime := k.now(), config.Get().JWT.TokenLifetime
+	for _, key := range state.keys {
+		if key.Algorithm == AlgorithmHS256 || key.Status(now, lifetime) == KeyExpired {
+			continue
+		}
+		jwk, err := NewJWK(key.KID, key.Algorithm, key.verify)
+		if err != nil {
+			slog.Error("jwt keyring: key not published", "kid", key.KID, "error", err)
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sortJWKs(set.Keys)
+	return set
+}
+
+// All the keys of the table, the newest first.
+func ListSigningKeys() ([]SigningKey, error) {
+	var keys []SigningKey
+	err := GetDB().Order("created_at desc, id desc").Find(&keys).Error
+	return keys, err
+}
+
+// Create a random key of the algorithm, config.JWTConfig.Algorithm when it is empty.
+// It verifies tokens as soon as the servers reload the keys, and it signs them once activated:
+// adding it a keyring_refresh before activating it lets every server (and the JWKS clients) know it
+// before the first token it signed shows up.
+//
+//	key, err := common.AddSigningKey("EdDSA", false)
+func AddSigningKey(algorithm string, activate bool) (SigningKey, error) {
+	if algorithm == "" {
+		algorithm = config.Get().JWT.Algorithm
+	}
+	key, err := newSigningKey(algorithm)
+	if err != nil {
+		return key, err
+	}
+	if err := GetDB().Create(&key).Error; err != nil {
+		return key, err
+	}
+	if activate {
+		return ActivateSigningKey(key.KID)
+	}
+	return key, nil
+}
+
+// Make a key sign, for `serve`: while no key is active, a key of jwt.algorithm is created and
+// activated. The config secret keeps signing instead when jwt.algorithm is HS256 and
+// jwt.accept_config_secret is on. The active key is returned with whether it was just created.
+//
+//	key, created, err := common.EnsureSigningKey()
+func EnsureSigningKey() (SigningKey, bool, error) {
+	cfg := config.Get().JWT
+	var active SigningKey
+	err := GetDB().Where("activated_at IS NOT NULL AND retired_at IS NULL").Order("activated_at desc").First(&active).Error
+	if !gorm.IsRecordNotFoundError(err) {
+		return active, false, err
+	}
+	if cfg.Algorithm == AlgorithmHS256 && cfg.AcceptConfigSecret {
+		return SigningKey{}, false, nil
+	}
+	key, err := AddSigningKey(cfg.Algorithm, true)
+	return key, err == nil, err
+}
+
+func findSigningKey(db *gorm.DB, kid string) (SigningKey, error) {
+	var key SigningKey
+	err := db.Where(&SigningKey{KID: kid}).First(&key).Error
+	if gorm.IsRecordNotFoundError(err) {
+		err = fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	return key, err
+}
+
+// Make the key sign the new tokens, the key active until now is retired.
+func ActivateSigningKey(kid string) (SigningKey, error) {
+	tx := GetDB().Begin()
+	key, err := findSigningKey(tx, kid)
+	if err == nil && key.RetiredAt != nil {
+		err = fmt.Errorf("signing key %q is retired", kid)
+	}
+	now := time.Now()
+	if err == nil {
+		err = tx.Model(&SigningKey{}).Where("activated_at IS NOT NULL AND retired_at IS NULL AND id <> ?", key.ID).
+			Update("retired_at", now).Error
+	}
+	if err == nil {
+		key.ActivatedAt = &now
+		err = tx.Model(&key).Update("activated_at", now).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return key, err
+	}
+	return key, tx.Commit().Error
+}
+
+// Stop signing with the key. The tokens it signed keep working until they expire.
+func RetireSigningKey(kid string) (SigningKey, error) {
+	db := GetDB()
+	key, err := findSigningKey(db, kid)
+	if err != nil {
+		return key, err
+	}
+	if key.RetiredAt != nil {
+		return key, nil
+	}
+	now := time.Now()
+	key.RetiredAt = &now
+	return key, db.Model(&key).Update("retired_at", now).Error
+}
+
+// Delete the expired keys, they can't verify anything anymore.
+func PruneSigningKeys() (int64, error) {
+	before := time.Now().Add(-config.Get().JWT.TokenLifetime)
+	db := GetDB().Where("retired_at IS NOT NULL AND retired_at <= ?", before).Delete(&SigningKey{})
+	return db.RowsAffected, db.Error
+}
@@ -3,6 +3,7 @@ package common
 
 import (
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"time"
 
@@ -11,6 +12,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
+
+	"realworld-backend/config"
 )
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
@@ -24,20 +27,46 @@ func RandString(n int) string {
 	return string(b)
 }
 
-// Keep this two config private, it should not expose to open source
-const NBSecretPassword = "A String Very Very Very Strong!!@##$!@#$"
-const NBRandomPassword = "A String Very Very Very Niubilty!!@##$!@#4"
+// Keep this config private, it should not expose to open source
+// NBSecretPassword is only the default of config.JWTConfig.Secret, set REALWORLD_JWT_SECRET to change it.
+const NBSecretPassword = config.DefaultJWTSecret
+
+// The claims of the access tokens: the user ID, the session ID (the family of refresh tokens
+// of the login, empty for a token made by GenToken), the roles of the user, and the jti, iat and exp.
+//
+// The roles are for the frontend and the other services: the server reads the permissions from
+// the DB, so a revoked role takes effect before the token expires.
+type TokenClaims struct {
+	UserID    uint     `json:"id"`
+	SessionID string   `json:"sid,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	jwt.RegisteredClaims
+}
 
 // A Util function to generate jwt_token which can be used in the request header
+// It is signed by the active key of the keyring, see GetKeyring.
 func GenToken(id uint) string {
-	jwt_token := jwt.New(jwt.GetSigningMethod("HS256"))
-	// Set some claims
-	jwt_token.Claims = jwt.MapClaims{
-		"id":  id,
-		"exp": time.Now().Add(time.Hour * 24).Unix(),
+	return GenSessionToken(id, "", nil)
+}
+
+// A token of the session sid, the logout of the session revokes it.
+func GenSessionToken(id uint, sid string, roles []string) string {
+	cfg := config.Get().JWT
+	now := time.Now()
+	// Set some claims, then sign and get the complete encoded token as a string
+	token, err := GetKeyring().Sign(TokenClaims{
+		UserID:    id,
+		SessionID: sid,
+		Roles:     roles,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        RandString(22),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(cfg.TokenLifetime)),
+		},
+	})
+	if err != nil {
+		slog.Error("jwt: signing failed", "error", err)
 	}
-	// Sign and get the complete encoded token as a string
-	token, _ := jwt_token.SignedString([]byte(NBSecretPassword))
 	return token
 }
 
@@ -0,0 +1,8 @@
+/*
+The config module containing the typed settings of the server.
+
+config.go: definition of the settings, their default value and validation
+
+loader.go: reading the settings from a YAML/TOML file and the REALWORLD_* environment variables
+*/
+package config
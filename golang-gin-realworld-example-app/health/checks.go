@@ -0,0 +1,153 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+	"realworld-backend/migrations"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// A readiness check, it returns nil when the dependency could serve requests.
+type Check func(ctx context.Context) error
+
+// The result of one check, as reported by /readyz.
+type ComponentStatus struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency"`
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker holds the checks of the readiness probe, every check gets Timeout to answer.
+type Checker struct {
+	Timeout time.Duration
+
+	mu     sync.RWMutex
+	checks []namedCheck
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{Timeout: timeout}
+}
+
+// The checks of the server itself: the database answers and its schema is current.
+//
+//	checker := health.NewDefaultChecker(cfg.Server.ReadinessTimeout)
+//	checker.Add("cache", func(ctx context.Context) error { return cache.Ping(ctx) })
+func NewDefaultChecker(timeout time.Duration) *Checker {
+	checker := NewChecker(timeout)
+	checker.Add("database", DatabaseCheck(common.GetDB))
+	checker.Add("migrations", MigrationsCheck(common.GetDB))
+	return checker
+}
+
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name, check})
+}
+
+// Run all the checks concurrently, ready is true only when all of them pass.
+func (c *Checker) Run(ctx context.Context) (ready bool, components map[string]ComponentStatus) {
+	c.mu.RLock()
+	checks := append([]namedCheck(nil), c.checks...)
+	c.mu.RUnlock()
+
+	components = make(map[string]ComponentStatus, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, nc := range checks {
+		wg.Add(1)
+		go func(nc namedCheck) {
+			defer wg.Done()
+			status := c.runOne(ctx, nc.check)
+			mu.Lock()
+			components[nc.name] = status
+			mu.Unlock()
+		}(nc)
+	}
+	wg.Wait()
+
+	ready = true
+	for _, status := range components {
+		if status.Status != StatusOK {
+			ready = false
+		}
+	}
+	return ready, components
+}
+
+// A check which doesn't return within the timeout is reported as failed, its goroutine is left to finish.
+func (c *Checker) runOne(ctx context.Context, check Check) ComponentStatus {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("no answer within %v", c.Timeout)
+	}
+	status := ComponentStatus{Status: StatusOK, Latency: time.Since(start).Round(time.Microsecond).String()}
+	if err != nil {
+		status.Status = StatusUnavailable
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// Ping the database, getDB is called on every check so it follows common.Init.
+func DatabaseCheck(getDB func() *gorm.DB) Check {
+	return func(ctx context.Context) error {
+		db := getDB()
+		if db == nil {
+			return errors.New("not connected")
+		}
+		if err := db.DB().PingContext(ctx); err != nil {
+			return err
+		}
+		// The sqlite driver answers a ping without touching the file, a query finds a locked one.
+		return db.DB().QueryRowContext(ctx, "SELECT 1").Scan(new(int))
+	}
+}
+
+// Fails while a migration is pending, e.g. when the instance runs with auto_migrate off
+// and `migrate up` wasn't run yet. The probe doesn't create the schema_migrations table.
+func MigrationsCheck(getDB func() *gorm.DB) Check {
+	return func(ctx context.Context) error {
+		db := getDB()
+		if db == nil {
+			return errors.New("not connected")
+		}
+		if !db.HasTable(&migrations.SchemaMigration{}) {
+			return errors.New("the schema_migrations table is missing")
+		}
+		pending, err := migrations.Pending(db)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%d pending migrations, the first one is %d_%s", len(pending), pending[0].Version, pending[0].Name)
+		}
+		return nil
+	}
+}
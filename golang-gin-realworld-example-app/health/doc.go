@@ -0,0 +1,8 @@
+/*
+The health module containing the probes of the orchestrator.
+
+checks.go: the readiness checks of the dependencies, run concurrently with a timeout
+
+routers.go: the /healthz (liveness) and /readyz (readiness) endpoints
+*/
+package health
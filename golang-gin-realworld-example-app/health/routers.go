@@ -0,0 +1,36 @@
+package health
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The probes are outside of /api, they are for the orchestrator and not for the clients.
+//
+//	health.HealthRegister(r.Group("/"), health.NewDefaultChecker(cfg.Server.ReadinessTimeout))
+func HealthRegister(router *gin.RouterGroup, checker *Checker) {
+	router.GET("/healthz", Liveness)
+	router.GET("/readyz", Readiness(checker))
+}
+
+// The process is alive as long as it answers, the dependencies are not checked here
+// so a database outage doesn't get the instance restarted.
+func Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": StatusOK})
+}
+
+// 200 when every check passes, 503 otherwise so the instance gets no traffic:
+//
+//	{"status": "unavailable", "components": {"database": {"status": "ok", "latency": "102µs"},
+//	  "migrations": {"status": "unavailable", "error": "1 pending migrations, ...", "latency": "1.2ms"}}}
+func Readiness(checker *Checker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ready, components := checker.Run(c.Request.Context())
+		code, status := http.StatusOK, StatusOK
+		if !ready {
+			code, status = http.StatusServiceUnavailable, StatusUnavailable
+		}
+		c.JSON(code, gin.H{"status": status, "components": components})
+	}
+}
@@ -0,0 +1,106 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"realworld-backend/common"
+	"realworld-backend/migrations"
+)
+
+var test_db *gorm.DB
+
+type probeResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+func probe(t *testing.T, checker *Checker, path string) (int, probeResponse) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	HealthRegister(r.Group("/"), checker)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	r.ServeHTTP(w, req)
+	var body probeResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, body
+}
+
+func TestLiveness(t *testing.T) {
+	asserts := assert.New(t)
+
+	checker := NewChecker(time.Second)
+	checker.Add("database", func(ctx context.Context) error { return errors.New("down") })
+	code, body := probe(t, checker, "/healthz")
+	asserts.Equal(http.StatusOK, code, "liveness should not depend on the checks")
+	asserts.Equal(StatusOK, body.Status)
+}
+
+func TestReadinessChecks(t *testing.T) {
+	asserts := assert.New(t)
+
+	checker := NewChecker(time.Millisecond * 50)
+	checker.Add("ok", func(ctx context.Context) error { return nil })
+	code, body := probe(t, checker, "/readyz")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(StatusOK, body.Status)
+	asserts.Equal(StatusOK, body.Components["ok"].Status)
+
+	checker.Add("broken", func(ctx context.Context) error { return errors.New("connection refused") })
+	checker.Add("slow", func(ctx context.Context) error { time.Sleep(time.Second); return nil })
+	code, body = probe(t, checker, "/readyz")
+	asserts.Equal(http.StatusServiceUnavailable, code)
+	asserts.Equal(StatusUnavailable, body.Status)
+	asserts.Len(body.Components, 3, "every component should be reported")
+	asserts.Equal(StatusOK, body.Components["ok"].Status)
+	asserts.Equal("connection refused", body.Components["broken"].Error)
+	asserts.Equal(StatusUnavailable, body.Components["slow"].Status, "a check past the timeout should fail")
+	asserts.Contains(body.Components["slow"].Error, "no answer within")
+}
+
+func TestDefaultChecks(t *testing.T) {
+	asserts := assert.New(t)
+	common.TestDBFree(test_db)
+	test_db = common.TestDBInit()
+
+	checker := NewDefaultChecker(time.Second)
+	code, body := probe(t, checker, "/readyz")
+	asserts.Equal(http.StatusServiceUnavailable, code, "an empty database should not be ready")
+	asserts.Equal(StatusOK, body.Components["database"].Status)
+	asserts.Contains(body.Components["migrations"].Error, "schema_migrations")
+	asserts.False(test_db.HasTable(&migrations.SchemaMigration{}), "the probe should not write to the database")
+
+	_, err := migrations.Up(test_db)
+	asserts.NoError(err)
+	code, body = probe(t, checker, "/readyz")
+	asserts.Equal(http.StatusOK, code, "a migrated database should be ready")
+	asserts.Equal(StatusOK, body.Components["migrations"].Status)
+
+	_, err = migrations.Down(test_db, 1)
+	asserts.NoError(err)
+	code, body = probe(t, checker, "/readyz")
+	asserts.Equal(http.StatusServiceUnavailable, code)
+	asserts.Contains(body.Components["migrations"].Error, "1 pending migrations")
+
+	asserts.Error(DatabaseCheck(func() *gorm.DB { return nil })(context.Background()))
+}
+
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
@@ -1,45 +1,151 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
 
-	"github.com/jinzhu/gorm"
 	"realworld-backend/articles"
 	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/health"
+	"realworld-backend/lifecycle"
+	"realworld-backend/logging"
+	"realworld-backend/mail"
+	"realworld-backend/metrics"
+	"realworld-backend/oidc"
+	"realworld-backend/ratelimit"
+	"realworld-backend/tracing"
 	"realworld-backend/users"
 )
 
-func Migrate(db *gorm.DB) {
-	users.AutoMigrate()
-	db.AutoMigrate(&articles.ArticleModel{})
-	db.AutoMigrate(&articles.TagModel{})
-	db.AutoMigrate(&articles.FavoriteModel{})
-	db.AutoMigrate(&articles.ArticleUserModel{})
-	db.AutoMigrate(&articles.CommentModel{})
-}
-
 func main() {
+	configPath := flag.String("config", os.Getenv("REALWORLD_CONFIG"), "path of a YAML or TOML config file")
+	flag.Usage = usage
+	flag.Parse()
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Set(cfg)
+	slog.SetDefault(logging.New(cfg.Log, os.Stderr))
+
+	name, args := "serve", []string{}
+	if flag.NArg() > 0 {
+		name, args = flag.Arg(0), flag.Args()[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(cfg, args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		log.Fatalf("%s: %v", cmd.name, err)
+	}
+}
 
-	db := common.Init()
-	Migrate(db)
-	defer db.Close()
+func serveCommand(cfg *config.Config, args []string) error {
+	if err := newFlagSet("serve").Parse(args); err != nil {
+		return err
+	}
+	if cfg.IsProduction() {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	shutdownTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		return err
+	}
+	m := lifecycle.New(cfg.Server.ShutdownTimeout)
+	// The first hook runs last, the spans of the whole shutdown get flushed.
+	m.OnShutdown("tracing", shutdownTracing)
+	db, err := openDB(cfg)
+	if err != nil {
+		m.Shutdown(context.Background())
+		return err
+	}
+	m.OnShutdown("database", func(ctx context.Context) error { return db.Close() })
+	// jwt.algorithm signs from the first token on, the other servers learn the key at their next reload.
+	key, created, err := common.EnsureSigningKey()
+	if err != nil {
+		m.Shutdown(context.Background())
+		return fmt.Errorf("jwt signing key: %w", err)
+	}
+	if created {
+		slog.Info("jwt signing key created", "kid", key.KID, "algorithm", key.Algorithm)
+	} else if key.KID != "" && key.Algorithm != cfg.JWT.Algorithm {
+		slog.Warn("the active jwt signing key is not of jwt.algorithm, rotate it with `jwt-keys`", "kid", key.KID, "algorithm", key.Algorithm)
+	}
+	if err := common.GetKeyring().Reload(); err != nil {
+		m.Shutdown(context.Background())
+		return err
+	}
+	if cfg.Tracing.Enabled {
+		tracing.InstrumentDB(db)
+	}
+	if cfg.Metrics.Enabled {
+		if err := metrics.RegisterDB(db.DB()); err != nil {
+			m.Shutdown(context.Background())
+			return err
+		}
+	}
+	mailer, err := mail.New(cfg.Mail)
+	if err != nil {
+		m.Shutdown(context.Background())
+		return err
+	}
+	mail.Set(mailer)
+	m.Go("mail sender", mail.GetQueue().Run)
+	if cfg.OIDC.Enabled {
+		oidc.Set(oidc.New(cfg.OIDC))
+	}
 
-	r := gin.Default()
+	r := gin.New()
+	if err := r.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		m.Shutdown(context.Background())
+		return err
+	}
+	r.Use(logging.RequestLogger(slog.Default(), cfg.Log), tracing.Middleware(), metrics.Middleware(), logging.Recovery())
 
 	// Configure CORS
 	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:4100"},
+		AllowOrigins:     cfg.Server.CORSOrigins,
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", logging.RequestIDHeader, "traceparent", "tracestate"},
+		ExposeHeaders:    []string{logging.RequestIDHeader, "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
 		AllowCredentials: true,
 	}))
 
+	health.HealthRegister(r.Group("/"), health.NewDefaultChecker(cfg.Server.ReadinessTimeout))
+	users.JWKSRegister(r.Group("/.well-known"))
+	if cfg.Metrics.Enabled && cfg.Metrics.Addr == "" {
+		metrics.MetricsRegister(r.Group("/"), cfg.Metrics)
+	}
+
 	v1 := r.Group("/api")
-	users.UsersRegister(v1.Group("/users"))
+	m.Go("expired rows pruner", func(ctx context.Context) { users.RunPruner(ctx, time.Hour) })
 	v1.Use(users.AuthMiddleware(false))
+	if cfg.RateLimit.Enabled {
+		store := ratelimit.NewMemoryStore()
+		m.Go("ratelimit sweeper", func(ctx context.Context) { store.Run(ctx, time.Minute) })
+		v1.Use(ratelimit.NewLimiter(cfg.RateLimit, store).Middleware())
+	}
+	users.UsersRegister(v1.Group("/users"))
 	articles.ArticlesAnonymousRegister(v1.Group("/articles"))
 	articles.TagsAnonymousRegister(v1.Group("/tags"))
 
@@ -49,6 +155,10 @@ func main() {
 
 	articles.ArticlesRegister(v1.Group("/articles"))
 
+	admin := v1.Group("/admin")
+	admin.Use(users.RequirePermission(users.PermissionRolesManage))
+	users.AdminRegister(admin)
+
 	testAuth := r.Group("/api/ping")
 
 	testAuth.GET("/", func(c *gin.Context) {
@@ -57,26 +167,34 @@ func main() {
 		})
 	})
 
-	// test 1 to 1
-	tx1 := db.Begin()
-	userA := users.UserModel{
-		Username: "AAAAAAAAAAAAAAAA",
-		Email:    "aaaa@g.cn",
-		Bio:      "hehddeda",
-		Image:    nil,
-	}
-	tx1.Save(&userA)
-	tx1.Commit()
-	fmt.Println(userA)
-
-	//db.Save(&ArticleUserModel{
-	//    UserModelID:userA.ID,
-	//})
-	//var userAA ArticleUserModel
-	//db.Where(&ArticleUserModel{
-	//    UserModelID:userA.ID,
-	//}).First(&userAA)
-	//fmt.Println(userAA)
-
-	r.Run() // listen and serve on 0.0.0.0:8080
+	srv := &http.Server{
+		Handler:           r,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+	// The metrics on their own internal listener, see config.MetricsConfig.
+	if cfg.Metrics.Enabled && cfg.Metrics.Addr != "" {
+		mr := gin.New()
+		mr.Use(logging.Recovery())
+		metrics.MetricsRegister(mr.Group("/"), cfg.Metrics)
+		mln, err := net.Listen("tcp", cfg.Metrics.Addr)
+		if err != nil {
+			m.Shutdown(context.Background())
+			return err
+		}
+		slog.Info("serving the metrics", "addr", mln.Addr().String(), "path", cfg.Metrics.Path)
+		m.GoServe("metrics", &http.Server{Handler: mr, ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout}, mln)
+	}
+
+	ln, err := net.Listen("tcp", cfg.Server.Addr) // listen and serve on 0.0.0.0:8080 by default
+	if err != nil {
+		m.Shutdown(context.Background())
+		return err
+	}
+	slog.Info("listening", "addr", ln.Addr().String())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return m.Serve(ctx, srv, ln)
 }
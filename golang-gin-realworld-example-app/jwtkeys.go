@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"realworld-backend/common"
+	"realworld-backend/config"
+)
+
+const jwtKeysUsage = "usage: jwt-keys list | add [-algorithm ALG] [-activate] | activate KID | retire KID | prune"
+
+// The `jwt-keys` command, the servers see its changes within jwt.keyring_refresh:
+//
+//	jwt-keys list            list the signing keys and their status
+//	jwt-keys add [-algorithm ALG] [-activate]
+//	                         create a key of ALG (jwt.algorithm by default: HS256, RS256, ES256
+//	                         or EdDSA), it verifies tokens and signs them once activated
+//	jwt-keys activate KID    sign the new tokens with KID, the key active until now is retired
+//	jwt-keys retire KID      stop signing with KID, its tokens work until they expire
+//	jwt-keys prune           delete the retired keys whose tokens have all expired
+//
+// A rotation is `add`, then `activate` a keyring_refresh later.
+func runJWTKeys(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(jwtKeysUsage)
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		keys, err := common.ListSigningKeys()
+		if err != nil {
+			return err
+		}
+		now, lifetime := time.Now(), config.Get().JWT.TokenLifetime
+		signing := common.ConfigKeyID
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KID\tALGORITHM\tSTATUS\tCREATED AT\tACTIVATED AT\tRETIRED AT")
+		for _, key := range keys {
+			status := key.Status(now, lifetime)
+			if status == common.KeyActive && signing == common.ConfigKeyID {
+				signing = key.KID
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", key.KID, key.Algorithm, status,
+				formatTime(&key.CreatedAt), formatTime(key.ActivatedAt), formatTime(key.RetiredAt))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if signing == common.ConfigKeyID {
+			fmt.Fprintln(out, "no active key, the new tokens are signed with jwt.secret")
+		}
+		return nil
+	case args[0] == "add":
+		fs := flag.NewFlagSet("jwt-keys add", flag.ContinueOnError)
+		algorithm := fs.String("algorithm", config.Get().JWT.Algorithm, "HS256, RS256, ES256 or EdDSA")
+		activate := fs.Bool("activate", false, "sign the new tokens with the key at once")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() > 0 {
+			break
+		}
+		key, err := common.AddSigningKey(*algorithm, *activate)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "added %s\t%s\t%s\n", key.KID, key.Algorithm, key.Status(time.Now(), config.Get().JWT.TokenLifetime))
+		return nil
+	case args[0] == "activate" && len(args) == 2:
+		key, err := common.ActivateSigningKey(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "activated %s, the new tokens are signed with it\n", key.KID)
+		return nil
+	case args[0] == "retire" && len(args) == 2:
+		key, err := common.RetireSigningKey(args[1])
+		if err != nil {
+			return err
+		}
+		expires := key.RetiredAt.Add(config.Get().JWT.TokenLifetime)
+		fmt.Fprintf(out, "retired %s, its tokens are valid until %s\n", key.KID, formatTime(&expires))
+		return nil
+	case args[0] == "prune" && len(args) == 1:
+		deleted, err := common.PruneSigningKeys()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d expired keys deleted\n", deleted)
+		return nil
+	}
+	return errors.New(jwtKeysUsage)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
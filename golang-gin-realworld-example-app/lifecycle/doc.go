@@ -0,0 +1,6 @@
+/*
+The lifecycle module containing the graceful start and stop of the server process.
+
+lifecycle.go: the background workers, the ordered shutdown hooks and the HTTP server draining on SIGINT/SIGTERM
+*/
+package lifecycle
@@ -0,0 +1,150 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Manager owns everything that has to stop cleanly with the process.
+//
+// The shutdown runs in this order, all of it under one ShutdownTimeout deadline:
+//  1. the HTTP server stops accepting connections and drains the in-flight requests
+//  2. the context of the background workers is cancelled and they are waited for
+//  3. the shutdown hooks run in the reverse order of their registration, like defer
+//
+// So a hook registered early (e.g. closing the database) runs after everything that still uses it.
+type Manager struct {
+	ShutdownTimeout time.Duration
+
+	mu      sync.Mutex
+	hooks   []hook
+	workers sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+	once    sync.Once
+	err     error
+}
+
+func New(shutdownTimeout time.Duration) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{ShutdownTimeout: shutdownTimeout, ctx: ctx, cancel: cancel}
+}
+
+// Register fn to run at shutdown, it should give up when ctx is done.
+//
+//	m.OnShutdown("database", func(ctx context.Context) error { return db.Close() })
+func (m *Manager) OnShutdown(name string, fn func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = append(m.hooks, hook{name, fn})
+}
+
+// Start a background worker, it should return soon after ctx is done.
+//
+//	m.Go("cleanup", func(ctx context.Context) { for { select { case <-ctx.Done(): return ... } } })
+func (m *Manager) Go(name string, fn func(ctx context.Context)) {
+	m.workers.Add(1)
+	go func() {
+		defer m.workers.Done()
+		fn(m.ctx)
+	}()
+}
+
+// Stop the workers and run the hooks, see Manager for the order. It only runs once,
+// the later calls return the result of the first one.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.once.Do(func() {
+		m.err = m.shutdown(ctx)
+	})
+	return m.err
+}
+
+func (m *Manager) shutdown(ctx context.Context) error {
+	var errs []error
+	m.cancel()
+	done := make(chan struct{})
+	go func() {
+		m.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("background workers: %w", ctx.Err()))
+	}
+
+	m.mu.Lock()
+	hooks := append([]hook(nil), m.hooks...)
+	m.mu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].fn(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", hooks[i].name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Serve srv on ln until ctx is done (e.g. by signal.NotifyContext on SIGTERM) or the server fails,
+// then shut everything down within ShutdownTimeout.
+//
+//	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+//	defer stop()
+//	err := m.Serve(ctx, srv, ln)
+func (m *Manager) Serve(ctx context.Context, srv *http.Server, ln net.Listener) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	var errs []error
+	select {
+	case err := <-serveErr:
+		errs = append(errs, fmt.Errorf("http server: %w", err))
+	case <-ctx.Done():
+		slog.Info("shutting down, draining the in-flight requests", "timeout", m.ShutdownTimeout.String())
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), m.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("http server: %w", err))
+		srv.Close()
+	}
+	if err := m.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Serve a secondary server, e.g. the internal one of the metrics, as a background worker:
+// it is shut down with the other workers, after the main server drained.
+func (m *Manager) GoServe(name string, srv *http.Server, ln net.Listener) {
+	m.Go(name, func(ctx context.Context) {
+		serveErr := make(chan error, 1)
+		go func() {
+			serveErr <- srv.Serve(ln)
+		}()
+		select {
+		case err := <-serveErr:
+			slog.Error("server stopped", "server", name, "error", err)
+			return
+		case <-ctx.Done():
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), m.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			srv.Close()
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownHooksOrder(t *testing.T) {
+	asserts := assert.New(t)
+
+	m := New(time.Second)
+	var order []string
+	for _, name := range []string{"database", "cache", "mailer"} {
+		name := name
+		m.OnShutdown(name, func(ctx context.Context) error {
+			order = append(order, name)
+			if name == "cache" {
+				return errors.New("flush failed")
+			}
+			return nil
+		})
+	}
+	err := m.Shutdown(context.Background())
+	asserts.Equal([]string{"mailer", "cache", "database"}, order, "hooks should run in the reverse order")
+	asserts.EqualError(err, "cache: flush failed", "a failing hook should not stop the others")
+
+	asserts.Equal(err, m.Shutdown(context.Background()), "Shutdown should only run once")
+	asserts.Len(order, 3)
+}
+
+func TestShutdownWorkers(t *testing.T) {
+	asserts := assert.New(t)
+
+	m := New(time.Second)
+	stopped := make(chan struct{})
+	m.Go("ticker", func(ctx context.Context) {
+		<-ctx.Done()
+		close(stopped)
+	})
+	workerDone := false
+	m.OnShutdown("database", func(ctx context.Context) error {
+		select {
+		case <-stopped:
+			workerDone = true
+		default:
+		}
+		return nil
+	})
+	asserts.NoError(m.Shutdown(context.Background()))
+	asserts.True(workerDone, "the workers should be stopped before the hooks run")
+
+	m = New(time.Second)
+	hookRan := false
+	m.Go("stuck", func(ctx context.Context) { select {} })
+	m.OnShutdown("database", func(ctx context.Context) error { hookRan = true; return nil })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err := m.Shutdown(ctx)
+	asserts.ErrorIs(err, context.DeadlineExceeded, "a stuck worker should not block past the deadline")
+	asserts.True(hookRan, "the hooks should still run after the deadline")
+}
+
+func TestServeDrainsRequests(t *testing.T) {
+	asserts := assert.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(time.Millisecond * 200)
+		w.Write([]byte("done"))
+	})}
+	m := New(time.Second * 5)
+	dbClosed := false
+	m.OnShutdown("database", func(ctx context.Context) error { dbClosed = true; return nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- m.Serve(ctx, srv, ln) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	response := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			response <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		response <- result{string(body), err}
+	}()
+	<-started
+	cancel()
+
+	res := <-response
+	asserts.NoError(res.err, "the in-flight request should finish")
+	asserts.Equal("done", res.body)
+	asserts.NoError(<-served)
+	asserts.True(dbClosed, "the hooks should run after the server stopped")
+
+	_, err = http.Get("http://" + ln.Addr().String())
+	asserts.Error(err, "new connections should be refused after the shutdown")
+}
+
+func TestServeListenerError(t *testing.T) {
+	asserts := assert.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	m := New(time.Second)
+	hookRan := false
+	m.OnShutdown("database", func(ctx context.Context) error { hookRan = true; return nil })
+	err = m.Serve(context.Background(), &http.Server{}, ln)
+	asserts.ErrorContains(err, "http server", "Serve should return when the server fails")
+	asserts.True(hookRan, "the hooks should run when the server fails")
+}
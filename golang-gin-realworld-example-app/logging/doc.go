@@ -0,0 +1,8 @@
+/*
+The logging module containing the structured (log/slog) logs of the server.
+
+logger.go: the slog logger built from the `log` settings
+
+middlewares.go: the request log, with the X-Request-ID correlation and the redaction of the secrets
+*/
+package logging
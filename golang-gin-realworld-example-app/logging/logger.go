@@ -0,0 +1,34 @@
+package logging
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+
+	"realworld-backend/config"
+)
+
+// A JSON (or text) slog logger at the configured level. main makes it the default one,
+// so the stdlib `log` calls are written by it too.
+//
+//	slog.SetDefault(logging.New(cfg.Log, os.Stderr))
+func New(cfg config.LogConfig, w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: ParseLevel(cfg.Level)}
+	if cfg.Format == "text" {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// debug, info, warn or error, anything else is info (config.Validate rejects it earlier).
+func ParseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,162 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+
+	"realworld-backend/config"
+)
+
+// The header of the request ID, it is read from the request when the client (or a proxy) sent one
+// and always written back on the response.
+const RequestIDHeader = "X-Request-ID"
+
+const redacted = "<redacted>"
+
+// The keys of the gin context set by RequestLogger.
+const (
+	requestIDKey = "request_id"
+	loggerKey    = "logger"
+)
+
+// A propagated ID is only kept when it is short and printable, so it is safe to log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// 16 random bytes, hex encoded.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// The ID of the current request, empty outside of RequestLogger.
+func RequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// The logger of the current request, every record has its request_id.
+//
+//	logging.FromContext(c).Warn("slug taken", "slug", slug)
+func FromContext(c *gin.Context) *slog.Logger {
+	if logger, ok := c.Get(loggerKey); ok {
+		return logger.(*slog.Logger)
+	}
+	return slog.Default()
+}
+
+// Write one record per request once it is handled. It should be the first middleware,
+// so the record has the status of the recovered panics and the my_user_id set by users.AuthMiddleware:
+//
+//	r.Use(logging.RequestLogger(slog.Default(), cfg.Log), logging.Recovery())
+//
+// The record has the route template (e.g. /api/articles/:slug) besides the path,
+// it is the one to group the requests by. 5xx are logged as errors and 4xx as warnings.
+func RequestLogger(logger *slog.Logger, cfg config.LogConfig) gin.HandlerFunc {
+	redactHeaders := make(map[string]bool, len(cfg.RedactHeaders))
+	for _, name := range cfg.RedactHeaders {
+		redactHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+	return func(c *gin.Context) {
+		start := time.Now()
+		requestID := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = NewRequestID()
+		}
+		c.Header(RequestIDHeader, requestID)
+		c.Set(requestIDKey, requestID)
+		c.Set(loggerKey, logger.With(requestIDKey, requestID))
+
+		c.Next()
+
+		status := c.Writer.Status()
+		attrs := []slog.Attr{
+			slog.String(requestIDKey, requestID),
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", max(c.Writer.Size(), 0)),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if c.Request.URL.RawQuery != "" {
+			attrs = append(attrs, slog.String("query", RedactQuery(c.Request.URL.Query(), cfg.RedactQuery)))
+		}
+		// The span of tracing.Middleware, so the record could be joined with its trace.
+		if spanContext := trace.SpanContextFromContext(c.Request.Context()); spanContext.IsValid() {
+			attrs = append(attrs, slog.String("trace_id", spanContext.TraceID().String()), slog.String("span_id", spanContext.SpanID().String()))
+		}
+		if myUserID := c.GetUint("my_user_id"); myUserID != 0 {
+			attrs = append(attrs, slog.Uint64("my_user_id", uint64(myUserID)))
+		}
+		var headers []any
+		for _, name := range cfg.RequestHeaders {
+			value := c.GetHeader(name)
+			if value == "" {
+				continue
+			}
+			if redactHeaders[http.CanonicalHeaderKey(name)] {
+				value = RedactHeader(value)
+			}
+			headers = append(headers, slog.String(name, value))
+		}
+		if len(headers) > 0 {
+			attrs = append(attrs, slog.Group("headers", headers...))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		logger.LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// The value is masked but its scheme is kept, "Token eyJhb..." is logged as "Token <redacted>".
+func RedactHeader(value string) string {
+	if scheme, _, ok := strings.Cut(value, " "); ok {
+		return scheme + " " + redacted
+	}
+	return redacted
+}
+
+// The encoded query with the values of the names masked, e.g. access_token=<redacted>&limit=10.
+func RedactQuery(query url.Values, names []string) string {
+	for _, name := range names {
+		for key, values := range query {
+			if strings.EqualFold(key, name) {
+				for i := range values {
+					values[i] = redacted
+				}
+			}
+		}
+	}
+	return strings.ReplaceAll(query.Encode(), url.QueryEscape(redacted), redacted)
+}
+
+// Like gin.Recovery, but the panic and its stack go to the request's logger
+// and the client gets a bare 500.
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		FromContext(c).Error("panic recovered", "error", fmt.Sprint(err), "stack", string(debug.Stack()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
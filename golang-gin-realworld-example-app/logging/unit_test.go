@@ -0,0 +1,139 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"realworld-backend/config"
+)
+
+// A router logging into a buffer, /articles/:slug authenticates the user 42 like users.AuthMiddleware does.
+func newTestRouter(buf *bytes.Buffer) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Default().Log
+	r := gin.New()
+	r.Use(RequestLogger(New(cfg, buf), cfg), Recovery())
+	r.GET("/articles/:slug", func(c *gin.Context) {
+		c.Set("my_user_id", uint(42))
+		FromContext(c).Info("handler")
+		c.JSON(http.StatusOK, gin.H{"slug": c.Param("slug")})
+	})
+	r.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+	return r
+}
+
+func decodeRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("not a JSON record: %q", line)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestRequestLogger(t *testing.T) {
+	asserts := assert.New(t)
+
+	var buf bytes.Buffer
+	r := newTestRouter(&buf)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/articles/hello?access_token=eyJhb.secret&limit=2", nil)
+	req.Header.Set("Authorization", "Token eyJhb.secret")
+	req.Header.Set("User-Agent", "unit-test")
+	r.ServeHTTP(w, req)
+
+	requestID := w.Header().Get(RequestIDHeader)
+	asserts.Len(requestID, 32, "a request ID should be generated")
+	asserts.NotContains(buf.String(), "eyJhb.secret", "the token should never be logged")
+
+	records := decodeRecords(t, &buf)
+	asserts.Len(records, 2)
+	asserts.Equal("handler", records[0]["msg"])
+	asserts.Equal(requestID, records[0]["request_id"], "the request logger should carry the request ID")
+
+	record := records[1]
+	asserts.Equal("INFO", record["level"])
+	asserts.Equal(requestID, record["request_id"])
+	asserts.Equal("/articles/:slug", record["route"])
+	asserts.Equal("/articles/hello", record["path"])
+	asserts.Equal(float64(200), record["status"])
+	asserts.Equal(float64(42), record["my_user_id"])
+	asserts.Contains(record, "latency_ms")
+	asserts.Equal("access_token=<redacted>&limit=2", record["query"])
+	asserts.Equal(map[string]interface{}{"User-Agent": "unit-test", "Authorization": "Token <redacted>"}, record["headers"])
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	asserts := assert.New(t)
+
+	var buf bytes.Buffer
+	r := newTestRouter(&buf)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/articles/hello", nil)
+	req.Header.Set(RequestIDHeader, "edge-7f3a:1")
+	r.ServeHTTP(w, req)
+	asserts.Equal("edge-7f3a:1", w.Header().Get(RequestIDHeader), "the ID of the client should be kept")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/articles/hello", nil)
+	req.Header.Set(RequestIDHeader, "bad id\n{\"level\":\"ERROR\"}")
+	r.ServeHTTP(w, req)
+	asserts.Len(w.Header().Get(RequestIDHeader), 32, "an unsafe ID should be replaced")
+}
+
+func TestRequestLoggerLevels(t *testing.T) {
+	asserts := assert.New(t)
+
+	var buf bytes.Buffer
+	r := newTestRouter(&buf)
+	for _, path := range []string{"/missing", "/panic"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		r.ServeHTTP(w, req)
+	}
+	records := decodeRecords(t, &buf)
+	asserts.Len(records, 3)
+	asserts.Equal("WARN", records[0]["level"], "4xx should be a warning")
+	asserts.Equal(float64(404), records[0]["status"])
+	asserts.Equal("panic recovered", records[1]["msg"])
+	asserts.Equal("boom", records[1]["error"])
+	asserts.Equal("ERROR", records[2]["level"], "5xx should be an error")
+	asserts.Equal(float64(500), records[2]["status"])
+	asserts.Equal("/panic", records[2]["route"])
+}
+
+func TestRedact(t *testing.T) {
+	asserts := assert.New(t)
+
+	asserts.Equal("Token <redacted>", RedactHeader("Token eyJhb"))
+	asserts.Equal("<redacted>", RedactHeader("eyJhb"))
+	query, _ := url.ParseQuery("Access_Token=a&access_token=b&tag=go")
+	asserts.Equal("Access_Token=<redacted>&access_token=<redacted>&tag=go", RedactQuery(query, []string{"access_token"}))
+}
+
+func TestNew(t *testing.T) {
+	asserts := assert.New(t)
+
+	var buf bytes.Buffer
+	cfg := config.LogConfig{Level: "warn", Format: "text"}
+	logger := New(cfg, &buf)
+	logger.Info("hidden")
+	logger.Warn("shown")
+	asserts.NotContains(buf.String(), "hidden", "records below the level should be dropped")
+	asserts.Contains(buf.String(), "level=WARN msg=shown")
+	asserts.Equal(slog.LevelInfo, ParseLevel("verbose"))
+}
@@ -0,0 +1,14 @@
+/*
+The mail module sending the mails of the users module, e.g. the password resets.
+
+mail.go: the Message, the Mailer interface and the Mailer of the config
+
+smtp.go: the Mailer sending through an SMTP server
+
+file.go: the Mailer writing every message to a directory, to read them in development
+
+memory.go: the Mailer keeping the messages in memory, the tests read them back
+
+queue.go: the Queue sending the messages in the background, so the handlers don't wait for the Mailer
+*/
+package mail
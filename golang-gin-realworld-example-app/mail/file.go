@@ -0,0 +1,40 @@
+package mail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileMailer writes every message to its own .eml file in Dir, any mail client opens them.
+type FileMailer struct {
+	Dir  string
+	from string
+	now  func() time.Time
+}
+
+func NewFileMailer(dir string, from string) *FileMailer {
+	return &FileMailer{Dir: dir, from: from, now: time.Now}
+}
+
+// The files are named by their time, so ls lists them in order: 20261017T184946.978Z-1f3a9c0b.eml
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	if err := msg.validate(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+	now := m.now()
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405.000Z"), hex.EncodeToString(suffix[:]))
+	if err := os.WriteFile(filepath.Join(m.Dir, name), msg.Bytes(m.from, now), 0600); err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"sync"
+	"time"
+
+	"realworld-backend/config"
+)
+
+// A plain text mail to a single address.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+var ErrInvalidMessage = errors.New("mail: invalid message")
+
+// The To and Subject go to the headers, a line break in them would add headers of its own.
+func (m Message) validate() error {
+	if m.To == "" || strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return ErrInvalidMessage
+	}
+	return nil
+}
+
+// The message in the RFC 5322 format, as it is sent or written to an .eml file.
+func (m Message) Bytes(from string, now time.Time) []byte {
+	var id [12]byte
+	rand.Read(id[:])
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@realworld>\r\n", hex.EncodeToString(id[:]))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&b)
+	w.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n")))
+	w.Close()
+	return b.Bytes()
+}
+
+// Mailer delivers the messages, see the smtp, file and memory implementations.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// The Mailer of the mail.driver of the config.
+//
+//	mailer, err := mail.New(cfg.Mail)
+//	mail.Set(mailer)
+func New(cfg config.MailConfig) (Mailer, error) {
+	switch cfg.Driver {
+	case "smtp":
+		return NewSMTPMailer(cfg.SMTP, cfg.From)
+	case "file":
+		return NewFileMailer(cfg.Dir, cfg.From), nil
+	case "memory":
+		return NewMemoryMailer(), nil
+	}
+	return nil, fmt.Errorf("mail: unknown driver %q", cfg.Driver)
+}
+
+var (
+	mu     sync.RWMutex
+	mailer Mailer = NewMemoryMailer()
+)
+
+// The Mailer of the server, an in-memory one until Set is called (e.g. in the unit tests).
+func Get() Mailer {
+	mu.RLock()
+	defer mu.RUnlock()
+	return mailer
+}
+
+func Set(m Mailer) {
+	mu.Lock()
+	defer mu.Unlock()
+	mailer = m
+}
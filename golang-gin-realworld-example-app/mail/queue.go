@@ -0,0 +1,89 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+var ErrQueueFull = errors.New("mail: the queue is full")
+
+type job struct {
+	ctx context.Context
+	msg Message
+}
+
+// Queue sends the messages in the background, with the Mailer of Get. A handler mailing a token
+// answers as fast as the one which doesn't, so the time of the answer doesn't tell who is registered.
+// Until Run is started (e.g. in the unit tests) the messages are sent at once.
+//
+//	m.Go("mail sender", mail.GetQueue().Run)
+//	err := mail.GetQueue().Send(ctx, msg)
+type Queue struct {
+	jobs chan job
+
+	mu      sync.RWMutex
+	running bool
+}
+
+func NewQueue(size int) *Queue {
+	return &Queue{jobs: make(chan job, size)}
+}
+
+var queue = NewQueue(256)
+
+// The queue of the server, the users module mails through it.
+func GetQueue() *Queue {
+	return queue
+}
+
+// Queue the message, only an invalid message or a full queue is an error then. The delivery
+// errors are logged.
+func (q *Queue) Send(ctx context.Context, msg Message) error {
+	if err := msg.validate(); err != nil {
+		return err
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if !q.running {
+		return Get().Send(ctx, msg)
+	}
+	select {
+	case q.jobs <- job{context.WithoutCancel(ctx), msg}:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Send the queued messages until ctx is done, then the ones left before returning.
+func (q *Queue) Run(ctx context.Context) {
+	q.mu.Lock()
+	q.running = true
+	q.mu.Unlock()
+	for {
+		select {
+		case j := <-q.jobs:
+			q.deliver(j)
+		case <-ctx.Done():
+			q.mu.Lock()
+			q.running = false
+			q.mu.Unlock()
+			for {
+				select {
+				case j := <-q.jobs:
+					q.deliver(j)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *Queue) deliver(j job) {
+	if err := Get().Send(j.ctx, j.msg); err != nil {
+		slog.Error("mail: delivery failed", "subject", j.msg.Subject, "error", err)
+	}
+}
@@ -0,0 +1,232 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"realworld-backend/config"
+)
+
+var testMessage = Message{
+	To:      "jake@jake.jake",
+	Subject: "Réinitialiser",
+	Body:    "Hi jake,\n\nhttp://localhost:4100/reset-password?token=abc=def\n",
+}
+
+// Read a message back as a mail client would.
+func parse(t *testing.T, data []byte) (*netmail.Message, string) {
+	msg, err := netmail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	return msg, string(body)
+}
+
+func TestMessageBytes(t *testing.T) {
+	asserts := assert.New(t)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	msg, body := parse(t, testMessage.Bytes("RealWorld <no-reply@localhost>", now))
+	asserts.Equal("RealWorld <no-reply@localhost>", msg.Header.Get("From"))
+	asserts.Equal("jake@jake.jake", msg.Header.Get("To"))
+	asserts.Equal("=?utf-8?q?R=C3=A9initialiser?=", msg.Header.Get("Subject"))
+	asserts.Equal("Mon, 01 Jan 2024 12:00:00 +0000", msg.Header.Get("Date"))
+	asserts.NotEmpty(msg.Header.Get("Message-ID"))
+	asserts.Equal("quoted-printable", msg.Header.Get("Content-Transfer-Encoding"))
+	asserts.Contains(body, "token=3Dabc=3Ddef", "the body should be quoted-printable")
+	asserts.Contains(body, "Hi jake,\r\n\r\n", "the lines should end with CRLF")
+
+	ctx := context.Background()
+	mailer := NewMemoryMailer()
+	asserts.ErrorIs(mailer.Send(ctx, Message{To: "jake@jake.jake\r\nBcc: x@evil.example"}), ErrInvalidMessage)
+	asserts.ErrorIs(mailer.Send(ctx, Message{To: "jake@jake.jake", Subject: "a\nBcc: x@evil.example"}), ErrInvalidMessage)
+	asserts.ErrorIs(mailer.Send(ctx, Message{Subject: "to nobody"}), ErrInvalidMessage)
+	asserts.Empty(mailer.Messages())
+}
+
+func TestMemoryMailer(t *testing.T) {
+	asserts := assert.New(t)
+	ctx := context.Background()
+
+	mailer := NewMemoryMailer()
+	_, ok := mailer.Last("jake@jake.jake")
+	asserts.False(ok)
+	asserts.NoError(mailer.Send(ctx, testMessage))
+	asserts.NoError(mailer.Send(ctx, Message{To: "other@jake.jake", Subject: "other"}))
+	asserts.NoError(mailer.Send(ctx, Message{To: "jake@jake.jake", Subject: "second"}))
+	asserts.Len(mailer.Messages(), 3)
+	last, ok := mailer.Last("jake@jake.jake")
+	asserts.True(ok)
+	asserts.Equal("second", last.Subject)
+	mailer.Reset()
+	asserts.Empty(mailer.Messages())
+
+	previous := Get()
+	defer Set(previous)
+	Set(mailer)
+	asserts.Same(mailer, Get())
+}
+
+// A Mailer which waits for release before sending, like a slow SMTP server.
+type slowMailer struct {
+	*MemoryMailer
+	release chan struct{}
+}
+
+func (m slowMailer) Send(ctx context.Context, msg Message) error {
+	<-m.release
+	return m.MemoryMailer.Send(ctx, msg)
+}
+
+func TestQueue(t *testing.T) {
+	asserts := assert.New(t)
+	previous := Get()
+	defer Set(previous)
+	mailer := NewMemoryMailer()
+	Set(mailer)
+
+	q := NewQueue(1)
+	asserts.NoError(q.Send(context.Background(), testMessage))
+	asserts.Len(mailer.Messages(), 1, "the messages should be sent at once until Run")
+	asserts.ErrorIs(q.Send(context.Background(), Message{Subject: "to nobody"}), ErrInvalidMessage)
+
+	slow := slowMailer{NewMemoryMailer(), make(chan struct{})}
+	Set(slow)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+	for {
+		q.mu.RLock()
+		running := q.running
+		q.mu.RUnlock()
+		if running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The request context is cancelled once the handler answered, the message is still sent.
+	requestCtx, requestCancel := context.WithCancel(context.Background())
+	asserts.NoError(q.Send(requestCtx, testMessage), "Send shouldn't wait for the delivery")
+	requestCancel()
+	asserts.Empty(slow.Messages())
+
+	// The first message is being delivered, the next one waits in the queue, the third one doesn't fit.
+	for len(q.jobs) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	asserts.NoError(q.Send(context.Background(), Message{To: "second@jake.jake"}))
+	asserts.ErrorIs(q.Send(context.Background(), Message{To: "third@jake.jake"}), ErrQueueFull)
+
+	// The messages left are sent before Run returns.
+	cancel()
+	close(slow.release)
+	<-done
+	asserts.Len(slow.Messages(), 2)
+}
+
+func TestFileMailer(t *testing.T) {
+	asserts := assert.New(t)
+
+	dir := filepath.Join(t.TempDir(), "mails")
+	mailer, err := New(config.MailConfig{Driver: "file", Dir: dir, From: "no-reply@localhost"})
+	asserts.NoError(err)
+	asserts.NoError(mailer.Send(context.Background(), testMessage))
+	asserts.NoError(mailer.Send(context.Background(), testMessage))
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	asserts.Len(files, 2, "every message should get its own file")
+	data, _ := os.ReadFile(files[0])
+	msg, _ := parse(t, data)
+	asserts.Equal("no-reply@localhost", msg.Header.Get("From"))
+	asserts.Equal("jake@jake.jake", msg.Header.Get("To"))
+}
+
+// An SMTP server accepting one message, it writes the commands it gets to lines.
+func fakeSMTPServer(t *testing.T, lines chan<- string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+		reply("220 fake ESMTP")
+		data := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines <- line
+			switch {
+			case data && line == ".":
+				data = false
+				reply("250 queued")
+			case data:
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250-fake\r\n250 8BITMIME")
+			case line == "DATA":
+				data = true
+				reply("354 go ahead")
+			case line == "QUIT":
+				reply("221 bye")
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestSMTPMailer(t *testing.T) {
+	asserts := assert.New(t)
+
+	lines := make(chan string, 100)
+	host, port, _ := net.SplitHostPort(fakeSMTPServer(t, lines))
+	portNumber, _ := strconv.Atoi(port)
+	cfg := config.SMTPConfig{Host: host, Port: portNumber}
+	_, err := New(config.MailConfig{Driver: "smtp", SMTP: cfg, From: "not an address"})
+	asserts.Error(err)
+	mailer, err := New(config.MailConfig{Driver: "smtp", SMTP: cfg, From: "RealWorld <no-reply@localhost>"})
+	asserts.NoError(err)
+	asserts.Error(mailer.Send(context.Background(), Message{To: "not an address"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	asserts.NoError(mailer.Send(ctx, testMessage))
+	var got []string
+	for line := range lines {
+		got = append(got, line)
+	}
+	session := strings.Join(got, "\n")
+	asserts.Contains(session, "MAIL FROM:<no-reply@localhost>")
+	asserts.Contains(session, "RCPT TO:<jake@jake.jake>")
+	asserts.Contains(session, "From: \"RealWorld\" <no-reply@localhost>")
+	asserts.Contains(session, "Subject: =?utf-8?q?R=C3=A9initialiser?=")
+	asserts.Equal("QUIT", got[len(got)-1])
+
+	_, err = New(config.MailConfig{Driver: "pigeon"})
+	asserts.Error(err)
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/migrations"
+	"realworld-backend/users"
+)
+
+// The test database with its schema, and the config of the commands pointing to it.
+func commandsDBInit() (*gorm.DB, *config.Config) {
+	cfg := config.Default()
+	cfg.Database.Driver, cfg.Database.DSN = common.TestDBSource()
+	cfg.Database.AutoMigrate = true
+	cfg.Mail.Driver = "memory"
+	config.Set(cfg)
+	test_db := common.TestDBInit()
+	migrations.Up(test_db)
+	return test_db, cfg
+}
+
+// Run the command with stdin as its input, what it printed on stdout is returned.
+// The commands close their own connection, common.GetDB is the test one again afterwards.
+func runCommand(cfg *config.Config, stdin string, name string, args ...string) (string, error) {
+	defer func(db *gorm.DB, in *os.File, out *os.File) {
+		common.DB, os.Stdin, os.Stdout = db, in, out
+	}(common.DB, os.Stdin, os.Stdout)
+
+	inReader, inWriter, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	defer inReader.Close()
+	io.WriteString(inWriter, stdin)
+	inWriter.Close()
+	outReader, outWriter, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	printed := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(outReader)
+		outReader.Close()
+		printed <- string(data)
+	}()
+	os.Stdin, os.Stdout = inReader, outWriter
+
+	err = findCommand(name).run(cfg, args)
+	outWriter.Close()
+	return <-printed, err
+}
+
+func TestUserCommands(t *testing.T) {
+	asserts := assert.New(t)
+
+	test_db, cfg := commandsDBInit()
+	defer config.Set(nil)
+	defer common.TestDBFree(test_db)
+
+	out, err := runCommand(cfg, "", "create-user", "-username", "alice", "-email", "alice@example.com", "-password", "password123", "-admin")
+	asserts.NoError(err)
+	asserts.Equal("created user 1 alice <alice@example.com>\n", out)
+	roles, _ := users.UserRoles(context.Background(), 1)
+	asserts.Equal([]string{users.RoleAdmin}, roles)
+	out, err = runCommand(cfg, "password456\n", "create-user", "-username", "bobby", "-email", "bob@example.com")
+	asserts.NoError(err, "the password should be read from stdin")
+	asserts.Equal("created user 2 bobby <bob@example.com>\n", out)
+
+	_, err = runCommand(cfg, "", "create-user", "-username", "carol", "-email", "carol@example.com")
+	asserts.EqualError(err, "password: nothing to read on stdin")
+	_, err = runCommand(cfg, "", "create-user", "-username", "bobby", "-email", "bob@example.com", "-password", "password123")
+	asserts.Error(err, "a taken email should be refused")
+	_, err = runCommand(cfg, "", "create-user", "-username", "x", "-email", "carol@example.com", "-password", "password123")
+	asserts.Error(err, "the username should be validated")
+	_, err = runCommand(cfg, "", "create-user", "-name", "carol")
+	asserts.ErrorContains(err, "flag provided but not defined: -name")
+	_, err = runCommand(cfg, "", "create-user", "-h")
+	asserts.ErrorIs(err, flag.ErrHelp)
+	var count int
+	test_db.Model(&users.UserModel{}).Count(&count)
+	asserts.Equal(2, count, "the refused users should not be created")
+
+	bob, _ := users.FindOneUser(context.Background(), &users.UserModel{Email: "bob@example.com"})
+	out, err = runCommand(cfg, "newpassword\n", "set-password", "-email", "bob@example.com")
+	asserts.NoError(err)
+	asserts.Equal("password of bob@example.com changed\n", out)
+	changed, _ := users.FindOneUser(context.Background(), &users.UserModel{Email: "bob@example.com"})
+	asserts.NotEqual(bob.PasswordHash, changed.PasswordHash)
+	_, err = runCommand(cfg, "", "set-password", "-email", "bob@example.com", "-password", "short")
+	asserts.Error(err, "the password rules of the API should apply")
+	_, err = runCommand(cfg, "", "set-password", "-email", "nobody@example.com", "-password", "password123")
+	asserts.ErrorIs(err, gorm.ErrRecordNotFound)
+	asserts.ErrorContains(err, "user nobody@example.com")
+	_, err = runCommand(cfg, "", "set-password", "-password", "password123")
+	asserts.EqualError(err, "-email is required")
+
+	out, err = runCommand(cfg, "", "promote-admin", "-email", "bob@example.com")
+	asserts.NoError(err)
+	asserts.Equal("bob@example.com roles: admin\n", out)
+	out, err = runCommand(cfg, "", "promote-admin", "-email", "bob@example.com", "-revoke")
+	asserts.NoError(err)
+	asserts.Equal("bob@example.com roles: \n", out)
+	_, err = runCommand(cfg, "", "promote-admin", "-email", "alice@example.com", "-revoke")
+	asserts.ErrorIs(err, users.ErrLastAdmin)
+	_, err = runCommand(cfg, "", "promote-admin", "-email", "nobody@example.com")
+	asserts.ErrorIs(err, gorm.ErrRecordNotFound)
+
+	out, err = runCommand(cfg, "", "grant-role", "-email", "bob@example.com", "-role", users.RoleModerator)
+	asserts.NoError(err)
+	asserts.Equal("bob@example.com roles: moderator\n", out)
+	out, err = runCommand(cfg, "", "grant-role", "-email", "alice@example.com", "-role", users.RoleModerator)
+	asserts.NoError(err)
+	asserts.Equal("alice@example.com roles: admin, moderator\n", out)
+	_, err = runCommand(cfg, "", "grant-role", "-email", "bob@example.com", "-role", "owner")
+	asserts.ErrorIs(err, users.ErrRoleNotFound)
+	asserts.ErrorContains(err, `role "owner"`)
+	_, err = runCommand(cfg, "", "grant-role", "-email", "bob@example.com", "-role")
+	asserts.ErrorContains(err, "flag needs an argument: -role")
+
+	out, err = runCommand(cfg, "", "disable-2fa", "-email", "bob@example.com")
+	asserts.NoError(err)
+	asserts.Equal("two-factor authentication of bob@example.com disabled\n", out)
+	_, err = runCommand(cfg, "", "disable-2fa", "-email", "nobody@example.com")
+	asserts.ErrorIs(err, gorm.ErrRecordNotFound)
+
+	users.RecordLoginFailure(context.Background(), "bob@example.com", "10.0.0.1", time.Now())
+	users.RecordLoginFailure(context.Background(), "bob@example.com", "10.0.0.1", time.Now())
+	out, err = runCommand(cfg, "", "unlock-login", "-email", "bob@example.com")
+	asserts.NoError(err)
+	asserts.Equal("unlocked, 2 failed logins forgotten\n", out)
+	out, err = runCommand(cfg, "", "unlock-login", "-email", "bob@example.com", "-ip", "10.0.0.1")
+	asserts.NoError(err)
+	asserts.Equal("unlocked, 2 failed logins forgotten\n", out, "only the failures of the IP should be left")
+	_, err = runCommand(cfg, "", "unlock-login")
+	asserts.EqualError(err, "-email or -ip is required")
+
+	_, err = runCommand(cfg, "", "delete-user", "-email", "alice@example.com")
+	asserts.ErrorIs(err, users.ErrLastAdmin)
+	_, err = users.FindOneUser(context.Background(), &users.UserModel{Email: "alice@example.com"})
+	asserts.NoError(err, "the last admin should be kept")
+	out, err = runCommand(cfg, "", "delete-user", "-email", "bob@example.com")
+	asserts.NoError(err)
+	asserts.Equal("deleted user 2 bobby <bob@example.com>\n", out)
+	_, err = runCommand(cfg, "", "delete-user", "-email", "bob@example.com")
+	asserts.ErrorIs(err, gorm.ErrRecordNotFound)
+	_, err = runCommand(cfg, "", "delete-user")
+	asserts.EqualError(err, "-email is required")
+}
+
+func TestReindexCommand(t *testing.T) {
+	asserts := assert.New(t)
+
+	test_db, cfg := commandsDBInit()
+	defer config.Set(nil)
+	defer common.TestDBFree(test_db)
+
+	out, err := runCommand(cfg, "", "reindex")
+	asserts.NoError(err)
+	asserts.Equal("0 slugs updated\n", out)
+
+	_, err = runCommand(cfg, "", "create-user", "-username", "alice", "-email", "alice@example.com", "-password", "password123")
+	asserts.NoError(err)
+	alice, _ := users.FindOneUser(context.Background(), &users.UserModel{Email: "alice@example.com"})
+	author := articles.GetArticleUserModel(context.Background(), alice)
+	test_db.Create(&articles.ArticleModel{Slug: "stale", Title: "Hello World", AuthorID: author.ID})
+	test_db.Create(&articles.ArticleModel{Slug: "other", Title: "Hello World", AuthorID: author.ID})
+	out, err = runCommand(cfg, "", "reindex")
+	asserts.NoError(err)
+	asserts.Equal("1 slugs updated\narticle 2 \"Hello World\" kept slug \"other\", its new slug is taken\n", out)
+	_, err = runCommand(cfg, "", "reindex", "-all")
+	asserts.ErrorContains(err, "flag provided but not defined: -all")
+
+	// Without auto_migrate the commands refuse an outdated schema.
+	cfg.Database.AutoMigrate = false
+	_, err = migrations.Down(test_db, 1)
+	asserts.NoError(err)
+	_, err = runCommand(cfg, "", "reindex")
+	asserts.EqualError(err, "1 pending migrations, run `migrate up` first")
+	cfg.Database.AutoMigrate = true
+	_, err = runCommand(cfg, "", "reindex")
+	asserts.NoError(err, "auto_migrate should apply the pending migrations")
+	pending, _ := migrations.Pending(test_db)
+	asserts.Len(pending, 0)
+}
+
+func TestMigrateCommand(t *testing.T) {
+	asserts := assert.New(t)
+
+	cfg := config.Default()
+	cfg.Database.Driver, cfg.Database.DSN = common.TestDBSource()
+	config.Set(cfg)
+	defer config.Set(nil)
+	test_db := common.TestDBInit()
+	defer common.TestDBFree(test_db)
+	all := migrations.All()
+	last := all[len(all)-1]
+	migrate := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runMigrate(test_db, args, &out)
+		return out.String(), err
+	}
+
+	out, err := migrate("status")
+	asserts.NoError(err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	asserts.Len(lines, len(all)+1)
+	asserts.Regexp(`^VERSION +NAME +APPLIED AT$`, lines[0])
+	asserts.Regexp(fmt.Sprintf(`^0001 +%s +pending$`, all[0].Name), lines[1])
+
+	out, err = migrate("up")
+	asserts.NoError(err)
+	lines = strings.Split(strings.TrimSpace(out), "\n")
+	asserts.Len(lines, len(all))
+	asserts.Equal(fmt.Sprintf("applied  0001_%s", all[0].Name), lines[0])
+	asserts.Equal(fmt.Sprintf("applied  %04d_%s", last.Version, last.Name), lines[len(lines)-1])
+	out, err = migrate("up")
+	asserts.NoError(err)
+	asserts.Equal("schema is up to date\n", out)
+	out, err = migrate("status")
+	asserts.NoError(err)
+	asserts.NotContains(out, "pending")
+	asserts.Regexp(fmt.Sprintf(`(?m)^%04d +%s +\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z$`, last.Version, last.Name), out)
+
+	out, err = migrate("down")
+	asserts.NoError(err)
+	asserts.Equal(fmt.Sprintf("reverted %04d_%s\n", last.Version, last.Name), out)
+	out, err = migrate("down", "2")
+	asserts.NoError(err)
+	asserts.Equal(fmt.Sprintf("reverted %04d_%s\nreverted %04d_%s\n",
+		all[len(all)-2].Version, all[len(all)-2].Name, all[len(all)-3].Version, all[len(all)-3].Name), out)
+	pending, _ := migrations.Pending(test_db)
+	asserts.Len(pending, 3)
+	out, err = migrate("status")
+	asserts.NoError(err)
+	asserts.Equal(3, strings.Count(out, "pending"))
+
+	for _, args := range [][]string{{"down", "0"}, {"down", "-1"}, {"down", "all"}} {
+		_, err = migrate(args...)
+		asserts.EqualError(err, fmt.Sprintf("migrate down: invalid steps %q", args[1]))
+	}
+	for _, args := range [][]string{{}, {"sideways"}, {"UP"}} {
+		_, err = migrate(args...)
+		asserts.EqualError(err, migrateUsage)
+	}
+	pending, _ = migrations.Pending(test_db)
+	asserts.Len(pending, 3, "the refused arguments should change nothing")
+
+	// The command opens the database of the config.
+	out, err = runCommand(cfg, "", "migrate", "up")
+	asserts.NoError(err)
+	asserts.Equal(3, strings.Count(out, "applied  "))
+	pending, _ = migrations.Pending(test_db)
+	asserts.Len(pending, 0)
+}
+
+func TestJWTKeysCommand(t *testing.T) {
+	asserts := assert.New(t)
+
+	test_db, cfg := commandsDBInit()
+	defer config.Set(nil)
+	defer common.TestDBFree(test_db)
+	jwtKeys := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runJWTKeys(args, &out)
+		return out.String(), err
+	}
+	// The kid of the `add` output: "added KID\tALGORITHM\tSTATUS".
+	added := func(out string) string {
+		return strings.Fields(out)[1]
+	}
+
+	out, err := jwtKeys("list")
+	asserts.NoError(err)
+	asserts.Equal("KID  ALGORITHM  STATUS  CREATED AT  ACTIVATED AT  RETIRED AT\n"+
+		"no active key, the new tokens are signed with jwt.secret\n", out)
+
+	out, err = jwtKeys("add")
+	asserts.NoError(err)
+	asserts.Regexp(`^added [0-9a-f]{16}\tHS256\tnew\n$`, out, "jwt.algorithm should be the default")
+	first := added(out)
+	out, err = jwtKeys("add", "-algorithm", common.AlgorithmES256, "-activate")
+	asserts.NoError(err)
+	asserts.Regexp(`^added [0-9a-f]{16}\tES256\tactive\n$`, out)
+	second := added(out)
+	out, err = jwtKeys("list")
+	asserts.NoError(err)
+	asserts.Regexp(fmt.Sprintf(`(?m)^%s +HS256 +new +\S+Z +- +-$`, first), out)
+	asserts.Regexp(fmt.Sprintf(`(?m)^%s +ES256 +active +\S+Z +\S+Z +-$`, second), out)
+	asserts.NotContains(out, "no active key")
+
+	out, err = jwtKeys("activate", first)
+	asserts.NoError(err)
+	asserts.Equal(fmt.Sprintf("activated %s, the new tokens are signed with it\n", first), out)
+	out, _ = jwtKeys("list")
+	asserts.Regexp(fmt.Sprintf(`(?m)^%s +ES256 +retired `, second), out, "the key active until then should be retired")
+	_, err = jwtKeys("activate", second)
+	asserts.ErrorContains(err, "is retired")
+
+	// Retiring the active key leaves the new tokens to jwt.secret.
+	out, err = jwtKeys("retire", first)
+	asserts.NoError(err)
+	asserts.Regexp(fmt.Sprintf(`^retired %s, its tokens are valid until \S+Z\n$`, first), out)
+	out, _ = jwtKeys("list")
+	asserts.Regexp(fmt.Sprintf(`(?m)^%s +HS256 +retired `, first), out)
+	asserts.Contains(out, "no active key, the new tokens are signed with jwt.secret")
+	asserts.NoError(common.GetKeyring().Reload())
+	asserts.Equal(common.ConfigKeyID, common.GetKeyring().ActiveKeyID())
+	_, err = jwtKeys("retire", first)
+	asserts.NoError(err, "retiring twice should change nothing")
+
+	for _, args := range [][]string{{"activate", "missing"}, {"retire", "missing"}} {
+		_, err = jwtKeys(args...)
+		asserts.ErrorIs(err, common.ErrUnknownKey)
+	}
+	_, err = jwtKeys("add", "-algorithm", "HS512")
+	asserts.ErrorContains(err, `unknown signing algorithm "HS512"`)
+	_, err = jwtKeys("add", "-bits", "4096")
+	asserts.ErrorContains(err, "flag provided but not defined: -bits")
+	for _, args := range [][]string{{}, {"rotate"}, {"list", "all"}, {"add", "now"}, {"activate"}, {"retire", first, second}, {"prune", "all"}} {
+		_, err = jwtKeys(args...)
+		asserts.EqualError(err, jwtKeysUsage)
+	}
+	var count int
+	test_db.Model(&common.SigningKey{}).Count(&count)
+	asserts.Equal(2, count, "the refused arguments should change nothing")
+
+	out, err = jwtKeys("prune")
+	asserts.NoError(err)
+	asserts.Equal("0 expired keys deleted\n", out, "the tokens of the retired keys are still valid")
+	test_db.Model(&common.SigningKey{}).Where("kid = ?", second).
+		Update("retired_at", time.Now().Add(-cfg.JWT.TokenLifetime))
+	out, err = jwtKeys("prune")
+	asserts.NoError(err)
+	asserts.Equal("1 expired keys deleted\n", out)
+	out, _ = jwtKeys("list")
+	asserts.NotContains(out, second)
+	asserts.Contains(out, first)
+
+	// The command opens the database of the config.
+	out, err = runCommand(cfg, "", "jwt-keys", "list")
+	asserts.NoError(err)
+	asserts.Contains(out, first)
+}
+
+func TestCheckConfigCommand(t *testing.T) {
+	asserts := assert.New(t)
+
+	cfg := config.Default()
+	cfg.JWT.Secret = "a-secret-not-to-print"
+	out, err := runCommand(cfg, "", "check-config")
+	asserts.NoError(err)
+	asserts.Contains(out, "environment: development\n")
+	asserts.Contains(out, "<redacted>")
+	asserts.NotContains(out, cfg.JWT.Secret)
+	_, err = runCommand(cfg, "", "check-config", "-v")
+	asserts.Error(err)
+}
+
+func TestServeCommand(t *testing.T) {
+	asserts := assert.New(t)
+
+	test_db, cfg := commandsDBInit()
+	defer config.Set(nil)
+	defer common.TestDBFree(test_db)
+
+	_, err := runCommand(cfg, "", "serve", "-port", "8080")
+	asserts.ErrorContains(err, "flag provided but not defined: -port")
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	asserts.NoError(err)
+	cfg.Server.Addr = taken.Addr().String()
+	_, err = runCommand(cfg, "", "serve")
+	var opErr *net.OpError
+	asserts.ErrorAs(err, &opErr, "a taken address should stop the server")
+	taken.Close()
+
+	served := make(chan error, 1)
+	go func() { served <- serveCommand(cfg, nil) }()
+	status := 0
+	for deadline := time.Now().Add(5 * time.Second); status != http.StatusOK && time.Now().Before(deadline); {
+		if resp, err := http.Get("http://" + cfg.Server.Addr + "/healthz"); err == nil {
+			status = resp.StatusCode
+			resp.Body.Close()
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	asserts.Equal(http.StatusOK, status, "the server should answer once it listens")
+	// The server answers only after the signals are caught, so SIGINT doesn't stop the test.
+	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	select {
+	case err := <-served:
+		asserts.NoError(err, "SIGINT should shut the server down cleanly")
+	case <-time.After(10 * time.Second):
+		t.Fatal("the server didn't stop on SIGINT")
+	}
+}
+
+// main exits with 2 on an unknown command or -h, and with 1 when the command fails.
+// It is run in a child process, the arguments are passed in REALWORLD_TEST_MAIN_ARGS.
+func TestMainExit(t *testing.T) {
+	if args, ok := os.LookupEnv("REALWORLD_TEST_MAIN_ARGS"); ok {
+		os.Args = append([]string{"realworld-server"}, strings.Fields(args)...)
+		main()
+		os.Exit(0)
+	}
+	asserts := assert.New(t)
+
+	test_db, _ := commandsDBInit()
+	defer config.Set(nil)
+	defer common.TestDBFree(test_db)
+	driver, dsn := common.TestDBSource()
+
+	for _, test := range []struct {
+		args   string
+		code   int
+		output string
+	}{
+		{"check-config", 0, "config is valid"},
+		{"unlock-login -ip 10.0.0.1", 0, "unlocked, 0 failed logins forgotten"},
+		{"rm -rf", 2, `unknown command "rm"`},
+		{"create-user -h", 2, "usage: create-user -username NAME"},
+		{"create-user -name alice", 1, "create-user: flag provided but not defined: -name"},
+		{"set-password -email nobody@example.com -password password123", 1, "set-password: user nobody@example.com: record not found"},
+	} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestMainExit$")
+		cmd.Env = append(os.Environ(), "REALWORLD_TEST_MAIN_ARGS="+test.args,
+			"REALWORLD_DB_DRIVER="+driver, "REALWORLD_DB_DSN="+dsn, "REALWORLD_DB_AUTO_MIGRATE=true")
+		output, err := cmd.CombinedOutput()
+		code := 0
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			code = exitErr.ExitCode()
+		}
+		asserts.Equal(test.code, code, fmt.Sprintf("exit code of %q", test.args))
+		asserts.Contains(string(output), test.output)
+	}
+}
@@ -0,0 +1,8 @@
+/*
+The metrics module containing the Prometheus metrics of the server.
+
+metrics.go: the registry, the HTTP, database pool and domain metrics
+
+middlewares.go: the per-route instrumentation and the protected /metrics endpoint
+*/
+package metrics
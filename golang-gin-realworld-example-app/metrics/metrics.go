@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"database/sql"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const namespace = "realworld"
+
+// The registry served by /metrics. It is not the global one of the client library,
+// so the tests (and other binaries) don't see the metrics of each other.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the HTTP requests by method and route template.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+)
+
+// The domain counters, incremented by the handlers once the change is saved:
+//
+//	metrics.UsersRegistered.Inc()
+//	metrics.Logins.WithLabelValues(metrics.ResultFailure).Inc()
+var (
+	UsersRegistered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "users_registered_total",
+		Help:      "Users registered by POST /api/users.",
+	})
+
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "user_logins_total",
+		Help:      "Login attempts by result.",
+	}, []string{"result"})
+
+	ArticlesCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "articles_created_total",
+		Help:      "Articles created.",
+	})
+
+	Favorites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "article_favorites_total",
+		Help:      "Articles favorited and unfavorited, by action.",
+	}, []string{"action"})
+
+	Comments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "comments_total",
+		Help:      "Comments created and deleted, by action.",
+	}, []string{"action"})
+)
+
+// The label values of the domain counters.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	ResultLocked  = "locked"
+
+	ActionFavorite   = "favorite"
+	ActionUnfavorite = "unfavorite"
+	ActionCreate     = "create"
+	ActionDelete     = "delete"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration,
+		UsersRegistered, Logins, ArticlesCreated, Favorites, Comments,
+	)
+	// Export the zero values, so the series exist before the first event.
+	for _, result := range []string{ResultSuccess, ResultFailure, ResultLocked} {
+		Logins.WithLabelValues(result)
+	}
+	for _, action := range []string{ActionFavorite, ActionUnfavorite} {
+		Favorites.WithLabelValues(action)
+	}
+	for _, action := range []string{ActionCreate, ActionDelete} {
+		Comments.WithLabelValues(action)
+	}
+}
+
+// Export the pool stats of db (open, in use and idle connections, waits...) as the go_sql_* metrics.
+// It is called once by the server with the handle of common.Init.
+//
+//	metrics.RegisterDB(common.GetDB().DB())
+func RegisterDB(db *sql.DB) error {
+	return Registry.Register(collectors.NewDBStatsCollector(db, namespace))
+}
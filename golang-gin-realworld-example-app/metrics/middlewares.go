@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"realworld-backend/config"
+)
+
+// The route label of the requests which match no route, so random paths don't create series.
+const unmatchedRoute = "unmatched"
+
+// Count and time every request by its route template (e.g. /api/articles/:slug), not by its path.
+//
+//	r.Use(metrics.Middleware())
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Bind the endpoint on router, on the API engine or on the internal one of cfg.Addr.
+//
+//	metrics.MetricsRegister(r.Group("/"), cfg.Metrics)
+func MetricsRegister(router *gin.RouterGroup, cfg config.MetricsConfig) {
+	router.GET(cfg.Path, Handler(cfg.BearerToken))
+}
+
+// The registry in the Prometheus text format, only for "Authorization: Bearer <token>" when token is set.
+func Handler(token string) gin.HandlerFunc {
+	h := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="metrics"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"realworld-backend/config"
+)
+
+func newTestRouter(cfg config.MetricsConfig) *gin.Engine {
+	r := gin.New()
+	r.Use(Middleware())
+	MetricsRegister(r.Group("/"), cfg)
+	r.GET("/articles/:slug", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"slug": c.Param("slug")})
+	})
+	return r
+}
+
+func get(r *gin.Engine, path string, header http.Header) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	asserts := assert.New(t)
+
+	r := newTestRouter(config.Default().Metrics)
+	before := testutil.ToFloat64(httpRequests.WithLabelValues("GET", "/articles/:slug", "200"))
+	get(r, "/articles/hello", nil)
+	get(r, "/articles/world", nil)
+	get(r, "/no/such/path", nil)
+	asserts.Equal(before+2, testutil.ToFloat64(httpRequests.WithLabelValues("GET", "/articles/:slug", "200")),
+		"requests should be counted by route template")
+	asserts.Equal(float64(1), testutil.ToFloat64(httpRequests.WithLabelValues("GET", unmatchedRoute, "404")),
+		"unknown paths should share one series")
+
+	body := get(r, "/metrics", nil).Body.String()
+	asserts.Contains(body, `realworld_http_request_duration_seconds_count{method="GET",route="/articles/:slug"} 2`)
+	asserts.NotContains(body, "/articles/hello", "paths should never be labels")
+	asserts.Contains(body, `realworld_user_logins_total{result="failure"} 0`, "the domain series should exist before the first event")
+}
+
+func TestHandlerToken(t *testing.T) {
+	asserts := assert.New(t)
+
+	cfg := config.Default().Metrics
+	cfg.BearerToken = "scrape-token"
+	r := newTestRouter(cfg)
+
+	w := get(r, "/metrics", nil)
+	asserts.Equal(http.StatusUnauthorized, w.Code)
+	asserts.Empty(w.Body.String())
+	w = get(r, "/metrics", http.Header{"Authorization": {"Bearer wrong"}})
+	asserts.Equal(http.StatusUnauthorized, w.Code)
+	w = get(r, "/metrics", http.Header{"Authorization": {"Bearer scrape-token"}})
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.True(strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain"), "should be the Prometheus text format")
+	asserts.Contains(w.Body.String(), "realworld_users_registered_total")
+}
+
+func TestRegisterDB(t *testing.T) {
+	asserts := assert.New(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	asserts.NoError(err)
+	defer db.Close()
+	asserts.NoError(db.Ping())
+
+	asserts.NoError(RegisterDB(db))
+	body := get(newTestRouter(config.Default().Metrics), "/metrics", nil).Body.String()
+	asserts.Contains(body, `go_sql_open_connections{db_name="realworld"} 1`)
+	asserts.Error(RegisterDB(db), "the pool should only be registered once")
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
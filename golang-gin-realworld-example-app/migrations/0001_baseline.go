@@ -0,0 +1,81 @@
+package migrations
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// The schema the users and articles modules had when they were still migrated by db.AutoMigrate.
+// It is written with AutoMigrate too, so an existing database of that time is adopted as it is.
+//
+// The structs are a frozen copy of the models with the columns only, plus the many2many
+// relationship which creates the article_tags join table. Their names give the table names.
+func init() {
+	register(Migration{
+		Version: 1,
+		Name:    "baseline",
+		Up: func(tx *gorm.DB) error {
+			type UserModel struct {
+				ID           uint    `gorm:"primary_key"`
+				Username     string  `gorm:"column:username"`
+				Email        string  `gorm:"column:email;size:255;unique_index"`
+				Bio          string  `gorm:"column:bio;size:1024"`
+				Image        *string `gorm:"column:image"`
+				PasswordHash string  `gorm:"column:password;not null"`
+			}
+			type FollowModel struct {
+				gorm.Model
+				FollowingID  uint
+				FollowedByID uint
+			}
+			type TagModel struct {
+				gorm.Model
+				Tag string `gorm:"size:255;unique_index"`
+			}
+			type ArticleModel struct {
+				gorm.Model
+				Slug        string `gorm:"size:255;unique_index"`
+				Title       string
+				Description string `gorm:"size:2048"`
+				Body        string `gorm:"size:2048"`
+				AuthorID    uint
+				Tags        []TagModel `gorm:"many2many:article_tags;"`
+			}
+			type ArticleUserModel struct {
+				gorm.Model
+				UserModelID uint
+			}
+			type FavoriteModel struct {
+				gorm.Model
+				FavoriteID   uint
+				FavoriteByID uint
+			}
+			type CommentModel struct {
+				gorm.Model
+				ArticleID uint
+				AuthorID  uint
+				Body      string `gorm:"size:2048"`
+			}
+			return tx.AutoMigrate(
+				&UserModel{},
+				&FollowModel{},
+				&TagModel{},
+				&ArticleModel{},
+				&ArticleUserModel{},
+				&FavoriteModel{},
+				&CommentModel{},
+			).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(
+				"comment_models",
+				"favorite_models",
+				"article_user_models",
+				"article_tags",
+				"article_models",
+				"tag_models",
+				"follow_models",
+				"user_models",
+			).Error
+		},
+	})
+}
@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// The foreign keys used by the lookups of the feed, the favorites, the comments and the followings.
+// AutoMigrate never created them, so every one of those queries was a full table scan.
+var lookupIndexes = []struct {
+	table   string
+	name    string
+	columns []string
+}{
+	{"article_models", "idx_article_models_author_id", []string{"author_id"}},
+	{"article_user_models", "idx_article_user_models_user_model_id", []string{"user_model_id"}},
+	{"comment_models", "idx_comment_models_article_id", []string{"article_id"}},
+	{"favorite_models", "idx_favorite_models_favorite_id", []string{"favorite_id"}},
+	{"favorite_models", "idx_favorite_models_favorite_by_id", []string{"favorite_by_id"}},
+	{"follow_models", "idx_follow_models_followed_by_id", []string{"followed_by_id"}},
+	{"follow_models", "idx_follow_models_following_id", []string{"following_id"}},
+}
+
+func init() {
+	register(Migration{
+		Version: 2,
+		Name:    "lookup_indexes",
+		Up: func(tx *gorm.DB) error {
+			for _, index := range lookupIndexes {
+				if err := tx.Table(index.table).AddIndex(index.name, index.columns...).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, index := range lookupIndexes {
+				if err := tx.Table(index.table).RemoveIndex(index.name).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
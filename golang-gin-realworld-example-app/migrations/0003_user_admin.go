@@ -0,0 +1,22 @@
+package migrations
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// The admin flag of the users, set by the `promote-admin` command.
+func init() {
+	register(Migration{
+		Version: 3,
+		Name:    "user_admin",
+		Up: func(tx *gorm.DB) error {
+			type UserModel struct {
+				Admin bool `gorm:"column:admin;not null;default:false"`
+			}
+			return tx.AutoMigrate(&UserModel{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Table("user_models").DropColumn("admin").Error
+		},
+	})
+}
@@ -0,0 +1,30 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The JWT signing keys of the keyring, managed by the `jwt-keys` command.
+func init() {
+	register(Migration{
+		Version: 4,
+		Name:    "signing_keys",
+		Up: func(tx *gorm.DB) error {
+			type SigningKey struct {
+				ID          uint   `gorm:"primary_key"`
+				KID         string `gorm:"column:kid;size:64;unique_index"`
+				Algorithm   string `gorm:"column:algorithm;size:16;not null"`
+				Secret      string `gorm:"column:secret;size:255;not null"`
+				CreatedAt   time.Time
+				ActivatedAt *time.Time
+				RetiredAt   *time.Time
+			}
+			return tx.AutoMigrate(&SigningKey{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("signing_keys").Error
+		},
+	})
+}
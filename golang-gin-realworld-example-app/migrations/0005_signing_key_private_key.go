@@ -0,0 +1,22 @@
+package migrations
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// The PEM private key of the RS256, ES256 and EdDSA signing keys, it doesn't fit in secret.
+func init() {
+	register(Migration{
+		Version: 5,
+		Name:    "signing_key_private_key",
+		Up: func(tx *gorm.DB) error {
+			type SigningKey struct {
+				PrivateKey string `gorm:"column:private_key;type:text"`
+			}
+			return tx.AutoMigrate(&SigningKey{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Table("signing_keys").DropColumn("private_key").Error
+		},
+	})
+}
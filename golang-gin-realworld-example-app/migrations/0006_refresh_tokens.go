@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The refresh tokens of the users, only their sha256 is stored.
+func init() {
+	register(Migration{
+		Version: 6,
+		Name:    "refresh_tokens",
+		Up: func(tx *gorm.DB) error {
+			type RefreshTokenModel struct {
+				ID          uint   `gorm:"primary_key"`
+				UserModelID uint   `gorm:"index;not null"`
+				FamilyID    string `gorm:"column:family_id;size:32;index;not null"`
+				TokenHash   string `gorm:"column:token_hash;size:64;unique_index;not null"`
+				CreatedAt   time.Time
+				ExpiresAt   time.Time
+				UsedAt      *time.Time
+				RevokedAt   *time.Time
+			}
+			return tx.AutoMigrate(&RefreshTokenModel{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("refresh_token_models").Error
+		},
+	})
+}
@@ -0,0 +1,30 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The revoked access tokens, sessions and users of the logouts. A row is only needed until
+// the tokens it revokes have expired.
+func init() {
+	register(Migration{
+		Version: 7,
+		Name:    "revocations",
+		Up: func(tx *gorm.DB) error {
+			type RevocationModel struct {
+				ID          uint   `gorm:"primary_key"`
+				Kind        string `gorm:"column:kind;size:8;not null"`
+				Value       string `gorm:"column:value;size:64;not null"`
+				UserModelID uint   `gorm:"index;not null"`
+				CreatedAt   time.Time
+				ExpiresAt   time.Time `gorm:"index"`
+			}
+			return tx.AutoMigrate(&RevocationModel{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("revocation_models").Error
+		},
+	})
+}
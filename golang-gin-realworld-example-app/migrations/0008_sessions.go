@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The sessions of the users, one per login. The ID is the refresh token family of the login.
+func init() {
+	register(Migration{
+		Version: 8,
+		Name:    "sessions",
+		Up: func(tx *gorm.DB) error {
+			type SessionModel struct {
+				ID          string `gorm:"primary_key;size:32"`
+				UserModelID uint   `gorm:"index;not null"`
+				IP          string `gorm:"column:ip;size:45"`
+				UserAgent   string `gorm:"column:user_agent;size:255"`
+				CreatedAt   time.Time
+				LastSeenAt  time.Time
+				ExpiresAt   time.Time
+				RevokedAt   *time.Time
+			}
+			return tx.AutoMigrate(&SessionModel{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("session_models").Error
+		},
+	})
+}
@@ -0,0 +1,29 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The tokens of the password reset mails, only their sha256 is saved.
+func init() {
+	register(Migration{
+		Version: 9,
+		Name:    "password_resets",
+		Up: func(tx *gorm.DB) error {
+			type PasswordResetModel struct {
+				ID          uint   `gorm:"primary_key"`
+				UserModelID uint   `gorm:"index;not null"`
+				TokenHash   string `gorm:"column:token_hash;size:64;unique_index;not null"`
+				CreatedAt   time.Time
+				ExpiresAt   time.Time
+				UsedAt      *time.Time
+			}
+			return tx.AutoMigrate(&PasswordResetModel{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("password_reset_models").Error
+		},
+	})
+}
@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The verified state of the emails and the tokens of the verification mails. The users
+// registered until now have an unverified email.
+func init() {
+	register(Migration{
+		Version: 10,
+		Name:    "email_verifications",
+		Up: func(tx *gorm.DB) error {
+			type UserModel struct {
+				EmailVerifiedAt *time.Time `gorm:"column:email_verified_at"`
+			}
+			type EmailVerificationModel struct {
+				ID          uint   `gorm:"primary_key"`
+				UserModelID uint   `gorm:"index;not null"`
+				Email       string `gorm:"column:email;size:255;not null"`
+				TokenHash   string `gorm:"column:token_hash;size:64;unique_index;not null"`
+				CreatedAt   time.Time
+				ExpiresAt   time.Time
+				UsedAt      *time.Time
+			}
+			return tx.AutoMigrate(&UserModel{}, &EmailVerificationModel{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.DropTableIfExists("email_verification_models").Error; err != nil {
+				return err
+			}
+			return tx.Table("user_models").DropColumn("email_verified_at").Error
+		},
+	})
+}
@@ -0,0 +1,27 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The failed logins by email and by client IP, for the login delays and lockouts.
+func init() {
+	register(Migration{
+		Version: 11,
+		Name:    "login_failures",
+		Up: func(tx *gorm.DB) error {
+			type LoginFailureModel struct {
+				Key           string `gorm:"column:login_key;primary_key;size:300"`
+				Failures      int    `gorm:"not null"`
+				LastFailureAt time.Time
+				LockedUntil   *time.Time
+			}
+			return tx.AutoMigrate(&LoginFailureModel{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("login_failure_models").Error
+		},
+	})
+}
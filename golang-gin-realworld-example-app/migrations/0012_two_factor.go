@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The TOTP secrets, the recovery codes and the login challenges of the two-factor authentication.
+func init() {
+	register(Migration{
+		Version: 12,
+		Name:    "two_factor",
+		Up: func(tx *gorm.DB) error {
+			type TwoFactorModel struct {
+				ID          uint   `gorm:"primary_key"`
+				UserModelID uint   `gorm:"unique_index;not null"`
+				Secret      string `gorm:"column:secret;size:32;not null"`
+				LastStep    int64  `gorm:"not null"`
+				CreatedAt   time.Time
+				EnabledAt   *time.Time
+			}
+			type RecoveryCodeModel struct {
+				ID          uint   `gorm:"primary_key"`
+				UserModelID uint   `gorm:"index;not null"`
+				CodeHash    string `gorm:"column:code_hash;size:64;not null"`
+				UsedAt      *time.Time
+			}
+			type TwoFactorChallengeModel struct {
+				ID          uint   `gorm:"primary_key"`
+				UserModelID uint   `gorm:"index;not null"`
+				TokenHash   string `gorm:"column:token_hash;size:64;unique_index;not null"`
+				Attempts    int    `gorm:"not null"`
+				CreatedAt   time.Time
+				ExpiresAt   time.Time
+				UsedAt      *time.Time
+			}
+			return tx.AutoMigrate(&TwoFactorModel{}, &RecoveryCodeModel{}, &TwoFactorChallengeModel{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("two_factor_challenge_models", "recovery_code_models", "two_factor_models").Error
+		},
+	})
+}
@@ -0,0 +1,29 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The tokens of the login links mailed for the passwordless logins.
+func init() {
+	register(Migration{
+		Version: 13,
+		Name:    "magic_links",
+		Up: func(tx *gorm.DB) error {
+			type MagicLinkModel struct {
+				ID          uint   `gorm:"primary_key"`
+				UserModelID uint   `gorm:"index;not null"`
+				TokenHash   string `gorm:"column:token_hash;size:64;unique_index;not null"`
+				CreatedAt   time.Time
+				ExpiresAt   time.Time
+				UsedAt      *time.Time
+			}
+			return tx.AutoMigrate(&MagicLinkModel{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("magic_link_models").Error
+		},
+	})
+}
@@ -0,0 +1,42 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The identities of the users at the OpenID Connect provider, and the logins started there.
+func init() {
+	register(Migration{
+		Version: 14,
+		Name:    "oidc",
+		Up: func(tx *gorm.DB) error {
+			type OIDCIdentityModel struct {
+				ID          uint   `gorm:"primary_key"`
+				UserModelID uint   `gorm:"index;not null"`
+				Issuer      string `gorm:"column:issuer;size:255;not null;unique_index:idx_oidc_identity"`
+				Subject     string `gorm:"column:subject;size:255;not null;unique_index:idx_oidc_identity"`
+				Email       string `gorm:"column:email;size:255"`
+				CreatedAt   time.Time
+				LastLoginAt time.Time
+			}
+			type OIDCStateModel struct {
+				ID        uint   `gorm:"primary_key"`
+				StateHash string `gorm:"column:state_hash;size:64;unique_index;not null"`
+				Nonce     string `gorm:"column:nonce;size:64;not null"`
+				Verifier  string `gorm:"column:verifier;size:64;not null"`
+				CreatedAt time.Time
+				ExpiresAt time.Time
+			}
+			// The tables are named like users.OIDCIdentityModel.TableName names them.
+			if err := tx.Table("oidc_identity_models").AutoMigrate(&OIDCIdentityModel{}).Error; err != nil {
+				return err
+			}
+			return tx.Table("oidc_state_models").AutoMigrate(&OIDCStateModel{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("oidc_state_models", "oidc_identity_models").Error
+		},
+	})
+}
@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The personal access tokens of the users, for the API automation.
+func init() {
+	register(Migration{
+		Version: 15,
+		Name:    "personal_access_tokens",
+		Up: func(tx *gorm.DB) error {
+			type PersonalAccessTokenModel struct {
+				ID          uint   `gorm:"primary_key"`
+				UserModelID uint   `gorm:"index;not null"`
+				Name        string `gorm:"column:name;size:100;not null"`
+				TokenHash   string `gorm:"column:token_hash;size:64;unique_index;not null"`
+				Scopes      string `gorm:"column:scopes;size:255;not null"`
+				CreatedAt   time.Time
+				ExpiresAt   *time.Time
+				LastUsedAt  *time.Time
+			}
+			return tx.AutoMigrate(&PersonalAccessTokenModel{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("personal_access_token_models").Error
+		},
+	})
+}
@@ -0,0 +1,62 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The roles and their permissions, the users of the admin flag of 0003 get the admin role.
+func init() {
+	register(Migration{
+		Version: 16,
+		Name:    "roles",
+		Up: func(tx *gorm.DB) error {
+			type RoleModel struct {
+				ID   uint   `gorm:"primary_key"`
+				Name string `gorm:"column:name;size:32;unique_index;not null"`
+			}
+			type RolePermissionModel struct {
+				ID          uint   `gorm:"primary_key"`
+				RoleModelID uint   `gorm:"not null;unique_index:idx_role_permission"`
+				Permission  string `gorm:"column:permission;size:64;not null;unique_index:idx_role_permission"`
+			}
+			type UserRoleModel struct {
+				ID          uint `gorm:"primary_key"`
+				UserModelID uint `gorm:"not null;unique_index:idx_user_role"`
+				RoleModelID uint `gorm:"not null;unique_index:idx_user_role;index"`
+				CreatedAt   time.Time
+			}
+			if err := tx.AutoMigrate(&RoleModel{}, &RolePermissionModel{}, &UserRoleModel{}).Error; err != nil {
+				return err
+			}
+			roles := []struct {
+				name        string
+				permissions []string
+			}{
+				{"admin", []string{"articles:moderate", "comments:moderate", "roles:manage"}},
+				{"moderator", []string{"articles:moderate", "comments:moderate"}},
+			}
+			for _, r := range roles {
+				role := RoleModel{Name: r.name}
+				if err := tx.Create(&role).Error; err != nil {
+					return err
+				}
+				for _, permission := range r.permissions {
+					if err := tx.Create(&RolePermissionModel{RoleModelID: role.ID, Permission: permission}).Error; err != nil {
+						return err
+					}
+				}
+			}
+			var admin RoleModel
+			if err := tx.Where("name = ?", "admin").First(&admin).Error; err != nil {
+				return err
+			}
+			return tx.Exec("INSERT INTO user_role_models (user_model_id, role_model_id, created_at) "+
+				"SELECT id, ?, ? FROM user_models WHERE admin = ?", admin.ID, time.Now(), true).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("user_role_models", "role_permission_models", "role_models").Error
+		},
+	})
+}
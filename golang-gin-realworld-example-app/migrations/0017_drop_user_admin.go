@@ -0,0 +1,29 @@
+package migrations
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// The admin flag of 0003 is left behind by the roles of 0016, drop it. Down adds it back for the
+// users with the admin role, so an older server finds its admins again.
+func init() {
+	register(Migration{
+		Version: 17,
+		Name:    "drop_user_admin",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table("user_models").DropColumn("admin").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			type UserModel struct {
+				Admin bool `gorm:"column:admin;not null;default:false"`
+			}
+			if err := tx.AutoMigrate(&UserModel{}).Error; err != nil {
+				return err
+			}
+			return tx.Exec("UPDATE user_models SET admin = ? WHERE id IN ("+
+				"SELECT user_role_models.user_model_id FROM user_role_models "+
+				"JOIN role_models ON role_models.id = user_role_models.role_model_id WHERE role_models.name = ?)",
+				true, "admin").Error
+		},
+	})
+}
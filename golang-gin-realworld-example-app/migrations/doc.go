@@ -0,0 +1,8 @@
+/*
+The migrations module containing the versioned, reversible changes of the database schema.
+
+migrations.go: the runner, it records the applied versions in the schema_migrations table
+
+0001_baseline.go, 0002_...: one numbered migration per file, each with an Up and a Down step
+*/
+package migrations
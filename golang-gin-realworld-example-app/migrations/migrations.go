@@ -0,0 +1,171 @@
+package migrations
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// A numbered change of the schema, Down should revert exactly what Up did.
+//
+// A migration is frozen once it is released: never edit it, add a new one instead.
+// That is also why they don't use the models of the other modules, a model changes over time.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// The record of an applied migration.
+type SchemaMigration struct {
+	Version   int64 `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// A migration with its state in the database, it is what `migrate status` prints.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+var registry []Migration
+
+// Every migration file registers itself in its init().
+func register(m Migration) {
+	for _, other := range registry {
+		if other.Version == m.Version {
+			panic(fmt.Sprintf("migrations: version %d is registered twice", m.Version))
+		}
+	}
+	registry = append(registry, m)
+	sort.Slice(registry, func(i, j int) bool { return registry[i].Version < registry[j].Version })
+}
+
+// All the known migrations, ordered by version.
+func All() []Migration {
+	return append([]Migration(nil), registry...)
+}
+
+// The records of the applied migrations, it only reads: without the schema_migrations table
+// nothing is applied yet, Up creates the table.
+func applied(db *gorm.DB) (map[int64]SchemaMigration, error) {
+	if !db.HasTable(&SchemaMigration{}) {
+		return map[int64]SchemaMigration{}, nil
+	}
+	var records []SchemaMigration
+	if err := db.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	ret := make(map[int64]SchemaMigration, len(records))
+	for _, record := range records {
+		ret[record.Version] = record
+	}
+	return ret, nil
+}
+
+// You could get the state of every known migration.
+//
+//	statuses, err := migrations.Status(db)
+func Status(db *gorm.DB) ([]MigrationStatus, error) {
+	done, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	var ret []MigrationStatus
+	for _, m := range registry {
+		record, ok := done[m.Version]
+		ret = append(ret, MigrationStatus{Migration: m, Applied: ok, AppliedAt: record.AppliedAt})
+	}
+	return ret, nil
+}
+
+// The migrations which are not applied yet, an empty list means the schema is current.
+// Like Status it doesn't write, e.g. for the readiness probe.
+func Pending(db *gorm.DB) ([]Migration, error) {
+	statuses, err := Status(db)
+	if err != nil {
+		return nil, err
+	}
+	var ret []Migration
+	for _, status := range statuses {
+		if !status.Applied {
+			ret = append(ret, status.Migration)
+		}
+	}
+	return ret, nil
+}
+
+// Apply the pending migrations in order, each one in its own transaction.
+// It stops at the first error and returns the migrations applied before it.
+//
+//	applied, err := migrations.Up(db)
+func Up(db *gorm.DB) ([]Migration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}).Error; err != nil {
+		return nil, err
+	}
+	pending, err := Pending(db)
+	if err != nil {
+		return nil, err
+	}
+	var ret []Migration
+	for _, m := range pending {
+		err := run(db, m.Up, func(tx *gorm.DB) error {
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now().UTC()}).Error
+		})
+		if err != nil {
+			return ret, fmt.Errorf("migrations: up %04d_%s: %w", m.Version, m.Name, err)
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+// Revert the last `steps` applied migrations, newest first.
+//
+//	reverted, err := migrations.Down(db, 1)
+func Down(db *gorm.DB, steps int) ([]Migration, error) {
+	statuses, err := Status(db)
+	if err != nil {
+		return nil, err
+	}
+	var ret []Migration
+	for i := len(statuses) - 1; i >= 0 && len(ret) < steps; i-- {
+		m := statuses[i].Migration
+		if !statuses[i].Applied {
+			continue
+		}
+		err := run(db, m.Down, func(tx *gorm.DB) error {
+			return tx.Delete(&SchemaMigration{Version: m.Version}).Error
+		})
+		if err != nil {
+			return ret, fmt.Errorf("migrations: down %04d_%s: %w", m.Version, m.Name, err)
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+func run(db *gorm.DB, step func(tx *gorm.DB) error, record func(tx *gorm.DB) error) error {
+	tx := db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	if err := step(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := record(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,182 @@
+package migrations
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+var test_db *gorm.DB
+
+// The current models, the schema written by the migrations should have all of their columns.
+var models = []interface{}{
+	&users.UserModel{},
+	&users.FollowModel{},
+	&articles.ArticleModel{},
+	&articles.TagModel{},
+	&articles.FavoriteModel{},
+	&articles.ArticleUserModel{},
+	&articles.CommentModel{},
+	&users.OIDCIdentityModel{},
+	&users.OIDCStateModel{},
+	&users.RoleModel{},
+	&users.RolePermissionModel{},
+	&users.UserRoleModel{},
+	&users.RefreshTokenModel{},
+	&users.RevocationModel{},
+	&users.SessionModel{},
+	&users.PasswordResetModel{},
+	&users.EmailVerificationModel{},
+	&users.LoginFailureModel{},
+	&users.TwoFactorModel{},
+	&users.RecoveryCodeModel{},
+	&users.TwoFactorChallengeModel{},
+	&users.MagicLinkModel{},
+	&users.PersonalAccessTokenModel{},
+}
+
+func resetDB() {
+	common.TestDBFree(test_db)
+	test_db = common.TestDBInit()
+}
+
+func TestRegistry(t *testing.T) {
+	asserts := assert.New(t)
+
+	all := All()
+	asserts.NotEmpty(all)
+	for i, m := range all {
+		asserts.Equal(int64(i+1), m.Version, "versions should be numbered without gaps")
+		asserts.NotEmpty(m.Name)
+		asserts.NotNil(m.Up, "every migration should have an up step")
+		asserts.NotNil(m.Down, "every migration should have a down step")
+	}
+	asserts.Panics(func() { register(Migration{Version: 1, Name: "duplicate"}) }, "a version should not be registered twice")
+}
+
+func TestUpDown(t *testing.T) {
+	asserts := assert.New(t)
+	resetDB()
+
+	pending, err := Pending(test_db)
+	asserts.NoError(err)
+	asserts.Len(pending, len(All()), "everything should be pending on an empty database")
+	asserts.False(test_db.HasTable("schema_migrations"), "pending should only read")
+	reverted, err := Down(test_db, 1)
+	asserts.NoError(err)
+	asserts.Len(reverted, 0, "down should be a no-op on an empty database")
+
+	applied, err := Up(test_db)
+	asserts.NoError(err)
+	asserts.Len(applied, len(All()))
+	asserts.True(test_db.HasTable("schema_migrations"))
+	asserts.True(test_db.Dialect().HasIndex("article_models", "idx_article_models_author_id"))
+
+	applied, err = Up(test_db)
+	asserts.NoError(err)
+	asserts.Len(applied, 0, "up should be a no-op when the schema is current")
+
+	statuses, err := Status(test_db)
+	asserts.NoError(err)
+	for _, s := range statuses {
+		asserts.True(s.Applied, "migration %d should be applied", s.Version)
+		asserts.False(s.AppliedAt.IsZero())
+	}
+
+	reverted, err = Down(test_db, 1)
+	asserts.NoError(err)
+	asserts.Len(reverted, 1)
+	asserts.Equal(All()[len(All())-1].Version, reverted[0].Version, "down should revert the newest migration first")
+	pending, err = Pending(test_db)
+	asserts.NoError(err)
+	asserts.Len(pending, 1)
+
+	reverted, err = Down(test_db, len(All()))
+	asserts.NoError(err)
+	asserts.Len(reverted, len(All())-1, "down should only revert applied migrations")
+	for _, model := range models {
+		asserts.False(test_db.HasTable(model), "down should drop every table")
+	}
+
+	_, err = Up(test_db)
+	asserts.NoError(err, "up should work again after everything was reverted")
+}
+
+func TestBaselineMatchesModels(t *testing.T) {
+	asserts := assert.New(t)
+	resetDB()
+
+	_, err := Up(test_db)
+	asserts.NoError(err)
+	for _, model := range models {
+		scope := test_db.NewScope(model)
+		asserts.True(test_db.HasTable(model), "table %v should exist", scope.TableName())
+		for _, field := range scope.GetModelStruct().StructFields {
+			if field.IsIgnored || !field.IsNormal {
+				continue
+			}
+			asserts.True(test_db.Dialect().HasColumn(scope.TableName(), field.DBName),
+				"column %v.%v should exist, add a migration when a model changes", scope.TableName(), field.DBName)
+		}
+	}
+	asserts.True(test_db.HasTable("article_tags"), "the many2many join table should exist")
+}
+
+func TestBaselineAdoptsAutoMigratedDatabase(t *testing.T) {
+	asserts := assert.New(t)
+	resetDB()
+
+	// The way the server created its schema before the migrations.
+	test_db.AutoMigrate(models...)
+	user := users.UserModel{Username: "user1", Email: "user1@linkedin.com", PasswordHash: "hash"}
+	asserts.NoError(test_db.Create(&user).Error)
+
+	_, err := Up(test_db)
+	asserts.NoError(err, "baseline should accept the existing tables")
+	var count int
+	test_db.Model(&users.UserModel{}).Count(&count)
+	asserts.Equal(1, count, "baseline should keep the existing rows")
+}
+
+func TestRolesAdoptAdmins(t *testing.T) {
+	asserts := assert.New(t)
+	resetDB()
+
+	_, err := Up(test_db)
+	asserts.NoError(err)
+	asserts.False(test_db.Dialect().HasColumn("user_models", "admin"), "the admin flag should be dropped")
+	// Back to the admin flag, before the roles.
+	_, err = Down(test_db, 2)
+	asserts.NoError(err)
+	asserts.NoError(test_db.Exec("INSERT INTO user_models (username, email, password, admin) VALUES (?, ?, ?, ?), (?, ?, ?, ?)",
+		"user1", "user1@linkedin.com", "hash", true, "user2", "user2@linkedin.com", "hash", false).Error)
+
+	_, err = Up(test_db)
+	asserts.NoError(err)
+	var admins []string
+	test_db.Table("user_models").
+		Joins("JOIN user_role_models ON user_role_models.user_model_id = user_models.id").
+		Joins("JOIN role_models ON role_models.id = user_role_models.role_model_id").
+		Where("role_models.name = ?", users.RoleAdmin).Pluck("user_models.username", &admins)
+	asserts.Equal([]string{"user1"}, admins, "the admin flag should become the admin role")
+	asserts.False(test_db.Dialect().HasColumn("user_models", "admin"))
+
+	_, err = Down(test_db, 1)
+	asserts.NoError(err)
+	admins = nil
+	test_db.Table("user_models").Where("admin = ?", true).Pluck("username", &admins)
+	asserts.Equal([]string{"user1"}, admins, "down should give the admin flag back to the admins")
+}
+
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
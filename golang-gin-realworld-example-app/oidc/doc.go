@@ -0,0 +1,10 @@
+/*
+The oidc module, the OpenID Connect client of the social login of the users module.
+
+oidc.go: the Provider of the config, its discovery document and the authorization code flow with PKCE
+
+verify.go: the verification of the ID tokens against the keys of the provider
+
+oidctest: an in-process provider for the tests
+*/
+package oidc
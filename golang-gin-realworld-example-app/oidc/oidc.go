@@ -0,0 +1,216 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"realworld-backend/config"
+)
+
+// The longest a request to the provider may take.
+const httpTimeout = 10 * time.Second
+
+// The endpoints of the provider, from its discovery document.
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// The error of the token endpoint, e.g. invalid_grant for a used or expired code.
+type TokenError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *TokenError) Error() string {
+	if e.Description == "" {
+		return "oidc: token endpoint: " + e.Code
+	}
+	return "oidc: token endpoint: " + e.Code + ": " + e.Description
+}
+
+// Provider is the client of an OpenID Connect provider. The discovery document is fetched on
+// the first login and kept, the keys are fetched again when a token has an unknown kid.
+type Provider struct {
+	cfg    config.OIDCConfig
+	client *http.Client
+	now    func() time.Time
+
+	mu        sync.Mutex
+	discovery *Discovery
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+}
+
+// The Provider of the oidc section of the config.
+//
+//	oidc.Set(oidc.New(cfg.OIDC))
+func New(cfg config.OIDCConfig) *Provider {
+	return &Provider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: httpTimeout},
+		now:    time.Now,
+	}
+}
+
+// The issuer as configured, without the trailing slash.
+func (p *Provider) Issuer() string {
+	return strings.TrimSuffix(p.cfg.Issuer, "/")
+}
+
+// Whether a login of an unknown identity creates its account, oidc.allow_signup.
+func (p *Provider) AllowSignup() bool {
+	return p.cfg.AllowSignup
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("oidc: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return fmt.Errorf("oidc: GET %s: %w", url, err)
+	}
+	return nil
+}
+
+// The discovery document of the provider, its issuer has to be the configured one.
+func (p *Provider) Discover(ctx context.Context) (Discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return *p.discovery, nil
+	}
+	var discovery Discovery
+	if err := p.getJSON(ctx, p.Issuer()+"/.well-known/openid-configuration", &discovery); err != nil {
+		return discovery, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.Issuer() {
+		return discovery, fmt.Errorf("oidc: the discovery document is of the issuer %q", discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return discovery, errors.New("oidc: the discovery document misses an endpoint")
+	}
+	p.discovery = &discovery
+	return discovery, nil
+}
+
+// The code challenge of the verifier for the S256 method of PKCE (RFC 7636).
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// The URL of the provider to send the user to. The state comes back with the code to the
+// redirect_url, the nonce in the ID token, and the verifier goes with the code to Exchange.
+//
+//	url, err := provider.AuthCodeURL(ctx, state, nonce, verifier)
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	discovery, err := p.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {CodeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// You could trade the code of the redirect for the ID token of the user, see Verify.
+//
+//	idToken, err := provider.Exchange(ctx, code, verifier)
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string) (string, error) {
+	discovery, err := p.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		TokenError
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("oidc: token endpoint: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Code != "" {
+		if body.Code == "" {
+			body.Code = resp.Status
+		}
+		return "", &body.TokenError
+	}
+	if body.IDToken == "" {
+		return "", errors.New("oidc: token endpoint: no id_token, is the openid scope asked for?")
+	}
+	return body.IDToken, nil
+}
+
+var (
+	mu       sync.RWMutex
+	provider *Provider
+)
+
+// The Provider of the server, nil while the OIDC login is off.
+func Get() *Provider {
+	mu.RLock()
+	defer mu.RUnlock()
+	return provider
+}
+
+func Set(p *Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	provider = p
+}
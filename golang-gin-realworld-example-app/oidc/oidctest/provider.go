@@ -0,0 +1,257 @@
+// Package oidctest runs an OpenID Connect provider in the process, like net/http/httptest runs
+// a server, so the login with a provider is tested without a real one:
+//
+//	provider := oidctest.NewProvider("realworld", "secret")
+//	defer provider.Close()
+//	provider.User = oidctest.User{Subject: "1234", Email: "jake@jake.jake", EmailVerified: true}
+//	code, state, err := provider.Authorize(authCodeURL)
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"realworld-backend/common"
+	"realworld-backend/config"
+)
+
+// The account logged in at the provider, the claims of the next ID tokens.
+type User struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// An authorization code with what the token endpoint checks it against.
+type grant struct {
+	user        User
+	redirectURI string
+	challenge   string
+	nonce       string
+}
+
+// Provider is the in-process provider. It approves every authorization for User at once,
+// and checks the client, the redirect_uri and the PKCE verifier of the codes.
+type Provider struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+	KeyID        string
+	User         User
+	// The lifetime of the ID tokens.
+	TokenLifetime time.Duration
+
+	key    *rsa.PrivateKey
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+func NewProvider(clientID string, clientSecret string) *Provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	p := &Provider{
+		ClientID:      clientID,
+		ClientSecret:  clientSecret,
+		KeyID:         "oidctest",
+		TokenLifetime: time.Hour,
+		key:           key,
+		grants:        map[string]grant{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("GET /authorize", p.authorize)
+	mux.HandleFunc("POST /token", p.token)
+	mux.HandleFunc("GET /jwks", p.jwks)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// The oidc section of a config for the provider.
+func (p *Provider) Config(redirectURL string) config.OIDCConfig {
+	return config.OIDCConfig{
+		Enabled:      true,
+		Issuer:       p.URL,
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+		AllowSignup:  true,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.URL,
+		"authorization_endpoint":                p.URL + "/authorize",
+		"token_endpoint":                        p.URL + "/token",
+		"jwks_uri":                              p.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	jwk, err := common.NewJWK(p.KeyID, "RS256", &p.key.PublicKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, common.JWKSet{Keys: []common.JWK{jwk}})
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The S256 code challenge of PKCE.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	switch {
+	case query.Get("client_id") != p.ClientID:
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	case err != nil || redirectURI.Host == "":
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	case query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "":
+		http.Error(w, "the code flow with PKCE S256 is expected", http.StatusBadRequest)
+		return
+	}
+	code := randomString()
+	p.mu.Lock()
+	p.grants[code] = grant{user: p.User, redirectURI: redirectURI.String(), challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+	p.mu.Unlock()
+	back := redirectURI.Query()
+	back.Set("code", code)
+	back.Set("state", query.Get("state"))
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	invalid := func(code string, description string) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID, _ = url.QueryUnescape(clientID); clientID != p.ClientID {
+		invalid("invalid_client", "unknown client")
+		return
+	}
+	if clientSecret, _ = url.QueryUnescape(clientSecret); p.ClientSecret != "" && clientSecret != p.ClientSecret {
+		invalid("invalid_client", "wrong client secret")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		invalid("unsupported_grant_type", "")
+		return
+	}
+	p.mu.Lock()
+	code := r.PostFormValue("code")
+	grant, ok := p.grants[code]
+	// A code works once.
+	delete(p.grants, code)
+	p.mu.Unlock()
+	switch {
+	case !ok:
+		invalid("invalid_grant", "unknown or used code")
+		return
+	case r.PostFormValue("redirect_uri") != grant.redirectURI:
+		invalid("invalid_grant", "redirect_uri mismatch")
+		return
+	case codeChallenge(r.PostFormValue("code_verifier")) != grant.challenge:
+		invalid("invalid_grant", "PKCE verification failed")
+		return
+	}
+	idToken, err := p.IDToken(grant.user, grant.nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// An ID token of the provider for the user, as the token endpoint gives it.
+func (p *Provider) IDToken(user User, nonce string) (string, error) {
+	now := time.Now()
+	return p.Sign(jwt.MapClaims{
+		"iss":                p.URL,
+		"sub":                user.Subject,
+		"aud":                p.ClientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(p.TokenLifetime).Unix(),
+		"nonce":              nonce,
+		"email":              user.Email,
+		"email_verified":     user.EmailVerified,
+		"name":               user.Name,
+		"preferred_username": user.PreferredUsername,
+	})
+}
+
+// Any claims signed by the key of the provider, e.g. an ID token with a wrong audience.
+func (p *Provider) Sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = p.KeyID
+	return token.SignedString(p.key)
+}
+
+// Play the browser of the user at the authorization URL: the code and the state of the
+// redirect the provider answers with.
+func (p *Provider) Authorize(authCodeURL string) (string, string, error) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authCodeURL)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		return "", "", fmt.Errorf("oidctest: authorize: %s", resp.Status)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", "", err
+	}
+	query := location.Query()
+	if query.Get("code") == "" {
+		return "", "", errors.New("oidctest: authorize: no code in the redirect")
+	}
+	return query.Get("code"), query.Get("state"), nil
+}
@@ -0,0 +1,123 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+
+	"realworld-backend/oidc/oidctest"
+)
+
+func TestProvider(t *testing.T) {
+	asserts := assert.New(t)
+	ctx := context.Background()
+	mock := oidctest.NewProvider("realworld", "s3cret&more")
+	defer mock.Close()
+	mock.User = oidctest.User{Subject: "248289761001", Email: "jane@example.com", EmailVerified: true, Name: "Jane Doe"}
+	p := New(mock.Config("https://app.example.com/oidc/callback"))
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	asserts.Equal("E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", CodeChallenge(verifier), "the example of RFC 7636")
+	authURL, err := p.AuthCodeURL(ctx, "state1", "nonce1", verifier)
+	asserts.NoError(err)
+	parsed, _ := url.Parse(authURL)
+	asserts.Equal(mock.URL+"/authorize", parsed.Scheme+"://"+parsed.Host+parsed.Path)
+	query := parsed.Query()
+	asserts.Equal("openid email profile", query.Get("scope"))
+	asserts.Equal("S256", query.Get("code_challenge_method"))
+	asserts.Equal(CodeChallenge(verifier), query.Get("code_challenge"))
+	asserts.Equal("https://app.example.com/oidc/callback", query.Get("redirect_uri"))
+
+	code, state, err := mock.Authorize(authURL)
+	asserts.NoError(err)
+	asserts.Equal("state1", state)
+	_, err = p.Exchange(ctx, code, "another verifier of the right length, 43 chars")
+	var tokenErr *TokenError
+	if asserts.ErrorAs(err, &tokenErr) {
+		asserts.Equal("invalid_grant", tokenErr.Code, "the code should need its verifier")
+	}
+
+	code, _, _ = mock.Authorize(authURL)
+	idToken, err := p.Exchange(ctx, code, verifier)
+	asserts.NoError(err)
+	claims, err := p.Verify(ctx, idToken, "nonce1")
+	asserts.NoError(err)
+	asserts.Equal("248289761001", claims.Subject)
+	asserts.Equal("jane@example.com", claims.Email)
+	asserts.True(bool(claims.EmailVerified))
+	asserts.Equal("Jane Doe", claims.Name)
+	_, err = p.Verify(ctx, idToken, "nonce2")
+	asserts.ErrorIs(err, ErrInvalidIDToken, "the nonce should be the one of the login")
+	_, err = p.Exchange(ctx, code, verifier)
+	asserts.ErrorAs(err, &tokenErr, "a code should work once")
+
+	// The client authenticates with its secret.
+	wrongSecret := mock.Config("https://app.example.com/oidc/callback")
+	wrongSecret.ClientSecret = "guess"
+	code, _, _ = mock.Authorize(authURL)
+	_, err = New(wrongSecret).Exchange(ctx, code, verifier)
+	if asserts.ErrorAs(err, &tokenErr) {
+		asserts.Equal("invalid_client", tokenErr.Code)
+	}
+
+	now := time.Now()
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{"iss": mock.URL, "sub": "1", "aud": "realworld", "iat": now.Unix(), "exp": now.Add(time.Minute).Unix(), "nonce": "n"}
+	}
+	for msg, change := range map[string]func(jwt.MapClaims){
+		"another issuer":        func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" },
+		"another audience":      func(c jwt.MapClaims) { c["aud"] = "another-client" },
+		"an expired token":      func(c jwt.MapClaims) { c["exp"] = now.Add(-2 * time.Minute).Unix() },
+		"no expiration":         func(c jwt.MapClaims) { delete(c, "exp") },
+		"no subject":            func(c jwt.MapClaims) { delete(c, "sub") },
+		"another party":         func(c jwt.MapClaims) { c["aud"] = []string{"realworld", "another-client"}; c["azp"] = "another-client" },
+		"a token of the future": func(c jwt.MapClaims) { c["iat"] = now.Add(time.Hour).Unix() },
+	} {
+		claims := valid()
+		change(claims)
+		token, _ := mock.Sign(claims)
+		_, err := p.Verify(ctx, token, "n")
+		asserts.ErrorIs(err, ErrInvalidIDToken, "%s should be refused", msg)
+	}
+	token, _ := mock.Sign(valid())
+	_, err = p.Verify(ctx, token, "n")
+	asserts.NoError(err)
+
+	// An HMAC token with the client secret, and a token of an unknown key.
+	hmacToken := jwt.NewWithClaims(jwt.SigningMethodHS256, valid())
+	hmacToken.Header["kid"] = mock.KeyID
+	signed, _ := hmacToken.SignedString([]byte("s3cret&more"))
+	_, err = p.Verify(ctx, signed, "n")
+	asserts.ErrorIs(err, ErrInvalidIDToken)
+	mock.KeyID = "rotated"
+	token, _ = mock.Sign(valid())
+	_, err = p.Verify(ctx, token, "n")
+	asserts.ErrorContains(err, `unknown kid "rotated"`, "the keys should not be fetched again at once")
+	p.keysAt = now.Add(-keysRefresh)
+	_, err = p.Verify(ctx, token, "n")
+	asserts.NoError(err, "the keys should be fetched again for a rotated key")
+
+	// A provider which is down.
+	down := oidctest.NewProvider("realworld", "")
+	down.Close()
+	_, err = New(down.Config("https://app.example.com/oidc/callback")).AuthCodeURL(ctx, "s", "n", verifier)
+	asserts.Error(err)
+}
+
+func TestBool(t *testing.T) {
+	asserts := assert.New(t)
+	var claims struct {
+		A Bool `json:"a"`
+		B Bool `json:"b"`
+		C Bool `json:"c"`
+	}
+	asserts.NoError(json.Unmarshal([]byte(`{"a":true,"b":"true","c":"false"}`), &claims))
+	asserts.True(bool(claims.A))
+	asserts.True(bool(claims.B), "some providers send the string")
+	asserts.False(bool(claims.C))
+}
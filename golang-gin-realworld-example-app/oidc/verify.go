@@ -0,0 +1,112 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"realworld-backend/common"
+)
+
+// The signing algorithms accepted for the ID tokens, never the HMAC ones.
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "ES256", "EdDSA"}
+
+// The keys are fetched again for an unknown kid at most once a keysRefresh.
+const keysRefresh = time.Minute
+
+// The clocks of the provider and of the server may be apart by clockSkew.
+const clockSkew = time.Minute
+
+// The email_verified claim: a JSON boolean, or the string "true" for some providers.
+type Bool bool
+
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	*b = string(data) == "true" || string(data) == `"true"`
+	return nil
+}
+
+// The claims of an ID token used by the users module.
+type Claims struct {
+	jwt.RegisteredClaims
+	Nonce             string `json:"nonce"`
+	AuthorizedParty   string `json:"azp"`
+	Email             string `json:"email"`
+	EmailVerified     Bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+var ErrInvalidIDToken = errors.New("oidc: invalid ID token")
+
+// The keys of the provider by kid, fetched again when the kid is unknown.
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	discovery, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if p.now().Sub(p.keysAt) < keysRefresh {
+		return nil, fmt.Errorf("%w: unknown kid %q", ErrInvalidIDToken, kid)
+	}
+	var set common.JWKSet
+	if err := p.getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// A broken or unsupported key is skipped, the other ones still work.
+		if key, err := jwk.PublicKey(); err == nil {
+			keys[jwk.KID] = key
+		}
+	}
+	p.keys, p.keysAt = keys, p.now()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown kid %q", ErrInvalidIDToken, kid)
+}
+
+// You could check an ID token of Exchange: its signature by a key of the provider, its issuer,
+// its audience (the client_id), its lifetime and its nonce, the one of AuthCodeURL.
+//
+//	claims, err := provider.Verify(ctx, idToken, nonce)
+func (p *Provider) Verify(ctx context.Context, idToken string, nonce string) (Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(idToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	},
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithIssuer(p.Issuer()),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(clockSkew),
+		jwt.WithTimeFunc(p.now),
+	)
+	if err != nil {
+		return claims, fmt.Errorf("%w: %w", ErrInvalidIDToken, err)
+	}
+	if claims.Subject == "" {
+		return claims, fmt.Errorf("%w: no sub", ErrInvalidIDToken)
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return claims, fmt.Errorf("%w: the nonce doesn't match", ErrInvalidIDToken)
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.ClientID {
+		return claims, fmt.Errorf("%w: azp %q is not the client", ErrInvalidIDToken, claims.AuthorizedParty)
+	}
+	return claims, nil
+}
@@ -0,0 +1,8 @@
+/*
+The ratelimit module containing the token bucket rate limits of the API.
+
+store.go: the Store interface of the buckets and its in-memory implementation
+
+middlewares.go: the Limiter applying the per-route policies of the config, keyed by client IP or user
+*/
+package ratelimit
@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"realworld-backend/common"
+	"realworld-backend/config"
+)
+
+// The key types of config.RateLimitPolicy.
+const (
+	KeyIP   = "ip"
+	KeyUser = "user"
+)
+
+// Limiter applies the policies of the config to the requests, its buckets are in Store.
+type Limiter struct {
+	Policies []config.RateLimitPolicy
+	Store    Store
+}
+
+func NewLimiter(cfg config.RateLimitConfig, store Store) *Limiter {
+	return &Limiter{Policies: cfg.Policies, Store: store}
+}
+
+// The policies whose method and route template match the request.
+func (l *Limiter) match(c *gin.Context) []config.RateLimitPolicy {
+	var ret []config.RateLimitPolicy
+	for _, p := range l.Policies {
+		if (p.Method == "" || p.Method == c.Request.Method) && (p.Route == "" || p.Route == c.FullPath()) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// The bucket key of the request for the policy, e.g. "login|ip:10.0.0.1" or "comments|user:42".
+func bucketKey(c *gin.Context, p config.RateLimitPolicy) string {
+	if p.Key == KeyUser {
+		if myUserID := c.GetUint("my_user_id"); myUserID != 0 {
+			return fmt.Sprintf("%s|user:%d", p.Name, myUserID)
+		}
+	}
+	return p.Name + "|ip:" + c.ClientIP()
+}
+
+// Mount it on a group after users.AuthMiddleware, so the "user" policies know the user:
+//
+//	v1.Use(users.AuthMiddleware(false), limiter.Middleware())
+//
+// The RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers describe the most
+// restrictive matching policy. An empty bucket answers 429 with Retry-After in seconds.
+// A failing store lets the request through, the limits shouldn't take the API down.
+func (l *Limiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var tightest *Result
+		var denied *Result
+		for _, p := range l.match(c) {
+			limit := Limit{Requests: p.Requests, Period: p.Period, Burst: p.Burst}
+			result, err := l.Store.Take(c.Request.Context(), bucketKey(c, p), limit)
+			if err != nil {
+				slog.Error("rate limit store failed", "policy", p.Name, "error", err)
+				continue
+			}
+			if tightest == nil || result.Remaining < tightest.Remaining {
+				tightest = &result
+			}
+			if !result.Allowed && (denied == nil || result.RetryAfter > denied.RetryAfter) {
+				denied = &result
+			}
+		}
+		if denied != nil {
+			tightest = denied
+		}
+		if tightest == nil {
+			return
+		}
+		c.Header("RateLimit-Limit", strconv.Itoa(tightest.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(tightest.Reset)))
+		if denied != nil {
+			retryAfter := ceilSeconds(denied.RetryAfter)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, common.NewError("ratelimit", fmt.Errorf("Too many requests, retry in %ds", retryAfter)))
+		}
+	}
+}
+
+// Whole seconds for the headers, rounded up so a client waiting that long finds a token.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,132 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// A token bucket: it holds up to Burst tokens and gets Requests tokens back every Period.
+// Every request takes one token, so Burst requests could go at once, then Requests per Period.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// Tokens per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// The bucket size, Requests when Burst is not set.
+func (l Limit) capacity() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// The state of a bucket after a Take, it gives the values of the RateLimit-* headers.
+type Result struct {
+	Allowed bool
+	// The bucket size.
+	Limit int
+	// The tokens left after this request.
+	Remaining int
+	// How long until a token is back, zero when the request was allowed.
+	RetryAfter time.Duration
+	// How long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Store keeps the buckets. The in-memory one is good for a single instance,
+// a shared one (e.g. on Redis) is needed to limit across the replicas.
+type Store interface {
+	// Take a token from the bucket of key, a new bucket starts full.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// Refill the bucket for the time elapsed since its last use.
+func (b *bucket) refill(now time.Time) {
+	capacity := float64(b.limit.capacity())
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*b.limit.rate())
+	b.last = now
+}
+
+// MemoryStore keeps the buckets in a map of the process. Full buckets carry no information,
+// Sweep drops them so the map doesn't grow with every client ever seen.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{tokens: float64(limit.capacity()), last: now, limit: limit}
+		s.buckets[key] = b
+	}
+	b.refill(now)
+
+	rate := limit.rate()
+	result := Result{Limit: limit.capacity()}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((float64(limit.capacity()) - b.tokens) / rate)
+	return result, nil
+}
+
+// Drop the buckets which refilled completely, it returns how many are left.
+func (s *MemoryStore) Sweep() int {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, b := range s.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.capacity()) {
+			delete(s.buckets, key)
+		}
+	}
+	return len(s.buckets)
+}
+
+// Sweep every interval until ctx is done, the server runs it as a background worker:
+//
+//	m.Go("ratelimit sweeper", func(ctx context.Context) { store.Run(ctx, time.Minute) })
+func (s *MemoryStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Sweep()
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
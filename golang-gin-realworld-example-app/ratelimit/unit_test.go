@@ -0,0 +1,162 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"realworld-backend/config"
+)
+
+// A store with a clock moved by the test.
+func newTestStore() (*MemoryStore, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	return store, &now
+}
+
+func TestMemoryStore(t *testing.T) {
+	asserts := assert.New(t)
+	store, now := newTestStore()
+	ctx := context.Background()
+
+	limit := Limit{Requests: 6, Period: time.Minute, Burst: 3}
+	for i := 2; i >= 0; i-- {
+		result, err := store.Take(ctx, "login|ip:10.0.0.1", limit)
+		asserts.NoError(err)
+		asserts.True(result.Allowed, "the burst should go at once")
+		asserts.Equal(3, result.Limit)
+		asserts.Equal(i, result.Remaining)
+	}
+	result, _ := store.Take(ctx, "login|ip:10.0.0.1", limit)
+	asserts.False(result.Allowed, "an empty bucket should refuse")
+	asserts.Equal(time.Second*10, result.RetryAfter, "6 per minute is a token every 10s")
+	asserts.Equal(time.Second*30, result.Reset)
+
+	result, _ = store.Take(ctx, "login|ip:10.0.0.2", limit)
+	asserts.True(result.Allowed, "every key should have its own bucket")
+
+	*now = now.Add(time.Second * 10)
+	result, _ = store.Take(ctx, "login|ip:10.0.0.1", limit)
+	asserts.True(result.Allowed, "a token should be back after 10s")
+	asserts.Equal(0, result.Remaining)
+
+	*now = now.Add(time.Hour)
+	result, _ = store.Take(ctx, "login|ip:10.0.0.1", limit)
+	asserts.Equal(2, result.Remaining, "the bucket should not refill past its burst")
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	asserts := assert.New(t)
+	store, now := newTestStore()
+	ctx := context.Background()
+
+	store.Take(ctx, "a", Limit{Requests: 1, Period: time.Minute})
+	store.Take(ctx, "b", Limit{Requests: 1, Period: time.Hour})
+	asserts.Equal(2, store.Sweep(), "used buckets should be kept")
+	*now = now.Add(time.Minute)
+	asserts.Equal(1, store.Sweep(), "a full bucket should be dropped")
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		store.Run(ctx, time.Millisecond)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run should return when ctx is done")
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	return Result{}, errors.New("connection refused")
+}
+
+var testPolicies = []config.RateLimitPolicy{
+	{Name: "global", Key: KeyIP, Requests: 100, Period: time.Minute},
+	{Name: "login", Method: "POST", Route: "/users/login", Key: KeyIP, Requests: 2, Period: time.Minute},
+	{Name: "comments", Method: "POST", Route: "/articles/:slug/comments", Key: KeyUser, Requests: 1, Period: time.Minute},
+}
+
+// The user of a request is its X-User header, as users.AuthMiddleware would set it.
+func newTestRouter(store Store) *gin.Engine {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if c.GetHeader("X-User") == "42" {
+			c.Set("my_user_id", uint(42))
+		}
+	})
+	r.Use(NewLimiter(config.RateLimitConfig{Enabled: true, Policies: testPolicies}, store).Middleware())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.POST("/users/login", ok)
+	r.POST("/articles/:slug/comments", ok)
+	r.GET("/articles/:slug", ok)
+	return r
+}
+
+func request(r *gin.Engine, method, path, remoteAddr, user string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, nil)
+	req.RemoteAddr = remoteAddr
+	if user != "" {
+		req.Header.Set("X-User", user)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	asserts := assert.New(t)
+	store, _ := newTestStore()
+	r := newTestRouter(store)
+
+	w := request(r, "POST", "/users/login", "10.0.0.1:1234", "")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("2", w.Header().Get("RateLimit-Limit"), "the headers should describe the tightest policy")
+	asserts.Equal("1", w.Header().Get("RateLimit-Remaining"))
+	asserts.Equal("30", w.Header().Get("RateLimit-Reset"))
+	request(r, "POST", "/users/login", "10.0.0.1:1234", "")
+
+	w = request(r, "POST", "/users/login", "10.0.0.1:1234", "")
+	asserts.Equal(http.StatusTooManyRequests, w.Code)
+	asserts.Equal("30", w.Header().Get("Retry-After"))
+	asserts.Equal("0", w.Header().Get("RateLimit-Remaining"))
+	asserts.Equal(`{"errors":{"ratelimit":"Too many requests, retry in 30s"}}`, w.Body.String())
+
+	asserts.Equal(http.StatusOK, request(r, "POST", "/users/login", "10.0.0.2:1234", "").Code, "another IP should have its own bucket")
+	w = request(r, "GET", "/articles/hello", "10.0.0.1:1234", "")
+	asserts.Equal(http.StatusOK, w.Code, "other routes should only have the global policy")
+	asserts.Equal("100", w.Header().Get("RateLimit-Limit"))
+
+	asserts.Equal(http.StatusOK, request(r, "POST", "/articles/hello/comments", "10.0.0.1:1234", "42").Code)
+	asserts.Equal(http.StatusTooManyRequests, request(r, "POST", "/articles/world/comments", "10.0.0.3:1234", "42").Code,
+		"the user should be limited whatever the IP")
+	asserts.Equal(http.StatusOK, request(r, "POST", "/articles/hello/comments", "10.0.0.1:1234", "").Code,
+		"anonymous requests should be keyed by IP")
+}
+
+func TestMiddlewareFailingStore(t *testing.T) {
+	asserts := assert.New(t)
+
+	w := request(newTestRouter(failingStore{}), "POST", "/users/login", "10.0.0.1:1234", "")
+	asserts.Equal(http.StatusOK, w.Code, "a failing store should let the requests through")
+	asserts.Empty(w.Header().Get("RateLimit-Limit"))
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
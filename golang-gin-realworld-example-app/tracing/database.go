@@ -0,0 +1,67 @@
+package tracing
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"realworld-backend/common"
+)
+
+// The scope key of the span between the before and after callbacks.
+const spanInstanceKey = "tracing:span"
+
+// Wrap every query of db in a client span, child of the span in the context of common.GetDBContext.
+// The span has the SQL with its placeholders (not the values) and the table name.
+// It is called once by the server after common.Init:
+//
+//	tracing.InstrumentDB(db)
+func InstrumentDB(db *gorm.DB) {
+	system := db.Dialect().GetName()
+	callback := db.Callback()
+	callback.Create().Before("gorm:begin_transaction").Register("tracing:before_create", beforeQuery(system, "INSERT"))
+	callback.Create().After("gorm:commit_or_rollback_transaction").Register("tracing:after_create", afterQuery)
+	callback.Update().Before("gorm:begin_transaction").Register("tracing:before_update", beforeQuery(system, "UPDATE"))
+	callback.Update().After("gorm:commit_or_rollback_transaction").Register("tracing:after_update", afterQuery)
+	callback.Delete().Before("gorm:begin_transaction").Register("tracing:before_delete", beforeQuery(system, "DELETE"))
+	callback.Delete().After("gorm:commit_or_rollback_transaction").Register("tracing:after_delete", afterQuery)
+	callback.Query().Before("gorm:query").Register("tracing:before_query", beforeQuery(system, "SELECT"))
+	callback.Query().After("gorm:after_query").Register("tracing:after_query", afterQuery)
+	callback.RowQuery().Before("gorm:row_query").Register("tracing:before_row_query", beforeQuery(system, "SELECT"))
+	callback.RowQuery().After("gorm:row_query").Register("tracing:after_row_query", afterQuery)
+}
+
+func beforeQuery(system, operation string) func(scope *gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		table := scope.TableName()
+		_, span := otel.Tracer(instrumentationName).Start(common.ScopeContext(scope), strings.TrimSpace(operation+" "+table),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system.name", system),
+				attribute.String("db.operation.name", operation),
+				attribute.String("db.collection.name", table),
+			))
+		scope.InstanceSet(spanInstanceKey, span)
+	}
+}
+
+func afterQuery(scope *gorm.Scope) {
+	value, ok := scope.InstanceGet(spanInstanceKey)
+	if !ok {
+		return
+	}
+	span := value.(trace.Span)
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("db.query.text", scope.SQL),
+		attribute.Int64("db.response.returned_rows", scope.DB().RowsAffected),
+	)
+	if err := scope.DB().Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
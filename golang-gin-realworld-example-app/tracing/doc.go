@@ -0,0 +1,12 @@
+/*
+The tracing module containing the OpenTelemetry traces of the server.
+
+tracing.go: the tracer provider, its offline exporters and the Start helper of the model functions
+
+otlp.go: the exporter of the file, writing the spans in OTLP/JSON
+
+middlewares.go: the server span of every request, continued from its W3C traceparent header
+
+database.go: the gorm callbacks wrapping every DB query in a span
+*/
+package tracing
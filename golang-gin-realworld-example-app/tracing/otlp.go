@@ -0,0 +1,289 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// OTLPExporter writes every batch of spans as an OTLP/JSON ExportTraceServiceRequest, one per
+// line, the format of the OpenTelemetry Collector's file exporter: the otlpjsonfile receiver of a
+// collector, or any OTLP/JSON reader, imports the file later.
+//
+//	exporter := tracing.NewOTLPExporter(file)
+type OTLPExporter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	stopped bool
+}
+
+func NewOTLPExporter(w io.Writer) *OTLPExporter {
+	return &OTLPExporter{w: w}
+}
+
+// The messages of opentelemetry-proto in their JSON encoding: lowerCamelCase names, hex ids,
+// enums as numbers and 64-bit integers as strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	SchemaURL  string           `json:"schemaUrl,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope     otlpScope  `json:"scope"`
+	Spans     []otlpSpan `json:"spans"`
+	SchemaURL string     `json:"schemaUrl,omitempty"`
+}
+
+type otlpScope struct {
+	Name       string         `json:"name,omitempty"`
+	Version    string         `json:"version,omitempty"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID                string         `json:"traceId"`
+	SpanID                 string         `json:"spanId"`
+	TraceState             string         `json:"traceState,omitempty"`
+	ParentSpanID           string         `json:"parentSpanId,omitempty"`
+	Flags                  uint32         `json:"flags,omitempty"`
+	Name                   string         `json:"name"`
+	Kind                   int            `json:"kind"`
+	StartTimeUnixNano      string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano        string         `json:"endTimeUnixNano"`
+	Attributes             []otlpKeyValue `json:"attributes,omitempty"`
+	DroppedAttributesCount int            `json:"droppedAttributesCount,omitempty"`
+	Events                 []otlpEvent    `json:"events,omitempty"`
+	DroppedEventsCount     int            `json:"droppedEventsCount,omitempty"`
+	Links                  []otlpLink     `json:"links,omitempty"`
+	DroppedLinksCount      int            `json:"droppedLinksCount,omitempty"`
+	Status                 otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano           string         `json:"timeUnixNano"`
+	Name                   string         `json:"name"`
+	Attributes             []otlpKeyValue `json:"attributes,omitempty"`
+	DroppedAttributesCount int            `json:"droppedAttributesCount,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID                string         `json:"traceId"`
+	SpanID                 string         `json:"spanId"`
+	TraceState             string         `json:"traceState,omitempty"`
+	Attributes             []otlpKeyValue `json:"attributes,omitempty"`
+	DroppedAttributesCount int            `json:"droppedAttributesCount,omitempty"`
+}
+
+type otlpStatus struct {
+	Message string `json:"message,omitempty"`
+	Code    int    `json:"code,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	BoolValue   *bool           `json:"boolValue,omitempty"`
+	IntValue    *string         `json:"intValue,omitempty"`
+	DoubleValue *float64        `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpValue(v attribute.Value) otlpAnyValue {
+	var out otlpAnyValue
+	switch v.Type() {
+	case attribute.BOOL:
+		b := v.AsBool()
+		out.BoolValue = &b
+	case attribute.INT64:
+		i := strconv.FormatInt(v.AsInt64(), 10)
+		out.IntValue = &i
+	case attribute.FLOAT64:
+		f := v.AsFloat64()
+		out.DoubleValue = &f
+	case attribute.BOOLSLICE:
+		out.ArrayValue = &otlpArrayValue{}
+		for _, b := range v.AsBoolSlice() {
+			out.ArrayValue.Values = append(out.ArrayValue.Values, otlpValue(attribute.BoolValue(b)))
+		}
+	case attribute.INT64SLICE:
+		out.ArrayValue = &otlpArrayValue{}
+		for _, i := range v.AsInt64Slice() {
+			out.ArrayValue.Values = append(out.ArrayValue.Values, otlpValue(attribute.Int64Value(i)))
+		}
+	case attribute.FLOAT64SLICE:
+		out.ArrayValue = &otlpArrayValue{}
+		for _, f := range v.AsFloat64Slice() {
+			out.ArrayValue.Values = append(out.ArrayValue.Values, otlpValue(attribute.Float64Value(f)))
+		}
+	case attribute.STRINGSLICE:
+		out.ArrayValue = &otlpArrayValue{}
+		for _, s := range v.AsStringSlice() {
+			out.ArrayValue.Values = append(out.ArrayValue.Values, otlpValue(attribute.StringValue(s)))
+		}
+	default:
+		s := v.Emit()
+		out.StringValue = &s
+	}
+	return out
+}
+
+func otlpAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	var out []otlpKeyValue
+	for _, kv := range attrs {
+		out = append(out, otlpKeyValue{Key: string(kv.Key), Value: otlpValue(kv.Value)})
+	}
+	return out
+}
+
+// The status codes of OTLP are not numbered like the ones of the API: OK is 1 and ERROR is 2.
+func otlpStatusCode(code codes.Code) int {
+	switch code {
+	case codes.Ok:
+		return 1
+	case codes.Error:
+		return 2
+	}
+	return 0
+}
+
+func otlpSpanOf(span sdktrace.ReadOnlySpan) otlpSpan {
+	sc := span.SpanContext()
+	out := otlpSpan{
+		TraceID:                sc.TraceID().String(),
+		SpanID:                 sc.SpanID().String(),
+		TraceState:             sc.TraceState().String(),
+		Flags:                  uint32(sc.TraceFlags()),
+		Name:                   span.Name(),
+		Kind:                   int(span.SpanKind()),
+		StartTimeUnixNano:      otlpTime(span.StartTime()),
+		EndTimeUnixNano:        otlpTime(span.EndTime()),
+		Attributes:             otlpAttributes(span.Attributes()),
+		DroppedAttributesCount: span.DroppedAttributes(),
+		DroppedEventsCount:     span.DroppedEvents(),
+		DroppedLinksCount:      span.DroppedLinks(),
+		Status:                 otlpStatus{Message: span.Status().Description, Code: otlpStatusCode(span.Status().Code)},
+	}
+	if span.Parent().HasSpanID() {
+		out.ParentSpanID = span.Parent().SpanID().String()
+	}
+	for _, event := range span.Events() {
+		out.Events = append(out.Events, otlpEvent{
+			TimeUnixNano:           otlpTime(event.Time),
+			Name:                   event.Name,
+			Attributes:             otlpAttributes(event.Attributes),
+			DroppedAttributesCount: event.DroppedAttributeCount,
+		})
+	}
+	for _, link := range span.Links() {
+		out.Links = append(out.Links, otlpLink{
+			TraceID:                link.SpanContext.TraceID().String(),
+			SpanID:                 link.SpanContext.SpanID().String(),
+			TraceState:             link.SpanContext.TraceState().String(),
+			Attributes:             otlpAttributes(link.Attributes),
+			DroppedAttributesCount: link.DroppedAttributeCount,
+		})
+	}
+	return out
+}
+
+type otlpScopeKey struct {
+	name, version, schemaURL string
+	attributes               attribute.Distinct
+}
+
+// The spans grouped by their resource, then by their instrumentation scope, in the order they came.
+func otlpRequestOf(spans []sdktrace.ReadOnlySpan) otlpRequest {
+	var request otlpRequest
+	resources := map[attribute.Distinct]int{}
+	scopes := map[attribute.Distinct]map[otlpScopeKey]int{}
+	for _, span := range spans {
+		res := span.Resource()
+		if res == nil {
+			res = resource.Empty()
+		}
+		key := res.Equivalent()
+		i, ok := resources[key]
+		if !ok {
+			i = len(request.ResourceSpans)
+			resources[key] = i
+			scopes[key] = map[otlpScopeKey]int{}
+			request.ResourceSpans = append(request.ResourceSpans, otlpResourceSpans{
+				Resource:  otlpResource{Attributes: otlpAttributes(res.Attributes())},
+				SchemaURL: res.SchemaURL(),
+			})
+		}
+		resourceSpans := &request.ResourceSpans[i]
+		scope := span.InstrumentationScope()
+		scopeKey := otlpScopeKey{scope.Name, scope.Version, scope.SchemaURL, scope.Attributes.Equivalent()}
+		j, ok := scopes[key][scopeKey]
+		if !ok {
+			j = len(resourceSpans.ScopeSpans)
+			scopes[key][scopeKey] = j
+			resourceSpans.ScopeSpans = append(resourceSpans.ScopeSpans, otlpScopeSpans{
+				Scope:     otlpScope{Name: scope.Name, Version: scope.Version, Attributes: otlpAttributes(scope.Attributes.ToSlice())},
+				SchemaURL: scope.SchemaURL,
+			})
+		}
+		resourceSpans.ScopeSpans[j].Spans = append(resourceSpans.ScopeSpans[j].Spans, otlpSpanOf(span))
+	}
+	return request
+}
+
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(otlpRequestOf(spans))
+	if err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stopped {
+		return nil
+	}
+	if _, err := e.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	return nil
+}
+
+// The spans exported after the shutdown are dropped, the file is closed by Setup.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stopped = true
+	return nil
+}
+
+var _ sdktrace.SpanExporter = (*OTLPExporter)(nil)
@@ -0,0 +1,93 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"realworld-backend/config"
+)
+
+// The name of the tracer of the server's own spans.
+const instrumentationName = "realworld-backend"
+
+// The exporters of config.TracingConfig, both work offline: stdout writes the spans for a human
+// to read, file appends them in OTLP/JSON for a collector to import, see OTLPExporter.
+const (
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// Install the global tracer provider and the W3C trace-context propagator.
+// Nothing is installed when tracing is disabled, the spans are then no-ops.
+// The returned function flushes the exporter, the server runs it at shutdown:
+//
+//	shutdown, err := tracing.Setup(cfg.Tracing)
+//	m.OnShutdown("tracing", shutdown)
+func Setup(cfg config.TracingConfig) (func(ctx context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !cfg.Enabled {
+		return func(ctx context.Context) error { return nil }, nil
+	}
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if cfg.Exporter == ExporterFile {
+		var err error
+		if file, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return nil, fmt.Errorf("tracing: %w", err)
+		}
+		w = file
+	}
+	tp, err := NewProvider(cfg, w)
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+	otel.SetTracerProvider(tp)
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if file != nil {
+			err = errors.Join(err, file.Close())
+		}
+		return err
+	}, nil
+}
+
+// A provider writing the finished spans to w in batches, in the format of cfg.Exporter: a JSON
+// document per span for stdout, an OTLP/JSON line per batch for file.
+// The spans of a sampled parent are always kept, the new traces by cfg.SampleRatio.
+func NewProvider(cfg config.TracingConfig, w io.Writer) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter = NewOTLPExporter(w)
+	if cfg.Exporter != ExporterFile {
+		var err error
+		if exporter, err = stdouttrace.New(stdouttrace.WithWriter(w)); err != nil {
+			return nil, fmt.Errorf("tracing: %w", err)
+		}
+	}
+	res := resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName))
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	), nil
+}
+
+// Start a span of the server's own code, e.g. around a model function:
+//
+//	ctx, span := tracing.Start(ctx, "articles.FindManyArticle")
+//	defer span.End()
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
@@ -0,0 +1,212 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"realworld-backend/common"
+	"realworld-backend/config"
+)
+
+var test_db *gorm.DB
+
+type testModel struct {
+	ID   uint `gorm:"primary_key"`
+	Name string
+}
+
+// Record the spans in memory for the test.
+func newRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestMiddleware(t *testing.T) {
+	asserts := assert.New(t)
+	recorder := newRecorder(t)
+	if _, err := Setup(config.Default().Tracing); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(Middleware())
+	r.GET("/articles/:slug", func(c *gin.Context) {
+		_, span := Start(c.Request.Context(), "articles.FindOneArticle")
+		span.End()
+		c.Status(http.StatusInternalServerError)
+	})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/articles/hello", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(w, req)
+
+	spans := recorder.Ended()
+	if !asserts.Len(spans, 2) {
+		return
+	}
+	model, server := spans[0], spans[1]
+	asserts.Equal("GET /articles/:slug", server.Name(), "the span should be named by the route template")
+	asserts.Equal("4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String(), "the trace of the caller should be continued")
+	asserts.Equal("00f067aa0ba902b7", server.Parent().SpanID().String())
+	asserts.Equal(int64(500), spanAttribute(server, "http.response.status_code").AsInt64())
+	asserts.Equal(codes.Error, server.Status().Code, "5xx should mark the span as failed")
+	asserts.Equal("articles.FindOneArticle", model.Name())
+	asserts.Equal(server.SpanContext().SpanID(), model.Parent().SpanID(), "the model span should be a child of the request")
+}
+
+func TestInstrumentDB(t *testing.T) {
+	asserts := assert.New(t)
+	recorder := newRecorder(t)
+
+	InstrumentDB(test_db)
+	test_db.AutoMigrate(&testModel{})
+
+	ctx, parent := Start(context.Background(), "users.SaveOne")
+	tx := common.GetDBContext(ctx)
+	asserts.NoError(tx.Save(&testModel{Name: "traced"}).Error)
+	var count int
+	tx.Model(&testModel{}).Count(&count)
+	var model testModel
+	asserts.Error(tx.Table("missing_table").First(&model).Error)
+	parent.End()
+
+	spans := recorder.Ended()
+	if !asserts.Len(spans, 4) {
+		return
+	}
+	asserts.Equal("INSERT test_models", spans[0].Name())
+	asserts.Contains(spanAttribute(spans[0], "db.query.text").AsString(), `INSERT INTO "test_models"`)
+	asserts.Equal("sqlite3", spanAttribute(spans[0], "db.system.name").AsString())
+	asserts.Equal("SELECT test_models", spans[1].Name(), "Count should be traced too")
+	asserts.Equal("SELECT missing_table", spans[2].Name())
+	asserts.Equal(codes.Error, spans[2].Status().Code, "a failed query should mark its span")
+	for _, span := range spans[:3] {
+		asserts.Equal(parent.SpanContext().SpanID(), span.Parent().SpanID(), "the queries should be children of the span in the context")
+	}
+	asserts.NotContains(spanAttribute(spans[0], "db.query.text").AsString(), "traced", "the values should not be in the span")
+}
+
+func TestSetup(t *testing.T) {
+	asserts := assert.New(t)
+	previous := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(previous)
+
+	cfg := config.Default().Tracing
+	shutdown, err := Setup(cfg)
+	asserts.NoError(err)
+	asserts.Equal(previous, otel.GetTracerProvider(), "nothing should be installed when tracing is disabled")
+	asserts.NoError(shutdown(context.Background()))
+
+	cfg.Enabled = true
+	cfg.Exporter = ExporterFile
+	cfg.File = filepath.Join(t.TempDir(), "traces.jsonl")
+	shutdown, err = Setup(cfg)
+	asserts.NoError(err)
+	_, span := Start(context.Background(), "articles.getAllTags")
+	span.End()
+	asserts.NoError(shutdown(context.Background()), "shutdown should flush the spans")
+	data, err := os.ReadFile(cfg.File)
+	asserts.NoError(err)
+	asserts.True(strings.HasSuffix(string(data), "}\n"), "the file should have a request per line")
+	asserts.Contains(string(data), `"name":"articles.getAllTags"`)
+	asserts.Contains(string(data), `{"key":"service.name","value":{"stringValue":"realworld-backend"}}`,
+		"the spans should have the service name")
+
+	cfg.File = filepath.Join(t.TempDir(), "missing", "traces.jsonl")
+	_, err = Setup(cfg)
+	asserts.Error(err)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	asserts := assert.New(t)
+	var buf bytes.Buffer
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(NewOTLPExporter(&buf)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "realworld-backend"))),
+	)
+	tracer := tp.Tracer(instrumentationName)
+	ctx, parent := tracer.Start(context.Background(), "GET /api/articles/", trace.WithSpanKind(trace.SpanKindServer))
+	_, child := tracer.Start(ctx, "articles.FindManyArticle", trace.WithAttributes(
+		attribute.Int64("db.rows", 20), attribute.Bool("cached", false), attribute.StringSlice("tags", []string{"go"})))
+	child.AddEvent("retry")
+	child.SetStatus(codes.Error, "database is locked")
+	child.End()
+	parent.SetStatus(codes.Ok, "")
+	parent.End()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	asserts.Len(lines, 2, "a request per batch, WithSyncer sends each span alone")
+	var request struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []map[string]interface{} `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Scope map[string]interface{}   `json:"scope"`
+				Spans []map[string]interface{} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	asserts.NoError(json.Unmarshal([]byte(lines[0]), &request))
+	asserts.Len(request.ResourceSpans, 1)
+	asserts.Equal("realworld-backend", request.ResourceSpans[0].ScopeSpans[0].Scope["name"])
+	span := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	asserts.Equal("articles.FindManyArticle", span["name"])
+	asserts.Equal(child.SpanContext().TraceID().String(), span["traceId"], "the ids should be hex")
+	asserts.Equal(parent.SpanContext().SpanID().String(), span["parentSpanId"])
+	asserts.Equal(float64(1), span["kind"], "an internal span")
+	asserts.Regexp(`^[0-9]+$`, span["startTimeUnixNano"], "the 64-bit integers should be strings")
+	asserts.Equal(map[string]interface{}{"message": "database is locked", "code": float64(2)}, span["status"])
+	asserts.Contains(lines[0], `{"key":"db.rows","value":{"intValue":"20"}}`)
+	asserts.Contains(lines[0], `{"key":"cached","value":{"boolValue":false}}`)
+	asserts.Contains(lines[0], `{"key":"tags","value":{"arrayValue":{"values":[{"stringValue":"go"}]}}}`)
+	asserts.Contains(lines[0], `"events":[{"timeUnixNano":`)
+
+	request.ResourceSpans = nil
+	asserts.NoError(json.Unmarshal([]byte(lines[1]), &request))
+	span = request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	asserts.Equal(float64(2), span["kind"], "a server span")
+	asserts.Nil(span["parentSpanId"])
+	asserts.Equal(map[string]interface{}{"code": float64(1)}, span["status"], "OK is 1 in OTLP")
+
+	asserts.NoError(tp.Shutdown(context.Background()))
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	test_db = common.TestDBInit()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
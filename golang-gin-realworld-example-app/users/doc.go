@@ -8,5 +8,29 @@ routers.go: router binding and core logic
 serializers.go: definition the schema of return data
 
 validators.go: definition the validator of form data
+
+tokens.go: the refresh tokens and their families
+
+revocations.go: the logouts and the access tokens they revoke
+
+sessions.go: the logins of the users, listed and logged out one by one
+
+passwords.go: the password reset mails and their tokens, the password changes and the bcrypt cost upgrades
+
+verifications.go: the email verification mails, the email changes wait for them
+
+lockouts.go: the failed logins, the delays and lockouts they bring
+
+twofactor.go: the TOTP two-factor authentication, its recovery codes and login challenges
+
+magiclinks.go: the login links mailed for the logins without a password
+
+oidc.go: the logins with an OpenID Connect provider, the identities linked to the users
+
+personaltokens.go: the personal access tokens of the API automation, and their scopes
+
+roles.go: the roles of the users and the permissions they give, like moderating the articles
+
+prune.go: the deletion of the rows which expired, in every table of the module
 */
 package users
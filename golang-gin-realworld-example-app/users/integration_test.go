@@ -1,6 +1,7 @@
 package users
 
 import (
+	"context"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -71,7 +72,7 @@ func TestIntegration_Users_CompleteRegistrationFlow(t *testing.T) {
 	asserts.NotEmpty(user["token"], "Token should not be empty")
 	
 	// Verify database
-	userModel, err := FindOneUser(&UserModel{Email: "test@example.com"})
+	userModel, err := FindOneUser(context.Background(), &UserModel{Email: "test@example.com"})
 	asserts.NoError(err, "User should exist in database")
 	asserts.Equal("testuser", userModel.Username)
 	asserts.NotEmpty(userModel.PasswordHash, "Password should be hashed")
@@ -317,10 +318,10 @@ func TestIntegration_Users_UpdateUserProfile(t *testing.T) {
 	asserts.Equal(http.StatusOK, w.Code)
 	
 	// Verify database
-	updatedUser, _ := FindOneUser(&UserModel{ID: user.ID})
+	updatedUser, _ := FindOneUser(context.Background(), &UserModel{ID: user.ID})
 	asserts.Equal("updateduser", updatedUser.Username)
 	asserts.Equal("Updated bio", updatedUser.Bio)
-	asserts.Equal("updated@example.com", updatedUser.Email)
+	asserts.Equal(user.Email, updatedUser.Email, "the new email waits for its confirmation")
 }
 
 // TestIntegration_Users_UpdateWithoutAuthentication tests authorization protection
@@ -402,7 +403,7 @@ func TestIntegration_Users_FollowUser(t *testing.T) {
 	asserts.Equal(true, profile["following"], "Should show following: true")
 	
 	// Verify in database
-	asserts.True(userA.isFollowing(userB), "Following relationship should exist in database")
+	asserts.True(userA.isFollowing(context.Background(), userB), "Following relationship should exist in database")
 }
 
 // TestIntegration_Users_UnfollowUser tests unfollow functionality
@@ -419,7 +420,7 @@ func TestIntegration_Users_UnfollowUser(t *testing.T) {
 	userB := users[1]
 	
 	// Create follow relationship
-	userA.following(userB)
+	userA.following(context.Background(), userB)
 	tokenA := common.GenToken(userA.ID)
 	
 	// User A unfollows User B
@@ -437,7 +438,7 @@ func TestIntegration_Users_UnfollowUser(t *testing.T) {
 	asserts.Equal(false, profile["following"], "Should show following: false")
 	
 	// Verify in database
-	asserts.False(userA.isFollowing(userB), "Following relationship should be removed")
+	asserts.False(userA.isFollowing(context.Background(), userB), "Following relationship should be removed")
 }
 
 // TestIntegration_Users_FollowNonexistentUser tests error handling
@@ -478,18 +479,18 @@ func TestIntegration_Users_MultipleFollowRelationships(t *testing.T) {
 	userD := users[3]
 	
 	// A follows B, C, D
-	userA.following(userB)
-	userA.following(userC)
-	userA.following(userD)
+	userA.following(context.Background(), userB)
+	userA.following(context.Background(), userC)
+	userA.following(context.Background(), userD)
 	
 	// Verify
-	followings := userA.GetFollowings()
+	followings := userA.GetFollowings(context.Background())
 	asserts.Equal(3, len(followings), "A should be following 3 users")
 	
 	// B follows A (mutual following)
-	userB.following(userA)
-	asserts.True(userA.isFollowing(userB), "A should be following B")
-	asserts.True(userB.isFollowing(userA), "B should be following A")
+	userB.following(context.Background(), userA)
+	asserts.True(userA.isFollowing(context.Background(), userB), "A should be following B")
+	asserts.True(userB.isFollowing(context.Background(), userA), "B should be following A")
 }
 
 // TestIntegration_Users_ValidJWTTokenAuthentication tests middleware with valid token
@@ -0,0 +1,175 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+
+	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/tracing"
+)
+
+// The failed logins of an email or of a client IP, Key is "email:<email>" or "ip:<ip>".
+// The emails are counted whether they are registered or not, so a lockout doesn't tell.
+type LoginFailureModel struct {
+	Key           string `gorm:"column:login_key;primary_key;size:300"`
+	Failures      int    `gorm:"not null"`
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+var (
+	ErrLoginLocked    = errors.New("Too many failed logins, the account is locked for a while")
+	ErrLoginThrottled = errors.New("Too many failed logins, wait before the next one")
+)
+
+// A hash to check the passwords of unknown emails against, made once at auth.bcrypt_cost.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a password"), config.Get().Auth.BcryptCost)
+	return string(hash)
+})
+
+func emailLoginKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func ipLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+// What a login gets before its password is checked: Err is ErrLoginLocked (a locked email),
+// ErrLoginThrottled (a delay, or a locked IP) or nil when it may go on. RetryAfter tells when to retry.
+type LoginThrottle struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+// The count of the model at now, a count is forgotten lockout_duration after its last failure.
+func (m LoginFailureModel) failures(now time.Time) int {
+	if now.Sub(m.LastFailureAt) >= config.Get().Auth.LockoutDuration {
+		return 0
+	}
+	return m.Failures
+}
+
+// The wait after the failures of an email: login_delay from login_delay_after failures on, doubled by each one.
+func loginDelay(failures int) time.Duration {
+	auth := config.Get().Auth
+	if failures < auth.LoginDelayAfter {
+		return 0
+	}
+	delay := auth.LoginDelay
+	for i := auth.LoginDelayAfter; i < failures && delay < auth.LockoutDuration; i++ {
+		delay *= 2
+	}
+	return min(delay, auth.LockoutDuration)
+}
+
+func findLoginFailures(db *gorm.DB, keys ...string) (map[string]LoginFailureModel, error) {
+	var models []LoginFailureModel
+	if err := db.Where("login_key IN (?)", keys).Find(&models).Error; err != nil {
+		return nil, err
+	}
+	found := make(map[string]LoginFailureModel, len(models))
+	for _, model := range models {
+		found[model.Key] = model
+	}
+	return found, nil
+}
+
+// You could check whether a login of email from ip may go on, before its password is checked.
+//
+//	throttle, err := CheckLogin(ctx, email, c.ClientIP(), time.Now())
+func CheckLogin(ctx context.Context, email string, ip string, now time.Time) (LoginThrottle, error) {
+	ctx, span := tracing.Start(ctx, "users.CheckLogin")
+	defer span.End()
+	found, err := findLoginFailures(common.GetDBContext(ctx), emailLoginKey(email), ipLoginKey(ip))
+	if err != nil {
+		return LoginThrottle{}, err
+	}
+	if model, ok := found[emailLoginKey(email)]; ok {
+		if model.LockedUntil != nil && now.Before(*model.LockedUntil) {
+			return LoginThrottle{ErrLoginLocked, model.LockedUntil.Sub(now)}, nil
+		}
+		if next := model.LastFailureAt.Add(loginDelay(model.failures(now))); now.Before(next) {
+			return LoginThrottle{ErrLoginThrottled, next.Sub(now)}, nil
+		}
+	}
+	if model, ok := found[ipLoginKey(ip)]; ok && model.LockedUntil != nil && now.Before(*model.LockedUntil) {
+		return LoginThrottle{ErrLoginThrottled, model.LockedUntil.Sub(now)}, nil
+	}
+	return LoginThrottle{}, nil
+}
+
+// You could count a failed login of email from ip, the email or the ip is locked at its threshold.
+//
+//	err := RecordLoginFailure(ctx, email, c.ClientIP(), time.Now())
+func RecordLoginFailure(ctx context.Context, email string, ip string, now time.Time) error {
+	ctx, span := tracing.Start(ctx, "users.RecordLoginFailure")
+	defer span.End()
+	auth := config.Get().Auth
+	tx := common.GetDBContext(ctx).Begin()
+	found, err := findLoginFailures(tx, emailLoginKey(email), ipLoginKey(ip))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for key, threshold := range map[string]int{emailLoginKey(email): auth.LockoutThreshold, ipLoginKey(ip): auth.IPLockoutThreshold} {
+		model, ok := found[key]
+		model.Key = key
+		model.Failures = model.failures(now) + 1
+		model.LastFailureAt = now
+		if model.Failures >= threshold {
+			lockedUntil := now.Add(auth.LockoutDuration)
+			model.LockedUntil = &lockedUntil
+		}
+		if ok {
+			err = tx.Save(&model).Error
+		} else {
+			err = tx.Create(&model).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// You could forget the failed logins of email after a successful one, the ones of its IP are kept.
+//
+//	err := ResetLoginFailures(ctx, email)
+func ResetLoginFailures(ctx context.Context, email string) error {
+	ctx, span := tracing.Start(ctx, "users.ResetLoginFailures")
+	defer span.End()
+	return common.GetDBContext(ctx).Where("login_key = ?", emailLoginKey(email)).Delete(LoginFailureModel{}).Error
+}
+
+// You could unlock an email or a client IP at once, it returns the failed logins forgotten.
+//
+//	failures, err := UnlockLogin("jake@jake.jake", "")
+func UnlockLogin(email string, ip string) (int, error) {
+	var keys []string
+	if email != "" {
+		keys = append(keys, emailLoginKey(email))
+	}
+	if ip != "" {
+		keys = append(keys, ipLoginKey(ip))
+	}
+	db := common.GetDB()
+	found, err := findLoginFailures(db, keys...)
+	if err != nil {
+		return 0, err
+	}
+	failures := 0
+	for _, model := range found {
+		failures += model.Failures
+	}
+	return failures, db.Where("login_key IN (?)", keys).Delete(LoginFailureModel{}).Error
+}
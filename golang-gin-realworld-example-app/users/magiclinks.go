@@ -0,0 +1,115 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/mail"
+	"realworld-backend/tracing"
+)
+
+// A login link mailed to the user, for a login without the password. Like the password reset
+// tokens, only its sha256 is saved. A link works once, until ExpiresAt.
+type MagicLinkModel struct {
+	ID          uint   `gorm:"primary_key"`
+	UserModelID uint   `gorm:"index;not null"`
+	TokenHash   string `gorm:"column:token_hash;size:64;unique_index;not null"`
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	UsedAt      *time.Time
+}
+
+// The window of auth.magic_link_limit.
+const magicLinkWindow = time.Hour
+
+var (
+	ErrMagicLinkInvalid = errors.New("Invalid or expired login link")
+	ErrMagicLinkLimited = errors.New("Too many login links, try again later")
+)
+
+// You could mail a login link to the user, the link works for auth.magic_link_lifetime.
+// The user gets auth.magic_link_limit links an hour at most, then ErrMagicLinkLimited.
+// The mail is queued, see mail.Queue.
+//
+//	err := SendMagicLink(ctx, userModel)
+func SendMagicLink(ctx context.Context, userModel UserModel) error {
+	ctx, span := tracing.Start(ctx, "users.SendMagicLink")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	now := time.Now()
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	model := MagicLinkModel{
+		UserModelID: userModel.ID,
+		TokenHash:   hashToken(token),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(config.Get().Auth.MagicLinkLifetime),
+	}
+	if err := db.Create(&model).Error; err != nil {
+		return err
+	}
+	// Counted after the insert, the links up to this one: of the requests racing each other,
+	// only the first ones within the limit keep their link.
+	var count int
+	err = db.Model(&MagicLinkModel{}).
+		Where("user_model_id = ? AND created_at > ? AND id <= ?", userModel.ID, now.Add(-magicLinkWindow), model.ID).
+		Count(&count).Error
+	if err == nil && count > config.Get().Auth.MagicLinkLimit {
+		err = ErrMagicLinkLimited
+	}
+	if err != nil {
+		db.Delete(&model)
+		return err
+	}
+	return mail.GetQueue().Send(ctx, mail.Message{
+		To:      userModel.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Open this link to log in, it works once, until %s:\n\n%s\n\n"+
+			"If you didn't ask for it, ignore this mail: nobody can log in without the link.\n",
+			userModel.Username, model.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"), frontendLink("/magic-link", token)),
+	})
+}
+
+// You could trade the token of a login link for its user, the link stops working.
+//
+//	userModel, err := RedeemMagicLink(ctx, token)
+func RedeemMagicLink(ctx context.Context, token string) (UserModel, error) {
+	ctx, span := tracing.Start(ctx, "users.RedeemMagicLink")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	var userModel UserModel
+	var model MagicLinkModel
+	err := db.Where(&MagicLinkModel{TokenHash: hashToken(token)}).First(&model).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return userModel, ErrMagicLinkInvalid
+	}
+	if err != nil {
+		return userModel, err
+	}
+	now := time.Now()
+	if model.UsedAt != nil || !now.Before(model.ExpiresAt) {
+		return userModel, ErrMagicLinkInvalid
+	}
+	// The condition on used_at makes the link single use under concurrent logins too.
+	result := db.Model(&MagicLinkModel{}).Where("id = ? AND used_at IS NULL", model.ID).Update("used_at", now)
+	if result.Error != nil {
+		return userModel, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return userModel, ErrMagicLinkInvalid
+	}
+	err = db.Where("id = ?", model.UserModelID).First(&userModel).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return userModel, ErrMagicLinkInvalid
+	}
+	return userModel, err
+}
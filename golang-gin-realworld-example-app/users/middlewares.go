@@ -1,12 +1,16 @@
 package users
 
 import (
+	"fmt"
 	"net/http"
 	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/logging"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/golang-jwt/jwt/v5/request"
 )
 
@@ -22,8 +26,8 @@ func stripBearerPrefixFromTokenString(tok string) (string, error) {
 // Extract  token from Authorization header
 // Uses PostExtractionFilter to strip "TOKEN " prefix from header
 var AuthorizationHeaderExtractor = &request.PostExtractionFilter{
-	request.HeaderExtractor{"Authorization"},
-	stripBearerPrefixFromTokenString,
+	Extractor: request.HeaderExtractor{"Authorization"},
+	Filter:    stripBearerPrefixFromTokenString,
 }
 
 // Extractor for OAuth2 access tokens.  Looks in 'Authorization'
@@ -33,11 +37,17 @@ var MyAuth2Extractor = &request.MultiExtractor{
 	request.ArgumentExtractor{"access_token"},
 }
 
+// A helper to write the tokens the UserSerializer responds with to the context
+func UpdateContextTokens(c *gin.Context, access_token string, refresh_token string) {
+	c.Set("my_access_token", access_token)
+	c.Set("my_refresh_token", refresh_token)
+}
+
 // A helper to write user_id and user_model to the context
 func UpdateContextUserModel(c *gin.Context, my_user_id uint) {
 	var myUserModel UserModel
 	if my_user_id != 0 {
-		db := common.GetDB()
+		db := common.GetDBContext(c.Request.Context())
 		db.First(&myUserModel, my_user_id)
 	}
 	c.Set("my_user_id", my_user_id)
@@ -48,21 +58,136 @@ func UpdateContextUserModel(c *gin.Context, my_user_id uint) {
 //  r.Use(AuthMiddleware(true))
 func AuthMiddleware(auto401 bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Mounted twice, e.g. AuthMiddleware(false) then AuthMiddleware(true), a token checked by the first one is kept
+		if _, ok := c.Get("my_token_claims"); ok {
+			return
+		}
+		if _, ok := c.Get("my_personal_access_token"); ok {
+			return
+		}
 		UpdateContextUserModel(c, 0)
-		token, err := request.ParseFromRequest(c.Request, MyAuth2Extractor, func(token *jwt.Token) (interface{}, error) {
-			b := ([]byte(common.NBSecretPassword))
-			return b, nil
-		})
+		UpdateContextTokens(c, "", "")
+		if raw, _ := MyAuth2Extractor.ExtractToken(c.Request); strings.HasPrefix(raw, PersonalAccessTokenPrefix) {
+			personalAccessTokenAuth(c, raw, auto401)
+			return
+		}
+		// The key is picked by the kid of the token, see common.Keyring
+		claims := common.TokenClaims{}
+		token, err := request.ParseFromRequest(c.Request, MyAuth2Extractor, common.GetKeyring().Keyfunc,
+			request.WithClaims(&claims))
+		if err == nil && GetRevocationStore().IsRevoked(claims) {
+			err = ErrTokenRevoked
+		}
 		if err != nil {
 			if auto401 {
 				c.AbortWithError(http.StatusUnauthorized, err)
 			}
 			return
 		}
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			my_user_id := uint(claims["id"].(float64))
-			//fmt.Println(my_user_id,claims["id"])
-			UpdateContextUserModel(c, my_user_id)
+		UpdateContextUserModel(c, claims.UserID)
+		UpdateContextTokens(c, token.Raw, "")
+		c.Set("my_token_claims", claims)
+		if claims.SessionID != "" {
+			if err := touchSession(c.Request.Context(), claims.SessionID, c.ClientIP(), time.Now()); err != nil {
+				logging.FromContext(c).Warn("session last seen not saved", "error", err)
+			}
+		}
+	}
+}
+
+// A personal access token instead of a JWT, RequireScope checks its scopes on each route.
+func personalAccessTokenAuth(c *gin.Context, raw string, auto401 bool) {
+	model, err := FindPersonalAccessToken(c.Request.Context(), raw)
+	if err != nil {
+		if auto401 {
+			c.AbortWithError(http.StatusUnauthorized, err)
+		}
+		return
+	}
+	UpdateContextUserModel(c, model.UserModelID)
+	c.Set("my_personal_access_token", model)
+}
+
+// Refuse the personal access tokens without the scope, after AuthMiddleware(true).
+// The logins have every scope:
+//
+//	router.POST("/", users.RequireScope(users.ScopeArticlesWrite), ArticleCreate)
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if model, ok := c.Get("my_personal_access_token"); ok && !model.(PersonalAccessTokenModel).HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("scope", fmt.Errorf("The token lacks the %s scope", scope)))
+		}
+	}
+}
+
+// Refuse the personal access tokens, for the routes of the account itself: its password, its
+// sessions, its two-factor authentication and the tokens.
+//
+//	router.PUT("/", users.RequireLogin(), UserUpdate)
+func RequireLogin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("my_personal_access_token"); ok {
+			c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("scope", ErrLoginRequired))
+		}
+	}
+}
+
+// The permissions of the roles of the user of the request, read once per request. The roles
+// act on the logins only: a personal access token has none.
+func myPermissions(c *gin.Context) ([]string, error) {
+	if permissions, ok := c.Get("my_permissions"); ok {
+		return permissions.([]string), nil
+	}
+	var permissions []string
+	if _, ok := c.Get("my_personal_access_token"); !ok && c.GetUint("my_user_id") != 0 {
+		var err error
+		if permissions, err = UserPermissions(c.Request.Context(), c.GetUint("my_user_id")); err != nil {
+			return nil, err
+		}
+	}
+	c.Set("my_permissions", permissions)
+	return permissions, nil
+}
+
+// Whether a role of the user of the request has the permission, e.g. for the moderators
+// to change the articles of the others:
+//
+//	if article.AuthorID != myArticleUserModel.ID && !users.HasPermission(c, users.PermissionArticlesModerate) { ... }
+func HasPermission(c *gin.Context, permission string) bool {
+	permissions, err := myPermissions(c)
+	if err != nil {
+		logging.FromContext(c).Error("permissions not read", "error", err)
+	}
+	return slices.Contains(permissions, permission)
+}
+
+// Refuse the users without the permission, after AuthMiddleware(true), for a route or a group:
+//
+//	admin.Use(users.RequirePermission(users.PermissionRolesManage))
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		permissions, err := myPermissions(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+		if !slices.Contains(permissions, permission) {
+			c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("permission", fmt.Errorf("You need the %s permission", permission)))
+		}
+	}
+}
+
+// Refuse the users whose email is not verified when auth.require_verified_email is set, after AuthMiddleware(true):
+//
+//	router.POST("/", users.RequireVerifiedEmail(), ArticleCreate)
+func RequireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !config.Get().Auth.RequireVerifiedEmail {
+			return
+		}
+		myUserModel := c.MustGet("my_user_model").(UserModel)
+		if !myUserModel.EmailVerified() {
+			c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("email", ErrEmailNotVerified))
 		}
 	}
 }
@@ -1,24 +1,40 @@
 package users
 
 import (
+	"context"
 	"errors"
 	"github.com/jinzhu/gorm"
 	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/tracing"
+	"time"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // Models should only be concerned with database schema, more strict checking should be put in validator.
 //
+// The functions called by the handlers take the context of the request first,
+// their spans and the spans of their queries belong to its trace.
+//
 // More detail you can find here: http://jinzhu.me/gorm/models.html#model-definition
 //
 // HINT: If you want to split null and "", you should use *string instead of string.
+//
+// HINT: Keep a size on unique string columns, mysql can't put an unique index on a text column.
 type UserModel struct {
-	ID           uint    `gorm:"primary_key"`
-	Username     string  `gorm:"column:username"`
-	Email        string  `gorm:"column:email;unique_index"`
-	Bio          string  `gorm:"column:bio;size:1024"`
-	Image        *string `gorm:"column:image"`
-	PasswordHash string  `gorm:"column:password;not null"`
+	ID       uint    `gorm:"primary_key"`
+	Username string  `gorm:"column:username"`
+	Email    string  `gorm:"column:email;size:255;unique_index"`
+	Bio      string  `gorm:"column:bio;size:1024"`
+	Image    *string `gorm:"column:image"`
+	// Empty for a user of the provider login (see oidc.go), who has no password until a reset.
+	PasswordHash string `gorm:"column:password;not null"`
+	// When the user confirmed Email with the link of a verification mail, nil until then.
+	EmailVerifiedAt *time.Time `gorm:"column:email_verified_at"`
+}
+
+func (u UserModel) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
 }
 
 // A hack way to save ManyToMany relationship,
@@ -45,19 +61,39 @@ func AutoMigrate() {
 
 	db.AutoMigrate(&UserModel{})
 	db.AutoMigrate(&FollowModel{})
+	db.AutoMigrate(&RefreshTokenModel{})
+	db.AutoMigrate(&RevocationModel{})
+	db.AutoMigrate(&SessionModel{})
+	db.AutoMigrate(&PasswordResetModel{})
+	db.AutoMigrate(&EmailVerificationModel{})
+	db.AutoMigrate(&LoginFailureModel{})
+	db.AutoMigrate(&TwoFactorModel{})
+	db.AutoMigrate(&RecoveryCodeModel{})
+	db.AutoMigrate(&TwoFactorChallengeModel{})
+	db.AutoMigrate(&MagicLinkModel{})
+	db.AutoMigrate(&OIDCIdentityModel{})
+	db.AutoMigrate(&OIDCStateModel{})
+	db.AutoMigrate(&PersonalAccessTokenModel{})
+	db.AutoMigrate(&RoleModel{})
+	db.AutoMigrate(&RolePermissionModel{})
+	db.AutoMigrate(&UserRoleModel{})
+	seedRoles(db)
 }
 
 // What's bcrypt? https://en.wikipedia.org/wiki/Bcrypt
 // Golang bcrypt doc: https://godoc.org/golang.org/x/crypto/bcrypt
-// You can change the value in bcrypt.DefaultCost to adjust the security index.
+// You can change auth.bcrypt_cost in the config to adjust the security index.
 // 	err := userModel.setPassword("password0")
 func (u *UserModel) setPassword(password string) error {
 	if len(password) == 0 {
 		return errors.New("password should not be empty!")
 	}
 	bytePassword := []byte(password)
-	// Make sure the second param `bcrypt generator cost` between [4, 32)
-	passwordHash, _ := bcrypt.GenerateFromPassword(bytePassword, bcrypt.DefaultCost)
+	// The config makes sure the second param `bcrypt generator cost` is between [4, 32)
+	passwordHash, err := bcrypt.GenerateFromPassword(bytePassword, config.Get().Auth.BcryptCost)
+	if err != nil {
+		return err
+	}
 	u.PasswordHash = string(passwordHash)
 	return nil
 }
@@ -70,35 +106,49 @@ func (u *UserModel) checkPassword(password string) error {
 	return bcrypt.CompareHashAndPassword(byteHashedPassword, bytePassword)
 }
 
+// Whether the hash was made at a lower cost than auth.bcrypt_cost, rehashPassword upgrades it.
+func (u *UserModel) passwordOutdated() bool {
+	cost, err := bcrypt.Cost([]byte(u.PasswordHash))
+	return err == nil && cost < config.Get().Auth.BcryptCost
+}
+
 // You could input the conditions and it will return an UserModel in database with error info.
-// 	userModel, err := FindOneUser(&UserModel{Username: "username0"})
-func FindOneUser(condition interface{}) (UserModel, error) {
-	db := common.GetDB()
+// 	userModel, err := FindOneUser(ctx, &UserModel{Username: "username0"})
+func FindOneUser(ctx context.Context, condition interface{}) (UserModel, error) {
+	ctx, span := tracing.Start(ctx, "users.FindOneUser")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	var model UserModel
 	err := db.Where(condition).First(&model).Error
 	return model, err
 }
 
 // You could input an UserModel which will be saved in database returning with error info
-// 	if err := SaveOne(&userModel); err != nil { ... }
-func SaveOne(data interface{}) error {
-	db := common.GetDB()
+// 	if err := SaveOne(ctx, &userModel); err != nil { ... }
+func SaveOne(ctx context.Context, data interface{}) error {
+	ctx, span := tracing.Start(ctx, "users.SaveOne")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	err := db.Save(data).Error
 	return err
 }
 
 // You could update properties of an UserModel to database returning with error info.
-//  err := db.Model(userModel).Update(UserModel{Username: "wangzitian0"}).Error
-func (model *UserModel) Update(data interface{}) error {
-	db := common.GetDB()
+//  err := userModel.Update(ctx, UserModel{Username: "wangzitian0"})
+func (model *UserModel) Update(ctx context.Context, data interface{}) error {
+	ctx, span := tracing.Start(ctx, "users.UserModel.Update")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	err := db.Model(model).Update(data).Error
 	return err
 }
 
 // You could add a following relationship as userModel1 following userModel2
-// 	err = userModel1.following(userModel2)
-func (u UserModel) following(v UserModel) error {
-	db := common.GetDB()
+// 	err = userModel1.following(ctx, userModel2)
+func (u UserModel) following(ctx context.Context, v UserModel) error {
+	ctx, span := tracing.Start(ctx, "users.UserModel.following")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	var follow FollowModel
 	err := db.FirstOrCreate(&follow, &FollowModel{
 		FollowingID:  v.ID,
@@ -108,9 +158,11 @@ func (u UserModel) following(v UserModel) error {
 }
 
 // You could check whether  userModel1 following userModel2
-// 	followingBool = myUserModel.isFollowing(self.UserModel)
-func (u UserModel) isFollowing(v UserModel) bool {
-	db := common.GetDB()
+// 	followingBool = myUserModel.isFollowing(ctx, self.UserModel)
+func (u UserModel) isFollowing(ctx context.Context, v UserModel) bool {
+	ctx, span := tracing.Start(ctx, "users.UserModel.isFollowing")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	var follow FollowModel
 	db.Where(FollowModel{
 		FollowingID:  v.ID,
@@ -120,9 +172,11 @@ func (u UserModel) isFollowing(v UserModel) bool {
 }
 
 // You could delete a following relationship as userModel1 following userModel2
-// 	err = userModel1.unFollowing(userModel2)
-func (u UserModel) unFollowing(v UserModel) error {
-	db := common.GetDB()
+// 	err = userModel1.unFollowing(ctx, userModel2)
+func (u UserModel) unFollowing(ctx context.Context, v UserModel) error {
+	ctx, span := tracing.Start(ctx, "users.UserModel.unFollowing")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 	err := db.Where(FollowModel{
 		FollowingID:  v.ID,
 		FollowedByID: u.ID,
@@ -130,16 +184,75 @@ func (u UserModel) unFollowing(v UserModel) error {
 	return err
 }
 
-// You could get a following list of userModel
-// 	followings := userModel.GetFollowings()
-func (u UserModel) GetFollowings() []UserModel {
+// You could delete an UserModel with the following relationships from and to it.
+// The articles module owns the rest of the user's data, see articles.DeleteArticleUserModel.
+// The last admin is kept with ErrLastAdmin, like RevokeRole does.
+// 	err := DeleteUserModel(userModel)
+func DeleteUserModel(model UserModel) error {
 	db := common.GetDB()
 	tx := db.Begin()
+	if err := checkLastAdmin(tx, model.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	err := tx.Unscoped().Where("following_id = ? OR followed_by_id = ?", model.ID, model.ID).Delete(FollowModel{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Where("user_model_id = ?", model.ID).Delete(RefreshTokenModel{}).Error
+	if err == nil {
+		err = tx.Where("user_model_id = ?", model.ID).Delete(SessionModel{}).Error
+	}
+	if err == nil {
+		err = tx.Where("user_model_id = ?", model.ID).Delete(PasswordResetModel{}).Error
+	}
+	if err == nil {
+		err = tx.Where("user_model_id = ?", model.ID).Delete(EmailVerificationModel{}).Error
+	}
+	if err == nil {
+		err = tx.Where("user_model_id = ?", model.ID).Delete(MagicLinkModel{}).Error
+	}
+	if err == nil {
+		err = tx.Where("user_model_id = ?", model.ID).Delete(OIDCIdentityModel{}).Error
+	}
+	if err == nil {
+		err = tx.Where("user_model_id = ?", model.ID).Delete(PersonalAccessTokenModel{}).Error
+	}
+	if err == nil {
+		err = tx.Where("user_model_id = ?", model.ID).Delete(UserRoleModel{}).Error
+	}
+	if err == nil {
+		err = deleteTwoFactor(tx, model.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	result := tx.Delete(&model)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return gorm.ErrRecordNotFound
+	}
+	return tx.Commit().Error
+}
+
+// You could get a following list of userModel
+// 	followings := userModel.GetFollowings(ctx)
+func (u UserModel) GetFollowings(ctx context.Context) []UserModel {
+	ctx, span := tracing.Start(ctx, "users.UserModel.GetFollowings")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	tx := db.Begin()
 	var follows []FollowModel
 	var followings []UserModel
 	tx.Where(FollowModel{
 		FollowedByID: u.ID,
-	}).Find(&follows)
+	}).Order("id").Find(&follows)
 	for _, follow := range follows {
 		var userModel UserModel
 		tx.Model(&follow).Related(&userModel, "Following")
@@ -0,0 +1,242 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+	"realworld-backend/oidc"
+	"realworld-backend/tracing"
+)
+
+// The account of the user at an OpenID Connect provider: the provider (Issuer) and its id of
+// the user (Subject) never change, the email may. A user logs in with it instead of a password.
+type OIDCIdentityModel struct {
+	ID          uint   `gorm:"primary_key"`
+	UserModelID uint   `gorm:"index;not null"`
+	Issuer      string `gorm:"column:issuer;size:255;not null;unique_index:idx_oidc_identity"`
+	Subject     string `gorm:"column:subject;size:255;not null;unique_index:idx_oidc_identity"`
+	// The email of the last login, the provider's one and not always the user's.
+	Email       string `gorm:"column:email;size:255"`
+	CreatedAt   time.Time
+	LastLoginAt time.Time
+}
+
+// gorm would name it o_id_c_identity_models.
+func (OIDCIdentityModel) TableName() string {
+	return "oidc_identity_models"
+}
+
+// A login started at the provider and not finished yet. The state comes back with the code,
+// only its sha256 is saved, the nonce and the PKCE verifier go along with the code.
+type OIDCStateModel struct {
+	ID        uint   `gorm:"primary_key"`
+	StateHash string `gorm:"column:state_hash;size:64;unique_index;not null"`
+	Nonce     string `gorm:"column:nonce;size:64;not null"`
+	Verifier  string `gorm:"column:verifier;size:64;not null"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (OIDCStateModel) TableName() string {
+	return "oidc_state_models"
+}
+
+// The time the user has at the provider to log in.
+const oidcStateLifetime = 10 * time.Minute
+
+var (
+	ErrOIDCStateInvalid    = errors.New("Invalid or expired login state")
+	ErrOIDCProvider        = errors.New("The login with the provider failed")
+	ErrOIDCEmailMissing    = errors.New("The provider didn't give an email")
+	ErrOIDCEmailUnverified = errors.New("An account has this email, and the provider didn't verify it")
+	ErrOIDCUserUnverified  = errors.New("An account has this email, and it isn't verified yet")
+	ErrOIDCSignupDisabled  = errors.New("No account has this identity, and the signup with the provider is off")
+)
+
+// You could start a login with the provider: the URL to send the user to, the provider sends
+// them back to oidc.redirect_url with the code and the state for FinishOIDCLogin.
+//
+//	authURL, err := StartOIDCLogin(ctx, oidc.Get())
+func StartOIDCLogin(ctx context.Context, provider *oidc.Provider) (string, error) {
+	ctx, span := tracing.Start(ctx, "users.StartOIDCLogin")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	var secrets [3]string
+	for i := range secrets {
+		secret, err := randomToken(32)
+		if err != nil {
+			return "", err
+		}
+		secrets[i] = secret
+	}
+	state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+	now := time.Now()
+	model := OIDCStateModel{
+		StateHash: hashToken(state),
+		Nonce:     nonce,
+		Verifier:  verifier,
+		CreatedAt: now,
+		ExpiresAt: now.Add(oidcStateLifetime),
+	}
+	if err := db.Create(&model).Error; err != nil {
+		return "", err
+	}
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrOIDCProvider, err)
+	}
+	return authURL, nil
+}
+
+// The login of a state works once, until ExpiresAt.
+func consumeOIDCState(db *gorm.DB, state string) (OIDCStateModel, error) {
+	var model OIDCStateModel
+	err := db.Where(&OIDCStateModel{StateHash: hashToken(state)}).First(&model).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return model, ErrOIDCStateInvalid
+	}
+	if err != nil {
+		return model, err
+	}
+	// The delete makes the state single use under concurrent callbacks too.
+	result := db.Where("id = ?", model.ID).Delete(OIDCStateModel{})
+	if result.Error != nil {
+		return model, result.Error
+	}
+	if result.RowsAffected == 0 || !time.Now().Before(model.ExpiresAt) {
+		return model, ErrOIDCStateInvalid
+	}
+	return model, nil
+}
+
+// You could finish a login with the code and the state of the provider's redirect: the user
+// of the identity in the ID token. An unknown identity is linked to the user of its email when
+// both the provider and the user verified it, else it gets a new user without a password if oidc.allow_signup,
+// and created is true.
+//
+//	userModel, created, err := FinishOIDCLogin(ctx, oidc.Get(), code, state)
+func FinishOIDCLogin(ctx context.Context, provider *oidc.Provider, code string, state string) (UserModel, bool, error) {
+	ctx, span := tracing.Start(ctx, "users.FinishOIDCLogin")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	var userModel UserModel
+	stateModel, err := consumeOIDCState(db, state)
+	if err != nil {
+		return userModel, false, err
+	}
+	idToken, err := provider.Exchange(ctx, code, stateModel.Verifier)
+	if err != nil {
+		return userModel, false, fmt.Errorf("%w: %w", ErrOIDCProvider, err)
+	}
+	claims, err := provider.Verify(ctx, idToken, stateModel.Nonce)
+	if err != nil {
+		return userModel, false, fmt.Errorf("%w: %w", ErrOIDCProvider, err)
+	}
+
+	now := time.Now()
+	var identity OIDCIdentityModel
+	err = db.Where(&OIDCIdentityModel{Issuer: provider.Issuer(), Subject: claims.Subject}).First(&identity).Error
+	if err == nil {
+		err = db.Model(&identity).Updates(map[string]interface{}{"email": claims.Email, "last_login_at": now}).Error
+		if err == nil {
+			err = db.Where("id = ?", identity.UserModelID).First(&userModel).Error
+		}
+		return userModel, false, err
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return userModel, false, err
+	}
+
+	if claims.Email == "" {
+		return userModel, false, ErrOIDCEmailMissing
+	}
+	identity = OIDCIdentityModel{
+		Issuer:      provider.Issuer(),
+		Subject:     claims.Subject,
+		Email:       claims.Email,
+		CreatedAt:   now,
+		LastLoginAt: now,
+	}
+	err = db.Where(&UserModel{Email: claims.Email}).First(&userModel).Error
+	if err == nil {
+		// Anybody may claim an email at some providers, only a verified one gets the account.
+		if !claims.EmailVerified {
+			return UserModel{}, false, ErrOIDCEmailUnverified
+		}
+		// Anybody may register an email here too: the password of whoever registered it before
+		// its owner would keep working on the account of the owner.
+		if !userModel.EmailVerified() {
+			return UserModel{}, false, ErrOIDCUserUnverified
+		}
+		identity.UserModelID = userModel.ID
+		return userModel, false, db.Create(&identity).Error
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return userModel, false, err
+	}
+	if !provider.AllowSignup() {
+		return userModel, false, ErrOIDCSignupDisabled
+	}
+
+	username, err := oidcUsername(db, claims)
+	if err != nil {
+		return userModel, false, err
+	}
+	// No PasswordHash: the user logs in with the provider, or sets a password by a reset mail.
+	userModel = UserModel{Username: username, Email: claims.Email}
+	if claims.EmailVerified {
+		userModel.EmailVerifiedAt = &now
+	}
+	tx := db.Begin()
+	if err := tx.Create(&userModel).Error; err != nil {
+		tx.Rollback()
+		return UserModel{}, false, err
+	}
+	identity.UserModelID = userModel.ID
+	if err := tx.Create(&identity).Error; err != nil {
+		tx.Rollback()
+		return UserModel{}, false, err
+	}
+	err = tx.Commit().Error
+	return userModel, err == nil, err
+}
+
+// A free username for a new user of the provider, from the alphanumerics of its
+// preferred_username, name or email, like the ones the registration accepts.
+func oidcUsername(db *gorm.DB, claims oidc.Claims) (string, error) {
+	base := ""
+	for _, candidate := range []string{claims.PreferredUsername, claims.Name, strings.Split(claims.Email, "@")[0]} {
+		base = strings.Map(func(r rune) rune {
+			if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+				return r
+			}
+			return -1
+		}, candidate)
+		if base != "" {
+			break
+		}
+	}
+	if len(base) < 4 {
+		base = "user" + base
+	}
+	base = base[:min(len(base), 32)]
+	username := base
+	for i := 2; ; i++ {
+		var count int
+		if err := db.Model(&UserModel{}).Where("username = ?", username).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return username, nil
+		}
+		username = base + strconv.Itoa(i)
+	}
+}
@@ -0,0 +1,192 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/mail"
+	"realworld-backend/tracing"
+)
+
+// A password reset token, mailed to the user as a link to the frontend. Like the refresh
+// tokens, only its sha256 is saved. A token works once, until ExpiresAt.
+type PasswordResetModel struct {
+	ID          uint   `gorm:"primary_key"`
+	UserModelID uint   `gorm:"index;not null"`
+	TokenHash   string `gorm:"column:token_hash;size:64;unique_index;not null"`
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	UsedAt      *time.Time
+}
+
+var ErrPasswordResetInvalid = errors.New("Invalid or expired password reset token")
+
+// A page of the frontend with the token in its query, e.g. http://localhost:4100/reset-password?token=...
+func frontendLink(path string, token string) string {
+	return strings.TrimSuffix(config.Get().Server.FrontendURL, "/") + path + "?" + url.Values{"token": {token}}.Encode()
+}
+
+// You could mail a password reset link to the user, the link works for auth.password_reset_lifetime.
+// The mail is queued, see mail.Queue.
+//
+//	err := SendPasswordReset(ctx, userModel)
+func SendPasswordReset(ctx context.Context, userModel UserModel) error {
+	ctx, span := tracing.Start(ctx, "users.SendPasswordReset")
+	defer span.End()
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	model := PasswordResetModel{
+		UserModelID: userModel.ID,
+		TokenHash:   hashToken(token),
+		ExpiresAt:   now.Add(config.Get().Auth.PasswordResetLifetime),
+	}
+	if err := common.GetDBContext(ctx).Create(&model).Error; err != nil {
+		return err
+	}
+	return mail.GetQueue().Send(ctx, mail.Message{
+		To:      userModel.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to reset the password of your account. Open this link to choose a new one,\n"+
+			"it works once, until %s:\n\n%s\n\n"+
+			"If it wasn't you, ignore this mail: your password stays as it is.\n",
+			userModel.Username, model.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"), frontendLink("/reset-password", token)),
+	})
+}
+
+// You could set a new password with the token of a reset mail. The other reset tokens of the user
+// stop working, and so do the sessions and the personal access tokens: whoever knew the old
+// password is logged out.
+//
+//	userModel, err := ResetPassword(ctx, token, "password1")
+func ResetPassword(ctx context.Context, token string, password string) (UserModel, error) {
+	ctx, span := tracing.Start(ctx, "users.ResetPassword")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	var userModel UserModel
+	var model PasswordResetModel
+	err := db.Where(&PasswordResetModel{TokenHash: hashToken(token)}).First(&model).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return userModel, ErrPasswordResetInvalid
+	}
+	if err != nil {
+		return userModel, err
+	}
+	now := time.Now()
+	if model.UsedAt != nil || !now.Before(model.ExpiresAt) {
+		return userModel, ErrPasswordResetInvalid
+	}
+	if err := userModel.setPassword(password); err != nil {
+		return userModel, err
+	}
+
+	tx := db.Begin()
+	// The condition on used_at makes the token single use under concurrent resets too.
+	result := tx.Model(&PasswordResetModel{}).Where("id = ? AND used_at IS NULL", model.ID).Update("used_at", now)
+	if result.Error != nil {
+		tx.Rollback()
+		return userModel, result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return userModel, ErrPasswordResetInvalid
+	}
+	err = tx.Model(&PasswordResetModel{}).Where("user_model_id = ? AND used_at IS NULL", model.UserModelID).
+		Update("used_at", now).Error
+	if err == nil {
+		err = tx.Model(&UserModel{}).Where("id = ?", model.UserModelID).Update("password", userModel.PasswordHash).Error
+	}
+	if err == nil {
+		err = tx.Where("user_model_id = ?", model.UserModelID).Delete(PersonalAccessTokenModel{}).Error
+	}
+	if err == nil {
+		err = tx.Where("id = ?", model.UserModelID).First(&userModel).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return userModel, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return userModel, err
+	}
+	_, err = GetRevocationStore().RevokeUser(ctx, userModel.ID)
+	return userModel, err
+}
+
+var (
+	ErrPasswordIncorrect = errors.New("The current password is wrong")
+	ErrPasswordNotSet    = errors.New("The account has no password yet, set one with a password reset")
+)
+
+// You could change the password of the user, who gives the current one. The user stays logged in
+// the session sid, the other sessions and the tokens without a session are logged out, like the
+// unused password reset links. The personal access tokens stay, the user revokes them one by one.
+//
+//	err := ChangePassword(ctx, myUserModel, claims.SessionID, "password0", "password1")
+func ChangePassword(ctx context.Context, userModel UserModel, sid string, current string, password string) error {
+	ctx, span := tracing.Start(ctx, "users.ChangePassword")
+	defer span.End()
+	// A user of the provider or the login links has nothing to check the current password against.
+	if userModel.PasswordHash == "" {
+		return ErrPasswordNotSet
+	}
+	if userModel.checkPassword(current) != nil {
+		return ErrPasswordIncorrect
+	}
+	if err := userModel.setPassword(password); err != nil {
+		return err
+	}
+	tx := common.GetDBContext(ctx).Begin()
+	err := tx.Model(&UserModel{}).Where("id = ?", userModel.ID).Update("password", userModel.PasswordHash).Error
+	if err == nil {
+		err = tx.Model(&PasswordResetModel{}).Where("user_model_id = ? AND used_at IS NULL", userModel.ID).
+			Update("used_at", time.Now()).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	_, err = GetRevocationStore().RevokeOtherSessions(ctx, userModel.ID, sid)
+	return err
+}
+
+// Hash the password again at auth.bcrypt_cost after a login with it, when the cost was raised
+// since the hash was made. A concurrent change of the password wins.
+func rehashPassword(ctx context.Context, userModel UserModel, password string) error {
+	ctx, span := tracing.Start(ctx, "users.rehashPassword")
+	defer span.End()
+	if !userModel.passwordOutdated() {
+		return nil
+	}
+	oldHash := userModel.PasswordHash
+	if err := userModel.setPassword(password); err != nil {
+		return err
+	}
+	return common.GetDBContext(ctx).Model(&UserModel{}).Where("id = ? AND password = ?", userModel.ID, oldHash).
+		Update("password", userModel.PasswordHash).Error
+}
+
+// Set the password of the user for the `set-password` command, without the current one.
+// The sessions of the user stay logged in.
+//
+//	err := SetPassword(userModel, "password1")
+func SetPassword(userModel UserModel, password string) error {
+	if err := userModel.setPassword(password); err != nil {
+		return err
+	}
+	return common.GetDB().Model(&UserModel{}).Where("id = ?", userModel.ID).Update("password", userModel.PasswordHash).Error
+}
@@ -0,0 +1,148 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+	"realworld-backend/tracing"
+)
+
+// The scopes of the personal access tokens, each route of ArticlesRegister, UserRegister and
+// ProfileRegister asks for one with RequireScope. A login has them all.
+const (
+	ScopeArticlesWrite  = "articles:write"
+	ScopeCommentsWrite  = "comments:write"
+	ScopeFavoritesWrite = "favorites:write"
+	ScopeProfileRead    = "profile:read"
+	ScopeProfileWrite   = "profile:write"
+)
+
+var Scopes = []string{ScopeArticlesWrite, ScopeCommentsWrite, ScopeFavoritesWrite, ScopeProfileRead, ScopeProfileWrite}
+
+// The personal access tokens start with it, so AuthMiddleware tells them from the JWTs.
+const PersonalAccessTokenPrefix = "rwpat_"
+
+// A long-lived token of the user for the API automation, e.g. a CI bot posting articles.
+// Like the refresh tokens, only its sha256 is saved. It works until ExpiresAt, forever when
+// nil, and is revoked by deleting it.
+type PersonalAccessTokenModel struct {
+	ID          uint   `gorm:"primary_key"`
+	UserModelID uint   `gorm:"index;not null"`
+	Name        string `gorm:"column:name;size:100;not null"`
+	TokenHash   string `gorm:"column:token_hash;size:64;unique_index;not null"`
+	// The scopes separated by spaces, like the scope of OAuth2.
+	Scopes     string `gorm:"column:scopes;size:255;not null"`
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+// Whether the token may use the routes of the scope.
+func (m PersonalAccessTokenModel) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(m.Scopes), scope)
+}
+
+var (
+	ErrPersonalAccessTokenNotFound = errors.New("Invalid personal access token")
+	ErrPersonalAccessTokenExpired  = errors.New("The expiration should be in the future")
+	ErrLoginRequired               = errors.New("A personal access token can't do this, log in")
+)
+
+// You could create a token of the user with some of Scopes, shown once: only its hash is kept.
+//
+//	model, token, err := CreatePersonalAccessToken(ctx, myUserModel.ID, "ci", []string{ScopeArticlesWrite}, nil)
+func CreatePersonalAccessToken(ctx context.Context, userID uint, name string, scopes []string, expiresAt *time.Time) (PersonalAccessTokenModel, string, error) {
+	ctx, span := tracing.Start(ctx, "users.CreatePersonalAccessToken")
+	defer span.End()
+	now := time.Now()
+	if expiresAt != nil && !expiresAt.After(now) {
+		return PersonalAccessTokenModel{}, "", ErrPersonalAccessTokenExpired
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return PersonalAccessTokenModel{}, "", err
+	}
+	token := PersonalAccessTokenPrefix + secret
+	scopes = slices.Clone(scopes)
+	slices.Sort(scopes)
+	model := PersonalAccessTokenModel{
+		UserModelID: userID,
+		Name:        name,
+		TokenHash:   hashToken(token),
+		Scopes:      strings.Join(slices.Compact(scopes), " "),
+		CreatedAt:   now,
+		ExpiresAt:   expiresAt,
+	}
+	if err := common.GetDBContext(ctx).Create(&model).Error; err != nil {
+		return PersonalAccessTokenModel{}, "", err
+	}
+	return model, token, nil
+}
+
+// The tokens of the user which are not expired, the newest first.
+//
+//	tokens, err := ListPersonalAccessTokens(ctx, myUserModel.ID)
+func ListPersonalAccessTokens(ctx context.Context, userID uint) ([]PersonalAccessTokenModel, error) {
+	ctx, span := tracing.Start(ctx, "users.ListPersonalAccessTokens")
+	defer span.End()
+	var models []PersonalAccessTokenModel
+	err := common.GetDBContext(ctx).
+		Where("user_model_id = ? AND (expires_at IS NULL OR expires_at > ?)", userID, time.Now()).
+		Order("created_at desc, id desc").Find(&models).Error
+	return models, err
+}
+
+// You could revoke a token of the user, the tokens of the other users give ErrPersonalAccessTokenNotFound.
+//
+//	err := RevokePersonalAccessToken(ctx, myUserModel.ID, id)
+func RevokePersonalAccessToken(ctx context.Context, userID uint, id uint) error {
+	ctx, span := tracing.Start(ctx, "users.RevokePersonalAccessToken")
+	defer span.End()
+	result := common.GetDBContext(ctx).Where("id = ? AND user_model_id = ?", id, userID).Delete(PersonalAccessTokenModel{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrPersonalAccessTokenNotFound
+	}
+	return nil
+}
+
+// The LastUsedAt of a token is written like the last seen time of a session.
+var personalAccessTokensSeen seenThrottle
+
+// The token of AuthMiddleware, ErrPersonalAccessTokenNotFound when unknown or expired.
+// LastUsedAt is written once a sessionSeenInterval by each server, see touchSession.
+func FindPersonalAccessToken(ctx context.Context, token string) (PersonalAccessTokenModel, error) {
+	ctx, span := tracing.Start(ctx, "users.FindPersonalAccessToken")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	var model PersonalAccessTokenModel
+	err := db.Where(&PersonalAccessTokenModel{TokenHash: hashToken(token)}).First(&model).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return model, ErrPersonalAccessTokenNotFound
+	}
+	if err != nil {
+		return model, err
+	}
+	now := time.Now()
+	if model.ExpiresAt != nil && !now.Before(*model.ExpiresAt) {
+		return model, ErrPersonalAccessTokenNotFound
+	}
+	if !personalAccessTokensSeen.due(model.TokenHash, now) {
+		return model, nil
+	}
+	err = db.Model(&PersonalAccessTokenModel{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", model.ID, now.Add(-sessionSeenInterval)).
+		Update("last_used_at", now).Error
+	if err != nil {
+		personalAccessTokensSeen.forget(model.TokenHash)
+	}
+	return model, err
+}
@@ -0,0 +1,67 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/tracing"
+)
+
+// Delete the rows of the module which can't be used anymore at now: the expired revocations,
+// refresh tokens, password resets, email verifications, magic links, two-factor challenges,
+// login states and personal access tokens, the sessions which ended and the forgotten failed
+// logins. A table which fails doesn't stop the other ones, the errors are joined.
+//
+//	err := users.PruneExpired(ctx, time.Now())
+func PruneExpired(ctx context.Context, now time.Time) error {
+	ctx, span := tracing.Start(ctx, "users.PruneExpired")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	tables := []struct {
+		name  string
+		model interface{}
+		query string
+		args  []interface{}
+	}{
+		{"revocations", RevocationModel{}, "expires_at <= ?", []interface{}{now}},
+		{"sessions", SessionModel{}, "expires_at <= ? OR revoked_at IS NOT NULL", []interface{}{now}},
+		{"refresh tokens", RefreshTokenModel{}, "expires_at <= ?", []interface{}{now}},
+		{"login failures", LoginFailureModel{}, "last_failure_at <= ?", []interface{}{now.Add(-config.Get().Auth.LockoutDuration)}},
+		{"password resets", PasswordResetModel{}, "expires_at <= ?", []interface{}{now}},
+		{"email verifications", EmailVerificationModel{}, "expires_at <= ?", []interface{}{now}},
+		// The links of the last magicLinkWindow count for auth.magic_link_limit, expired or not.
+		{"magic links", MagicLinkModel{}, "expires_at <= ? AND created_at <= ?", []interface{}{now, now.Add(-magicLinkWindow)}},
+		{"two-factor challenges", TwoFactorChallengeModel{}, "expires_at <= ?", []interface{}{now}},
+		{"oidc states", OIDCStateModel{}, "expires_at <= ?", []interface{}{now}},
+		{"personal access tokens", PersonalAccessTokenModel{}, "expires_at <= ?", []interface{}{now}},
+	}
+	var errs []error
+	for _, table := range tables {
+		if err := db.Where(table.query, table.args...).Delete(table.model).Error; err != nil {
+			slog.Error("users: prune failed", "table", table.name, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", table.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// PruneExpired every interval until ctx is done, the server runs it as a background worker:
+//
+//	m.Go("expired rows pruner", func(ctx context.Context) { users.RunPruner(ctx, time.Hour) })
+func RunPruner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			PruneExpired(ctx, now)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/tracing"
+)
+
+// The kinds of revocation, a revocation is one of:
+//
+//	RevokedToken    the access token whose jti is Value
+//	RevokedSession  the access tokens of the session (refresh token family) Value
+//	RevokedUser     the access tokens without a session of the user Value, issued until CreatedAt
+//
+// A row is kept until ExpiresAt, when the tokens it revokes have all expired.
+const (
+	RevokedToken   = "jti"
+	RevokedSession = "sid"
+	RevokedUser    = "user"
+)
+
+var ErrTokenRevoked = errors.New("token is revoked")
+
+type RevocationModel struct {
+	ID          uint   `gorm:"primary_key"`
+	Kind        string `gorm:"column:kind;size:8;not null"`
+	Value       string `gorm:"column:value;size:64;not null"`
+	UserModelID uint   `gorm:"index;not null"`
+	CreatedAt   time.Time
+	ExpiresAt   time.Time `gorm:"index"`
+}
+
+// The revocations of the logouts. They are written to the database for the other servers and
+// cached here, so the AuthMiddleware checks a token without a query. The cache reads the
+// database again every jwt.revocation_refresh, that is how long a logout on another server
+// takes to show up here.
+type RevocationStore struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	loadedAt time.Time
+	revoked  map[string]RevocationModel
+	// The revocations saved while a reload queries, its result may miss them.
+	reloading bool
+	saved     []RevocationModel
+
+	// One reload at a time, the query runs without mu so the requests go on with the cache.
+	reloadMu sync.Mutex
+}
+
+func NewRevocationStore() *RevocationStore {
+	return &RevocationStore{now: time.Now, revoked: map[string]RevocationModel{}}
+}
+
+var revocations = NewRevocationStore()
+
+// The store of the AuthMiddleware and of the logouts.
+func GetRevocationStore() *RevocationStore {
+	return revocations
+}
+
+func revocationKey(kind string, value string) string {
+	return kind + ":" + value
+}
+
+// Add a revocation to the cache, a user keeps its latest one.
+func (s *RevocationStore) put(revoked map[string]RevocationModel, model RevocationModel) {
+	key := revocationKey(model.Kind, model.Value)
+	if previous, ok := revoked[key]; ok && previous.CreatedAt.After(model.CreatedAt) {
+		return
+	}
+	revoked[key] = model
+}
+
+// Read the revocations again, the ones expired are left out. The cache is kept when the query fails.
+func (s *RevocationStore) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return s.reload()
+}
+
+// The query runs without mu, the new cache is swapped in after it.
+func (s *RevocationStore) reload() error {
+	now := s.now()
+	s.mu.Lock()
+	s.reloading, s.saved = true, nil
+	s.mu.Unlock()
+
+	db := common.GetDB()
+	var models []RevocationModel
+	var err error
+	if db != nil && db.HasTable(&RevocationModel{}) {
+		err = db.Where("expires_at > ?", now).Find(&models).Error
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loadedAt = now
+	saved := s.saved
+	s.reloading, s.saved = false, nil
+	if err != nil {
+		return err
+	}
+	revoked := make(map[string]RevocationModel, len(models)+len(saved))
+	for _, model := range append(models, saved...) {
+		s.put(revoked, model)
+	}
+	s.revoked = revoked
+	return nil
+}
+
+func (s *RevocationStore) stale() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadedAt.IsZero() || s.now().Sub(s.loadedAt) >= config.Get().JWT.RevocationRefresh
+}
+
+// Reload the cache once it is jwt.revocation_refresh old. A single request reloads, the other ones
+// go on with the cache meanwhile, so a slow database doesn't hold them. Only the first load is
+// waited for, there is no cache before it.
+func (s *RevocationStore) refresh() {
+	if !s.stale() {
+		return
+	}
+	s.mu.Lock()
+	first := s.loadedAt.IsZero()
+	s.mu.Unlock()
+	if first {
+		s.reloadMu.Lock()
+	} else if !s.reloadMu.TryLock() {
+		return
+	}
+	defer s.reloadMu.Unlock()
+	// Another request may have reloaded while this one waited.
+	if !s.stale() {
+		return
+	}
+	if err := s.reload(); err != nil {
+		slog.Error("revocations: reload failed", "error", err)
+	}
+}
+
+// Whether a logout revoked the token of the claims.
+func (s *RevocationStore) IsRevoked(claims common.TokenClaims) bool {
+	s.refresh()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	find := func(kind string, value string) (RevocationModel, bool) {
+		model, ok := s.revoked[revocationKey(kind, value)]
+		return model, ok && now.Before(model.ExpiresAt)
+	}
+	if _, ok := find(RevokedToken, claims.ID); ok && claims.ID != "" {
+		return true
+	}
+	if claims.SessionID != "" {
+		_, ok := find(RevokedSession, claims.SessionID)
+		return ok
+	}
+	model, ok := find(RevokedUser, strconv.FormatUint(uint64(claims.UserID), 10))
+	if !ok {
+		return false
+	}
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	return !issuedAt.After(model.CreatedAt)
+}
+
+// Save the revocations and cache them at once, the other servers see them at their next reload.
+func (s *RevocationStore) save(tx *gorm.DB, models ...RevocationModel) error {
+	for i := range models {
+		if err := tx.Create(&models[i]).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for _, model := range models {
+		s.put(s.revoked, model)
+	}
+	if s.reloading {
+		s.saved = append(s.saved, models...)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// The access tokens of a session may be fresher than the one revoking it, so the revocation lasts a full lifetime.
+func (s *RevocationStore) sessionRevocation(userID uint, sid string, now time.Time) RevocationModel {
+	return RevocationModel{
+		Kind:        RevokedSession,
+		Value:       sid,
+		UserModelID: userID,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(config.Get().JWT.TokenLifetime),
+	}
+}
+
+// The revocation of the tokens without a session of the user, made until now.
+func (s *RevocationStore) userRevocation(userID uint, now time.Time) RevocationModel {
+	return RevocationModel{
+		Kind:        RevokedUser,
+		Value:       strconv.FormatUint(uint64(userID), 10),
+		UserModelID: userID,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(config.Get().JWT.TokenLifetime),
+	}
+}
+
+// You could log a session out: its refresh tokens and its access tokens are revoked.
+//
+//	err := GetRevocationStore().RevokeSession(ctx, userID, claims.SessionID)
+func (s *RevocationStore) RevokeSession(ctx context.Context, userID uint, sid string) error {
+	ctx, span := tracing.Start(ctx, "users.RevocationStore.RevokeSession")
+	defer span.End()
+	tx := common.GetDBContext(ctx).Begin()
+	now := s.now()
+	err := tx.Model(&RefreshTokenModel{}).Where("family_id = ? AND revoked_at IS NULL", sid).
+		Update("revoked_at", now).Error
+	if err == nil {
+		err = tx.Model(&SessionModel{}).Where("id = ? AND revoked_at IS NULL", sid).Update("revoked_at", now).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return s.save(tx, s.sessionRevocation(userID, sid, now))
+}
+
+// You could log out the token of the claims: its whole session, or the token alone when it has
+// no session. A token from before the jti has no ID either, all of those tokens of the user are revoked.
+//
+//	err := GetRevocationStore().RevokeToken(ctx, claims)
+func (s *RevocationStore) RevokeToken(ctx context.Context, claims common.TokenClaims) error {
+	if claims.SessionID != "" {
+		return s.RevokeSession(ctx, claims.UserID, claims.SessionID)
+	}
+	ctx, span := tracing.Start(ctx, "users.RevocationStore.RevokeToken")
+	defer span.End()
+	tx := common.GetDBContext(ctx).Begin()
+	now := s.now()
+	model := s.userRevocation(claims.UserID, now)
+	if claims.ID != "" {
+		model.Kind, model.Value = RevokedToken, claims.ID
+		if claims.ExpiresAt != nil {
+			model.ExpiresAt = claims.ExpiresAt.Time
+		}
+	}
+	return s.save(tx, model)
+}
+
+// You could log the user out everywhere: every session and every token without a session.
+// It returns the number of sessions revoked.
+//
+//	sessions, err := GetRevocationStore().RevokeUser(ctx, userID)
+func (s *RevocationStore) RevokeUser(ctx context.Context, userID uint) (int, error) {
+	ctx, span := tracing.Start(ctx, "users.RevocationStore.RevokeUser")
+	defer span.End()
+	return s.revokeUser(ctx, userID, "")
+}
+
+// You could log the user out everywhere but in the session sid, e.g. after a password change in it.
+// The tokens without a session are revoked too. It returns the number of sessions revoked.
+//
+//	sessions, err := GetRevocationStore().RevokeOtherSessions(ctx, userID, claims.SessionID)
+func (s *RevocationStore) RevokeOtherSessions(ctx context.Context, userID uint, sid string) (int, error) {
+	ctx, span := tracing.Start(ctx, "users.RevocationStore.RevokeOtherSessions")
+	defer span.End()
+	return s.revokeUser(ctx, userID, sid)
+}
+
+func (s *RevocationStore) revokeUser(ctx context.Context, userID uint, keep string) (int, error) {
+	tx := common.GetDBContext(ctx).Begin()
+	now := s.now()
+	families, err := liveRefreshTokenFamilies(tx, userID, now)
+	families = slices.DeleteFunc(families, func(family string) bool { return family == keep })
+	if err == nil {
+		err = tx.Model(&RefreshTokenModel{}).Where("user_model_id = ? AND family_id <> ? AND revoked_at IS NULL", userID, keep).
+			Update("revoked_at", now).Error
+	}
+	if err == nil {
+		err = tx.Model(&SessionModel{}).Where("user_model_id = ? AND id <> ? AND revoked_at IS NULL", userID, keep).
+			Update("revoked_at", now).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	models := []RevocationModel{s.userRevocation(userID, now)}
+	for _, family := range families {
+		models = append(models, s.sessionRevocation(userID, family, now))
+	}
+	return len(families), s.save(tx, models...)
+}
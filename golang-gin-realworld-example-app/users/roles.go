@@ -0,0 +1,202 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/tracing"
+)
+
+// The roles the migrations create, with the permissions of defaultRoles.
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
+// The permissions of the roles, RequirePermission and HasPermission check them.
+const (
+	// Change and delete the articles of the other users.
+	PermissionArticlesModerate = "articles:moderate"
+	// Delete the comments of the other users.
+	PermissionCommentsModerate = "comments:moderate"
+	// Grant and revoke the roles, see AdminRegister.
+	PermissionRolesManage = "roles:manage"
+)
+
+var defaultRoles = map[string][]string{
+	RoleAdmin:     {PermissionArticlesModerate, PermissionCommentsModerate, PermissionRolesManage},
+	RoleModerator: {PermissionArticlesModerate, PermissionCommentsModerate},
+}
+
+// A role and its permissions. The roles of a user are in the UserRoleModels.
+type RoleModel struct {
+	ID          uint   `gorm:"primary_key"`
+	Name        string `gorm:"column:name;size:32;unique_index;not null"`
+	Permissions []RolePermissionModel
+}
+
+type RolePermissionModel struct {
+	ID          uint   `gorm:"primary_key"`
+	RoleModelID uint   `gorm:"not null;unique_index:idx_role_permission"`
+	Permission  string `gorm:"column:permission;size:64;not null;unique_index:idx_role_permission"`
+}
+
+type UserRoleModel struct {
+	ID          uint `gorm:"primary_key"`
+	UserModelID uint `gorm:"not null;unique_index:idx_user_role"`
+	RoleModelID uint `gorm:"not null;unique_index:idx_user_role;index"`
+	CreatedAt   time.Time
+}
+
+var (
+	ErrRoleNotFound = errors.New("Invalid role")
+	ErrLastAdmin    = errors.New("The last admin can't lose the admin role")
+)
+
+// Create the roles of defaultRoles which are missing, for AutoMigrate. The migrations seed their own.
+func seedRoles(db *gorm.DB) {
+	for name, permissions := range defaultRoles {
+		var role RoleModel
+		db.Where(RoleModel{Name: name}).FirstOrCreate(&role)
+		for _, permission := range permissions {
+			db.Where(RolePermissionModel{RoleModelID: role.ID, Permission: permission}).FirstOrCreate(&RolePermissionModel{})
+		}
+	}
+}
+
+// The roles with their permissions, by name.
+//
+//	roles, err := ListRoles(ctx)
+func ListRoles(ctx context.Context) ([]RoleModel, error) {
+	ctx, span := tracing.Start(ctx, "users.ListRoles")
+	defer span.End()
+	var roles []RoleModel
+	err := common.GetDBContext(ctx).Preload("Permissions", func(db *gorm.DB) *gorm.DB {
+		return db.Order("permission")
+	}).Order("name").Find(&roles).Error
+	return roles, err
+}
+
+// The names of the roles of the user, sorted.
+//
+//	roles, err := UserRoles(ctx, myUserModel.ID)
+func UserRoles(ctx context.Context, userID uint) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "users.UserRoles")
+	defer span.End()
+	roles := []string{}
+	err := common.GetDBContext(ctx).Table("role_models").
+		Joins("JOIN user_role_models ON user_role_models.role_model_id = role_models.id").
+		Where("user_role_models.user_model_id = ?", userID).
+		Order("role_models.name").Pluck("role_models.name", &roles).Error
+	return roles, err
+}
+
+// The permissions of all the roles of the user.
+//
+//	permissions, err := UserPermissions(ctx, myUserModel.ID)
+func UserPermissions(ctx context.Context, userID uint) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "users.UserPermissions")
+	defer span.End()
+	var permissions []string
+	err := common.GetDBContext(ctx).Table("role_permission_models").
+		Joins("JOIN user_role_models ON user_role_models.role_model_id = role_permission_models.role_model_id").
+		Where("user_role_models.user_model_id = ?", userID).
+		Pluck("role_permission_models.permission", &permissions).Error
+	slices.Sort(permissions)
+	return slices.Compact(permissions), err
+}
+
+func findRole(db *gorm.DB, name string) (RoleModel, error) {
+	var role RoleModel
+	err := db.Where(&RoleModel{Name: name}).First(&role).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return role, ErrRoleNotFound
+	}
+	return role, err
+}
+
+// You could grant a role to the user, granting it twice changes nothing.
+//
+//	err := GrantRole(ctx, userModel.ID, RoleModerator)
+func GrantRole(ctx context.Context, userID uint, name string) error {
+	ctx, span := tracing.Start(ctx, "users.GrantRole")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	role, err := findRole(db, name)
+	if err != nil {
+		return err
+	}
+	return db.Where(UserRoleModel{UserModelID: userID, RoleModelID: role.ID}).
+		Attrs(UserRoleModel{CreatedAt: time.Now()}).FirstOrCreate(&UserRoleModel{}).Error
+}
+
+// You could revoke a role of the user, a role the user doesn't have changes nothing.
+// The last admin keeps the admin role with ErrLastAdmin, so somebody can still grant roles.
+//
+//	err := RevokeRole(ctx, userModel.ID, RoleModerator)
+func RevokeRole(ctx context.Context, userID uint, name string) error {
+	ctx, span := tracing.Start(ctx, "users.RevokeRole")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	role, err := findRole(db, name)
+	if err != nil {
+		return err
+	}
+	tx := db.Begin()
+	if name == RoleAdmin {
+		if err := checkLastAdmin(tx, userID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Where("user_model_id = ? AND role_model_id = ?", userID, role.ID).Delete(UserRoleModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// ErrLastAdmin when the user is the only admin left, for the changes taking the admin role away.
+// The admin roles are locked until the end of tx: two admins revoking each other at once would
+// both see the other one still there otherwise. SQLite has no FOR UPDATE, its writers take turns.
+func checkLastAdmin(tx *gorm.DB, userID uint) error {
+	last, err := lastAdmin(tx, userID, tx.Dialect().GetName() != config.DriverSQLite)
+	if err == nil && last {
+		err = ErrLastAdmin
+	}
+	return err
+}
+
+func lastAdmin(db *gorm.DB, userID uint, lock bool) (bool, error) {
+	role, err := findRole(db, RoleAdmin)
+	if errors.Is(err, ErrRoleNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	query := db.Where("role_model_id = ?", role.ID)
+	if lock {
+		query = query.Set("gorm:query_option", "FOR UPDATE")
+	}
+	var admins []UserRoleModel
+	if err := query.Find(&admins).Error; err != nil {
+		return false, err
+	}
+	return len(admins) == 1 && admins[0].UserModelID == userID, nil
+}
+
+// Whether the user is the only admin left, e.g. to refuse deleting it before anything else is.
+//
+//	last, err := IsLastAdmin(ctx, userModel.ID)
+func IsLastAdmin(ctx context.Context, userID uint) (bool, error) {
+	ctx, span := tracing.Start(ctx, "users.IsLastAdmin")
+	defer span.End()
+	return lastAdmin(common.GetDBContext(ctx), userID, false)
+}
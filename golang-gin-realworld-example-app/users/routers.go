@@ -2,30 +2,88 @@ package users
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/logging"
+	"realworld-backend/metrics"
+	"realworld-backend/oidc"
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func UsersRegister(router *gin.RouterGroup) {
 	router.POST("/", UsersRegistration)
 	router.POST("/login", UsersLogin)
+	router.POST("/login/2fa", UsersLoginTwoFactor)
+	router.POST("/magic-link", UsersMagicLink)
+	router.POST("/magic-link/redeem", UsersMagicLinkRedeem)
+	router.POST("/oidc/authorize", UsersOIDCAuthorize)
+	router.POST("/oidc/callback", UsersOIDCCallback)
+	router.POST("/token/refresh", UsersTokenRefresh)
+	router.POST("/password/forgot", UsersPasswordForgot)
+	router.POST("/password/reset", UsersPasswordReset)
+	router.POST("/email/confirm", UsersEmailConfirm)
 }
 
 func UserRegister(router *gin.RouterGroup) {
-	router.GET("/", UserRetrieve)
-	router.PUT("/", UserUpdate)
+	router.GET("/", RequireScope(ScopeProfileRead), UserRetrieve)
+	router.PUT("/", RequireLogin(), UserUpdate)
+	router.PUT("/password", RequireLogin(), UserPasswordChange)
+	router.POST("/logout", RequireLogin(), UserLogout)
+	router.POST("/logout/all", RequireLogin(), UserLogoutAll)
+	router.GET("/sessions", RequireLogin(), SessionList)
+	router.DELETE("/sessions/:id", RequireLogin(), SessionDelete)
+	router.POST("/email/verify", RequireLogin(), UserEmailVerify)
+	router.GET("/2fa", RequireLogin(), TwoFactorRetrieve)
+	router.POST("/2fa/enroll", RequireLogin(), TwoFactorEnroll)
+	router.POST("/2fa/confirm", RequireLogin(), TwoFactorConfirm)
+	router.POST("/2fa/recovery-codes", RequireLogin(), TwoFactorRecoveryCodes)
+	router.POST("/2fa/disable", RequireLogin(), TwoFactorDisable)
+	router.GET("/tokens", RequireLogin(), PersonalAccessTokenList)
+	router.POST("/tokens", RequireLogin(), PersonalAccessTokenCreate)
+	router.DELETE("/tokens/:id", RequireLogin(), PersonalAccessTokenDelete)
+}
+
+// The role management, for a group behind RequirePermission:
+//
+//	admin := v1.Group("/admin")
+//	admin.Use(users.RequirePermission(users.PermissionRolesManage))
+//	users.AdminRegister(admin)
+func AdminRegister(router *gin.RouterGroup) {
+	router.GET("/roles", RoleList)
+	router.GET("/users/:username/roles", UserRoleList)
+	router.PUT("/users/:username/roles/:role", UserRoleGrant)
+	router.DELETE("/users/:username/roles/:role", UserRoleRevoke)
+}
+
+// The public signing keys, the other services verify the tokens of GenToken with them:
+//
+//	users.JWKSRegister(r.Group("/.well-known"))
+func JWKSRegister(router *gin.RouterGroup) {
+	router.GET("/jwks.json", JWKSRetrieve)
 }
 
 func ProfileRegister(router *gin.RouterGroup) {
-	router.GET("/:username", ProfileRetrieve)
-	router.POST("/:username/follow", ProfileFollow)
-	router.DELETE("/:username/follow", ProfileUnfollow)
+	router.GET("/:username", RequireScope(ScopeProfileRead), ProfileRetrieve)
+	router.POST("/:username/follow", RequireScope(ScopeProfileWrite), ProfileFollow)
+	router.DELETE("/:username/follow", RequireScope(ScopeProfileWrite), ProfileUnfollow)
+}
+
+// The clients may cache the keys as long as the keyring does, a new key shows up at the next reload.
+func JWKSRetrieve(c *gin.Context) {
+	maxAge := int(config.Get().JWT.KeyringRefresh.Seconds())
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	c.JSON(http.StatusOK, common.GetKeyring().JWKS())
 }
 
 func ProfileRetrieve(c *gin.Context) {
 	username := c.Param("username")
-	userModel, err := FindOneUser(&UserModel{Username: username})
+	userModel, err := FindOneUser(c.Request.Context(), &UserModel{Username: username})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
 		return
@@ -36,13 +94,13 @@ func ProfileRetrieve(c *gin.Context) {
 
 func ProfileFollow(c *gin.Context) {
 	username := c.Param("username")
-	userModel, err := FindOneUser(&UserModel{Username: username})
+	userModel, err := FindOneUser(c.Request.Context(), &UserModel{Username: username})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(UserModel)
-	err = myUserModel.following(userModel)
+	err = myUserModel.following(c.Request.Context(), userModel)
 	if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
@@ -53,14 +111,14 @@ func ProfileFollow(c *gin.Context) {
 
 func ProfileUnfollow(c *gin.Context) {
 	username := c.Param("username")
-	userModel, err := FindOneUser(&UserModel{Username: username})
+	userModel, err := FindOneUser(c.Request.Context(), &UserModel{Username: username})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(UserModel)
 
-	err = myUserModel.unFollowing(userModel)
+	err = myUserModel.unFollowing(c.Request.Context(), userModel)
 	if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
@@ -76,11 +134,19 @@ func UsersRegistration(c *gin.Context) {
 		return
 	}
 
-	if err := SaveOne(&userModelValidator.userModel); err != nil {
+	if err := SaveOne(c.Request.Context(), &userModelValidator.userModel); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	metrics.UsersRegistered.Inc()
 	c.Set("my_user_model", userModelValidator.userModel)
+	if err := issueTokens(c, userModelValidator.userModel.ID); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if err := SendEmailVerification(c.Request.Context(), userModelValidator.userModel, userModelValidator.userModel.Email); err != nil {
+		logging.FromContext(c).Error("email verification mail not sent", "error", err)
+	}
 	serializer := UserSerializer{c}
 	c.JSON(http.StatusCreated, gin.H{"user": serializer.Response()})
 }
@@ -91,22 +157,409 @@ func UsersLogin(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
 		return
 	}
-	userModel, err := FindOneUser(&UserModel{Email: loginValidator.userModel.Email})
+	email := loginValidator.userModel.Email
+	if loginThrottled(c, email) {
+		return
+	}
 
+	userModel, err := FindOneUser(c.Request.Context(), &UserModel{Email: email})
+	if err == nil && userModel.PasswordHash == "" {
+		// A user of the provider login has no password to log in with.
+		err = errors.New("no password")
+	}
 	if err != nil {
+		// The same bcrypt work as a registered email, so the timing doesn't tell either.
+		userModel.PasswordHash = dummyPasswordHash()
+	}
+	if userModel.checkPassword(loginValidator.User.Password) != nil || err != nil {
+		loginFailed(c, email)
 		c.JSON(http.StatusForbidden, common.NewError("login", errors.New("Not Registered email or invalid password")))
 		return
 	}
+	// The login is the only time the server sees the password, to hash it at a raised auth.bcrypt_cost.
+	if err := rehashPassword(c.Request.Context(), userModel, loginValidator.User.Password); err != nil {
+		logging.FromContext(c).Warn("password not rehashed", "error", err)
+	}
+	loginVerified(c, userModel)
+}
 
-	if userModel.checkPassword(loginValidator.User.Password) != nil {
-		c.JSON(http.StatusForbidden, common.NewError("login", errors.New("Not Registered email or invalid password")))
+// The password or the login link of the user was right: a session, or a challenge for the code
+// with two-factor authentication. The failed logins are only forgotten after the code then.
+func loginVerified(c *gin.Context, userModel UserModel) {
+	twoFactor, err := TwoFactorEnabled(c.Request.Context(), userModel.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if twoFactor {
+		challenge, token, err := CreateTwoFactorChallenge(c.Request.Context(), userModel.ID)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"twoFactor": gin.H{
+			"challengeToken": token,
+			"expiresAt":      challenge.ExpiresAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		}})
+		return
+	}
+	loginSucceeded(c, userModel)
+}
+
+// The second step of a login with two-factor authentication: the challenge token of the first
+// step with a code of the authenticator app or a recovery code.
+func UsersLoginTwoFactor(c *gin.Context) {
+	twoFactorLoginValidator := NewTwoFactorLoginValidator()
+	if err := twoFactorLoginValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	challenge, err := FindTwoFactorChallenge(c.Request.Context(), twoFactorLoginValidator.User.ChallengeToken)
+	if errors.Is(err, ErrTwoFactorChallengeInvalid) {
+		c.JSON(http.StatusUnauthorized, common.NewError("challengeToken", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	userModel, err := FindOneUser(c.Request.Context(), &UserModel{ID: challenge.UserModelID})
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, common.NewError("challengeToken", ErrTwoFactorChallengeInvalid))
+		return
+	}
+	if loginThrottled(c, userModel.Email) {
+		return
+	}
+	err = VerifyTwoFactorChallenge(c.Request.Context(), challenge, twoFactorLoginValidator.User.Code)
+	if errors.Is(err, ErrTwoFactorChallengeInvalid) {
+		c.JSON(http.StatusUnauthorized, common.NewError("challengeToken", err))
+		return
+	}
+	if errors.Is(err, ErrTwoFactorCodeInvalid) || errors.Is(err, ErrTwoFactorNotEnabled) {
+		loginFailed(c, userModel.Email)
+		c.JSON(http.StatusForbidden, common.NewError("code", ErrTwoFactorCodeInvalid))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	loginSucceeded(c, userModel)
+}
+
+// Answer the login of email with a 423 or a 429 while it is locked or has to wait, see CheckLogin.
+func loginThrottled(c *gin.Context, email string) bool {
+	throttle, err := CheckLogin(c.Request.Context(), email, c.ClientIP(), time.Now())
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return true
+	}
+	if throttle.Err == nil {
+		return false
+	}
+	metrics.Logins.WithLabelValues(metrics.ResultLocked).Inc()
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(throttle.RetryAfter.Seconds()))))
+	status := http.StatusTooManyRequests
+	if errors.Is(throttle.Err, ErrLoginLocked) {
+		status = http.StatusLocked
+	}
+	c.JSON(status, common.NewError("login", throttle.Err))
+	return true
+}
+
+func loginFailed(c *gin.Context, email string) {
+	metrics.Logins.WithLabelValues(metrics.ResultFailure).Inc()
+	if err := RecordLoginFailure(c.Request.Context(), email, c.ClientIP(), time.Now()); err != nil {
+		logging.FromContext(c).Warn("failed login not recorded", "error", err)
+	}
+}
+
+func loginSucceeded(c *gin.Context, userModel UserModel) {
+	if err := ResetLoginFailures(c.Request.Context(), userModel.Email); err != nil {
+		logging.FromContext(c).Warn("failed logins not reset", "error", err)
+	}
+	metrics.Logins.WithLabelValues(metrics.ResultSuccess).Inc()
 	UpdateContextUserModel(c, userModel.ID)
+	if err := issueTokens(c, userModel.ID); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := UserSerializer{c}
+	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
+}
+
+// A new session for a login: an access token and the first refresh token of a new family.
+func issueTokens(c *gin.Context, my_user_id uint) error {
+	family, refreshToken, err := IssueRefreshToken(c.Request.Context(), my_user_id)
+	if err != nil {
+		return err
+	}
+	if _, err := CreateSession(c.Request.Context(), family, c.ClientIP(), c.Request.UserAgent()); err != nil {
+		return err
+	}
+	roles, err := UserRoles(c.Request.Context(), my_user_id)
+	if err != nil {
+		return err
+	}
+	UpdateContextTokens(c, common.GenSessionToken(my_user_id, family.FamilyID, roles), refreshToken)
+	return nil
+}
+
+// Trade the refresh token for a new access token and the next refresh token.
+func UsersTokenRefresh(c *gin.Context) {
+	refreshTokenValidator := NewRefreshTokenValidator()
+	if err := refreshTokenValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	session, refreshToken, err := RotateRefreshToken(c.Request.Context(), refreshTokenValidator.User.RefreshToken)
+	if errors.Is(err, ErrRefreshTokenReused) {
+		logging.FromContext(c).Warn("refresh token reused, its session is revoked", "user_id", session.UserModelID)
+	}
+	if errors.Is(err, ErrRefreshTokenInvalid) || errors.Is(err, ErrRefreshTokenReused) {
+		c.JSON(http.StatusUnauthorized, common.NewError("refreshToken", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	roles, err := UserRoles(c.Request.Context(), session.UserModelID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	UpdateContextUserModel(c, session.UserModelID)
+	UpdateContextTokens(c, common.GenSessionToken(session.UserModelID, session.FamilyID, roles), refreshToken)
 	serializer := UserSerializer{c}
 	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
 }
 
+// Mail a reset link to the user of the email. The response is the same for an unknown email,
+// so it doesn't tell who is registered.
+func UsersPasswordForgot(c *gin.Context) {
+	passwordForgotValidator := NewPasswordForgotValidator()
+	if err := passwordForgotValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	userModel, err := FindOneUser(c.Request.Context(), &UserModel{Email: passwordForgotValidator.User.Email})
+	if err == nil {
+		err = SendPasswordReset(c.Request.Context(), userModel)
+	} else if gorm.IsRecordNotFoundError(err) {
+		err = nil
+	}
+	if err != nil {
+		logging.FromContext(c).Error("password reset mail not sent", "error", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"user": "Password reset mail sent"})
+}
+
+// Mail a login link to the user. Unknown emails, and emails which got too many links, get the
+// same answer, so it doesn't tell which emails are registered.
+func UsersMagicLink(c *gin.Context) {
+	magicLinkValidator := NewMagicLinkValidator()
+	if err := magicLinkValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	userModel, err := FindOneUser(c.Request.Context(), &UserModel{Email: magicLinkValidator.User.Email})
+	if err == nil {
+		err = SendMagicLink(c.Request.Context(), userModel)
+	} else if gorm.IsRecordNotFoundError(err) {
+		err = nil
+	}
+	if errors.Is(err, ErrMagicLinkLimited) {
+		logging.FromContext(c).Warn("login link not sent", "error", err, "user_id", userModel.ID)
+	} else if err != nil {
+		logging.FromContext(c).Error("login link not sent", "error", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"user": "Login link sent"})
+}
+
+// Log in with the token of a login link, the answer is the one of UsersLogin.
+func UsersMagicLinkRedeem(c *gin.Context) {
+	magicLinkRedeemValidator := NewMagicLinkRedeemValidator()
+	if err := magicLinkRedeemValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	userModel, err := RedeemMagicLink(c.Request.Context(), magicLinkRedeemValidator.User.Token)
+	if errors.Is(err, ErrMagicLinkInvalid) {
+		metrics.Logins.WithLabelValues(metrics.ResultFailure).Inc()
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("token", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	loginVerified(c, userModel)
+}
+
+// Start a login with the OpenID Connect provider, the frontend sends the user to the URL:
+// 	{"oidc":{"url":"https://accounts.example.com/authorize?client_id=..."}}
+func UsersOIDCAuthorize(c *gin.Context) {
+	provider := oidc.Get()
+	if provider == nil {
+		c.JSON(http.StatusNotFound, common.NewError("oidc", errors.New("The login with a provider is off")))
+		return
+	}
+	authURL, err := StartOIDCLogin(c.Request.Context(), provider)
+	if errors.Is(err, ErrOIDCProvider) {
+		logging.FromContext(c).Error("oidc login not started", "error", err)
+		c.JSON(http.StatusBadGateway, common.NewError("oidc", ErrOIDCProvider))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"oidc": gin.H{"url": authURL}})
+}
+
+// Finish the login with the code and the state the provider sent back to the frontend,
+// the answer is the one of UsersLogin.
+func UsersOIDCCallback(c *gin.Context) {
+	provider := oidc.Get()
+	if provider == nil {
+		c.JSON(http.StatusNotFound, common.NewError("oidc", errors.New("The login with a provider is off")))
+		return
+	}
+	oidcCallbackValidator := NewOIDCCallbackValidator()
+	if err := oidcCallbackValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	userModel, created, err := FinishOIDCLogin(c.Request.Context(), provider, oidcCallbackValidator.OIDC.Code, oidcCallbackValidator.OIDC.State)
+	if created {
+		metrics.UsersRegistered.Inc()
+	}
+	if err != nil {
+		metrics.Logins.WithLabelValues(metrics.ResultFailure).Inc()
+	}
+	switch {
+	case err == nil:
+		loginVerified(c, userModel)
+	case errors.Is(err, ErrOIDCStateInvalid):
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("state", err))
+	case errors.Is(err, ErrOIDCProvider):
+		// The details are for the logs, the user only learns the provider refused the login.
+		logging.FromContext(c).Warn("oidc login refused", "error", err)
+		c.JSON(http.StatusUnauthorized, common.NewError("oidc", ErrOIDCProvider))
+	case errors.Is(err, ErrOIDCEmailMissing), errors.Is(err, ErrOIDCEmailUnverified), errors.Is(err, ErrOIDCUserUnverified),
+		errors.Is(err, ErrOIDCSignupDisabled):
+		c.JSON(http.StatusForbidden, common.NewError("oidc", err))
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+	}
+}
+
+// Set the new password with the token of the reset mail, the user then logs in with it.
+func UsersPasswordReset(c *gin.Context) {
+	passwordResetValidator := NewPasswordResetValidator()
+	if err := passwordResetValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	_, err := ResetPassword(c.Request.Context(), passwordResetValidator.User.Token, passwordResetValidator.User.Password)
+	if errors.Is(err, ErrPasswordResetInvalid) {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("token", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": "Password reset success"})
+}
+
+// Confirm an email with the token of the verification mail, the user may be logged out.
+func UsersEmailConfirm(c *gin.Context) {
+	emailConfirmValidator := NewEmailConfirmValidator()
+	if err := emailConfirmValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	_, err := ConfirmEmail(c.Request.Context(), emailConfirmValidator.User.Token)
+	if errors.Is(err, ErrEmailVerificationInvalid) {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("token", err))
+		return
+	}
+	if errors.Is(err, ErrEmailTaken) {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("email", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": "Email confirmed"})
+}
+
+// Mail the verification link of the email of the user again.
+func UserEmailVerify(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if myUserModel.EmailVerified() {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("email", errors.New("Email already verified")))
+		return
+	}
+	if err := SendEmailVerification(c.Request.Context(), myUserModel, myUserModel.Email); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("email", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": "Verification mail sent"})
+}
+
+// Log out the session of the access token, its refresh token stops working too.
+func UserLogout(c *gin.Context) {
+	claims := c.MustGet("my_token_claims").(common.TokenClaims)
+	if err := GetRevocationStore().RevokeToken(c.Request.Context(), claims); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": "Logout success"})
+}
+
+// Log out every session of the user, e.g. after a token leaked.
+func UserLogoutAll(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	sessions, err := GetRevocationStore().RevokeUser(c.Request.Context(), myUserModel.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": "Logout success", "sessions": sessions})
+}
+
+// The sessions where the user is logged in, the one of the request is current.
+func SessionList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	sessions, err := ListSessions(c.Request.Context(), myUserModel.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := SessionsSerializer{c, sessions}
+	c.JSON(http.StatusOK, gin.H{"sessions": serializer.Response()})
+}
+
+// Log a session of the user out, e.g. a lost phone.
+func SessionDelete(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	err := RevokeUserSession(c.Request.Context(), myUserModel.ID, c.Param("id"))
+	if errors.Is(err, ErrSessionNotFound) {
+		c.JSON(http.StatusNotFound, common.NewError("session", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"session": "Delete success"})
+}
+
 func UserRetrieve(c *gin.Context) {
 	serializer := UserSerializer{c}
 	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
@@ -114,18 +567,295 @@ func UserRetrieve(c *gin.Context) {
 
 func UserUpdate(c *gin.Context) {
 	myUserModel := c.MustGet("my_user_model").(UserModel)
-	userModelValidator := NewUserModelValidatorFillWith(myUserModel)
+	userModelValidator := NewUserUpdateValidatorFillWith(myUserModel)
 	if err := userModelValidator.Bind(c); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
 		return
 	}
+	if userModelValidator.User.Password != "" {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("password", errors.New("Change the password with PUT /api/user/password")))
+		return
+	}
+
+	// A new email takes effect once it is confirmed with the link mailed to it, see ConfirmEmail.
+	newEmail := userModelValidator.userModel.Email
+	if newEmail != myUserModel.Email {
+		if _, err := FindOneUser(c.Request.Context(), &UserModel{Email: newEmail}); err == nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("email", ErrEmailTaken))
+			return
+		}
+		userModelValidator.userModel.Email = myUserModel.Email
+	}
 
 	userModelValidator.userModel.ID = myUserModel.ID
-	if err := myUserModel.Update(userModelValidator.userModel); err != nil {
+	if err := myUserModel.Update(c.Request.Context(), userModelValidator.userModel); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if newEmail != myUserModel.Email {
+		if err := SendEmailVerification(c.Request.Context(), myUserModel, newEmail); err != nil {
+			logging.FromContext(c).Error("email verification mail not sent", "error", err)
+		}
+	}
+	UpdateContextUserModel(c, myUserModel.ID)
+	serializer := UserSerializer{c}
+	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
+}
+
+// Change the password with the current one, the other sessions are logged out. A request without
+// a session, e.g. with a token of GenToken, is logged out too and gets a new session instead.
+func UserPasswordChange(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	claims := c.MustGet("my_token_claims").(common.TokenClaims)
+	passwordChangeValidator := NewPasswordChangeValidator()
+	if err := passwordChangeValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	// The current password is guessed like the one of a login, so it is throttled the same.
+	if loginThrottled(c, myUserModel.Email) {
+		return
+	}
+	err := ChangePassword(c.Request.Context(), myUserModel, claims.SessionID,
+		passwordChangeValidator.User.CurrentPassword, passwordChangeValidator.User.Password)
+	if errors.Is(err, ErrPasswordIncorrect) {
+		if err := RecordLoginFailure(c.Request.Context(), myUserModel.Email, c.ClientIP(), time.Now()); err != nil {
+			logging.FromContext(c).Warn("failed login not recorded", "error", err)
+		}
+		c.JSON(http.StatusForbidden, common.NewError("currentPassword", err))
+		return
+	}
+	if errors.Is(err, ErrPasswordNotSet) {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("password", err))
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
 	UpdateContextUserModel(c, myUserModel.ID)
+	if claims.SessionID == "" {
+		if err := issueTokens(c, myUserModel.ID); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+	}
 	serializer := UserSerializer{c}
 	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
 }
+
+func TwoFactorRetrieve(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	enabled, err := TwoFactorEnabled(c.Request.Context(), myUserModel.ID)
+	var recoveryCodes int
+	if err == nil && enabled {
+		recoveryCodes, err = CountRecoveryCodes(c.Request.Context(), myUserModel.ID)
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"twoFactor": gin.H{"enabled": enabled, "recoveryCodesLeft": recoveryCodes}})
+}
+
+// Start the enrolment: the secret to add to an authenticator app, and its otpauth:// URI for a QR code.
+func TwoFactorEnroll(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	twoFactor, uri, err := EnrollTwoFactor(c.Request.Context(), myUserModel)
+	if errors.Is(err, ErrTwoFactorEnabled) {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("twoFactor", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"twoFactor": gin.H{"secret": twoFactor.Secret, "uri": uri}})
+}
+
+// Turn the two-factor authentication on with a first code of the app, the recovery codes are only shown here.
+func TwoFactorConfirm(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	twoFactorCodeValidator := NewTwoFactorCodeValidator()
+	if err := twoFactorCodeValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	recoveryCodes, err := ConfirmTwoFactor(c.Request.Context(), myUserModel.ID, twoFactorCodeValidator.TwoFactor.Code)
+	twoFactorRecoveryCodesResponse(c, recoveryCodes, err)
+}
+
+// New recovery codes for a code, e.g. after most of them were used.
+func TwoFactorRecoveryCodes(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	twoFactorCodeValidator := NewTwoFactorCodeValidator()
+	if err := twoFactorCodeValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	recoveryCodes, err := RegenerateRecoveryCodes(c.Request.Context(), myUserModel.ID, twoFactorCodeValidator.TwoFactor.Code)
+	twoFactorRecoveryCodesResponse(c, recoveryCodes, err)
+}
+
+func twoFactorRecoveryCodesResponse(c *gin.Context, recoveryCodes []string, err error) {
+	if errors.Is(err, ErrTwoFactorCodeInvalid) {
+		c.JSON(http.StatusForbidden, common.NewError("code", err))
+		return
+	}
+	if errors.Is(err, ErrTwoFactorEnabled) || errors.Is(err, ErrTwoFactorNotEnabled) || errors.Is(err, ErrTwoFactorNotEnrolled) {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("twoFactor", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"twoFactor": gin.H{"enabled": true, "recoveryCodes": recoveryCodes}})
+}
+
+// Turn the two-factor authentication off for a code of the app or a recovery code.
+func TwoFactorDisable(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	twoFactorCodeValidator := NewTwoFactorCodeValidator()
+	if err := twoFactorCodeValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	err := DisableTwoFactor(c.Request.Context(), myUserModel.ID, twoFactorCodeValidator.TwoFactor.Code)
+	if errors.Is(err, ErrTwoFactorCodeInvalid) {
+		c.JSON(http.StatusForbidden, common.NewError("code", err))
+		return
+	}
+	if errors.Is(err, ErrTwoFactorNotEnabled) {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("twoFactor", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"twoFactor": gin.H{"enabled": false, "recoveryCodesLeft": 0}})
+}
+
+func PersonalAccessTokenList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	tokens, err := ListPersonalAccessTokens(c.Request.Context(), myUserModel.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := PersonalAccessTokensSerializer{c, tokens}
+	c.JSON(http.StatusOK, gin.H{"tokens": serializer.Response()})
+}
+
+// Create a personal access token, the response is the only one with the token itself:
+// 	{"token":{"id":1,"name":"ci","scopes":["articles:write"],...,"token":"rwpat_Qm9yaW5n..."}}
+func PersonalAccessTokenCreate(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	personalAccessTokenValidator := NewPersonalAccessTokenValidator()
+	if err := personalAccessTokenValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	input := personalAccessTokenValidator.Token
+	model, token, err := CreatePersonalAccessToken(c.Request.Context(), myUserModel.ID, input.Name, input.Scopes, input.ExpiresAt)
+	if errors.Is(err, ErrPersonalAccessTokenExpired) {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("expiresAt", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := PersonalAccessTokenSerializer{c, model}
+	response := serializer.Response()
+	response.Token = token
+	c.JSON(http.StatusCreated, gin.H{"token": response})
+}
+
+func PersonalAccessTokenDelete(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("token", ErrPersonalAccessTokenNotFound))
+		return
+	}
+	err = RevokePersonalAccessToken(c.Request.Context(), myUserModel.ID, uint(id))
+	if errors.Is(err, ErrPersonalAccessTokenNotFound) {
+		c.JSON(http.StatusNotFound, common.NewError("token", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"token": "Delete success"})
+}
+
+func RoleList(c *gin.Context) {
+	roles, err := ListRoles(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := RolesSerializer{c, roles}
+	c.JSON(http.StatusOK, gin.H{"roles": serializer.Response()})
+}
+
+// The roles of the user of :username after the change, or of a GET:
+// 	{"roles":["moderator"]}
+func userRolesResponse(c *gin.Context, userModel UserModel, err error) {
+	if errors.Is(err, ErrRoleNotFound) {
+		c.JSON(http.StatusNotFound, common.NewError("role", err))
+		return
+	}
+	if errors.Is(err, ErrLastAdmin) {
+		c.JSON(http.StatusConflict, common.NewError("role", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	roles, err := UserRoles(c.Request.Context(), userModel.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+func findRoleUser(c *gin.Context) (UserModel, bool) {
+	userModel, err := FindOneUser(c.Request.Context(), &UserModel{Username: c.Param("username")})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		return userModel, false
+	}
+	return userModel, true
+}
+
+func UserRoleList(c *gin.Context) {
+	if userModel, ok := findRoleUser(c); ok {
+		userRolesResponse(c, userModel, nil)
+	}
+}
+
+func UserRoleGrant(c *gin.Context) {
+	if userModel, ok := findRoleUser(c); ok {
+		err := GrantRole(c.Request.Context(), userModel.ID, c.Param("role"))
+		if err == nil {
+			logging.FromContext(c).Info("role granted", "user_id", userModel.ID, "role", c.Param("role"))
+		}
+		userRolesResponse(c, userModel, err)
+	}
+}
+
+func UserRoleRevoke(c *gin.Context) {
+	if userModel, ok := findRoleUser(c); ok {
+		err := RevokeRole(c.Request.Context(), userModel.ID, c.Param("role"))
+		if err == nil {
+			logging.FromContext(c).Info("role revoked", "user_id", userModel.ID, "role", c.Param("role"))
+		}
+		userRolesResponse(c, userModel, err)
+	}
+}
@@ -1,6 +1,9 @@
 package users
 
 import (
+	"strings"
+	"time"
+
 	"github.com/gin-gonic/gin"
 
 	"realworld-backend/common"
@@ -28,7 +31,7 @@ func (self *ProfileSerializer) Response() ProfileResponse {
 		Username:  self.Username,
 		Bio:       self.Bio,
 		Image:     self.Image,
-		Following: myUserModel.isFollowing(self.UserModel),
+		Following: myUserModel.isFollowing(self.C.Request.Context(), self.UserModel),
 	}
 	return profile
 }
@@ -37,22 +40,143 @@ type UserSerializer struct {
 	c *gin.Context
 }
 
+// Token is the access token of the request, or the new one after a login or a refresh,
+// which also give the RefreshToken to get the next access token with.
 type UserResponse struct {
-	Username string  `json:"username"`
-	Email    string  `json:"email"`
-	Bio      string  `json:"bio"`
-	Image    *string `json:"image"`
-	Token    string  `json:"token"`
+	Username      string  `json:"username"`
+	Email         string  `json:"email"`
+	EmailVerified bool    `json:"emailVerified"`
+	Bio           string  `json:"bio"`
+	Image         *string `json:"image"`
+	Token         string  `json:"token"`
+	RefreshToken  string  `json:"refreshToken,omitempty"`
 }
 
 func (self *UserSerializer) Response() UserResponse {
 	myUserModel := self.c.MustGet("my_user_model").(UserModel)
 	user := UserResponse{
-		Username: myUserModel.Username,
-		Email:    myUserModel.Email,
-		Bio:      myUserModel.Bio,
-		Image:    myUserModel.Image,
-		Token:    common.GenToken(myUserModel.ID),
+		Username:      myUserModel.Username,
+		Email:         myUserModel.Email,
+		EmailVerified: myUserModel.EmailVerified(),
+		Bio:           myUserModel.Bio,
+		Image:         myUserModel.Image,
+		Token:         self.c.GetString("my_access_token"),
+		RefreshToken:  self.c.GetString("my_refresh_token"),
 	}
 	return user
 }
+
+type SessionSerializer struct {
+	C *gin.Context
+	SessionModel
+}
+
+type SessionsSerializer struct {
+	C        *gin.Context
+	Sessions []SessionModel
+}
+
+// Current is the session of the access token of the request.
+type SessionResponse struct {
+	ID         string `json:"id"`
+	IP         string `json:"ip"`
+	UserAgent  string `json:"userAgent"`
+	CreatedAt  string `json:"createdAt"`
+	LastSeenAt string `json:"lastSeenAt"`
+	Current    bool   `json:"current"`
+}
+
+func (s *SessionSerializer) Response() SessionResponse {
+	var current bool
+	if claims, ok := s.C.Get("my_token_claims"); ok {
+		current = claims.(common.TokenClaims).SessionID == s.ID
+	}
+	return SessionResponse{
+		ID:         s.ID,
+		IP:         s.IP,
+		UserAgent:  s.UserAgent,
+		CreatedAt:  s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		LastSeenAt: s.LastSeenAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Current:    current,
+	}
+}
+
+func (s *SessionsSerializer) Response() []SessionResponse {
+	response := []SessionResponse{}
+	for _, session := range s.Sessions {
+		serializer := SessionSerializer{s.C, session}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
+
+type PersonalAccessTokenSerializer struct {
+	C *gin.Context
+	PersonalAccessTokenModel
+}
+
+type PersonalAccessTokensSerializer struct {
+	C      *gin.Context
+	Tokens []PersonalAccessTokenModel
+}
+
+// Token is the token itself, only in the response of its creation.
+type PersonalAccessTokenResponse struct {
+	ID         uint     `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"createdAt"`
+	ExpiresAt  *string  `json:"expiresAt"`
+	LastUsedAt *string  `json:"lastUsedAt"`
+	Token      string   `json:"token,omitempty"`
+}
+
+func formatTime(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	s := t.UTC().Format("2006-01-02T15:04:05.999Z")
+	return &s
+}
+
+func (s *PersonalAccessTokenSerializer) Response() PersonalAccessTokenResponse {
+	return PersonalAccessTokenResponse{
+		ID:         s.ID,
+		Name:       s.Name,
+		Scopes:     strings.Fields(s.Scopes),
+		CreatedAt:  s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		ExpiresAt:  formatTime(s.ExpiresAt),
+		LastUsedAt: formatTime(s.LastUsedAt),
+	}
+}
+
+func (s *PersonalAccessTokensSerializer) Response() []PersonalAccessTokenResponse {
+	response := []PersonalAccessTokenResponse{}
+	for _, token := range s.Tokens {
+		serializer := PersonalAccessTokenSerializer{s.C, token}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
+
+type RolesSerializer struct {
+	C     *gin.Context
+	Roles []RoleModel
+}
+
+type RoleResponse struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+func (s *RolesSerializer) Response() []RoleResponse {
+	response := []RoleResponse{}
+	for _, role := range s.Roles {
+		permissions := []string{}
+		for _, permission := range role.Permissions {
+			permissions = append(permissions, permission.Permission)
+		}
+		response = append(response, RoleResponse{Name: role.Name, Permissions: permissions})
+	}
+	return response
+}
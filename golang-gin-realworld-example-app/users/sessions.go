@@ -0,0 +1,148 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+	"realworld-backend/tracing"
+)
+
+// A login of the user, so the user can see where they are logged in. Its ID is the refresh
+// token family of the login, which is also the sid of its access tokens.
+//
+// A session lasts as long as its refresh tokens: ExpiresAt follows the refreshes.
+type SessionModel struct {
+	ID          string `gorm:"primary_key;size:32"`
+	UserModelID uint   `gorm:"index;not null"`
+	IP          string `gorm:"column:ip;size:45"`
+	UserAgent   string `gorm:"column:user_agent;size:255"`
+	CreatedAt   time.Time
+	LastSeenAt  time.Time
+	ExpiresAt   time.Time
+	RevokedAt   *time.Time
+}
+
+// The last seen time of a session is written at most once a sessionSeenInterval.
+const sessionSeenInterval = time.Minute
+
+// When each key was last written by this server, so the requests in between skip the UPDATE.
+// The keys older than a sessionSeenInterval are dropped once an interval.
+type seenThrottle struct {
+	mu      sync.Mutex
+	seen    map[string]time.Time
+	sweptAt time.Time
+}
+
+// Whether key is due to be written at now, it counts as written from then on.
+func (t *seenThrottle) due(key string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if last, ok := t.seen[key]; ok && now.Sub(last) < sessionSeenInterval {
+		return false
+	}
+	if t.seen == nil {
+		t.seen = map[string]time.Time{}
+	}
+	if now.Sub(t.sweptAt) >= sessionSeenInterval {
+		for seenKey, last := range t.seen {
+			if now.Sub(last) >= sessionSeenInterval {
+				delete(t.seen, seenKey)
+			}
+		}
+		t.sweptAt = now
+	}
+	t.seen[key] = now
+	return true
+}
+
+// The write of key failed, the next request tries again.
+func (t *seenThrottle) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.seen, key)
+}
+
+var sessionsSeen seenThrottle
+
+var ErrSessionNotFound = errors.New("Invalid session")
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// You could record the session of a new refresh token family.
+//
+//	session, err := CreateSession(ctx, refreshTokenModel, c.ClientIP(), c.Request.UserAgent())
+func CreateSession(ctx context.Context, family RefreshTokenModel, ip string, userAgent string) (SessionModel, error) {
+	ctx, span := tracing.Start(ctx, "users.CreateSession")
+	defer span.End()
+	session := SessionModel{
+		ID:          family.FamilyID,
+		UserModelID: family.UserModelID,
+		IP:          truncate(ip, 45),
+		UserAgent:   truncate(userAgent, 255),
+		CreatedAt:   family.CreatedAt,
+		LastSeenAt:  family.CreatedAt,
+		ExpiresAt:   family.ExpiresAt,
+	}
+	err := common.GetDBContext(ctx).Create(&session).Error
+	return session, err
+}
+
+// The sessions of the user which are neither revoked nor expired, the last seen first.
+//
+//	sessions, err := ListSessions(ctx, myUserModel.ID)
+func ListSessions(ctx context.Context, userID uint) ([]SessionModel, error) {
+	ctx, span := tracing.Start(ctx, "users.ListSessions")
+	defer span.End()
+	var sessions []SessionModel
+	err := common.GetDBContext(ctx).
+		Where("user_model_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at desc").Find(&sessions).Error
+	return sessions, err
+}
+
+// You could revoke a session of the user: its refresh tokens and its access tokens stop working.
+// The sessions of the other users, revoked or expired ones give ErrSessionNotFound.
+//
+//	err := RevokeUserSession(ctx, myUserModel.ID, c.Param("id"))
+func RevokeUserSession(ctx context.Context, userID uint, id string) error {
+	ctx, span := tracing.Start(ctx, "users.RevokeUserSession")
+	defer span.End()
+	var session SessionModel
+	err := common.GetDBContext(ctx).
+		Where("id = ? AND user_model_id = ? AND revoked_at IS NULL AND expires_at > ?", id, userID, time.Now()).
+		First(&session).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return GetRevocationStore().RevokeSession(ctx, userID, session.ID)
+}
+
+// Record that the session was just used from ip. A session is written once a sessionSeenInterval
+// by each server, the last_seen_at condition keeps the other servers from writing it again.
+func touchSession(ctx context.Context, id string, ip string, now time.Time) error {
+	if !sessionsSeen.due(id, now) {
+		return nil
+	}
+	ctx, span := tracing.Start(ctx, "users.touchSession")
+	defer span.End()
+	err := common.GetDBContext(ctx).Model(&SessionModel{}).
+		Where("id = ? AND last_seen_at < ?", id, now.Add(-sessionSeenInterval)).
+		Updates(map[string]interface{}{"last_seen_at": now, "ip": truncate(ip, 45)}).Error
+	if err != nil {
+		sessionsSeen.forget(id)
+	}
+	return err
+}
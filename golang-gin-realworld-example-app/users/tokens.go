@@ -0,0 +1,150 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/tracing"
+)
+
+// The refresh tokens are random strings, the database only keeps their sha256.
+//
+// A login starts a family of tokens. Every refresh uses up the token and gives the next one of
+// its family, so a used token showing up again means two clients hold the same family: one of
+// them stole it. The whole family is revoked and the user has to log in again.
+//
+// The family is the session of the login: its ID is the sid of the access tokens.
+type RefreshTokenModel struct {
+	ID          uint   `gorm:"primary_key"`
+	UserModelID uint   `gorm:"index;not null"`
+	FamilyID    string `gorm:"column:family_id;size:32;index;not null"`
+	TokenHash   string `gorm:"column:token_hash;size:64;unique_index;not null"`
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	UsedAt      *time.Time
+	RevokedAt   *time.Time
+}
+
+var (
+	ErrRefreshTokenInvalid = errors.New("Invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("Refresh token already used, please log in again")
+)
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Save a new token of the family, only its hash goes to the database.
+func saveRefreshToken(db *gorm.DB, userID uint, familyID string, now time.Time) (RefreshTokenModel, string, error) {
+	model := RefreshTokenModel{
+		UserModelID: userID,
+		FamilyID:    familyID,
+		ExpiresAt:   now.Add(config.Get().JWT.RefreshTokenLifetime),
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return model, "", err
+	}
+	model.TokenHash = hashToken(token)
+	err = db.Create(&model).Error
+	return model, token, err
+}
+
+// You could start a new family of refresh tokens when the user logs in.
+//
+//	model, refreshToken, err := IssueRefreshToken(ctx, userModel.ID)
+//	accessToken := common.GenSessionToken(userModel.ID, model.FamilyID, roles)
+func IssueRefreshToken(ctx context.Context, userID uint) (RefreshTokenModel, string, error) {
+	ctx, span := tracing.Start(ctx, "users.IssueRefreshToken")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	familyID, err := randomToken(12)
+	if err != nil {
+		return RefreshTokenModel{}, "", err
+	}
+	return saveRefreshToken(db, userID, familyID, time.Now())
+}
+
+// You could trade a refresh token for the next one of its family.
+// A token used twice revokes its family and returns ErrRefreshTokenReused with its model.
+//
+//	model, refreshToken, err := RotateRefreshToken(ctx, token)
+func RotateRefreshToken(ctx context.Context, token string) (RefreshTokenModel, string, error) {
+	ctx, span := tracing.Start(ctx, "users.RotateRefreshToken")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	var model RefreshTokenModel
+	err := db.Where(&RefreshTokenModel{TokenHash: hashToken(token)}).First(&model).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return model, "", ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return model, "", err
+	}
+	now := time.Now()
+	if model.RevokedAt != nil || !now.Before(model.ExpiresAt) {
+		return model, "", ErrRefreshTokenInvalid
+	}
+	if model.UsedAt != nil {
+		return model, "", revokeReusedFamily(ctx, model)
+	}
+
+	tx := db.Begin()
+	// The condition on used_at makes the loser of two concurrent refreshes a reuse too.
+	result := tx.Model(&RefreshTokenModel{}).Where("id = ? AND used_at IS NULL", model.ID).Update("used_at", now)
+	if result.Error != nil {
+		tx.Rollback()
+		return model, "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return model, "", revokeReusedFamily(ctx, model)
+	}
+	next, nextToken, err := saveRefreshToken(tx, model.UserModelID, model.FamilyID, now)
+	if err == nil {
+		err = tx.Model(&SessionModel{}).Where("id = ?", model.FamilyID).
+			Updates(map[string]interface{}{"expires_at": next.ExpiresAt, "last_seen_at": now}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return next, "", err
+	}
+	return next, nextToken, tx.Commit().Error
+}
+
+// A reuse means the session is in two hands, its access tokens are revoked with its refresh tokens.
+func revokeReusedFamily(ctx context.Context, model RefreshTokenModel) error {
+	if err := GetRevocationStore().RevokeSession(ctx, model.UserModelID, model.FamilyID); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// The families of the user whose access tokens may still be alive: the ones not revoked yet
+// whose refresh tokens expired less than an access token lifetime ago.
+func liveRefreshTokenFamilies(db *gorm.DB, userID uint, now time.Time) ([]string, error) {
+	var families []string
+	err := db.Model(&RefreshTokenModel{}).
+		Where("user_model_id = ? AND revoked_at IS NULL AND expires_at > ?",
+			userID, now.Add(-config.Get().JWT.TokenLifetime)).
+		Pluck("DISTINCT family_id", &families).Error
+	return families, err
+}
@@ -0,0 +1,411 @@
+package users
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/tracing"
+)
+
+// The TOTP of RFC 6238 as the authenticator apps expect it: HMAC-SHA1, 6 digits, 30s steps.
+// A code of the step before or after the current one works too, for the clocks apart.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpSkew   = 1
+
+	recoveryCodeCount          = 10
+	twoFactorChallengeAttempts = 5
+)
+
+// The TOTP secret of a user. The two-factor authentication is on once EnabledAt is set, by a
+// code of the secret. LastStep is the step of the last code used, so a code works once.
+type TwoFactorModel struct {
+	ID          uint   `gorm:"primary_key"`
+	UserModelID uint   `gorm:"unique_index;not null"`
+	Secret      string `gorm:"column:secret;size:32;not null"`
+	LastStep    int64  `gorm:"not null"`
+	CreatedAt   time.Time
+	EnabledAt   *time.Time
+}
+
+// The recovery codes of a user, for a lost phone. Like the tokens, only their sha256 is saved.
+type RecoveryCodeModel struct {
+	ID          uint   `gorm:"primary_key"`
+	UserModelID uint   `gorm:"index;not null"`
+	CodeHash    string `gorm:"column:code_hash;size:64;not null"`
+	UsedAt      *time.Time
+}
+
+// The first step of a login with two-factor authentication: the password was right, the code comes
+// with the token of the challenge. It works once, for twoFactorChallengeAttempts codes at most.
+type TwoFactorChallengeModel struct {
+	ID          uint   `gorm:"primary_key"`
+	UserModelID uint   `gorm:"index;not null"`
+	TokenHash   string `gorm:"column:token_hash;size:64;unique_index;not null"`
+	Attempts    int    `gorm:"not null"`
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	UsedAt      *time.Time
+}
+
+var (
+	ErrTwoFactorEnabled          = errors.New("Two-factor authentication already enabled")
+	ErrTwoFactorNotEnabled       = errors.New("Two-factor authentication is not enabled")
+	ErrTwoFactorNotEnrolled      = errors.New("Start the two-factor enrolment first")
+	ErrTwoFactorCodeInvalid      = errors.New("Invalid two-factor code")
+	ErrTwoFactorChallengeInvalid = errors.New("Invalid or expired two-factor challenge")
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// The code of the secret at the step, RFC 4226 with the step as the counter.
+func totpCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// The step of the code at now, it has to come after the last step used.
+func (m TwoFactorModel) matchCode(code string, now time.Time) (int64, bool) {
+	secret, err := base32NoPadding.DecodeString(m.Secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > m.LastStep && hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// The URI of the QR code for the authenticator apps, see
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func totpURI(secret string, account string) string {
+	issuer := config.Get().Auth.TwoFactorIssuer
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + query.Encode()
+}
+
+// A recovery code as it is typed, e.g. "abcde-fghij", lower case letters and digits.
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32NoPadding.EncodeToString(b))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+// The two-factor settings of the user, gorm.ErrRecordNotFound when they never enrolled.
+//
+//	twoFactor, err := FindTwoFactor(ctx, myUserModel.ID)
+func FindTwoFactor(ctx context.Context, userID uint) (TwoFactorModel, error) {
+	ctx, span := tracing.Start(ctx, "users.FindTwoFactor")
+	defer span.End()
+	var model TwoFactorModel
+	err := common.GetDBContext(ctx).Where("user_model_id = ?", userID).First(&model).Error
+	return model, err
+}
+
+// Whether a login of the user needs a code after the password.
+//
+//	enabled, err := TwoFactorEnabled(ctx, userModel.ID)
+func TwoFactorEnabled(ctx context.Context, userID uint) (bool, error) {
+	model, err := FindTwoFactor(ctx, userID)
+	if gorm.IsRecordNotFoundError(err) {
+		return false, nil
+	}
+	return err == nil && model.EnabledAt != nil, err
+}
+
+// You could start the enrolment of the user: a new secret, to add to an authenticator app with
+// its otpauth:// URI. Nothing changes until ConfirmTwoFactor with a code of the app.
+//
+//	twoFactor, uri, err := EnrollTwoFactor(ctx, myUserModel)
+func EnrollTwoFactor(ctx context.Context, userModel UserModel) (TwoFactorModel, string, error) {
+	ctx, span := tracing.Start(ctx, "users.EnrollTwoFactor")
+	defer span.End()
+	model, err := FindTwoFactor(ctx, userModel.ID)
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return model, "", err
+	}
+	if model.EnabledAt != nil {
+		return model, "", ErrTwoFactorEnabled
+	}
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return model, "", err
+	}
+	model.UserModelID = userModel.ID
+	model.Secret = base32NoPadding.EncodeToString(secret)
+	model.LastStep = 0
+	model.CreatedAt = time.Now()
+	if err := common.GetDBContext(ctx).Save(&model).Error; err != nil {
+		return model, "", err
+	}
+	return model, totpURI(model.Secret, userModel.Email), nil
+}
+
+// Replace the recovery codes of the user, the codes are only returned here.
+func saveRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_model_id = ?", userID).Delete(RecoveryCodeModel{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		model := RecoveryCodeModel{UserModelID: userID, CodeHash: hashToken(normalizeRecoveryCode(code))}
+		if err := tx.Create(&model).Error; err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+	return codes, nil
+}
+
+// You could turn the two-factor authentication of the user on with a code of the enrolled secret,
+// it returns the recovery codes to write down.
+//
+//	recoveryCodes, err := ConfirmTwoFactor(ctx, myUserModel.ID, "123456")
+func ConfirmTwoFactor(ctx context.Context, userID uint, code string) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "users.ConfirmTwoFactor")
+	defer span.End()
+	model, err := FindTwoFactor(ctx, userID)
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if model.EnabledAt != nil {
+		return nil, ErrTwoFactorEnabled
+	}
+	now := time.Now()
+	step, ok := model.matchCode(code, now)
+	if !ok {
+		return nil, ErrTwoFactorCodeInvalid
+	}
+	tx := common.GetDBContext(ctx).Begin()
+	result := tx.Model(&TwoFactorModel{}).Where("id = ? AND enabled_at IS NULL", model.ID).
+		Updates(map[string]interface{}{"enabled_at": now, "last_step": step})
+	if result.Error == nil && result.RowsAffected == 0 {
+		result.Error = ErrTwoFactorEnabled
+	}
+	if result.Error != nil {
+		tx.Rollback()
+		return nil, result.Error
+	}
+	codes, err := saveRecoveryCodes(tx, userID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return codes, tx.Commit().Error
+}
+
+// Use a code of the app or a recovery code of the user, either works once.
+func useTwoFactorCode(db *gorm.DB, userID uint, code string, now time.Time) error {
+	var model TwoFactorModel
+	err := db.Where("user_model_id = ? AND enabled_at IS NOT NULL", userID).First(&model).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return err
+	}
+	var result *gorm.DB
+	if step, ok := model.matchCode(code, now); ok {
+		// The condition on last_step keeps a code from working twice under concurrent logins too.
+		result = db.Model(&TwoFactorModel{}).Where("id = ? AND last_step < ?", model.ID, step).Update("last_step", step)
+	} else {
+		result = db.Model(&RecoveryCodeModel{}).
+			Where("user_model_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(normalizeRecoveryCode(code))).
+			Update("used_at", now)
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTwoFactorCodeInvalid
+	}
+	return nil
+}
+
+// The recovery codes of the user which were not used yet.
+//
+//	count, err := CountRecoveryCodes(ctx, myUserModel.ID)
+func CountRecoveryCodes(ctx context.Context, userID uint) (int, error) {
+	ctx, span := tracing.Start(ctx, "users.CountRecoveryCodes")
+	defer span.End()
+	var count int
+	err := common.GetDBContext(ctx).Model(&RecoveryCodeModel{}).
+		Where("user_model_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// You could give the user new recovery codes for a code, the old ones stop working.
+//
+//	recoveryCodes, err := RegenerateRecoveryCodes(ctx, myUserModel.ID, "123456")
+func RegenerateRecoveryCodes(ctx context.Context, userID uint, code string) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "users.RegenerateRecoveryCodes")
+	defer span.End()
+	tx := common.GetDBContext(ctx).Begin()
+	if err := useTwoFactorCode(tx, userID, code, time.Now()); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	codes, err := saveRecoveryCodes(tx, userID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return codes, tx.Commit().Error
+}
+
+func deleteTwoFactor(tx *gorm.DB, userID uint) error {
+	err := tx.Where("user_model_id = ?", userID).Delete(TwoFactorModel{}).Error
+	if err == nil {
+		err = tx.Where("user_model_id = ?", userID).Delete(RecoveryCodeModel{}).Error
+	}
+	if err == nil {
+		err = tx.Where("user_model_id = ?", userID).Delete(TwoFactorChallengeModel{}).Error
+	}
+	return err
+}
+
+// You could turn the two-factor authentication of the user off for a code, with the secret and
+// the recovery codes.
+//
+//	err := DisableTwoFactor(ctx, myUserModel.ID, "123456")
+func DisableTwoFactor(ctx context.Context, userID uint, code string) error {
+	ctx, span := tracing.Start(ctx, "users.DisableTwoFactor")
+	defer span.End()
+	tx := common.GetDBContext(ctx).Begin()
+	err := useTwoFactorCode(tx, userID, code, time.Now())
+	if err == nil {
+		err = deleteTwoFactor(tx, userID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// You could turn the two-factor authentication of the user off without a code, for the admins.
+//
+//	err := ResetTwoFactor(userModel.ID)
+func ResetTwoFactor(userID uint) error {
+	tx := common.GetDB().Begin()
+	if err := deleteTwoFactor(tx, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// You could start a login of the user with two-factor authentication, after the password.
+// The token goes with the code to VerifyTwoFactorChallenge within auth.two_factor_challenge_lifetime.
+//
+//	challenge, token, err := CreateTwoFactorChallenge(ctx, userModel.ID)
+func CreateTwoFactorChallenge(ctx context.Context, userID uint) (TwoFactorChallengeModel, string, error) {
+	ctx, span := tracing.Start(ctx, "users.CreateTwoFactorChallenge")
+	defer span.End()
+	token, err := randomToken(32)
+	if err != nil {
+		return TwoFactorChallengeModel{}, "", err
+	}
+	model := TwoFactorChallengeModel{
+		UserModelID: userID,
+		TokenHash:   hashToken(token),
+		ExpiresAt:   time.Now().Add(config.Get().Auth.TwoFactorChallengeLifetime),
+	}
+	err = common.GetDBContext(ctx).Create(&model).Error
+	return model, token, err
+}
+
+// The challenge of the token while it may still take a code, else ErrTwoFactorChallengeInvalid.
+//
+//	challenge, err := FindTwoFactorChallenge(ctx, token)
+func FindTwoFactorChallenge(ctx context.Context, token string) (TwoFactorChallengeModel, error) {
+	ctx, span := tracing.Start(ctx, "users.FindTwoFactorChallenge")
+	defer span.End()
+	var model TwoFactorChallengeModel
+	err := common.GetDBContext(ctx).Where(&TwoFactorChallengeModel{TokenHash: hashToken(token)}).First(&model).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return model, ErrTwoFactorChallengeInvalid
+	}
+	if err != nil {
+		return model, err
+	}
+	if model.UsedAt != nil || model.Attempts >= twoFactorChallengeAttempts || !time.Now().Before(model.ExpiresAt) {
+		return model, ErrTwoFactorChallengeInvalid
+	}
+	return model, nil
+}
+
+// You could finish the login of the challenge with a code of the app or a recovery code. A wrong
+// code uses an attempt of the challenge, the right one uses the challenge.
+//
+//	err := VerifyTwoFactorChallenge(ctx, challenge, "123456")
+func VerifyTwoFactorChallenge(ctx context.Context, challenge TwoFactorChallengeModel, code string) error {
+	ctx, span := tracing.Start(ctx, "users.VerifyTwoFactorChallenge")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	// The attempt is counted first, so concurrent codes can't go past the limit.
+	result := db.Model(&TwoFactorChallengeModel{}).
+		Where("id = ? AND used_at IS NULL AND attempts < ?", challenge.ID, twoFactorChallengeAttempts).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTwoFactorChallengeInvalid
+	}
+	now := time.Now()
+	tx := db.Begin()
+	err := useTwoFactorCode(tx, challenge.UserModelID, code, now)
+	if err == nil {
+		result = tx.Model(&TwoFactorChallengeModel{}).Where("id = ? AND used_at IS NULL", challenge.ID).Update("used_at", now)
+		if err = result.Error; err == nil && result.RowsAffected == 0 {
+			err = ErrTwoFactorChallengeInvalid
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
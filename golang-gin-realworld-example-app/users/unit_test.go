@@ -1,6 +1,9 @@
 package users
 
 import (
+	"context"
+	"encoding/json"
+	"time"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -11,13 +14,26 @@ import (
 	"net/http/httptest"
 	"os"
 	"realworld-backend/common"
-	_ "regexp"
+	"realworld-backend/config"
+	"realworld-backend/mail"
+	"realworld-backend/metrics"
+	"realworld-backend/oidc"
+	"realworld-backend/oidc/oidctest"
+	"regexp"
+	"strings"
+	"sync"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var image_url = "https://golang.org/doc/gopher/frontpage.png"
+
+// Every SQL backend words the unique violation of user_models.email in its own way.
+var uniqueEmailError = `(UNIQUE constraint failed: user_models.email|pq: duplicate key value violates unique constraint \\"uix_user_models_email\\"|Error 1062: Duplicate entry .* for key '(user_models.)?uix_user_models_email')`
 var test_db *gorm.DB
 
 func newUserModel() UserModel {
@@ -78,19 +94,74 @@ func TestUserModel(t *testing.T) {
 	a := users[0]
 	b := users[1]
 	c := users[2]
-	asserts.Equal(0, len(a.GetFollowings()), "GetFollowings should be right before following")
-	asserts.Equal(false, a.isFollowing(b), "isFollowing relationship should be right at init")
-	a.following(b)
-	asserts.Equal(1, len(a.GetFollowings()), "GetFollowings should be right after a following b")
-	asserts.Equal(true, a.isFollowing(b), "isFollowing should be right after a following b")
-	a.following(c)
-	asserts.Equal(2, len(a.GetFollowings()), "GetFollowings be right after a following c")
-	asserts.EqualValues(b, a.GetFollowings()[0], "GetFollowings should be right")
-	asserts.EqualValues(c, a.GetFollowings()[1], "GetFollowings should be right")
-	a.unFollowing(b)
-	asserts.Equal(1, len(a.GetFollowings()), "GetFollowings should be right after a unFollowing b")
-	asserts.EqualValues(c, a.GetFollowings()[0], "GetFollowings should be right after a unFollowing b")
-	asserts.Equal(false, a.isFollowing(b), "isFollowing should be right after a unFollowing b")
+	asserts.Equal(0, len(a.GetFollowings(context.Background())), "GetFollowings should be right before following")
+	asserts.Equal(false, a.isFollowing(context.Background(), b), "isFollowing relationship should be right at init")
+	a.following(context.Background(), b)
+	asserts.Equal(1, len(a.GetFollowings(context.Background())), "GetFollowings should be right after a following b")
+	asserts.Equal(true, a.isFollowing(context.Background(), b), "isFollowing should be right after a following b")
+	a.following(context.Background(), c)
+	asserts.Equal(2, len(a.GetFollowings(context.Background())), "GetFollowings be right after a following c")
+	asserts.EqualValues(b, a.GetFollowings(context.Background())[0], "GetFollowings should be right")
+	asserts.EqualValues(c, a.GetFollowings(context.Background())[1], "GetFollowings should be right")
+	a.unFollowing(context.Background(), b)
+	asserts.Equal(1, len(a.GetFollowings(context.Background())), "GetFollowings should be right after a unFollowing b")
+	asserts.EqualValues(c, a.GetFollowings(context.Background())[0], "GetFollowings should be right after a unFollowing b")
+	asserts.Equal(false, a.isFollowing(context.Background(), b), "isFollowing should be right after a unFollowing b")
+}
+
+func TestUserModelValidatorValidate(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	userModelValidator := NewUserModelValidator()
+	userModelValidator.User.Username = "admin0"
+	userModelValidator.User.Email = "admin0@linkedin.com"
+	userModelValidator.User.Password = "password123"
+	userModel, err := userModelValidator.Validate()
+	asserts.NoError(err, "valid data should be validated")
+	asserts.Equal("admin0", userModel.Username)
+	asserts.NoError(userModel.checkPassword("password123"), "password should be hashed into the model")
+
+	userModelValidator = NewUserModelValidator()
+	userModelValidator.User.Username = "ad"
+	userModelValidator.User.Email = "admin0"
+	_, err = userModelValidator.Validate()
+	asserts.Error(err, "invalid data should return err")
+
+	asserts.NoError(ValidatePassword("password124"))
+	asserts.Error(ValidatePassword("pas"), "a short password should return err")
+}
+
+func TestUserModelAdmin(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	users := userModelMocker(2)
+	a := users[0]
+	b := users[1]
+	roles, _ := UserRoles(context.Background(), a.ID)
+	asserts.Empty(roles, "users should not be admin by default")
+	asserts.NoError(GrantRole(context.Background(), a.ID, RoleAdmin))
+	asserts.NoError(GrantRole(context.Background(), b.ID, RoleAdmin))
+	roles, _ = UserRoles(context.Background(), a.ID)
+	asserts.Equal([]string{RoleAdmin}, roles, "GrantRole should promote the user")
+	asserts.NoError(RevokeRole(context.Background(), a.ID, RoleAdmin))
+	roles, _ = UserRoles(context.Background(), a.ID)
+	asserts.Empty(roles, "RevokeRole should revoke the admin")
+	asserts.NoError(GrantRole(context.Background(), a.ID, RoleModerator))
+
+	a.following(context.Background(), b)
+	b.following(context.Background(), a)
+	asserts.NoError(DeleteUserModel(a))
+	_, err := FindOneUser(context.Background(), &UserModel{ID: a.ID})
+	asserts.Error(err, "deleted user should not be found")
+	asserts.Equal(0, len(b.GetFollowings(context.Background())), "following relationships to the deleted user should be gone")
+	var count int
+	test_db.Unscoped().Model(&FollowModel{}).Count(&count)
+	asserts.Equal(0, count, "following relationships should be deleted for real")
+	test_db.Model(&UserRoleModel{}).Where("user_model_id = ?", a.ID).Count(&count)
+	asserts.Equal(0, count, "the roles should go with their user")
+	asserts.Error(DeleteUserModel(a), "deleting a missing user should return err")
 }
 
 //Reset test DB and create new one with mock data
@@ -106,6 +177,24 @@ func HeaderTokenMock(req *http.Request, u uint) {
 	req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(u)))
 }
 
+// Serve a request with a JSON body on r, the token goes to the Authorization header unless it is
+// empty. The options change the request before it is served, e.g. its User-Agent.
+//
+//	code, body := RequestMock(r, "POST", "/user/logout", "", token)
+func RequestMock(r http.Handler, method, url, body, token string, options ...func(*http.Request)) (int, string) {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	for _, option := range options {
+		option(req)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code, w.Body.String()
+}
+
 //You could write the init logic like reset database code here
 var unauthRequestTests = []struct {
 	init           func(*http.Request)
@@ -128,7 +217,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "jakejxke"}}`,
 		http.StatusCreated,
-		`{"user":{"username":"wangzitian0","email":"wzt@gg.cn","bio":"","image":null,"token":"([a-zA-Z0-9-_.]{115})"}}`,
+		`{"user":{"username":"wangzitian0","email":"wzt@gg.cn","emailVerified":false,"bio":"","image":null,"token":"([a-zA-Z0-9-_.]{232})","refreshToken":"([a-zA-Z0-9-_]{43})"}}`,
 		"valid data and should return StatusCreated",
 	},
 	{
@@ -137,7 +226,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "jakejxke"}}`,
 		http.StatusUnprocessableEntity,
-		`{"errors":{"database":"UNIQUE constraint failed: user_models.email"}}`,
+		`{"errors":{"database":"` + uniqueEmailError + `"}}`,
 		"duplicated data and should return StatusUnprocessableEntity",
 	},
 	{
@@ -177,7 +266,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"email": "user1@linkedin.com","password": "password123"}}`,
 		http.StatusOK,
-		`{"user":{"username":"user1","email":"user1@linkedin.com","bio":"bio1","image":"http://image/1.jpg","token":"([a-zA-Z0-9-_.]{115})"}}`,
+		`{"user":{"username":"user1","email":"user1@linkedin.com","emailVerified":false,"bio":"bio1","image":"http://image/1.jpg","token":"([a-zA-Z0-9-_.]{232})","refreshToken":"([a-zA-Z0-9-_]{43})"}}`,
 		"right info login should return user",
 	},
 	{
@@ -248,7 +337,7 @@ var unauthRequestTests = []struct {
 		"GET",
 		``,
 		http.StatusOK,
-		`{"user":{"username":"user1","email":"user1@linkedin.com","bio":"bio1","image":"http://image/1.jpg","token":"([a-zA-Z0-9-_.]{115})"}}`,
+		`{"user":{"username":"user1","email":"user1@linkedin.com","emailVerified":false,"bio":"bio1","image":"http://image/1.jpg","token":"([a-zA-Z0-9-_.]{199})"}}`,
 		"request should return current user with token",
 	},
 
@@ -296,10 +385,10 @@ var unauthRequestTests = []struct {
 		},
 		"/user/",
 		"PUT",
-		`{"user":{"username":"user123","password": "password126","email":"user123@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg"}}`,
+		`{"user":{"username":"user123","email":"user123@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg"}}`,
 		http.StatusOK,
-		`{"user":{"username":"user123","email":"user123@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg","token":"([a-zA-Z0-9-_.]{115})"}}`,
-		"current user profile should be changed",
+		`{"user":{"username":"user123","email":"user1@linkedin.com","emailVerified":false,"bio":"bio123","image":"http://hehe/123.jpg","token":"([a-zA-Z0-9-_.]{199})"}}`,
+		"current user profile should be changed, the email once confirmed",
 	},
 	{
 		func(req *http.Request) {
@@ -316,10 +405,10 @@ var unauthRequestTests = []struct {
 		func(req *http.Request) {},
 		"/users/login",
 		"POST",
-		`{"user":{"email": "user123@linkedin.com","password": "password126"}}`,
+		`{"user":{"email": "user1@linkedin.com","password": "password123"}}`,
 		http.StatusOK,
-		`{"user":{"username":"user123","email":"user123@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg","token":"([a-zA-Z0-9-_.]{115})"}}`,
-		"user should login using new password after changed",
+		`{"user":{"username":"user123","email":"user1@linkedin.com","emailVerified":false,"bio":"bio123","image":"http://hehe/123.jpg","token":"([a-zA-Z0-9-_.]{232})","refreshToken":"([a-zA-Z0-9-_]{43})"}}`,
+		"user should login with the same password after the profile changed",
 	},
 	{
 		func(req *http.Request) {
@@ -327,10 +416,10 @@ var unauthRequestTests = []struct {
 		},
 		"/user/",
 		"PUT",
-		`{"user":{"password": "pas"}}`,
+		`{"user":{"password": "password126"}}`,
 		http.StatusUnprocessableEntity,
-		`{"errors":{"Password":"{min: 8}"}}`,
-		"current user profile should not be changed with error user info",
+		`{"errors":{"password":"Change the password with PUT /api/user/password"}}`,
+		"the password should not be changed with the profile",
 	},
 
 	//---------------------   Testing for db errors   ---------------------
@@ -352,10 +441,10 @@ var unauthRequestTests = []struct {
 		},
 		"/user/",
 		"PUT",
-		`{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "jakejxke"}}`,
+		`{"user":{"username": "wangzitian0","email": "user2@linkedin.com"}}`,
 		http.StatusUnprocessableEntity,
-		`{"errors":{"database":"UNIQUE constraint failed: user_models.email"}}`,
-		"cheat validator and test database connecting error for user update",
+		`{"errors":{"email":"Email already registered"}}`,
+		"cheat validator and test the email of another user for user update",
 	},
 	{
 		func(req *http.Request) {
@@ -483,8 +572,1355 @@ func TestWithoutAuth(t *testing.T) {
 	}
 }
 
+func TestUsersMetrics(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	post := func(url, body string) int {
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	registered := testutil.ToFloat64(metrics.UsersRegistered)
+	succeeded := testutil.ToFloat64(metrics.Logins.WithLabelValues(metrics.ResultSuccess))
+	failed := testutil.ToFloat64(metrics.Logins.WithLabelValues(metrics.ResultFailure))
+
+	asserts.Equal(http.StatusCreated, post("/users/", `{"user":{"username": "metrics1","email": "metrics@gg.cn","password": "jakejxke"}}`))
+	asserts.Equal(http.StatusUnprocessableEntity, post("/users/", `{"user":{"username": "metrics1","email": "metrics@gg.cn","password": "jakejxke"}}`))
+	asserts.Equal(http.StatusOK, post("/users/login", `{"user":{"email": "metrics@gg.cn","password": "jakejxke"}}`))
+	asserts.Equal(http.StatusForbidden, post("/users/login", `{"user":{"email": "metrics@gg.cn","password": "wrongpass"}}`))
+	asserts.Equal(http.StatusForbidden, post("/users/login", `{"user":{"email": "nobody@gg.cn","password": "jakejxke"}}`))
+
+	asserts.Equal(registered+1, testutil.ToFloat64(metrics.UsersRegistered), "only the saved user should be counted")
+	asserts.Equal(succeeded+1, testutil.ToFloat64(metrics.Logins.WithLabelValues(metrics.ResultSuccess)))
+	asserts.Equal(failed+2, testutil.ToFloat64(metrics.Logins.WithLabelValues(metrics.ResultFailure)))
+}
+
+func TestJWKS(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	test_db.AutoMigrate(&common.SigningKey{})
+	defer func() {
+		test_db.DropTableIfExists(&common.SigningKey{})
+		common.GetKeyring().Reload()
+	}()
+
+	r := gin.New()
+	JWKSRegister(r.Group("/.well-known"))
+	r.Use(AuthMiddleware(true))
+	UserRegister(r.Group("/user"))
+	get := func(url, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Token "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	hmacToken := common.GenToken(1)
+
+	key, err := common.AddSigningKey(common.AlgorithmEdDSA, true)
+	asserts.NoError(err)
+	asserts.NoError(common.GetKeyring().Reload())
+	w := get("/.well-known/jwks.json", "")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("public, max-age=60", w.Header().Get("Cache-Control"))
+	asserts.Regexp(`^{"keys":\[{"kid":"`+key.KID+`","kty":"OKP","alg":"EdDSA","use":"sig","crv":"Ed25519","x":"[A-Za-z0-9_-]{43}"}\]}$`, w.Body.String())
+
+	edToken := common.GenToken(1)
+	asserts.Equal(http.StatusOK, get("/user/", edToken).Code, "an EdDSA token should authenticate")
+	asserts.Equal(http.StatusOK, get("/user/", hmacToken).Code, "an HS256 token of the config secret should still authenticate")
+}
+
+func TestRefreshTokens(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	r.Use(AuthMiddleware(true))
+	UserRegister(r.Group("/user"))
+	call := func(method, url, body, token string) (int, UserResponse) {
+		code, response := RequestMock(r, method, url, body, token)
+		var user struct {
+			User UserResponse `json:"user"`
+		}
+		json.Unmarshal([]byte(response), &user)
+		return code, user.User
+	}
+
+	refresh := func(refreshToken string) (int, UserResponse) {
+		return call("POST", "/users/token/refresh", `{"user":{"refreshToken":"`+refreshToken+`"}}`, "")
+	}
+
+	code, registered := call("POST", "/users/", `{"user":{"username":"refresh1","email":"refresh@gg.cn","password":"jakejxke"}}`, "")
+	asserts.Equal(http.StatusCreated, code)
+	asserts.NotEmpty(registered.RefreshToken, "a registration should log the user in")
+
+	code, retrieved := call("GET", "/user/", "", registered.Token)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(registered.Token, retrieved.Token, "the access token of the request should be given back")
+	asserts.Empty(retrieved.RefreshToken)
+
+	code, first := refresh(registered.RefreshToken)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal("refresh1", first.Username)
+	asserts.NotEqual(registered.RefreshToken, first.RefreshToken, "the refresh token should rotate")
+	code, _ = call("GET", "/user/", "", first.Token)
+	asserts.Equal(http.StatusOK, code, "the new access token should authenticate")
+	code, second := refresh(first.RefreshToken)
+	asserts.Equal(http.StatusOK, code)
+
+	code, _ = refresh(registered.RefreshToken)
+	asserts.Equal(http.StatusUnauthorized, code, "a used refresh token should be refused")
+	code, _ = refresh(second.RefreshToken)
+	asserts.Equal(http.StatusUnauthorized, code, "a reuse should revoke the whole family")
+
+	code, login := call("POST", "/users/login", `{"user":{"email":"refresh@gg.cn","password":"jakejxke"}}`, "")
+	asserts.Equal(http.StatusOK, code)
+	code, _ = refresh(login.RefreshToken)
+	asserts.Equal(http.StatusOK, code, "a login should start a new family")
+
+	code, login = call("POST", "/users/login", `{"user":{"email":"refresh@gg.cn","password":"jakejxke"}}`, "")
+	test_db.Model(&RefreshTokenModel{}).Where("token_hash = ?", hashToken(login.RefreshToken)).
+		Update("expires_at", time.Now().Add(-time.Second))
+	code, _ = refresh(login.RefreshToken)
+	asserts.Equal(http.StatusUnauthorized, code, "an expired refresh token should be refused")
+	code, _ = refresh("not-a-token")
+	asserts.Equal(http.StatusUnauthorized, code)
+	code, _ = call("POST", "/users/token/refresh", `{"user":{}}`, "")
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+
+	userModel, _ := FindOneUser(context.Background(), &UserModel{Email: "refresh@gg.cn"})
+	asserts.NoError(DeleteUserModel(userModel))
+	var count int
+	test_db.Model(&RefreshTokenModel{}).Where("user_model_id = ?", userModel.ID).Count(&count)
+	asserts.Equal(0, count, "the refresh tokens should be deleted with the user")
+}
+
 //This is a hack way to add test database for each case, as whole test will just share one database.
 //You can read TestWithoutAuth's comment to know how to not share database each case.
+func TestLogout(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	r.Use(AuthMiddleware(true))
+	UserRegister(r.Group("/user"))
+	login := func() UserResponse {
+		_, body := RequestMock(r, "POST", "/users/login", `{"user":{"email":"logout@gg.cn","password":"jakejxke"}}`, "")
+		var response struct {
+			User UserResponse `json:"user"`
+		}
+		json.Unmarshal([]byte(body), &response)
+		return response.User
+	}
+	refresh := func(refreshToken string) int {
+		code, _ := RequestMock(r, "POST", "/users/token/refresh", `{"user":{"refreshToken":"`+refreshToken+`"}}`, "")
+		return code
+	}
+
+	code, _ := RequestMock(r, "POST", "/users/", `{"user":{"username":"logout1","email":"logout@gg.cn","password":"jakejxke"}}`, "")
+	asserts.Equal(http.StatusCreated, code)
+	first, second := login(), login()
+
+	code, body := RequestMock(r, "POST", "/user/logout", "", first.Token)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(`{"user":"Logout success"}`, body)
+	code, _ = RequestMock(r, "GET", "/user/", "", first.Token)
+	asserts.Equal(http.StatusUnauthorized, code, "the access token of the session should be revoked")
+	asserts.Equal(http.StatusUnauthorized, refresh(first.RefreshToken), "the refresh token of the session should be revoked")
+	code, _ = RequestMock(r, "GET", "/user/", "", second.Token)
+	asserts.Equal(http.StatusOK, code, "the other sessions should be kept")
+
+	// A token without a session is revoked by its jti alone.
+	userModel, _ := FindOneUser(context.Background(), &UserModel{Email: "logout@gg.cn"})
+	plain, other := common.GenToken(userModel.ID), common.GenToken(userModel.ID)
+	code, _ = RequestMock(r, "POST", "/user/logout", "", plain)
+	asserts.Equal(http.StatusOK, code)
+	code, _ = RequestMock(r, "GET", "/user/", "", plain)
+	asserts.Equal(http.StatusUnauthorized, code)
+	code, _ = RequestMock(r, "GET", "/user/", "", other)
+	asserts.Equal(http.StatusOK, code)
+
+	// The session of the registration, second and third.
+	third := login()
+	code, body = RequestMock(r, "POST", "/user/logout/all", "", third.Token)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(`{"sessions":3,"user":"Logout success"}`, body)
+	for _, token := range []string{second.Token, third.Token, other} {
+		code, _ = RequestMock(r, "GET", "/user/", "", token)
+		asserts.Equal(http.StatusUnauthorized, code, "every token of the user should be revoked")
+	}
+	asserts.Equal(http.StatusUnauthorized, refresh(second.RefreshToken))
+	asserts.Equal(http.StatusUnauthorized, refresh(third.RefreshToken))
+
+	fourth := login()
+	code, _ = RequestMock(r, "GET", "/user/", "", fourth.Token)
+	asserts.Equal(http.StatusOK, code, "a new login should work after logging out everywhere")
+	code, _ = RequestMock(r, "POST", "/user/logout", "", "")
+	asserts.Equal(http.StatusUnauthorized, code)
+
+	// Another server sees the logouts at its next reload.
+	var claims common.TokenClaims
+	jwt.ParseWithClaims(fourth.Token, &claims, common.GetKeyring().Keyfunc)
+	store := NewRevocationStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	asserts.False(store.IsRevoked(claims))
+	asserts.NoError(GetRevocationStore().RevokeToken(context.Background(), claims))
+	asserts.False(store.IsRevoked(claims), "the cache should be kept until jwt.revocation_refresh")
+	now = now.Add(config.Get().JWT.RevocationRefresh)
+	asserts.True(store.IsRevoked(claims))
+	// While another request reloads, the cache answers at once.
+	now = now.Add(config.Get().JWT.RevocationRefresh)
+	store.reloadMu.Lock()
+	asserts.True(store.IsRevoked(claims), "a running reload shouldn't hold the requests")
+	store.reloadMu.Unlock()
+
+	// The optional auth of the public routes reads a revoked token as no token.
+	optional := gin.New()
+	optional.Use(AuthMiddleware(false))
+	optional.GET("/me", func(c *gin.Context) { c.String(http.StatusOK, "%d", c.MustGet("my_user_id").(uint)) })
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", "Token "+fourth.Token)
+	w := httptest.NewRecorder()
+	optional.ServeHTTP(w, req)
+	asserts.Equal("0", w.Body.String())
+}
+
+func TestSessions(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	r.Use(AuthMiddleware(true))
+	UserRegister(r.Group("/user"))
+	call := func(method, url, body, token, userAgent string) (int, string) {
+		return RequestMock(r, method, url, body, token, func(req *http.Request) {
+			req.Header.Set("User-Agent", userAgent)
+			req.RemoteAddr = "192.0.2.7:4321"
+		})
+	}
+
+	login := func(email, userAgent string) UserResponse {
+		_, body := call("POST", "/users/login", `{"user":{"email":"`+email+`","password":"jakejxke"}}`, "", userAgent)
+		var response struct {
+			User UserResponse `json:"user"`
+		}
+		json.Unmarshal([]byte(body), &response)
+		return response.User
+	}
+	list := func(token string) (int, []SessionResponse) {
+		code, body := call("GET", "/user/sessions", "", token, "laptop")
+		var response struct {
+			Sessions []SessionResponse `json:"sessions"`
+		}
+		json.Unmarshal([]byte(body), &response)
+		return code, response.Sessions
+	}
+
+	call("POST", "/users/", `{"user":{"username":"session1","email":"session1@gg.cn","password":"jakejxke"}}`, "", "laptop")
+	call("POST", "/users/", `{"user":{"username":"session2","email":"session2@gg.cn","password":"jakejxke"}}`, "", "laptop")
+	laptop := login("session1@gg.cn", "laptop")
+	phone := login("session1@gg.cn", "phone")
+	stranger := login("session2@gg.cn", "laptop")
+
+	code, sessions := list(laptop.Token)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Len(sessions, 3, "the registration and both logins should be listed")
+	var phoneSession SessionResponse
+	for _, session := range sessions {
+		asserts.Equal("192.0.2.7", session.IP)
+		asserts.NotEmpty(session.CreatedAt)
+		if session.UserAgent == "phone" {
+			phoneSession = session
+		}
+	}
+	asserts.NotEmpty(phoneSession.ID)
+	asserts.False(phoneSession.Current)
+	current := 0
+	for _, session := range sessions {
+		if session.Current {
+			current++
+		}
+	}
+	asserts.Equal(1, current, "the session of the request should be current")
+
+	// The last seen time is written once a minute at most.
+	past := time.Now().Add(-time.Hour)
+	test_db.Model(&SessionModel{}).Where("id = ?", phoneSession.ID).Update("last_seen_at", past)
+	code, _ = call("GET", "/user/", "", phone.Token, "phone")
+	asserts.Equal(http.StatusOK, code)
+	var phoneModel SessionModel
+	test_db.Where("id = ?", phoneSession.ID).First(&phoneModel)
+	asserts.True(phoneModel.LastSeenAt.After(past.Add(time.Minute)), "a request should update the last seen time")
+	test_db.Model(&SessionModel{}).Where("id = ?", phoneSession.ID).Update("last_seen_at", past)
+	code, _ = call("GET", "/user/", "", phone.Token, "phone")
+	asserts.Equal(http.StatusOK, code)
+	test_db.Where("id = ?", phoneSession.ID).First(&phoneModel)
+	asserts.WithinDuration(past, phoneModel.LastSeenAt, time.Second, "the next requests of the minute should write nothing")
+	asserts.True(sessionsSeen.due(phoneSession.ID, time.Now().Add(sessionSeenInterval)))
+
+	code, body := call("DELETE", "/user/sessions/"+phoneSession.ID, "", stranger.Token, "laptop")
+	asserts.Equal(http.StatusNotFound, code, "the session of another user should not be found")
+	asserts.Equal(`{"errors":{"session":"Invalid session"}}`, body)
+	code, _ = call("DELETE", "/user/sessions/unknown", "", laptop.Token, "laptop")
+	asserts.Equal(http.StatusNotFound, code)
+
+	code, body = call("DELETE", "/user/sessions/"+phoneSession.ID, "", laptop.Token, "laptop")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(`{"session":"Delete success"}`, body)
+	code, _ = call("GET", "/user/", "", phone.Token, "phone")
+	asserts.Equal(http.StatusUnauthorized, code, "the access token of a deleted session should be refused")
+	code, _ = call("POST", "/users/token/refresh", `{"user":{"refreshToken":"`+phone.RefreshToken+`"}}`, "", "phone")
+	asserts.Equal(http.StatusUnauthorized, code, "the refresh token of a deleted session should be refused")
+	code, _ = call("DELETE", "/user/sessions/"+phoneSession.ID, "", laptop.Token, "laptop")
+	asserts.Equal(http.StatusNotFound, code, "a session is deleted once")
+
+	code, sessions = list(laptop.Token)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Len(sessions, 2)
+	code, _ = list("")
+	asserts.Equal(http.StatusUnauthorized, code)
+
+	call("POST", "/user/logout/all", "", laptop.Token, "laptop")
+	_, sessions = list(login("session1@gg.cn", "laptop").Token)
+	asserts.Len(sessions, 1, "logging out everywhere should end every session")
+
+	// Mounted twice like in hello.go, the second pass keeps the token checked by the first one.
+	tablet := login("session2@gg.cn", "tablet")
+	both := gin.New()
+	both.Use(AuthMiddleware(false), func(c *gin.Context) {
+		if claims, ok := c.Get("my_token_claims"); ok {
+			GetRevocationStore().RevokeToken(c.Request.Context(), claims.(common.TokenClaims))
+		}
+	}, AuthMiddleware(true))
+	both.GET("/me", func(c *gin.Context) { c.String(http.StatusOK, "%d", c.MustGet("my_user_id").(uint)) })
+	code, body = RequestMock(both, "GET", "/me", "", tablet.Token)
+	asserts.Equal(http.StatusOK, code, "the token should be checked once per request")
+	asserts.NotEqual("0", body)
+	code, _ = RequestMock(both, "GET", "/me", "", tablet.Token)
+	asserts.Equal(http.StatusUnauthorized, code)
+}
+
+func TestPasswordReset(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	mailer := mail.NewMemoryMailer()
+	mail.Set(mailer)
+
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	r.Use(AuthMiddleware(true))
+	UserRegister(r.Group("/user"))
+	forgot := func() (int, string) {
+		return RequestMock(r, "POST", "/users/password/forgot", `{"user":{"email":"reset@gg.cn"}}`, "")
+	}
+	reset := func(token, password string) (int, string) {
+		return RequestMock(r, "POST", "/users/password/reset", `{"user":{"token":"`+token+`","password":"`+password+`"}}`, "")
+	}
+	login := func(password string) (int, UserResponse) {
+		code, body := RequestMock(r, "POST", "/users/login", `{"user":{"email":"reset@gg.cn","password":"`+password+`"}}`, "")
+		var response struct {
+			User UserResponse `json:"user"`
+		}
+		json.Unmarshal([]byte(body), &response)
+		return code, response.User
+	}
+	// The token of the last link mailed to the user.
+	linkToken := regexp.MustCompile(`/reset-password\?token=([a-zA-Z0-9-_]{43})`)
+	mailedToken := func() string {
+		msg, ok := mailer.Last("reset@gg.cn")
+		asserts.True(ok, "a reset mail should be sent")
+		match := linkToken.FindStringSubmatch(msg.Body)
+		if asserts.Len(match, 2, "the mail should have the link: %s", msg.Body) {
+			return match[1]
+		}
+		return ""
+	}
+
+	code, body := forgot()
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(`{"user":"Password reset mail sent"}`, body, "an unknown email should get the same response")
+	asserts.Empty(mailer.Messages())
+
+	RequestMock(r, "POST", "/users/", `{"user":{"username":"reset1","email":"reset@gg.cn","password":"jakejxke"}}`, "")
+	_, session := login("jakejxke")
+	code, body = forgot()
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(`{"user":"Password reset mail sent"}`, body)
+	msg, _ := mailer.Last("reset@gg.cn")
+	asserts.Equal("Reset your password", msg.Subject)
+	asserts.Contains(msg.Body, "Hi reset1,")
+	first := mailedToken()
+	var count int
+	test_db.Model(&PasswordResetModel{}).Where("token_hash = ?", first).Count(&count)
+	asserts.Equal(0, count, "the token should not be saved as it is")
+
+	forgot()
+	second := mailedToken()
+	code, body = reset(second, "short")
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	code, body = reset("not-a-token", "jakejxke2")
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	asserts.Equal(`{"errors":{"token":"Invalid or expired password reset token"}}`, body)
+
+	code, body = reset(second, "jakejxke2")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(`{"user":"Password reset success"}`, body)
+	code, _ = login("jakejxke")
+	asserts.Equal(http.StatusForbidden, code, "the old password should not work anymore")
+	code, _ = login("jakejxke2")
+	asserts.Equal(http.StatusOK, code)
+	code, _ = RequestMock(r, "GET", "/user/", "", session.Token)
+	asserts.Equal(http.StatusUnauthorized, code, "the sessions should be logged out")
+
+	code, _ = reset(second, "jakejxke3")
+	asserts.Equal(http.StatusUnprocessableEntity, code, "a token should work once")
+	code, _ = reset(first, "jakejxke3")
+	asserts.Equal(http.StatusUnprocessableEntity, code, "the other tokens should stop working")
+
+	forgot()
+	expired := mailedToken()
+	test_db.Model(&PasswordResetModel{}).Where("token_hash = ?", hashToken(expired)).
+		Update("expires_at", time.Now().Add(-time.Second))
+	code, _ = reset(expired, "jakejxke3")
+	asserts.Equal(http.StatusUnprocessableEntity, code, "an expired token should be refused")
+	code, _ = login("jakejxke2")
+	asserts.Equal(http.StatusOK, code)
+}
+
+func TestEmailVerification(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	mailer := mail.NewMemoryMailer()
+	mail.Set(mailer)
+
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	r.Use(AuthMiddleware(true))
+	UserRegister(r.Group("/user"))
+	r.POST("/publish", RequireVerifiedEmail(), func(c *gin.Context) { c.String(http.StatusCreated, "published") })
+	user := func(token string) UserResponse {
+		_, body := RequestMock(r, "GET", "/user/", "", token)
+		var response struct {
+			User UserResponse `json:"user"`
+		}
+		json.Unmarshal([]byte(body), &response)
+		return response.User
+	}
+	confirm := func(token string) (int, string) {
+		return RequestMock(r, "POST", "/users/email/confirm", `{"user":{"token":"`+token+`"}}`, "")
+	}
+	// The token of the last link mailed to the address.
+	linkToken := regexp.MustCompile(`/verify-email\?token=([a-zA-Z0-9-_]{43})`)
+	mailedToken := func(to string) string {
+		msg, ok := mailer.Last(to)
+		asserts.True(ok, "a verification mail should be sent to %s", to)
+		match := linkToken.FindStringSubmatch(msg.Body)
+		if asserts.Len(match, 2, "the mail should have the link: %s", msg.Body) {
+			return match[1]
+		}
+		return ""
+	}
+
+	code, body := RequestMock(r, "POST", "/users/", `{"user":{"username":"verify1","email":"verify@gg.cn","password":"jakejxke"}}`, "")
+	asserts.Equal(http.StatusCreated, code)
+	asserts.Contains(body, `"emailVerified":false`)
+	var registered struct {
+		User UserResponse `json:"user"`
+	}
+	json.Unmarshal([]byte(body), &registered)
+	token := registered.User.Token
+	msg, _ := mailer.Last("verify@gg.cn")
+	asserts.Equal("Verify your email", msg.Subject)
+	first := mailedToken("verify@gg.cn")
+
+	// Only the last link mailed works.
+	code, body = RequestMock(r, "POST", "/user/email/verify", "", token)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(`{"user":"Verification mail sent"}`, body)
+	second := mailedToken("verify@gg.cn")
+	code, body = confirm(first)
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	asserts.Equal(`{"errors":{"token":"Invalid or expired email verification token"}}`, body)
+
+	cfg := config.Default()
+	cfg.Auth.RequireVerifiedEmail = true
+	config.Set(cfg)
+	defer config.Set(nil)
+	code, body = RequestMock(r, "POST", "/publish", "", token)
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(`{"errors":{"email":"Verify your email first"}}`, body)
+
+	code, body = confirm(second)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(`{"user":"Email confirmed"}`, body)
+	asserts.True(user(token).EmailVerified)
+	code, _ = RequestMock(r, "POST", "/publish", "", token)
+	asserts.Equal(http.StatusCreated, code, "a verified user should publish")
+	code, _ = confirm(second)
+	asserts.Equal(http.StatusUnprocessableEntity, code, "a token should work once")
+	code, body = RequestMock(r, "POST", "/user/email/verify", "", token)
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	asserts.Equal(`{"errors":{"email":"Email already verified"}}`, body)
+
+	// An email change waits for the confirmation of the new address.
+	code, body = RequestMock(r, "PUT", "/user/", `{"user":{"email":"verify2@gg.cn"}}`, token)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Contains(body, `"email":"verify@gg.cn","emailVerified":true`)
+	msg, _ = mailer.Last("verify2@gg.cn")
+	asserts.Equal("Confirm your new email", msg.Subject)
+	change := mailedToken("verify2@gg.cn")
+	code, _ = RequestMock(r, "POST", "/users/login", `{"user":{"email":"verify2@gg.cn","password":"jakejxke"}}`, "")
+	asserts.Equal(http.StatusForbidden, code, "the new email should not work before its confirmation")
+
+	code, _ = confirm(change)
+	asserts.Equal(http.StatusOK, code)
+	changed := user(token)
+	asserts.Equal("verify2@gg.cn", changed.Email)
+	asserts.True(changed.EmailVerified)
+	msg, _ = mailer.Last("verify@gg.cn")
+	asserts.Equal("Your email was changed", msg.Subject, "the old address should hear of the change")
+	code, _ = RequestMock(r, "POST", "/users/login", `{"user":{"email":"verify2@gg.cn","password":"jakejxke"}}`, "")
+	asserts.Equal(http.StatusOK, code)
+
+	// The new email may be registered by someone else before its confirmation.
+	RequestMock(r, "PUT", "/user/", `{"user":{"email":"verify3@gg.cn"}}`, token)
+	taken := mailedToken("verify3@gg.cn")
+	code, body = RequestMock(r, "PUT", "/user/", `{"user":{"email":"user1@linkedin.com"}}`, token)
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	asserts.Equal(`{"errors":{"email":"Email already registered"}}`, body)
+	RequestMock(r, "POST", "/users/", `{"user":{"username":"verify3","email":"verify3@gg.cn","password":"jakejxke"}}`, "")
+	code, body = confirm(taken)
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	asserts.Equal(`{"errors":{"email":"Email already registered"}}`, body)
+	asserts.Equal("verify2@gg.cn", user(token).Email)
+}
+
+func TestLoginLockout(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	cfg := config.Default()
+	cfg.Auth.LoginDelayAfter = 2
+	cfg.Auth.LoginDelay = time.Minute
+	cfg.Auth.LockoutThreshold = 4
+	cfg.Auth.IPLockoutThreshold = 6
+	cfg.Auth.LockoutDuration = time.Hour
+	config.Set(cfg)
+	defer config.Set(nil)
+
+	asserts.Equal(time.Duration(0), loginDelay(1))
+	asserts.Equal(time.Minute, loginDelay(2))
+	asserts.Equal(2*time.Minute, loginDelay(3), "the delay should double with each failure")
+	asserts.Equal(time.Hour, loginDelay(20), "the delay should stop at the lockout duration")
+
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	ip := "192.0.2.1"
+	login := func(email, password string) (int, string, string) {
+		req, _ := http.NewRequest("POST", "/users/login", bytes.NewBufferString(`{"user":{"email":"`+email+`","password":"`+password+`"}}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = ip + ":41234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code, w.Body.String(), w.Header().Get("Retry-After")
+	}
+	ctx := context.Background()
+
+	// A registered email and an unknown one get the same answers.
+	for _, email := range []string{"user1@linkedin.com", "nobody@linkedin.com"} {
+		for i := 0; i < 2; i++ {
+			code, body, _ := login(email, "wrongpass")
+			asserts.Equal(http.StatusForbidden, code)
+			asserts.Equal(`{"errors":{"login":"Not Registered email or invalid password"}}`, body)
+		}
+		code, body, retryAfter := login(email, "password123")
+		asserts.Equal(http.StatusTooManyRequests, code, "%s should wait after two failures, even with the right password", email)
+		asserts.Equal(`{"errors":{"login":"Too many failed logins, wait before the next one"}}`, body)
+		asserts.Equal("60", retryAfter)
+
+		now := time.Now()
+		RecordLoginFailure(ctx, email, "198.51.100.7", now)
+		RecordLoginFailure(ctx, email, "198.51.100.7", now)
+		code, body, retryAfter = login(email, "password123")
+		asserts.Equal(http.StatusLocked, code, "%s should be locked at the threshold", email)
+		asserts.Equal(`{"errors":{"login":"Too many failed logins, the account is locked for a while"}}`, body)
+		asserts.Equal("3600", retryAfter)
+	}
+
+	// The failures of an IP add up over the emails, its lockout holds for every email.
+	code, _, _ := login("user3@linkedin.com", "wrongpass")
+	asserts.Equal(http.StatusForbidden, code)
+	code, _, _ = login("other@linkedin.com", "wrongpass")
+	asserts.Equal(http.StatusForbidden, code)
+	code, _, retryAfter := login("user2@linkedin.com", "password123")
+	asserts.Equal(http.StatusTooManyRequests, code, "the IP should be locked at its threshold")
+	asserts.Equal("3600", retryAfter)
+	throttle, err := CheckLogin(ctx, "user2@linkedin.com", "198.51.100.8", time.Now())
+	asserts.NoError(err)
+	asserts.NoError(throttle.Err, "another IP should log in")
+
+	// The lockouts end after the lockout duration.
+	throttle, err = CheckLogin(ctx, "user1@linkedin.com", ip, time.Now().Add(time.Hour+time.Second))
+	asserts.NoError(err)
+	asserts.NoError(throttle.Err)
+
+	failures, err := UnlockLogin("", ip)
+	asserts.NoError(err)
+	asserts.Equal(6, failures)
+	failures, err = UnlockLogin("user1@linkedin.com", "")
+	asserts.NoError(err)
+	asserts.Equal(4, failures)
+	code, _, _ = login("user1@linkedin.com", "password123")
+	asserts.Equal(http.StatusOK, code, "an unlocked email should log in")
+	code, _, _ = login("nobody@linkedin.com", "password123")
+	asserts.Equal(http.StatusLocked, code, "the other emails should stay locked")
+
+	// A successful login forgets the failures of its email.
+	code, _, _ = login("user2@linkedin.com", "wrongpass")
+	asserts.Equal(http.StatusForbidden, code)
+	code, _, _ = login("user2@linkedin.com", "password123")
+	asserts.Equal(http.StatusOK, code)
+	var count int
+	test_db.Model(&LoginFailureModel{}).Where("login_key = ?", "email:user2@linkedin.com").Count(&count)
+	asserts.Equal(0, count)
+	code, _, _ = login("USER2@linkedin.com", "wrongpass")
+	asserts.Equal(http.StatusForbidden, code)
+	test_db.Model(&LoginFailureModel{}).Where("login_key = ?", "email:user2@linkedin.com").Count(&count)
+	asserts.Equal(1, count, "the emails should be counted in lower case")
+}
+
+func TestTOTP(t *testing.T) {
+	asserts := assert.New(t)
+	// The SHA1 test vectors of RFC 6238, with the last 6 of their 8 digits.
+	secret := []byte("12345678901234567890")
+	asserts.Equal("287082", totpCode(secret, 59/totpPeriod))
+	asserts.Equal("081804", totpCode(secret, 1111111109/totpPeriod))
+	asserts.Equal("005924", totpCode(secret, 1234567890/totpPeriod))
+	asserts.Equal("279037", totpCode(secret, 2000000000/totpPeriod))
+
+	model := TwoFactorModel{Secret: base32NoPadding.EncodeToString(secret)}
+	now := time.Unix(1111111109, 0)
+	step, ok := model.matchCode("081804", now)
+	asserts.True(ok)
+	asserts.Equal(int64(1111111109/totpPeriod), step)
+	_, ok = model.matchCode("081804", now.Add(totpPeriod*time.Second))
+	asserts.True(ok, "the code of the step before should work")
+	_, ok = model.matchCode("081804", now.Add(2*totpPeriod*time.Second))
+	asserts.False(ok, "the code of two steps before should not work")
+	model.LastStep = step
+	_, ok = model.matchCode("081804", now)
+	asserts.False(ok, "a code should work once")
+	_, ok = model.matchCode("81804", now)
+	asserts.False(ok)
+
+	code, err := newRecoveryCode()
+	asserts.NoError(err)
+	asserts.Regexp(`^[a-z2-7]{5}-[a-z2-7]{5}$`, code)
+	asserts.Equal(normalizeRecoveryCode(code), normalizeRecoveryCode(" "+strings.ToUpper(code)))
+}
+
+func TestTwoFactor(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	cfg := config.Default()
+	cfg.Auth.LoginDelayAfter = 100
+	cfg.Auth.LockoutThreshold = 100
+	config.Set(cfg)
+	defer config.Set(nil)
+
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	r.Use(AuthMiddleware(true))
+	UserRegister(r.Group("/user"))
+	var response struct {
+		User      UserResponse `json:"user"`
+		TwoFactor struct {
+			ChallengeToken    string   `json:"challengeToken"`
+			Secret            string   `json:"secret"`
+			URI               string   `json:"uri"`
+			Enabled           bool     `json:"enabled"`
+			RecoveryCodes     []string `json:"recoveryCodes"`
+			RecoveryCodesLeft int      `json:"recoveryCodesLeft"`
+		} `json:"twoFactor"`
+	}
+	parse := func(body string) {
+		response.User = UserResponse{}
+		response.TwoFactor.ChallengeToken = ""
+		response.TwoFactor.RecoveryCodes = nil
+		json.Unmarshal([]byte(body), &response)
+	}
+	login := func() (int, string) {
+		code, body := RequestMock(r, "POST", "/users/login", `{"user":{"email":"user1@linkedin.com","password":"password123"}}`, "")
+		parse(body)
+		return code, body
+	}
+	verify := func(challenge, otp string) (int, string) {
+		code, body := RequestMock(r, "POST", "/users/login/2fa", `{"user":{"challengeToken":"`+challenge+`","code":"`+otp+`"}}`, "")
+		parse(body)
+		return code, body
+	}
+
+	login()
+	token := response.User.Token
+	code, body := RequestMock(r, "GET", "/user/2fa", "", token)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(`{"twoFactor":{"enabled":false,"recoveryCodesLeft":0}}`, body)
+	code, body = RequestMock(r, "POST", "/user/2fa/confirm", `{"twoFactor":{"code":"123456"}}`, token)
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	asserts.Equal(`{"errors":{"twoFactor":"Start the two-factor enrolment first"}}`, body)
+
+	code, body = RequestMock(r, "POST", "/user/2fa/enroll", "", token)
+	asserts.Equal(http.StatusOK, code)
+	parse(body)
+	asserts.Regexp(`^[A-Z2-7]{32}$`, response.TwoFactor.Secret)
+	asserts.Equal("otpauth://totp/RealWorld:user1@linkedin.com?algorithm=SHA1&digits=6&issuer=RealWorld&period=30&secret="+response.TwoFactor.Secret, response.TwoFactor.URI)
+	secret, _ := base32NoPadding.DecodeString(response.TwoFactor.Secret)
+	step := time.Now().Unix() / totpPeriod
+	code, body = RequestMock(r, "POST", "/user/2fa/confirm", `{"twoFactor":{"code":"12345"}}`, token)
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(`{"errors":{"code":"Invalid two-factor code"}}`, body)
+	code, body = RequestMock(r, "POST", "/user/2fa/confirm", `{"twoFactor":{"code":"`+totpCode(secret, step)+`"}}`, token)
+	asserts.Equal(http.StatusOK, code)
+	parse(body)
+	asserts.True(response.TwoFactor.Enabled)
+	recoveryCodes := response.TwoFactor.RecoveryCodes
+	asserts.Len(recoveryCodes, 10)
+	code, _ = RequestMock(r, "POST", "/user/2fa/enroll", "", token)
+	asserts.Equal(http.StatusUnprocessableEntity, code, "an enabled secret should not be replaced")
+
+	// The password only gets a challenge, which is no access token.
+	code, body = login()
+	asserts.Equal(http.StatusOK, code)
+	asserts.NotContains(body, `"user"`)
+	challenge := response.TwoFactor.ChallengeToken
+	asserts.Len(challenge, 43)
+	code, _ = RequestMock(r, "GET", "/user/", "", challenge)
+	asserts.Equal(http.StatusUnauthorized, code)
+
+	code, body = verify(challenge, totpCode(secret, step))
+	asserts.Equal(http.StatusForbidden, code, "the code of the confirmation should not work again")
+	asserts.Equal(`{"errors":{"code":"Invalid two-factor code"}}`, body)
+	code, _ = verify(challenge, totpCode(secret, step+1))
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal("user1@linkedin.com", response.User.Email)
+	code, _ = RequestMock(r, "GET", "/user/", "", response.User.Token)
+	asserts.Equal(http.StatusOK, code)
+	code, body = verify(challenge, totpCode(secret, step+1))
+	asserts.Equal(http.StatusUnauthorized, code, "a challenge should work once")
+	asserts.Equal(`{"errors":{"challengeToken":"Invalid or expired two-factor challenge"}}`, body)
+
+	// A recovery code works once, in any case.
+	login()
+	code, _ = verify(response.TwoFactor.ChallengeToken, strings.ToUpper(recoveryCodes[0]))
+	asserts.Equal(http.StatusOK, code)
+	login()
+	challenge = response.TwoFactor.ChallengeToken
+	code, _ = verify(challenge, recoveryCodes[0])
+	asserts.Equal(http.StatusForbidden, code)
+	code, body = RequestMock(r, "GET", "/user/2fa", "", token)
+	asserts.Equal(`{"twoFactor":{"enabled":true,"recoveryCodesLeft":9}}`, body)
+
+	// A challenge takes 5 codes at most.
+	for i := 0; i < 4; i++ {
+		code, _ = verify(challenge, "nope")
+		asserts.Equal(http.StatusForbidden, code)
+	}
+	code, _ = verify(challenge, recoveryCodes[1])
+	asserts.Equal(http.StatusUnauthorized, code, "a challenge should be used up by its attempts")
+
+	code, body = RequestMock(r, "POST", "/user/2fa/recovery-codes", `{"twoFactor":{"code":"`+recoveryCodes[1]+`"}}`, token)
+	asserts.Equal(http.StatusOK, code)
+	parse(body)
+	asserts.Len(response.TwoFactor.RecoveryCodes, 10)
+	asserts.NotContains(response.TwoFactor.RecoveryCodes, recoveryCodes[2])
+	newRecoveryCodes := response.TwoFactor.RecoveryCodes
+	code, _ = RequestMock(r, "POST", "/user/2fa/disable", `{"twoFactor":{"code":"`+recoveryCodes[2]+`"}}`, token)
+	asserts.Equal(http.StatusForbidden, code, "the old recovery codes should not work")
+
+	code, body = RequestMock(r, "POST", "/user/2fa/disable", `{"twoFactor":{"code":"`+newRecoveryCodes[0]+`"}}`, token)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(`{"twoFactor":{"enabled":false,"recoveryCodesLeft":0}}`, body)
+	code, _ = login()
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal("user1@linkedin.com", response.User.Email, "the password should be enough again")
+
+	// The admins may turn it off without a code.
+	RequestMock(r, "POST", "/user/2fa/enroll", "", token)
+	twoFactor, _ := FindTwoFactor(context.Background(), 1)
+	secret, _ = base32NoPadding.DecodeString(twoFactor.Secret)
+	_, err := ConfirmTwoFactor(context.Background(), 1, totpCode(secret, time.Now().Unix()/totpPeriod))
+	asserts.NoError(err)
+	asserts.NoError(ResetTwoFactor(1))
+	enabled, err := TwoFactorEnabled(context.Background(), 1)
+	asserts.NoError(err)
+	asserts.False(enabled)
+}
+
+func TestMagicLink(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	mailer := mail.NewMemoryMailer()
+	mail.Set(mailer)
+	cfg := config.Default()
+	cfg.Auth.MagicLinkLimit = 2
+	config.Set(cfg)
+	defer config.Set(nil)
+
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	send := func(email string) {
+		code, body := RequestMock(r, "POST", "/users/magic-link", `{"user":{"email":"`+email+`"}}`, "")
+		asserts.Equal(http.StatusOK, code)
+		asserts.Equal(`{"user":"Login link sent"}`, body, "every email should get the same answer")
+	}
+	redeem := func(token string) (int, string) {
+		return RequestMock(r, "POST", "/users/magic-link/redeem", `{"user":{"token":"`+token+`"}}`, "")
+	}
+	// The token of the last link mailed to the address.
+	linkToken := regexp.MustCompile(`/magic-link\?token=([a-zA-Z0-9-_]{43})`)
+	mailedToken := func(to string) string {
+		msg, ok := mailer.Last(to)
+		asserts.True(ok, "a login link should be mailed to %s", to)
+		asserts.Equal("Your login link", msg.Subject)
+		match := linkToken.FindStringSubmatch(msg.Body)
+		if asserts.Len(match, 2, "the mail should have the link: %s", msg.Body) {
+			return match[1]
+		}
+		return ""
+	}
+
+	send("nobody@linkedin.com")
+	asserts.Empty(mailer.Messages(), "an unknown email should get no mail")
+	send("user1@linkedin.com")
+	token := mailedToken("user1@linkedin.com")
+	code, body := redeem(token)
+	asserts.Equal(http.StatusOK, code)
+	var response struct {
+		User UserResponse `json:"user"`
+	}
+	json.Unmarshal([]byte(body), &response)
+	asserts.Equal("user1@linkedin.com", response.User.Email)
+	asserts.Regexp(`^[a-zA-Z0-9-_.]{232}$`, response.User.Token)
+	asserts.Len(response.User.RefreshToken, 43)
+	code, body = redeem(token)
+	asserts.Equal(http.StatusUnprocessableEntity, code, "a link should work once")
+	asserts.Equal(`{"errors":{"token":"Invalid or expired login link"}}`, body)
+	code, _ = redeem("Qm9yaW5n")
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+
+	// An email gets auth.magic_link_limit links an hour.
+	send("user1@linkedin.com")
+	expired := mailedToken("user1@linkedin.com")
+	sent := len(mailer.Messages())
+	send("user1@linkedin.com")
+	asserts.Len(mailer.Messages(), sent, "the links over the limit should not be mailed")
+	test_db.Model(&MagicLinkModel{}).Where("token_hash = ?", hashToken(expired)).Update("expires_at", time.Now().Add(-time.Second))
+	code, _ = redeem(expired)
+	asserts.Equal(http.StatusUnprocessableEntity, code, "an expired link should not work")
+
+	// The requests racing each other don't get more links than the limit either.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			SendMagicLink(context.Background(), UserModel{ID: 3, Username: "user3", Email: "user3@linkedin.com"})
+		}()
+	}
+	wg.Wait()
+	var count int
+	test_db.Model(&MagicLinkModel{}).Where("user_model_id = ?", 3).Count(&count)
+	asserts.LessOrEqual(count, cfg.Auth.MagicLinkLimit)
+
+	// The link stands for the password, the code is still asked for.
+	_, _, err := EnrollTwoFactor(context.Background(), UserModel{ID: 2, Email: "user2@linkedin.com"})
+	asserts.NoError(err)
+	twoFactor, _ := FindTwoFactor(context.Background(), 2)
+	secret, _ := base32NoPadding.DecodeString(twoFactor.Secret)
+	_, err = ConfirmTwoFactor(context.Background(), 2, totpCode(secret, time.Now().Unix()/totpPeriod))
+	asserts.NoError(err)
+	send("user2@linkedin.com")
+	code, body = redeem(mailedToken("user2@linkedin.com"))
+	asserts.Equal(http.StatusOK, code)
+	asserts.Regexp(`^{"twoFactor":{"challengeToken":"[a-zA-Z0-9-_]{43}","expiresAt":"[^"]+"}}$`, body)
+}
+
+func TestOIDC(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	code, _ := RequestMock(r, "POST", "/users/oidc/authorize", ``, "")
+	asserts.Equal(http.StatusNotFound, code, "the login with a provider should be off by default")
+
+	mock := oidctest.NewProvider("realworld", "secret")
+	defer mock.Close()
+	oidc.Set(oidc.New(mock.Config("http://localhost:4100/oidc/callback")))
+	defer oidc.Set(nil)
+	authorize := func(user oidctest.User) (string, string) {
+		code, body := RequestMock(r, "POST", "/users/oidc/authorize", ``, "")
+		asserts.Equal(http.StatusOK, code)
+		var response struct {
+			OIDC struct {
+				URL string `json:"url"`
+			} `json:"oidc"`
+		}
+		json.Unmarshal([]byte(body), &response)
+		asserts.True(strings.HasPrefix(response.OIDC.URL, mock.URL+"/authorize?"), response.OIDC.URL)
+		mock.User = user
+		providerCode, state, err := mock.Authorize(response.OIDC.URL)
+		asserts.NoError(err)
+		return providerCode, state
+	}
+	callback := func(providerCode, state string) (int, string) {
+		return RequestMock(r, "POST", "/users/oidc/callback", `{"oidc":{"code":"`+providerCode+`","state":"`+state+`"}}`, "")
+	}
+	login := func(user oidctest.User) (int, UserResponse, string) {
+		code, body := callback(authorize(user))
+		var response struct {
+			User UserResponse `json:"user"`
+		}
+		json.Unmarshal([]byte(body), &response)
+		return code, response.User, body
+	}
+
+	// An unknown identity signs up, the next logins find it by its subject.
+	registered := testutil.ToFloat64(metrics.UsersRegistered)
+	jane := oidctest.User{Subject: "1001", Email: "jane@example.com", EmailVerified: true, PreferredUsername: "jane.doe"}
+	code, user, body := login(jane)
+	asserts.Equal(http.StatusOK, code, body)
+	asserts.Equal("jane@example.com", user.Email)
+	asserts.Equal("janedoe", user.Username)
+	asserts.Regexp(`^[a-zA-Z0-9-_.]{232}$`, user.Token)
+	asserts.Len(user.RefreshToken, 43)
+	asserts.Equal(registered+1, testutil.ToFloat64(metrics.UsersRegistered))
+	janeModel, err := FindOneUser(context.Background(), &UserModel{Email: "jane@example.com"})
+	asserts.NoError(err)
+	asserts.Empty(janeModel.PasswordHash, "a user of the provider should have no password")
+	asserts.True(janeModel.EmailVerified(), "the provider verified the email")
+	jane.Email = "jane@example.org"
+	code, user, _ = login(jane)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal("janedoe", user.Username, "the subject should find the user whatever its email at the provider")
+	asserts.Equal(registered+1, testutil.ToFloat64(metrics.UsersRegistered))
+	var identity OIDCIdentityModel
+	test_db.Where(&OIDCIdentityModel{Subject: "1001"}).First(&identity)
+	asserts.Equal(janeModel.ID, identity.UserModelID)
+	asserts.Equal("jane@example.org", identity.Email)
+
+	// Without a password, the password login fails like a wrong password.
+	code, body = RequestMock(r, "POST", "/users/login", `{"user":{"email":"jane@example.com","password":"password123"}}`, "")
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(`{"errors":{"login":"Not Registered email or invalid password"}}`, body)
+
+	// An email verified by both sides links the identity to its user, else it is refused: whoever
+	// registered the email here first could log in to the account of its owner with their password.
+	code, _, body = login(oidctest.User{Subject: "1002", Email: "user1@linkedin.com", EmailVerified: true})
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(`{"errors":{"oidc":"An account has this email, and it isn't verified yet"}}`, body)
+	asserts.True(test_db.Where(&OIDCIdentityModel{Subject: "1002"}).First(&OIDCIdentityModel{}).RecordNotFound())
+	test_db.Model(&UserModel{}).Where("id = ?", 1).Update("email_verified_at", time.Now())
+	code, user, _ = login(oidctest.User{Subject: "1002", Email: "user1@linkedin.com", EmailVerified: true})
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal("user1", user.Username)
+	code, _, body = login(oidctest.User{Subject: "1003", Email: "user2@linkedin.com"})
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(`{"errors":{"oidc":"An account has this email, and the provider didn't verify it"}}`, body)
+	code, _, _ = login(oidctest.User{Subject: "1004"})
+	asserts.Equal(http.StatusForbidden, code, "an identity without an email should not sign up")
+
+	// A taken username gets a number.
+	code, user, _ = login(oidctest.User{Subject: "1005", Email: "bob@example.com", EmailVerified: true, PreferredUsername: "user1"})
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal("user12", user.Username)
+	code, user, _ = login(oidctest.User{Subject: "1006", Email: "al@example.com", Name: "Al"})
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal("userAl", user.Username, "a username should have 4 characters at least")
+
+	// A state works once, and with its own code.
+	providerCode, state := authorize(jane)
+	code, _ = callback(providerCode, state)
+	asserts.Equal(http.StatusOK, code)
+	code, body = callback(providerCode, state)
+	asserts.Equal(http.StatusUnprocessableEntity, code, "a state should work once")
+	asserts.Equal(`{"errors":{"state":"Invalid or expired login state"}}`, body)
+	_, state = authorize(jane)
+	code, body = callback("Qm9yaW5n", state)
+	asserts.Equal(http.StatusUnauthorized, code, "the provider should refuse an unknown code")
+	asserts.Equal(`{"errors":{"oidc":"The login with the provider failed"}}`, body)
+	providerCode, state = authorize(jane)
+	test_db.Model(&OIDCStateModel{}).Where("state_hash = ?", hashToken(state)).Update("expires_at", time.Now().Add(-time.Second))
+	code, _ = callback(providerCode, state)
+	asserts.Equal(http.StatusUnprocessableEntity, code, "an expired state should not work")
+
+	// Without the signup, only the known identities log in.
+	cfg := mock.Config("http://localhost:4100/oidc/callback")
+	cfg.AllowSignup = false
+	oidc.Set(oidc.New(cfg))
+	code, _, body = login(oidctest.User{Subject: "1007", Email: "eve@example.com", EmailVerified: true})
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(`{"errors":{"oidc":"No account has this identity, and the signup with the provider is off"}}`, body)
+	code, _, _ = login(jane)
+	asserts.Equal(http.StatusOK, code)
+
+	asserts.NoError(DeleteUserModel(janeModel))
+	asserts.True(test_db.Where(&OIDCIdentityModel{Subject: "1001"}).First(&OIDCIdentityModel{}).RecordNotFound(), "the identities should go with their user")
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := gin.New()
+	r.Use(AuthMiddleware(true))
+	UserRegister(r.Group("/user"))
+	ProfileRegister(r.Group("/profiles"))
+	login := common.GenToken(1)
+	var created struct {
+		Token PersonalAccessTokenResponse `json:"token"`
+	}
+	code, body := RequestMock(r, "POST", "/user/tokens", `{"token":{"name":"ci","scopes":["profile:read","articles:write","profile:read"]}}`, login)
+	asserts.Equal(http.StatusCreated, code, body)
+	json.Unmarshal([]byte(body), &created)
+	asserts.Regexp(`^rwpat_[a-zA-Z0-9-_]{43}$`, created.Token.Token)
+	asserts.Equal([]string{"articles:write", "profile:read"}, created.Token.Scopes)
+	asserts.Nil(created.Token.ExpiresAt, "a token without expiration should work until revoked")
+	ci := created.Token.Token
+	var stored PersonalAccessTokenModel
+	test_db.First(&stored, created.Token.ID)
+	asserts.Equal(hashToken(ci), stored.TokenHash, "only the hash should be saved")
+
+	code, _ = RequestMock(r, "POST", "/user/tokens", `{"token":{"name":"ci","scopes":["admin"]}}`, login)
+	asserts.Equal(http.StatusUnprocessableEntity, code, "an unknown scope should be refused")
+	code, _ = RequestMock(r, "POST", "/user/tokens", `{"token":{"name":"ci","scopes":[]}}`, login)
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	code, body = RequestMock(r, "POST", "/user/tokens", `{"token":{"name":"ci","scopes":["profile:read"],"expiresAt":"2020-01-01T00:00:00Z"}}`, login)
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	asserts.Equal(`{"errors":{"expiresAt":"The expiration should be in the future"}}`, body)
+
+	// The token stands for its user on the routes of its scopes.
+	code, body = RequestMock(r, "GET", "/user/", ``, ci)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Contains(body, `"username":"user1"`)
+	code, _ = RequestMock(r, "GET", "/profiles/user2", ``, ci)
+	asserts.Equal(http.StatusOK, code)
+	code, body = RequestMock(r, "POST", "/profiles/user2/follow", ``, ci)
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(`{"errors":{"scope":"The token lacks the profile:write scope"}}`, body)
+	code, body = RequestMock(r, "POST", "/user/tokens", `{"token":{"name":"more","scopes":["profile:write"]}}`, ci)
+	asserts.Equal(http.StatusForbidden, code, "a token should not make tokens")
+	asserts.Equal(`{"errors":{"scope":"A personal access token can't do this, log in"}}`, body)
+
+	_, none, err := CreatePersonalAccessToken(context.Background(), 1, "none", nil, nil)
+	asserts.NoError(err)
+	for _, route := range r.Routes() {
+		url := strings.NewReplacer(":username", "user2", ":id", "1").Replace(route.Path)
+		code, _ := RequestMock(r, route.Method, url, `{}`, none)
+		asserts.Equal(http.StatusForbidden, code, "%s %s should ask for a scope or a login", route.Method, route.Path)
+	}
+
+	code, body = RequestMock(r, "GET", "/user/tokens", ``, login)
+	asserts.Equal(http.StatusOK, code)
+	var list struct {
+		Tokens []PersonalAccessTokenResponse `json:"tokens"`
+	}
+	json.Unmarshal([]byte(body), &list)
+	if asserts.Len(list.Tokens, 2) {
+		asserts.Equal("ci", list.Tokens[1].Name)
+		asserts.NotNil(list.Tokens[1].LastUsedAt)
+		asserts.Empty(list.Tokens[1].Token, "a token should only be shown at its creation")
+	}
+	past := time.Now().Add(-time.Hour)
+	test_db.Model(&PersonalAccessTokenModel{}).Where("id = ?", created.Token.ID).Update("last_used_at", past)
+	code, _ = RequestMock(r, "GET", "/user/", ``, ci)
+	asserts.Equal(http.StatusOK, code)
+	test_db.First(&stored, created.Token.ID)
+	asserts.WithinDuration(past, *stored.LastUsedAt, time.Second, "the next requests of the minute should write nothing")
+
+	// Mounted twice like in hello.go, the second pass keeps the token found by the first one.
+	_, twice, _ := CreatePersonalAccessToken(context.Background(), 1, "twice", []string{ScopeProfileRead}, nil)
+	both := gin.New()
+	both.Use(AuthMiddleware(false), func(c *gin.Context) {
+		if model, ok := c.Get("my_personal_access_token"); ok {
+			RevokePersonalAccessToken(c.Request.Context(), 1, model.(PersonalAccessTokenModel).ID)
+		}
+	}, AuthMiddleware(true))
+	both.GET("/me", func(c *gin.Context) { c.String(http.StatusOK, "%d", c.MustGet("my_user_id").(uint)) })
+	code, body = RequestMock(both, "GET", "/me", "", twice)
+	asserts.Equal(http.StatusOK, code, "the token should be looked up once per request")
+	asserts.Equal("1", body)
+	code, _ = RequestMock(both, "GET", "/me", "", twice)
+	asserts.Equal(http.StatusUnauthorized, code)
+
+	// Revoked, expired or reset by a password reset, the tokens stop working.
+	code, _ = RequestMock(r, "DELETE", fmt.Sprintf("/user/tokens/%d", created.Token.ID), ``, common.GenToken(2))
+	asserts.Equal(http.StatusNotFound, code, "the tokens of another user should not be revoked")
+	code, _ = RequestMock(r, "DELETE", fmt.Sprintf("/user/tokens/%d", created.Token.ID), ``, login)
+	asserts.Equal(http.StatusOK, code)
+	code, _ = RequestMock(r, "GET", "/user/", ``, ci)
+	asserts.Equal(http.StatusUnauthorized, code)
+	code, _ = RequestMock(r, "DELETE", fmt.Sprintf("/user/tokens/%d", created.Token.ID), ``, login)
+	asserts.Equal(http.StatusNotFound, code)
+	code, _ = RequestMock(r, "DELETE", "/user/tokens/abc", ``, login)
+	asserts.Equal(http.StatusNotFound, code)
+
+	expiresAt := time.Now().Add(time.Hour)
+	model, expiring, _ := CreatePersonalAccessToken(context.Background(), 1, "expiring", []string{ScopeProfileRead}, &expiresAt)
+	code, _ = RequestMock(r, "GET", "/user/", ``, expiring)
+	asserts.Equal(http.StatusOK, code)
+	test_db.Model(&model).Update("expires_at", time.Now().Add(-time.Second))
+	code, _ = RequestMock(r, "GET", "/user/", ``, expiring)
+	asserts.Equal(http.StatusUnauthorized, code, "an expired token should not work")
+
+	_, kept, _ := CreatePersonalAccessToken(context.Background(), 1, "kept", []string{ScopeProfileRead}, nil)
+	test_db.Create(&PasswordResetModel{UserModelID: 1, TokenHash: hashToken("reset"), CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)})
+	_, err = ResetPassword(context.Background(), "reset", "password456")
+	asserts.NoError(err)
+	code, _ = RequestMock(r, "GET", "/user/", ``, kept)
+	asserts.Equal(http.StatusUnauthorized, code, "a password reset should revoke the tokens")
+}
+
+func TestRoles(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	ctx := context.Background()
+
+	roles, err := ListRoles(ctx)
+	asserts.NoError(err)
+	if asserts.Len(roles, 2) {
+		asserts.Equal(RoleAdmin, roles[0].Name)
+		asserts.Len(roles[0].Permissions, 3)
+		asserts.Equal(RoleModerator, roles[1].Name)
+	}
+	asserts.ErrorIs(GrantRole(ctx, 1, "owner"), ErrRoleNotFound)
+	asserts.NoError(GrantRole(ctx, 1, RoleAdmin))
+	asserts.NoError(GrantRole(ctx, 1, RoleModerator))
+	asserts.NoError(GrantRole(ctx, 1, RoleModerator), "granting a role twice should change nothing")
+	names, _ := UserRoles(ctx, 1)
+	asserts.Equal([]string{RoleAdmin, RoleModerator}, names)
+	permissions, _ := UserPermissions(ctx, 1)
+	asserts.Equal([]string{PermissionArticlesModerate, PermissionCommentsModerate, PermissionRolesManage}, permissions)
+	asserts.ErrorIs(RevokeRole(ctx, 1, RoleAdmin), ErrLastAdmin)
+	asserts.NoError(RevokeRole(ctx, 2, RoleAdmin), "revoking a role the user doesn't have should change nothing")
+
+	// The roles are in the claims of the login.
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	r.Use(AuthMiddleware(true))
+	admin := r.Group("/admin")
+	admin.Use(RequirePermission(PermissionRolesManage))
+	AdminRegister(admin)
+	code, body := RequestMock(r, "POST", "/users/login", `{"user":{"email":"user1@linkedin.com","password":"password123"}}`, "")
+	asserts.Equal(http.StatusOK, code)
+	var response struct {
+		User UserResponse `json:"user"`
+	}
+	json.Unmarshal([]byte(body), &response)
+	claims := common.TokenClaims{}
+	_, err = jwt.ParseWithClaims(response.User.Token, &claims, common.GetKeyring().Keyfunc)
+	asserts.NoError(err)
+	asserts.Equal([]string{RoleAdmin, RoleModerator}, claims.Roles)
+	adminToken := response.User.Token
+
+	// The admin endpoints need roles:manage.
+	code, body = RequestMock(r, "PUT", "/admin/users/user2/roles/moderator", ``, common.GenToken(2))
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(`{"errors":{"permission":"You need the roles:manage permission"}}`, body)
+	code, body = RequestMock(r, "PUT", "/admin/users/user2/roles/moderator", ``, adminToken)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(`{"roles":["moderator"]}`, body)
+	code, body = RequestMock(r, "GET", "/admin/users/user2/roles", ``, adminToken)
+	asserts.Equal(`{"roles":["moderator"]}`, body)
+	code, body = RequestMock(r, "GET", "/admin/roles", ``, adminToken)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Contains(body, `{"name":"moderator","permissions":["articles:moderate","comments:moderate"]}`)
+	code, _ = RequestMock(r, "PUT", "/admin/users/user2/roles/owner", ``, adminToken)
+	asserts.Equal(http.StatusNotFound, code)
+	code, _ = RequestMock(r, "PUT", "/admin/users/nobody/roles/moderator", ``, adminToken)
+	asserts.Equal(http.StatusNotFound, code)
+	code, body = RequestMock(r, "DELETE", "/admin/users/user1/roles/admin", ``, adminToken)
+	asserts.Equal(http.StatusConflict, code)
+	asserts.Equal(`{"errors":{"role":"The last admin can't lose the admin role"}}`, body)
+	code, body = RequestMock(r, "DELETE", "/admin/users/user2/roles/moderator", ``, adminToken)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(`{"roles":[]}`, body)
+
+	// The roles act on the logins only.
+	_, pat, _ := CreatePersonalAccessToken(ctx, 1, "ci", []string{ScopeProfileRead}, nil)
+	code, _ = RequestMock(r, "GET", "/admin/roles", ``, pat)
+	asserts.Equal(http.StatusForbidden, code, "a personal access token should have no role")
+	asserts.NoError(GrantRole(ctx, 2, RoleAdmin))
+	asserts.NoError(RevokeRole(ctx, 1, RoleAdmin))
+	code, _ = RequestMock(r, "GET", "/admin/roles", ``, adminToken)
+	asserts.Equal(http.StatusForbidden, code, "a revoked role should take effect before the token expires")
+
+	// The last admin can't be deleted either, until there is another one.
+	last, err := IsLastAdmin(ctx, 2)
+	asserts.NoError(err)
+	asserts.True(last)
+	user2, _ := FindOneUser(ctx, &UserModel{ID: 2})
+	asserts.ErrorIs(DeleteUserModel(user2), ErrLastAdmin)
+	_, err = FindOneUser(ctx, &UserModel{ID: 2})
+	asserts.NoError(err, "the last admin should be kept")
+	asserts.NoError(GrantRole(ctx, 3, RoleAdmin))
+	last, _ = IsLastAdmin(ctx, 2)
+	asserts.False(last)
+	asserts.NoError(DeleteUserModel(user2))
+	names, _ = UserRoles(ctx, 3)
+	asserts.Equal([]string{RoleAdmin}, names)
+}
+
+func TestPasswordChange(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	r.Use(AuthMiddleware(true))
+	UserRegister(r.Group("/user"))
+	call := func(method, url, body, token string) (int, UserResponse, string) {
+		code, response := RequestMock(r, method, url, body, token)
+		var user struct {
+			User UserResponse `json:"user"`
+		}
+		json.Unmarshal([]byte(response), &user)
+		return code, user.User, response
+	}
+
+	login := func(password string) (int, UserResponse) {
+		code, user, _ := call("POST", "/users/login", `{"user":{"email":"change1@gg.cn","password":"`+password+`"}}`, "")
+		return code, user
+	}
+
+	call("POST", "/users/", `{"user":{"username":"change1","email":"change1@gg.cn","password":"jakejxke"}}`, "")
+	_, laptop := login("jakejxke")
+	_, phone := login("jakejxke")
+
+	code, _, body := call("PUT", "/user/password", `{"user":{"currentPassword":"wrongpass","password":"jakejxke2"}}`, laptop.Token)
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(`{"errors":{"currentPassword":"The current password is wrong"}}`, body)
+	code, _, _ = call("PUT", "/user/password", `{"user":{"currentPassword":"jakejxke","password":"short"}}`, laptop.Token)
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+
+	code, user, body := call("PUT", "/user/password", `{"user":{"currentPassword":"jakejxke","password":"jakejxke2"}}`, laptop.Token)
+	asserts.Equal(http.StatusOK, code, body)
+	asserts.Equal(laptop.Token, user.Token, "the session of the change should stay")
+	asserts.Empty(user.RefreshToken)
+	code, _, _ = call("GET", "/user/", "", laptop.Token)
+	asserts.Equal(http.StatusOK, code)
+	code, _, _ = call("GET", "/user/", "", phone.Token)
+	asserts.Equal(http.StatusUnauthorized, code, "the other sessions should be logged out")
+	code, _, _ = call("POST", "/users/token/refresh", `{"user":{"refreshToken":"`+phone.RefreshToken+`"}}`, "")
+	asserts.Equal(http.StatusUnauthorized, code, "the refresh tokens of the other sessions should be revoked")
+	code, _ = login("jakejxke")
+	asserts.Equal(http.StatusForbidden, code)
+	code, _ = login("jakejxke2")
+	asserts.Equal(http.StatusOK, code, "the new password should log in")
+
+	// A token without a session is revoked with the others, its user gets a new session.
+	// Another user: the iat of a token of the same second as the change above counts as revoked.
+	userModel := userModelMocker(1)[0]
+	plain := common.GenToken(userModel.ID)
+	code, user, body = call("PUT", "/user/password", `{"user":{"currentPassword":"password123","password":"jakejxke3"}}`, plain)
+	asserts.Equal(http.StatusOK, code, body)
+	asserts.NotEmpty(user.RefreshToken)
+	code, _, _ = call("GET", "/user/", "", user.Token)
+	asserts.Equal(http.StatusOK, code)
+	code, _, _ = call("GET", "/user/", "", plain)
+	asserts.Equal(http.StatusUnauthorized, code)
+
+	passwordless := UserModel{Username: "change2", Email: "change2@gg.cn"}
+	test_db.Create(&passwordless)
+	code, _, body = call("PUT", "/user/password", `{"user":{"currentPassword":"anything","password":"jakejxke2"}}`, common.GenToken(passwordless.ID))
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	asserts.Equal(`{"errors":{"password":"The account has no password yet, set one with a password reset"}}`, body)
+}
+
+func TestPasswordRehash(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	userModel := userModelMocker(1)[0]
+	weak, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	test_db.Model(&UserModel{}).Where("id = ?", userModel.ID).Update("password", string(weak))
+
+	req, _ := http.NewRequest("POST", "/users/login", bytes.NewBufferString(`{"user":{"email":"`+userModel.Email+`","password":"password123"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+
+	userModel, _ = FindOneUser(context.Background(), &UserModel{Email: userModel.Email})
+	cost, err := bcrypt.Cost([]byte(userModel.PasswordHash))
+	asserts.NoError(err)
+	asserts.Equal(config.Get().Auth.BcryptCost, cost, "the login should hash the password at the configured cost")
+	asserts.NoError(userModel.checkPassword("password123"))
+	asserts.False(userModel.passwordOutdated())
+}
+
+func TestPruneExpired(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	now := time.Now()
+	expired, valid := now.Add(-time.Second), now.Add(time.Hour)
+	forgotten := now.Add(-config.Get().Auth.LockoutDuration - time.Second)
+	for i, at := range []time.Time{expired, valid} {
+		hash := hashToken(fmt.Sprint(i))
+		test_db.Create(&RevocationModel{Kind: RevokedToken, Value: hash, UserModelID: 1, CreatedAt: now, ExpiresAt: at})
+		test_db.Create(&SessionModel{ID: hash[:32], UserModelID: 1, CreatedAt: now, LastSeenAt: now, ExpiresAt: at})
+		test_db.Create(&RefreshTokenModel{UserModelID: 1, FamilyID: hash[:32], TokenHash: hash, CreatedAt: now, ExpiresAt: at})
+		test_db.Create(&PasswordResetModel{UserModelID: 1, TokenHash: hash, CreatedAt: now, ExpiresAt: at})
+		test_db.Create(&EmailVerificationModel{UserModelID: 1, Email: "user1@linkedin.com", TokenHash: hash, CreatedAt: now, ExpiresAt: at})
+		test_db.Create(&TwoFactorChallengeModel{UserModelID: 1, TokenHash: hash, CreatedAt: now, ExpiresAt: at})
+		test_db.Create(&OIDCStateModel{StateHash: hash, Nonce: "nonce", Verifier: "verifier", CreatedAt: now, ExpiresAt: at})
+		expiresAt := at
+		test_db.Create(&PersonalAccessTokenModel{UserModelID: 1, Name: "ci", TokenHash: hash, Scopes: ScopeProfileRead, CreatedAt: now, ExpiresAt: &expiresAt})
+	}
+	test_db.Create(&SessionModel{ID: "revoked", UserModelID: 1, CreatedAt: now, LastSeenAt: now, ExpiresAt: valid, RevokedAt: &now})
+	test_db.Create(&PersonalAccessTokenModel{UserModelID: 1, Name: "forever", TokenHash: hashToken("forever"), Scopes: ScopeProfileRead, CreatedAt: now})
+	test_db.Create(&LoginFailureModel{Key: "old", Failures: 3, LastFailureAt: forgotten})
+	test_db.Create(&LoginFailureModel{Key: "recent", Failures: 3, LastFailureAt: now})
+	// An expired magic link still counts for the limit during its window.
+	test_db.Create(&MagicLinkModel{UserModelID: 1, TokenHash: hashToken("old"), CreatedAt: now.Add(-magicLinkWindow), ExpiresAt: expired})
+	test_db.Create(&MagicLinkModel{UserModelID: 1, TokenHash: hashToken("counted"), CreatedAt: now.Add(-time.Minute * 20), ExpiresAt: expired})
+	test_db.Create(&MagicLinkModel{UserModelID: 1, TokenHash: hashToken("valid"), CreatedAt: now, ExpiresAt: valid})
+
+	asserts.NoError(PruneExpired(context.Background(), now))
+	for model, left := range map[interface{}]int{
+		&RevocationModel{}: 1, &SessionModel{}: 1, &RefreshTokenModel{}: 1, &PasswordResetModel{}: 1,
+		&EmailVerificationModel{}: 1, &TwoFactorChallengeModel{}: 1, &OIDCStateModel{}: 1,
+		&PersonalAccessTokenModel{}: 2, &LoginFailureModel{}: 1, &MagicLinkModel{}: 2,
+	} {
+		var count int
+		test_db.Model(model).Count(&count)
+		asserts.Equal(left, count, "%T", model)
+	}
+	var session SessionModel
+	test_db.First(&session)
+	asserts.Equal(hashToken("1")[:32], session.ID, "the revoked and the expired sessions should be deleted")
+	var failure LoginFailureModel
+	test_db.First(&failure)
+	asserts.Equal("recent", failure.Key)
+	var links []MagicLinkModel
+	test_db.Order("id").Find(&links)
+	if asserts.Len(links, 2) {
+		asserts.Equal(hashToken("counted"), links[0].TokenHash)
+	}
+	asserts.NoError(PruneExpired(context.Background(), now), "pruning twice should change nothing")
+}
+
 func TestMain(m *testing.M) {
 	// Set GIN to test mode for cleaner output
 	gin.SetMode(gin.TestMode)
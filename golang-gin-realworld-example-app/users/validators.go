@@ -2,7 +2,9 @@ package users
 
 import (
 	"realworld-backend/common"
+	"time"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 // *ModelValidator containing two parts:
@@ -28,17 +30,32 @@ func (self *UserModelValidator) Bind(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
+	self.fill()
+	return nil
+}
+
+// The admin commands have no request to bind, they fill User themselves and validate it here.
+// 	userModelValidator := NewUserModelValidator()
+// 	userModelValidator.User.Username = "wangzitian0" ...
+// 	userModel, err := userModelValidator.Validate()
+func (self *UserModelValidator) Validate() (UserModel, error) {
+	if err := binding.Validator.ValidateStruct(self); err != nil {
+		return UserModel{}, err
+	}
+	self.fill()
+	return self.userModel, nil
+}
+
+// Copy the validated data into the DataModel.
+func (self *UserModelValidator) fill() {
 	self.userModel.Username = self.User.Username
 	self.userModel.Email = self.User.Email
 	self.userModel.Bio = self.User.Bio
 
-	if self.User.Password != common.NBRandomPassword {
-		self.userModel.setPassword(self.User.Password)
-	}
+	self.userModel.setPassword(self.User.Password)
 	if self.User.Image != "" {
 		self.userModel.Image = &self.User.Image
 	}
-	return nil
 }
 
 // You can put the default value of a Validator here
@@ -48,17 +65,70 @@ func NewUserModelValidator() UserModelValidator {
 	return userModelValidator
 }
 
-func NewUserModelValidatorFillWith(userModel UserModel) UserModelValidator {
-	userModelValidator := NewUserModelValidator()
-	userModelValidator.User.Username = userModel.Username
-	userModelValidator.User.Email = userModel.Email
-	userModelValidator.User.Bio = userModel.Bio
-	userModelValidator.User.Password = common.NBRandomPassword
+// The profile of the user, PUT /api/user. The password has its own PasswordChangeValidator: it
+// is only here to tell the old clients where it went.
+type UserUpdateValidator struct {
+	User struct {
+		Username string `form:"username" json:"username" binding:"required,alphanum,min=4,max=255"`
+		Email    string `form:"email" json:"email" binding:"required,email"`
+		Password string `form:"password" json:"password"`
+		Bio      string `form:"bio" json:"bio" binding:"max=1024"`
+		Image    string `form:"image" json:"image" binding:"omitempty,url"`
+	} `json:"user"`
+	userModel UserModel `json:"-"`
+}
+
+// The fields left out of the request keep the values of FillWith.
+func (self *UserUpdateValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, self)
+	if err != nil {
+		return err
+	}
+	self.userModel.Username = self.User.Username
+	self.userModel.Email = self.User.Email
+	self.userModel.Bio = self.User.Bio
+	if self.User.Image != "" {
+		self.userModel.Image = &self.User.Image
+	}
+	return nil
+}
+
+func NewUserUpdateValidatorFillWith(userModel UserModel) UserUpdateValidator {
+	userUpdateValidator := UserUpdateValidator{}
+	userUpdateValidator.User.Username = userModel.Username
+	userUpdateValidator.User.Email = userModel.Email
+	userUpdateValidator.User.Bio = userModel.Bio
 
 	if userModel.Image != nil {
-		userModelValidator.User.Image = *userModel.Image
+		userUpdateValidator.User.Image = *userModel.Image
 	}
-	return userModelValidator
+	return userUpdateValidator
+}
+
+// The new password with the current one, PUT /api/user/password:
+// 	{"user":{"currentPassword":"password0","password":"password1"}}
+type PasswordChangeValidator struct {
+	User struct {
+		CurrentPassword string `form:"currentPassword" json:"currentPassword" binding:"required,max=255"`
+		Password        string `form:"password" json:"password" binding:"required,min=8,max=255"`
+	} `json:"user"`
+}
+
+func (self *PasswordChangeValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewPasswordChangeValidator() PasswordChangeValidator {
+	return PasswordChangeValidator{}
+}
+
+// The admin commands check a new password like PasswordChangeValidator.
+// 	err := ValidatePassword("password1")
+func ValidatePassword(password string) error {
+	passwordChangeValidator := NewPasswordChangeValidator()
+	passwordChangeValidator.User.CurrentPassword = "unchecked"
+	passwordChangeValidator.User.Password = password
+	return binding.Validator.ValidateStruct(&passwordChangeValidator)
 }
 
 type LoginValidator struct {
@@ -84,3 +154,169 @@ func NewLoginValidator() LoginValidator {
 	loginValidator := LoginValidator{}
 	return loginValidator
 }
+
+// The refresh token is sent like the credentials of a login:
+// 	{"user":{"refreshToken":"hTn3Pj..."}}
+type RefreshTokenValidator struct {
+	User struct {
+		RefreshToken string `form:"refreshToken" json:"refreshToken" binding:"required,max=255"`
+	} `json:"user"`
+}
+
+func (self *RefreshTokenValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewRefreshTokenValidator() RefreshTokenValidator {
+	return RefreshTokenValidator{}
+}
+
+// The address to mail the reset link to:
+// 	{"user":{"email":"jake@jake.jake"}}
+type PasswordForgotValidator struct {
+	User struct {
+		Email string `form:"email" json:"email" binding:"required,email"`
+	} `json:"user"`
+}
+
+func (self *PasswordForgotValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewPasswordForgotValidator() PasswordForgotValidator {
+	return PasswordForgotValidator{}
+}
+
+// The token of the reset link with the new password:
+// 	{"user":{"token":"Qm9yaW5n...","password":"jakejake2"}}
+type PasswordResetValidator struct {
+	User struct {
+		Token    string `form:"token" json:"token" binding:"required,max=255"`
+		Password string `form:"password" json:"password" binding:"required,min=8,max=255"`
+	} `json:"user"`
+}
+
+func (self *PasswordResetValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewPasswordResetValidator() PasswordResetValidator {
+	return PasswordResetValidator{}
+}
+
+// The token of the verification link:
+// 	{"user":{"token":"Qm9yaW5n..."}}
+type EmailConfirmValidator struct {
+	User struct {
+		Token string `form:"token" json:"token" binding:"required,max=255"`
+	} `json:"user"`
+}
+
+func (self *EmailConfirmValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewEmailConfirmValidator() EmailConfirmValidator {
+	return EmailConfirmValidator{}
+}
+
+// The second step of a login with two-factor authentication, the code is one of the
+// authenticator app or a recovery code:
+// 	{"user":{"challengeToken":"Qm9yaW5n...","code":"123456"}}
+type TwoFactorLoginValidator struct {
+	User struct {
+		ChallengeToken string `form:"challengeToken" json:"challengeToken" binding:"required,max=255"`
+		Code           string `form:"code" json:"code" binding:"required,max=32"`
+	} `json:"user"`
+}
+
+func (self *TwoFactorLoginValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewTwoFactorLoginValidator() TwoFactorLoginValidator {
+	return TwoFactorLoginValidator{}
+}
+
+// A code of the authenticator app, or a recovery code where it is accepted:
+// 	{"twoFactor":{"code":"123456"}}
+type TwoFactorCodeValidator struct {
+	TwoFactor struct {
+		Code string `form:"code" json:"code" binding:"required,max=32"`
+	} `json:"twoFactor"`
+}
+
+func (self *TwoFactorCodeValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewTwoFactorCodeValidator() TwoFactorCodeValidator {
+	return TwoFactorCodeValidator{}
+}
+
+// The address to mail the login link to:
+// 	{"user":{"email":"jake@jake.jake"}}
+type MagicLinkValidator struct {
+	User struct {
+		Email string `form:"email" json:"email" binding:"required,email"`
+	} `json:"user"`
+}
+
+func (self *MagicLinkValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewMagicLinkValidator() MagicLinkValidator {
+	return MagicLinkValidator{}
+}
+
+// The token of the login link:
+// 	{"user":{"token":"Qm9yaW5n..."}}
+type MagicLinkRedeemValidator struct {
+	User struct {
+		Token string `form:"token" json:"token" binding:"required,max=255"`
+	} `json:"user"`
+}
+
+func (self *MagicLinkRedeemValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewMagicLinkRedeemValidator() MagicLinkRedeemValidator {
+	return MagicLinkRedeemValidator{}
+}
+
+// The code and the state of the provider's redirect to oidc.redirect_url:
+// 	{"oidc":{"code":"SplxlOBeZQQYbYS6WxSbIA","state":"af0ifjsldkj..."}}
+type OIDCCallbackValidator struct {
+	OIDC struct {
+		Code  string `form:"code" json:"code" binding:"required,max=2048"`
+		State string `form:"state" json:"state" binding:"required,max=255"`
+	} `json:"oidc"`
+}
+
+func (self *OIDCCallbackValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewOIDCCallbackValidator() OIDCCallbackValidator {
+	return OIDCCallbackValidator{}
+}
+
+// A new personal access token, with some of Scopes and an optional expiration:
+// 	{"token":{"name":"ci","scopes":["articles:write"],"expiresAt":"2027-01-01T00:00:00Z"}}
+type PersonalAccessTokenValidator struct {
+	Token struct {
+		Name      string     `form:"name" json:"name" binding:"required,max=100"`
+		Scopes    []string   `form:"scopes" json:"scopes" binding:"required,min=1,dive,oneof=articles:write comments:write favorites:write profile:read profile:write"`
+		ExpiresAt *time.Time `form:"expiresAt" json:"expiresAt"`
+	} `json:"token"`
+}
+
+func (self *PersonalAccessTokenValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewPersonalAccessTokenValidator() PersonalAccessTokenValidator {
+	return PersonalAccessTokenValidator{}
+}
@@ -0,0 +1,152 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+	"realworld-backend/config"
+	"realworld-backend/mail"
+	"realworld-backend/tracing"
+)
+
+// An email verification token, mailed to Email as a link to the frontend. Email is the address
+// of the user, or the new one of an email change, which only takes effect once it is confirmed.
+// Only the sha256 of the token is saved, it works once until ExpiresAt.
+type EmailVerificationModel struct {
+	ID          uint   `gorm:"primary_key"`
+	UserModelID uint   `gorm:"index;not null"`
+	Email       string `gorm:"column:email;size:255;not null"`
+	TokenHash   string `gorm:"column:token_hash;size:64;unique_index;not null"`
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	UsedAt      *time.Time
+}
+
+var (
+	ErrEmailVerificationInvalid = errors.New("Invalid or expired email verification token")
+	ErrEmailTaken               = errors.New("Email already registered")
+	ErrEmailNotVerified         = errors.New("Verify your email first")
+)
+
+// You could mail a verification link for email: the email of the user, or the new one it asked for.
+// Only the last link mailed to the user works, for auth.email_verification_lifetime.
+//
+//	err := SendEmailVerification(ctx, userModel, userModel.Email)
+func SendEmailVerification(ctx context.Context, userModel UserModel, email string) error {
+	ctx, span := tracing.Start(ctx, "users.SendEmailVerification")
+	defer span.End()
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	model := EmailVerificationModel{
+		UserModelID: userModel.ID,
+		Email:       email,
+		TokenHash:   hashToken(token),
+		ExpiresAt:   now.Add(config.Get().Auth.EmailVerificationLifetime),
+	}
+	tx := common.GetDBContext(ctx).Begin()
+	err = tx.Model(&EmailVerificationModel{}).Where("user_model_id = ? AND used_at IS NULL", userModel.ID).
+		Update("used_at", now).Error
+	if err == nil {
+		err = tx.Create(&model).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	subject, reason := "Verify your email", "confirm the email of your account"
+	if email != userModel.Email {
+		subject, reason = "Confirm your new email", "use this address for your account instead of "+userModel.Email
+	}
+	return mail.Get().Send(ctx, mail.Message{
+		To:      email,
+		Subject: subject,
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Open this link to %s,\n"+
+			"it works once, until %s:\n\n%s\n\n"+
+			"If it wasn't you, ignore this mail.\n",
+			userModel.Username, reason, model.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"), frontendLink("/verify-email", token)),
+	})
+}
+
+// You could confirm an email with the token of a verification mail. The email becomes the verified
+// email of the user, an email change takes effect here: ErrEmailTaken when another user got it meanwhile.
+//
+//	userModel, err := ConfirmEmail(ctx, token)
+func ConfirmEmail(ctx context.Context, token string) (UserModel, error) {
+	ctx, span := tracing.Start(ctx, "users.ConfirmEmail")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	var userModel UserModel
+	var model EmailVerificationModel
+	err := db.Where(&EmailVerificationModel{TokenHash: hashToken(token)}).First(&model).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return userModel, ErrEmailVerificationInvalid
+	}
+	if err != nil {
+		return userModel, err
+	}
+	now := time.Now()
+	if model.UsedAt != nil || !now.Before(model.ExpiresAt) {
+		return userModel, ErrEmailVerificationInvalid
+	}
+	if err := db.Where("id = ?", model.UserModelID).First(&userModel).Error; err != nil {
+		return userModel, err
+	}
+	previous := userModel.Email
+	if model.Email != previous {
+		var count int
+		if err := db.Model(&UserModel{}).Where("email = ?", model.Email).Count(&count).Error; err != nil {
+			return userModel, err
+		}
+		if count > 0 {
+			return userModel, ErrEmailTaken
+		}
+	}
+
+	tx := db.Begin()
+	// The condition on used_at makes the token single use under concurrent confirmations too.
+	result := tx.Model(&EmailVerificationModel{}).Where("id = ? AND used_at IS NULL", model.ID).Update("used_at", now)
+	if result.Error != nil {
+		tx.Rollback()
+		return userModel, result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return userModel, ErrEmailVerificationInvalid
+	}
+	err = tx.Model(&userModel).Updates(map[string]interface{}{"email": model.Email, "email_verified_at": now}).Error
+	if err != nil {
+		tx.Rollback()
+		return userModel, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return userModel, err
+	}
+	if model.Email != previous {
+		// The owner of the old address hears of the change, in case it wasn't them.
+		err := mail.Get().Send(ctx, mail.Message{
+			To:      previous,
+			Subject: "Your email was changed",
+			Body: fmt.Sprintf("Hi %s,\n\n"+
+				"The email of your account is now %s.\n"+
+				"If it wasn't you, reset your password and contact us.\n",
+				userModel.Username, model.Email),
+		})
+		if err != nil {
+			slog.Error("users: email change notice not sent", "user_id", userModel.ID, "error", err)
+		}
+	}
+	return userModel, nil
+}